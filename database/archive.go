@@ -0,0 +1,246 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"watgbridge/state"
+
+	"go.uber.org/zap"
+)
+
+// Whether the archive has a full-text index, searches fall back to LIKE
+// otherwise
+var archiveFullText bool
+
+// ArchiveSetupIndex creates the full-text index of the archive in the way of
+// the database type: an FTS5 table kept up to date by triggers for SQLite, a
+// generated tsvector column with a GIN index for Postgres and a FULLTEXT
+// index for MySQL. SQLite is only built with FTS5 with the sqlite_fts5 build
+// tag, without it searching falls back to LIKE.
+func ArchiveSetupIndex() error {
+	var (
+		db     = state.State.Database
+		logger = state.State.Logger
+	)
+
+	table, err := tableName(&ArchivedMessage{})
+	if err != nil {
+		return err
+	}
+
+	switch db.Dialector.Name() {
+	case "sqlite":
+		triggers := []string{table + "_fts_insert", table + "_fts_delete", table + "_fts_update"}
+
+		err = db.Exec(fmt.Sprintf("CREATE VIRTUAL TABLE IF NOT EXISTS %s_fts USING fts5(text, file_name, content='%s', content_rowid='id')",
+			table, table)).Error
+		if err != nil {
+			logger.Warn("full-text search is not available in this SQLite build, searching the archive without an index",
+				zap.Error(err),
+			)
+			// The triggers would fail every insert without the FTS5 module
+			for _, trigger := range triggers {
+				if err = db.Exec("DROP TRIGGER IF EXISTS " + trigger).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		var existing int64
+		err = db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = ?", triggers[0]).
+			Scan(&existing).Error
+		if err != nil {
+			return err
+		}
+
+		if existing == 0 {
+			statements := []string{
+				fmt.Sprintf(`CREATE TRIGGER %s AFTER INSERT ON %s BEGIN
+					INSERT INTO %s_fts(rowid, text, file_name) VALUES (new.id, new.text, new.file_name);
+				END`, triggers[0], table, table),
+				fmt.Sprintf(`CREATE TRIGGER %s AFTER DELETE ON %s BEGIN
+					INSERT INTO %s_fts(%s_fts, rowid, text, file_name) VALUES ('delete', old.id, old.text, old.file_name);
+				END`, triggers[1], table, table, table),
+				fmt.Sprintf(`CREATE TRIGGER %s AFTER UPDATE ON %s BEGIN
+					INSERT INTO %s_fts(%s_fts, rowid, text, file_name) VALUES ('delete', old.id, old.text, old.file_name);
+					INSERT INTO %s_fts(rowid, text, file_name) VALUES (new.id, new.text, new.file_name);
+				END`, triggers[2], table, table, table, table),
+				// Messages archived while the index did not exist
+				fmt.Sprintf("INSERT INTO %s_fts(%s_fts) VALUES ('rebuild')", table, table),
+			}
+			for _, statement := range statements {
+				if err = db.Exec(statement).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+	case "postgres":
+		statements := []string{
+			fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS search_vector tsvector
+				GENERATED ALWAYS AS (to_tsvector('simple', coalesce(text, '') || ' ' || coalesce(file_name, ''))) STORED`, table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_search_vector ON %s USING GIN (search_vector)", table, table),
+		}
+		for _, statement := range statements {
+			if err = db.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+
+	case "mysql":
+		indexName := "idx_" + table + "_fulltext"
+		if !db.Migrator().HasIndex(&ArchivedMessage{}, indexName) {
+			err = db.Exec(fmt.Sprintf("CREATE FULLTEXT INDEX %s ON %s (text, file_name)", indexName, table)).Error
+			if err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("full-text search is not supported for a database of type '%s'", db.Dialector.Name())
+	}
+
+	archiveFullText = true
+	return nil
+}
+
+// ArchiveSaveMessage adds a message to the archive, or updates it when it
+// was edited or sent again. An edit keeps the original timestamp, and the
+// media details when the edit does not carry them.
+func ArchiveSaveMessage(msg *ArchivedMessage) error {
+	db := state.State.Database
+
+	var existing ArchivedMessage
+	res := db.Where("wa_msg_id = ? AND wa_chat_id = ?", msg.WaMsgId, msg.WaChatId).Find(&existing)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if existing.ID != 0 {
+		msg.ID = existing.ID
+		msg.Timestamp = existing.Timestamp
+		if msg.MediaType == "" {
+			msg.MediaType = existing.MediaType
+			msg.MimeType = existing.MimeType
+			msg.FileName = existing.FileName
+			msg.FileSize = existing.FileSize
+			msg.TgFileId = existing.TgFileId
+		}
+	}
+
+	return db.Save(msg).Error
+}
+
+// ArchiveQuery filters the archived messages, empty fields match everything
+type ArchiveQuery struct {
+	Terms    []string // Words which must all be found in the text or file name
+	WaChatId string
+	SenderId string
+	Before   time.Time
+	After    time.Time
+	Limit    int
+}
+
+// archiveLikePattern matches a term anywhere in a LIKE comparison with '!'
+// as the escape character. It is not a backslash, which MySQL treats as an
+// escape in string literals too.
+func archiveLikePattern(term string) string {
+	return "%" + strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(term) + "%"
+}
+
+// archiveFTS5Match quotes the terms for an FTS5 MATCH, so that they are
+// matched as they are without the FTS5 operators
+func archiveFTS5Match(terms []string) string {
+	var match []string
+	for _, term := range terms {
+		match = append(match, `"`+strings.ReplaceAll(term, `"`, `""`)+`"`)
+	}
+	return strings.Join(match, " ")
+}
+
+// archiveMySQLMatch requires every term as a phrase in a boolean mode MATCH,
+// in which quotes cannot be escaped
+func archiveMySQLMatch(terms []string) string {
+	var match []string
+	for _, term := range terms {
+		match = append(match, `+"`+strings.ReplaceAll(term, `"`, "")+`"`)
+	}
+	return strings.Join(match, " ")
+}
+
+// ArchiveSearch returns the newest archived messages matching the query
+func ArchiveSearch(query ArchiveQuery) ([]ArchivedMessage, error) {
+	db := state.State.Database
+
+	if len(query.Terms) == 0 {
+		return nil, errors.New("nothing to search for")
+	}
+
+	table, err := tableName(&ArchivedMessage{})
+	if err != nil {
+		return nil, err
+	}
+
+	tx := db.Table(table)
+
+	switch {
+	case !archiveFullText:
+		for _, term := range query.Terms {
+			pattern := archiveLikePattern(term)
+			tx = tx.Where(fmt.Sprintf("(%s.text LIKE ? ESCAPE '!' OR %s.file_name LIKE ? ESCAPE '!')", table, table),
+				pattern, pattern)
+		}
+
+	case db.Dialector.Name() == "sqlite":
+		tx = tx.Joins(fmt.Sprintf("JOIN %s_fts ON %s_fts.rowid = %s.id", table, table, table)).
+			Where(fmt.Sprintf("%s_fts MATCH ?", table), archiveFTS5Match(query.Terms))
+
+	case db.Dialector.Name() == "postgres":
+		tx = tx.Where("search_vector @@ plainto_tsquery('simple', ?)", strings.Join(query.Terms, " "))
+
+	case db.Dialector.Name() == "mysql":
+		tx = tx.Where("MATCH(text, file_name) AGAINST (? IN BOOLEAN MODE)", archiveMySQLMatch(query.Terms))
+	}
+
+	if query.WaChatId != "" {
+		tx = tx.Where(table+".wa_chat_id = ?", query.WaChatId)
+	}
+	if query.SenderId != "" {
+		tx = tx.Where(table+".sender_id = ?", query.SenderId)
+	}
+	if !query.Before.IsZero() {
+		tx = tx.Where(table+".timestamp < ?", query.Before)
+	}
+	if !query.After.IsZero() {
+		tx = tx.Where(table+".timestamp >= ?", query.After)
+	}
+
+	var results []ArchivedMessage
+	res := tx.Select(table + ".*").
+		Order(table + ".timestamp DESC").
+		Limit(query.Limit).
+		Find(&results)
+	return results, res.Error
+}
+
+// ArchiveGetChatMessages returns the archived messages of a chat sent from
+// after up to before, in the order they were sent. Zero times do not limit.
+func ArchiveGetChatMessages(waChatId string, after, before time.Time) ([]ArchivedMessage, error) {
+	db := state.State.Database
+
+	tx := db.Where("wa_chat_id = ?", waChatId)
+	if !after.IsZero() {
+		tx = tx.Where("timestamp >= ?", after)
+	}
+	if !before.IsZero() {
+		tx = tx.Where("timestamp < ?", before)
+	}
+
+	var messages []ArchivedMessage
+	res := tx.Order("timestamp ASC").Find(&messages)
+	return messages, res.Error
+}
@@ -0,0 +1,52 @@
+package database
+
+import "testing"
+
+func TestArchiveLikePattern(t *testing.T) {
+	tests := []struct {
+		name     string
+		term     string
+		expected string
+	}{
+		{"plain", "hello", "%hello%"},
+		{"percent", "100%", "%100!%%"},
+		{"underscore", "snake_case", "%snake!_case%"},
+		{"escape character", "wow!", "%wow!!%"},
+		{"backslash is literal", `a\b`, `%a\b%`},
+		{"unicode", "héllo", "%héllo%"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := archiveLikePattern(test.term); got != test.expected {
+				t.Errorf("archiveLikePattern(%q) = %q, expected %q", test.term, got, test.expected)
+			}
+		})
+	}
+}
+
+func TestArchiveMatchQueries(t *testing.T) {
+	tests := []struct {
+		name  string
+		terms []string
+		fts5  string
+		mysql string
+	}{
+		{"single", []string{"hello"}, `"hello"`, `+"hello"`},
+		{"several", []string{"hello", "world"}, `"hello" "world"`, `+"hello" +"world"`},
+		{"operators", []string{"a", "OR", "b*"}, `"a" "OR" "b*"`, `+"a" +"OR" +"b*"`},
+		{"quotes", []string{`say"hi"`}, `"say""hi"""`, `+"sayhi"`},
+		{"minus", []string{"-not"}, `"-not"`, `+"-not"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := archiveFTS5Match(test.terms); got != test.fts5 {
+				t.Errorf("archiveFTS5Match(%q) = %q, expected %q", test.terms, got, test.fts5)
+			}
+			if got := archiveMySQLMatch(test.terms); got != test.mysql {
+				t.Errorf("archiveMySQLMatch(%q) = %q, expected %q", test.terms, got, test.mysql)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package database
+
+import "watgbridge/state"
+
+func BackupMessageAdd(tgChatId, tgMsgId int64) error {
+	db := state.State.Database
+
+	return db.Create(&BackupMessage{TgChatId: tgChatId, TgMsgId: tgMsgId}).Error
+}
+
+// BackupMessageGetOlder returns the backups sent to a chat, leaving out the
+// keep newest ones
+func BackupMessageGetOlder(tgChatId int64, keep int) ([]BackupMessage, error) {
+	db := state.State.Database
+
+	var backups []BackupMessage
+	// MySQL does not accept an offset without a limit
+	res := db.Where("tg_chat_id = ?", tgChatId).
+		Order("id DESC").
+		Offset(keep).
+		Limit(1 << 30).
+		Find(&backups)
+	return backups, res.Error
+}
+
+func BackupMessageDelete(ids []uint) error {
+	db := state.State.Database
+
+	return db.Delete(&BackupMessage{}, ids).Error
+}
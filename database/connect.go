@@ -1,8 +1,10 @@
 package database
 
 import (
+	"errors"
 	"fmt"
 
+	"watgbridge/metrics"
 	"watgbridge/state"
 
 	"gorm.io/driver/mysql"
@@ -23,7 +25,12 @@ func hasKeys(p_map *map[string]string, keys ...string) (missingKeys []string) {
 }
 
 func Connect() (*gorm.DB, error) {
-	dbConfig := state.State.Config.Database
+	return ConnectWith(state.State.Config.Database)
+}
+
+// ConnectWith opens the database described by the database section of a
+// config
+func ConnectWith(dbConfig map[string]string) (*gorm.DB, error) {
 	dbType, exists := dbConfig["type"]
 	if !exists {
 		return nil, fmt.Errorf("Error: key 'type' not found in database config")
@@ -35,7 +42,7 @@ func Connect() (*gorm.DB, error) {
 
 	case "postgres":
 
-		if missingKeys := hasKeys(&state.State.Config.Database,
+		if missingKeys := hasKeys(&dbConfig,
 			"host", "user", "password", "dbname", "port", "time_zone",
 		); len(missingKeys) != 0 {
 			return nil, fmt.Errorf("Error: database config for type '%s' requires the keys %+v", dbType, missingKeys)
@@ -52,19 +59,19 @@ func Connect() (*gorm.DB, error) {
 			dns += " sslmode=disable"
 		}
 
-		return gorm.Open(postgres.Open(dns), &gormConfig)
+		return open(postgres.Open(dns), &gormConfig)
 
 	case "sqlite":
 
-		if missingKeys := hasKeys(&state.State.Config.Database, "path"); len(missingKeys) != 0 {
+		if missingKeys := hasKeys(&dbConfig, "path"); len(missingKeys) != 0 {
 			return nil, fmt.Errorf("Error: database config for type '%s' requires the keys %+v", dbType, missingKeys)
 		}
 
-		return gorm.Open(sqlite.Open(dbConfig["path"]), &gormConfig)
+		return open(sqlite.Open(dbConfig["path"]), &gormConfig)
 
 	case "mysql":
 
-		if missingKeys := hasKeys(&state.State.Config.Database,
+		if missingKeys := hasKeys(&dbConfig,
 			"user", "password", "host", "port", "dbname",
 		); len(missingKeys) != 0 {
 			return nil, fmt.Errorf("Error: database config for type '%s' requires the keys %+v", dbType, missingKeys)
@@ -78,8 +85,48 @@ func Connect() (*gorm.DB, error) {
 			dbConfig["dbname"],
 		)
 
-		return gorm.Open(mysql.Open(dns), &gormConfig)
+		return open(mysql.Open(dns), &gormConfig)
 	}
 
 	return nil, fmt.Errorf("Database of type '%s' is not supported", dbType)
 }
+
+// open opens the database and counts the queries which fail in the metrics
+func open(dialector gorm.Dialector, gormConfig *gorm.Config) (*gorm.DB, error) {
+	db, err := gorm.Open(dialector, gormConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	countErrors := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+				metrics.DatabaseErrors.Inc(operation)
+			}
+		}
+	}
+	callbacks := db.Callback()
+	err = errors.Join(
+		callbacks.Create().After("gorm:create").Register("watgbridge:metrics", countErrors("create")),
+		callbacks.Query().After("gorm:query").Register("watgbridge:metrics", countErrors("query")),
+		callbacks.Update().After("gorm:update").Register("watgbridge:metrics", countErrors("update")),
+		callbacks.Delete().After("gorm:delete").Register("watgbridge:metrics", countErrors("delete")),
+		callbacks.Row().After("gorm:row").Register("watgbridge:metrics", countErrors("row")),
+		callbacks.Raw().After("gorm:raw").Register("watgbridge:metrics", countErrors("raw")),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not register database callbacks : %s", err)
+	}
+
+	return db, nil
+}
+
+// Close closes the connections to the database, it must be the last thing
+// done on shutdown
+func Close() error {
+	sqlDB, err := state.State.Database.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
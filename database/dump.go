@@ -0,0 +1,299 @@
+package database
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Version of the layout of logical dumps, to be raised when it changes in a
+// way older readers would not understand
+const dumpFormatVersion = 1
+
+// Name of the file describing the tables in the directory of a dump
+const DumpManifestFile = "manifest.json"
+
+// DumpManifest describes a logical dump, which holds the rows of each table
+// in a <table>.jsonl file next to it. Every line of these is a JSON array of
+// the values of a row, in the order of the columns.
+type DumpManifest struct {
+	Format    int         `json:"format"`
+	Dialect   string      `json:"dialect"`
+	CreatedAt time.Time   `json:"created_at"`
+	Tables    []DumpTable `json:"tables"`
+}
+
+type DumpTable struct {
+	Name    string       `json:"name"`
+	Columns []DumpColumn `json:"columns"`
+	Rows    int64        `json:"rows"`
+}
+
+// DumpColumn is a column of a dumped table. Its kind tells how its values
+// are written: binary as base64 strings, time as RFC 3339 strings in UTC,
+// integer, real and boolean as JSON numbers and booleans, text as strings.
+type DumpColumn struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+// A table to dump, with the columns to read or all of them when nil
+type dumpSource struct {
+	table   string
+	columns []string
+}
+
+// DumpBridgeDatabase writes a logical dump of every table of the bridge in db
+// into the dir directory of the zip, leaving out the ones which do not exist
+// yet. Only the columns of the models are dumped, leaving out the ones
+// generated by the database like the search index of the archive.
+func DumpBridgeDatabase(zipWriter *zip.Writer, dir string, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	var sources []dumpSource
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err = stmt.Parse(model); err != nil {
+			return err
+		}
+		// A database the bridge never ran with has no tables yet
+		if !db.Migrator().HasTable(stmt.Table) {
+			continue
+		}
+		sources = append(sources, dumpSource{table: stmt.Table, columns: stmt.Schema.DBNames})
+	}
+
+	return writeDump(zipWriter, dir, sqlDB, db.Dialector.Name(), sources)
+}
+
+// DumpStoreDatabase writes a logical dump of the tables of the WhatsApp
+// session store, opened with the given database/sql driver and address, into
+// the dir directory of the zip
+func DumpStoreDatabase(zipWriter *zip.Writer, dir, driver, address string) error {
+	dialect, err := storeDialect(driver)
+	if err != nil {
+		return err
+	}
+
+	sqlDB, err := sql.Open(driver, address)
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	tables, err := storeTables(sqlDB, dialect)
+	if err != nil {
+		return err
+	}
+
+	var sources []dumpSource
+	for _, table := range tables {
+		sources = append(sources, dumpSource{table: table})
+	}
+
+	return writeDump(zipWriter, dir, sqlDB, dialect, sources)
+}
+
+// storeDialect returns the dialect of a driver supported by the WhatsApp
+// session store
+func storeDialect(driver string) (string, error) {
+	switch strings.ToLower(driver) {
+	case "sqlite3", "sqlite":
+		return "sqlite", nil
+	case "postgres", "pgx":
+		return "postgres", nil
+	}
+	return "", fmt.Errorf("a WhatsApp login database of type '%s' is not supported", driver)
+}
+
+// storeTables lists the tables of whatsmeow in the database
+func storeTables(sqlDB *sql.DB, dialect string) ([]string, error) {
+	var query string
+	switch dialect {
+	case "sqlite":
+		query = "SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE 'whatsmeow!_%' ESCAPE '!' ORDER BY name"
+	case "postgres":
+		query = "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' AND table_name LIKE 'whatsmeow!_%' ESCAPE '!' ORDER BY table_name"
+	}
+
+	rows, err := sqlDB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// writeDump reads every table in a single read-only transaction, so that the
+// dump is a consistent snapshot of the database while the bridge writes to it
+func writeDump(zipWriter *zip.Writer, dir string, sqlDB *sql.DB, dialect string, sources []dumpSource) error {
+	ctx := context.Background()
+
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var begin string
+	switch dialect {
+	case "postgres":
+		begin = "BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY"
+	case "mysql":
+		begin = "START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY"
+	default:
+		begin = "BEGIN"
+	}
+	if _, err = conn.ExecContext(ctx, begin); err != nil {
+		return fmt.Errorf("failed to start the transaction of the dump : %s", err)
+	}
+	// Nothing is written, the transaction only holds the snapshot
+	defer conn.ExecContext(ctx, "ROLLBACK")
+
+	manifest := DumpManifest{
+		Format:    dumpFormatVersion,
+		Dialect:   dialect,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	for _, source := range sources {
+		table, err := dumpTable(ctx, zipWriter, dir, conn, source)
+		if err != nil {
+			return fmt.Errorf("failed to dump table '%s' : %s", source.table, err)
+		}
+		manifest.Tables = append(manifest.Tables, table)
+	}
+
+	entry, err := zipWriter.Create(path.Join(dir, DumpManifestFile))
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
+
+func dumpTable(ctx context.Context, zipWriter *zip.Writer, dir string, conn *sql.Conn, source dumpSource) (DumpTable, error) {
+	table := DumpTable{Name: source.table}
+
+	selected := "*"
+	if len(source.columns) > 0 {
+		selected = strings.Join(source.columns, ", ")
+	}
+
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s", selected, source.table))
+	if err != nil {
+		return table, err
+	}
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return table, err
+	}
+	for _, columnType := range columnTypes {
+		table.Columns = append(table.Columns, DumpColumn{
+			Name: columnType.Name(),
+			Kind: dumpColumnKind(columnType.DatabaseTypeName()),
+		})
+	}
+
+	entry, err := zipWriter.Create(path.Join(dir, source.table+".jsonl"))
+	if err != nil {
+		return table, err
+	}
+	encoder := json.NewEncoder(entry)
+
+	var (
+		values  = make([]any, len(columnTypes))
+		targets = make([]any, len(columnTypes))
+		encoded = make([]any, len(columnTypes))
+	)
+	for idx := range values {
+		targets[idx] = &values[idx]
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(targets...); err != nil {
+			return table, err
+		}
+		for idx, value := range values {
+			encoded[idx] = dumpValue(table.Columns[idx].Kind, value)
+		}
+		if err = encoder.Encode(encoded); err != nil {
+			return table, err
+		}
+		table.Rows += 1
+	}
+
+	return table, rows.Err()
+}
+
+// dumpColumnKind maps the type of a column, as named by its database, to the
+// kind of values written in a dump
+func dumpColumnKind(databaseType string) string {
+	databaseType = strings.ToUpper(databaseType)
+	switch {
+	case strings.Contains(databaseType, "BLOB"), strings.Contains(databaseType, "BYTEA"),
+		strings.Contains(databaseType, "BINARY"):
+		return "binary"
+	case strings.Contains(databaseType, "BOOL"):
+		return "boolean"
+	case strings.Contains(databaseType, "INT"):
+		return "integer"
+	case strings.Contains(databaseType, "REAL"), strings.Contains(databaseType, "FLOAT"),
+		strings.Contains(databaseType, "DOUBLE"), strings.Contains(databaseType, "NUMERIC"),
+		strings.Contains(databaseType, "DECIMAL"):
+		return "real"
+	case strings.Contains(databaseType, "TIME"), strings.Contains(databaseType, "DATE"):
+		return "time"
+	}
+	return "text"
+}
+
+// dumpValue converts a value read from a column to what is written for it
+// in a dump
+func dumpValue(kind string, value any) any {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		// MySQL returns most values as text
+		switch kind {
+		case "binary":
+			return base64.StdEncoding.EncodeToString(value)
+		case "integer", "real":
+			return json.RawMessage(value)
+		case "boolean":
+			return string(value) == "1" || strings.EqualFold(string(value), "true")
+		}
+		return string(value)
+	case int64:
+		if kind == "boolean" {
+			return value != 0
+		}
+	}
+	return value
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDumpColumnKind(t *testing.T) {
+	tests := []struct {
+		databaseType string
+		expected     string
+	}{
+		{"BLOB", "binary"},
+		{"bytea", "binary"},
+		{"VARBINARY", "binary"},
+		{"BOOLEAN", "boolean"},
+		{"bool", "boolean"},
+		{"INTEGER", "integer"},
+		{"BIGINT", "integer"},
+		{"int8", "integer"},
+		{"REAL", "real"},
+		{"DOUBLE", "real"},
+		{"NUMERIC", "real"},
+		{"DECIMAL", "real"},
+		{"TIMESTAMPTZ", "time"},
+		{"DATETIME", "time"},
+		{"DATE", "time"},
+		{"TEXT", "text"},
+		{"VARCHAR", "text"},
+		{"", "text"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.databaseType, func(t *testing.T) {
+			if got := dumpColumnKind(test.databaseType); got != test.expected {
+				t.Errorf("dumpColumnKind(%q) = %q, expected %q", test.databaseType, got, test.expected)
+			}
+		})
+	}
+}
+
+func TestDumpValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     string
+		value    any
+		expected string // JSON encoding of the dumped value
+	}{
+		{"null", "text", nil, `null`},
+		{"time in UTC", "time", time.Date(2024, 1, 2, 3, 4, 5, 6, time.FixedZone("", 3600)), `"2024-01-02T02:04:05.000000006Z"`},
+		{"binary", "binary", []byte{0, 1, 2}, `"AAEC"`},
+		{"mysql integer", "integer", []byte("42"), `42`},
+		{"mysql real", "real", []byte("1.5"), `1.5`},
+		{"mysql boolean", "boolean", []byte("1"), `true`},
+		{"mysql false", "boolean", []byte("0"), `false`},
+		{"mysql text", "text", []byte("héllo"), `"héllo"`},
+		{"sqlite boolean", "boolean", int64(1), `true`},
+		{"integer", "integer", int64(7), `7`},
+		{"string", "text", "plain", `"plain"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := json.Marshal(dumpValue(test.kind, test.value))
+			if err != nil {
+				t.Fatalf("failed to encode the value: %s", err)
+			}
+			if string(encoded) != test.expected {
+				t.Errorf("dumpValue(%q, %#v) = %s, expected %s", test.kind, test.value, encoded, test.expected)
+			}
+		})
+	}
+}
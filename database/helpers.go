@@ -2,6 +2,8 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"watgbridge/state"
@@ -42,6 +44,38 @@ func MsgIdAddNewPair(waMsgId, participantId, waChatId string, tgChatId, tgMsgId,
 	return res.Error
 }
 
+// MsgIdAddNewPart saves a Telegram message holding a part of a WhatsApp
+// message which was too long for one, the first part being saved with
+// MsgIdAddNewPair
+func MsgIdAddNewPart(waMsgId string, partNum int, participantId, waChatId string, tgChatId, tgMsgId, tgThreadId int64) error {
+
+	db := state.State.Database
+
+	res := db.Save(&MsgIdPair{
+		ID:            fmt.Sprintf("%s#%d", waMsgId, partNum),
+		ParticipantId: participantId,
+		WaChatId:      waChatId,
+		TgChatId:      tgChatId,
+		TgMsgId:       tgMsgId,
+		TgThreadId:    tgThreadId,
+		MarkRead:      sql.NullBool{Valid: true, Bool: true},
+		PartOf:        waMsgId,
+	})
+	return res.Error
+}
+
+// MsgIdGetParts returns the parts of a message after the first one, in order
+func MsgIdGetParts(waMsgId, waChatId string) ([]MsgIdPair, error) {
+
+	db := state.State.Database
+
+	var parts []MsgIdPair
+	res := db.Where("part_of = ? AND wa_chat_id = ?", waMsgId, waChatId).
+		Order("tg_msg_id ASC").Find(&parts)
+
+	return parts, res.Error
+}
+
 func MsgIdGetTgFromWa(waMsgId, waChatId string) (int64, int64, int64, error) {
 
 	db := state.State.Database
@@ -65,6 +99,9 @@ func MsgIdGetWaFromTg(tgChatId, tgMsgId, tgThreadId int64) (msgId, participantId
 	var bridgePair MsgIdPair
 	res := db.Where("tg_chat_id = ? AND tg_msg_id = ? AND tg_thread_id = ?", tgChatId, tgMsgId, tgThreadId).Find(&bridgePair)
 
+	if bridgePair.PartOf != "" {
+		return bridgePair.PartOf, bridgePair.ParticipantId, bridgePair.WaChatId, res.Error
+	}
 	return bridgePair.ID, bridgePair.ParticipantId, bridgePair.WaChatId, res.Error
 }
 
@@ -75,6 +112,9 @@ func MsgIdGetWaFromTgMessage(tgChatId, tgMsgId int64) (msgId, participantId, cha
 	var bridgePair MsgIdPair
 	res := db.Where("tg_chat_id = ? AND tg_msg_id = ?", tgChatId, tgMsgId).Find(&bridgePair)
 
+	if bridgePair.PartOf != "" {
+		return bridgePair.PartOf, bridgePair.ParticipantId, bridgePair.WaChatId, res.Error
+	}
 	return bridgePair.ID, bridgePair.ParticipantId, bridgePair.WaChatId, res.Error
 }
 
@@ -186,6 +226,542 @@ func MsgReceiptGetByMsg(waMsgId, waChatId string) ([]MessageReceipt, error) {
 	return receipts, res.Error
 }
 
+func PollPairAddNew(waMsgId, waChatId, waSenderId string, options []string, tgChatId, tgThreadId, tgMsgId int64, tgPollId string) error {
+
+	db := state.State.Database
+
+	optionsJson, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	res := db.Save(&PollPair{
+		ID:         waMsgId,
+		WaChatId:   waChatId,
+		WaSenderId: waSenderId,
+		Options:    string(optionsJson),
+		TgChatId:   tgChatId,
+		TgThreadId: tgThreadId,
+		TgMsgId:    tgMsgId,
+		TgPollId:   tgPollId,
+	})
+	return res.Error
+}
+
+func PollPairGetByWa(waMsgId, waChatId string) (PollPair, bool, error) {
+
+	db := state.State.Database
+
+	var pollPair PollPair
+	res := db.Where("id = ? AND wa_chat_id = ?", waMsgId, waChatId).Find(&pollPair)
+
+	found := (pollPair.ID == waMsgId && pollPair.WaChatId == waChatId)
+	return pollPair, found, res.Error
+}
+
+func PollPairGetByTgPollId(tgPollId string) (PollPair, bool, error) {
+
+	db := state.State.Database
+
+	var pollPair PollPair
+	res := db.Where("tg_poll_id = ?", tgPollId).Find(&pollPair)
+
+	found := (tgPollId != "" && pollPair.TgPollId == tgPollId)
+	return pollPair, found, res.Error
+}
+
+func PollPairSetTallyMsgId(waMsgId, waChatId string, tallyMsgId int64) error {
+
+	db := state.State.Database
+
+	return db.Model(&PollPair{}).
+		Where("id = ? AND wa_chat_id = ?", waMsgId, waChatId).
+		Update("tally_msg_id", tallyMsgId).Error
+}
+
+func PollVoteUpsert(waPollId, waChatId, voterId string, selectedOptions []string) error {
+
+	db := state.State.Database
+
+	selectedJson, err := json.Marshal(selectedOptions)
+	if err != nil {
+		return err
+	}
+
+	res := db.Save(&PollVote{
+		WaPollId:        waPollId,
+		WaChatId:        waChatId,
+		VoterId:         voterId,
+		SelectedOptions: string(selectedJson),
+		UpdatedAt:       time.Now().UTC(),
+	})
+	return res.Error
+}
+
+func PollVoteGetAll(waPollId, waChatId string) ([]PollVote, error) {
+
+	db := state.State.Database
+
+	var votes []PollVote
+	res := db.Where("wa_poll_id = ? AND wa_chat_id = ?", waPollId, waChatId).Order("updated_at ASC").Find(&votes)
+	return votes, res.Error
+}
+
+func LiveLocationAddNew(waMsgId, waChatId, waSenderId string, sequenceNumber int64, latitude, longitude float64,
+	tgChatId, tgThreadId, tgMsgId int64, fromTelegram bool, expiresAt time.Time) error {
+
+	db := state.State.Database
+
+	res := db.Save(&LiveLocation{
+		WaMsgId:        waMsgId,
+		WaChatId:       waChatId,
+		WaSenderId:     waSenderId,
+		SequenceNumber: sequenceNumber,
+		Latitude:       latitude,
+		Longitude:      longitude,
+		TgChatId:       tgChatId,
+		TgThreadId:     tgThreadId,
+		TgMsgId:        tgMsgId,
+		FromTelegram:   fromTelegram,
+		Active:         true,
+		ExpiresAt:      expiresAt,
+		LastUpdateAt:   time.Now().UTC(),
+	})
+	return res.Error
+}
+
+func LiveLocationGetActiveByWa(waChatId, waSenderId string) (LiveLocation, bool, error) {
+
+	db := state.State.Database
+
+	var liveLocation LiveLocation
+	res := db.Where("wa_chat_id = ? AND wa_sender_id = ? AND active = ? AND from_telegram = ?", waChatId, waSenderId, true, false).
+		Order("last_update_at DESC").Find(&liveLocation)
+
+	found := (liveLocation.WaMsgId != "")
+	return liveLocation, found, res.Error
+}
+
+func LiveLocationGetByWaMsg(waMsgId, waChatId string) (LiveLocation, bool, error) {
+
+	db := state.State.Database
+
+	var liveLocation LiveLocation
+	res := db.Where("wa_msg_id = ? AND wa_chat_id = ?", waMsgId, waChatId).Find(&liveLocation)
+
+	found := (liveLocation.WaMsgId == waMsgId && liveLocation.WaChatId == waChatId)
+	return liveLocation, found, res.Error
+}
+
+func LiveLocationGetByTg(tgChatId, tgMsgId int64) (LiveLocation, bool, error) {
+
+	db := state.State.Database
+
+	var liveLocation LiveLocation
+	res := db.Where("tg_chat_id = ? AND tg_msg_id = ?", tgChatId, tgMsgId).Find(&liveLocation)
+
+	found := (liveLocation.WaMsgId != "")
+	return liveLocation, found, res.Error
+}
+
+func LiveLocationSetSequence(waMsgId, waChatId string, sequenceNumber int64) error {
+
+	db := state.State.Database
+
+	return db.Model(&LiveLocation{}).
+		Where("wa_msg_id = ? AND wa_chat_id = ?", waMsgId, waChatId).
+		Updates(map[string]any{
+			"sequence_number": sequenceNumber,
+			"last_update_at":  time.Now().UTC(),
+		}).Error
+}
+
+// LiveLocationSetPosition records an update sent to WhatsApp for a session
+// from Telegram
+func LiveLocationSetPosition(waMsgId, waChatId string, sequenceNumber int64, latitude, longitude float64) error {
+
+	db := state.State.Database
+
+	return db.Model(&LiveLocation{}).
+		Where("wa_msg_id = ? AND wa_chat_id = ?", waMsgId, waChatId).
+		Updates(map[string]any{
+			"sequence_number": sequenceNumber,
+			"latitude":        latitude,
+			"longitude":       longitude,
+			"last_update_at":  time.Now().UTC(),
+		}).Error
+}
+
+func LiveLocationDeactivate(waMsgId, waChatId string) error {
+
+	db := state.State.Database
+
+	return db.Model(&LiveLocation{}).
+		Where("wa_msg_id = ? AND wa_chat_id = ?", waMsgId, waChatId).
+		Update("active", false).Error
+}
+
+// LiveLocationGetStale returns the active sessions which have passed their
+// expiry, and the ones from WhatsApp which were not updated since the given
+// time as WhatsApp does not send anything when the sharing is stopped
+func LiveLocationGetStale(updatedBefore time.Time) ([]LiveLocation, error) {
+
+	db := state.State.Database
+
+	var (
+		now           = time.Now().UTC()
+		liveLocations []LiveLocation
+	)
+	res := db.Where("active = ? AND ((from_telegram = ? AND last_update_at < ?) OR (expires_at > ? AND expires_at < ?))",
+		true, false, updatedBefore, time.Time{}, now).Find(&liveLocations)
+
+	return liveLocations, res.Error
+}
+
+// MsgReactionUpsert stores the reaction of a person to a message, an empty
+// emoji removes their reaction
+func MsgReactionUpsert(waMsgId, waChatId, reactorId, emoji string) error {
+
+	db := state.State.Database
+
+	if emoji == "" {
+		res := db.Where("wa_msg_id = ? AND wa_chat_id = ? AND reactor_id = ?", waMsgId, waChatId, reactorId).
+			Delete(&MessageReaction{})
+		return res.Error
+	}
+
+	res := db.Save(&MessageReaction{
+		WaMsgId:   waMsgId,
+		WaChatId:  waChatId,
+		ReactorId: reactorId,
+		Emoji:     emoji,
+		UpdatedAt: time.Now().UTC(),
+	})
+	return res.Error
+}
+
+func MsgReactionGetAll(waMsgId, waChatId string) ([]MessageReaction, error) {
+
+	db := state.State.Database
+
+	var reactions []MessageReaction
+	res := db.Where("wa_msg_id = ? AND wa_chat_id = ?", waMsgId, waChatId).Order("updated_at ASC").Find(&reactions)
+
+	return reactions, res.Error
+}
+
+func ReactionSummaryGet(waMsgId, waChatId string) (ReactionSummary, bool, error) {
+
+	db := state.State.Database
+
+	var summary ReactionSummary
+	res := db.Where("wa_msg_id = ? AND wa_chat_id = ?", waMsgId, waChatId).Find(&summary)
+
+	found := (summary.WaMsgId == waMsgId && summary.WaChatId == waChatId)
+	return summary, found, res.Error
+}
+
+func ReactionSummarySet(waMsgId, waChatId string, tgChatId, summaryMsgId int64) error {
+
+	db := state.State.Database
+
+	res := db.Save(&ReactionSummary{
+		WaMsgId:      waMsgId,
+		WaChatId:     waChatId,
+		TgChatId:     tgChatId,
+		SummaryMsgId: summaryMsgId,
+	})
+	return res.Error
+}
+
+func ReactionSummaryDelete(waMsgId, waChatId string) error {
+
+	db := state.State.Database
+
+	res := db.Where("wa_msg_id = ? AND wa_chat_id = ?", waMsgId, waChatId).Delete(&ReactionSummary{})
+	return res.Error
+}
+
+// HistoryMessageBulkAdd stores messages received through history syncs,
+// replacing the ones which were already stored
+func HistoryMessageBulkAdd(historyMessages []HistoryMessage) error {
+
+	db := state.State.Database
+
+	for start := 0; start < len(historyMessages); start += 500 {
+		end := min(start+500, len(historyMessages))
+		res := db.Save(historyMessages[start:end])
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+
+	return nil
+}
+
+// HistoryMessageGetNext returns the stored messages of the chats sent at or
+// after since, which come after the given cursor
+func HistoryMessageGetNext(waChatIds []string, since, afterTimestamp time.Time, afterMsgId string, limit int) ([]HistoryMessage, error) {
+
+	db := state.State.Database
+
+	var historyMessages []HistoryMessage
+	res := db.Where("wa_chat_id IN ? AND timestamp >= ? AND (timestamp > ? OR (timestamp = ? AND wa_msg_id > ?))",
+		waChatIds, since, afterTimestamp, afterTimestamp, afterMsgId).
+		Order("timestamp ASC, wa_msg_id ASC").Limit(limit).Find(&historyMessages)
+
+	return historyMessages, res.Error
+}
+
+func HistoryMessageGetOldest(waChatIds []string) (HistoryMessage, bool, error) {
+
+	db := state.State.Database
+
+	var historyMessage HistoryMessage
+	res := db.Where("wa_chat_id IN ?", waChatIds).Order("timestamp ASC").Limit(1).Find(&historyMessage)
+
+	found := (historyMessage.WaMsgId != "")
+	return historyMessage, found, res.Error
+}
+
+// HistoryMessageDelete deletes the stored messages of the chats sent at or
+// after since, once they were imported
+func HistoryMessageDelete(waChatIds []string, since time.Time) error {
+
+	db := state.State.Database
+
+	res := db.Where("wa_chat_id IN ? AND timestamp >= ?", waChatIds, since).Delete(&HistoryMessage{})
+	return res.Error
+}
+
+func HistoryImportJobStart(waChatId string, since time.Time) error {
+
+	db := state.State.Database
+
+	res := db.Save(&HistoryImportJob{
+		WaChatId: waChatId,
+		Since:    since,
+	})
+	return res.Error
+}
+
+func HistoryImportJobGet(waChatId string) (HistoryImportJob, bool, error) {
+
+	db := state.State.Database
+
+	var job HistoryImportJob
+	res := db.Where("wa_chat_id = ?", waChatId).Find(&job)
+
+	found := (job.WaChatId == waChatId)
+	return job, found, res.Error
+}
+
+func HistoryImportJobGetUnfinished() ([]HistoryImportJob, error) {
+
+	db := state.State.Database
+
+	var jobs []HistoryImportJob
+	res := db.Where("finished = ?", false).Find(&jobs)
+
+	return jobs, res.Error
+}
+
+func HistoryImportJobSetProgress(waChatId string, lastTimestamp time.Time, lastMsgId string, imported int64) error {
+
+	db := state.State.Database
+
+	return db.Model(&HistoryImportJob{}).
+		Where("wa_chat_id = ?", waChatId).
+		Updates(map[string]any{
+			"last_timestamp": lastTimestamp,
+			"last_msg_id":    lastMsgId,
+			"imported":       imported,
+		}).Error
+}
+
+func HistoryImportJobFinish(waChatId string) error {
+
+	db := state.State.Database
+
+	return db.Model(&HistoryImportJob{}).
+		Where("wa_chat_id = ?", waChatId).
+		Update("finished", true).Error
+}
+
+func OutboxAddNew(item *OutboxItem) error {
+
+	db := state.State.Database
+
+	item.CreatedAt = time.Now().UTC()
+	res := db.Create(item)
+	return res.Error
+}
+
+func OutboxGet(id uint) (OutboxItem, bool, error) {
+
+	db := state.State.Database
+
+	var item OutboxItem
+	res := db.Where("id = ?", id).Find(&item)
+
+	found := (item.ID == id && id != 0)
+	return item, found, res.Error
+}
+
+// OutboxGetAll returns the items which are waiting to be retried or were
+// given up on, oldest first
+func OutboxGetAll() ([]OutboxItem, error) {
+
+	db := state.State.Database
+
+	var items []OutboxItem
+	res := db.Where("status IN ?", []string{OutboxStatusPending, OutboxStatusFailed}).
+		Order("id ASC").Find(&items)
+
+	return items, res.Error
+}
+
+// OutboxGetPending returns the items waiting to be retried, due or not,
+// oldest first
+func OutboxGetPending() ([]OutboxItem, error) {
+
+	db := state.State.Database
+
+	var items []OutboxItem
+	res := db.Where("status = ?", OutboxStatusPending).
+		Order("id ASC").Find(&items)
+
+	return items, res.Error
+}
+
+// OutboxHasPending tells whether messages to a chat are waiting to be
+// retried
+func OutboxHasPending(waChatId string) (bool, error) {
+
+	db := state.State.Database
+
+	var count int64
+	res := db.Model(&OutboxItem{}).
+		Where("wa_chat_id = ? AND status = ?", waChatId, OutboxStatusPending).
+		Count(&count)
+
+	return count > 0, res.Error
+}
+
+// OutboxCountPending counts the items waiting to be sent, including the ones
+// being sent, but not the ones which were given up on
+func OutboxCountPending() (int64, error) {
+
+	db := state.State.Database
+
+	var count int64
+	res := db.Model(&OutboxItem{}).
+		Where("status <> ?", OutboxStatusFailed).
+		Count(&count)
+
+	return count, res.Error
+}
+
+func OutboxSetStatus(id uint, status string) error {
+
+	db := state.State.Database
+
+	return db.Model(&OutboxItem{}).
+		Where("id = ?", id).
+		Update("status", status).Error
+}
+
+func OutboxSetAttempt(id uint, status string, attempts int, lastError string, nextAttemptAt time.Time) error {
+
+	db := state.State.Database
+
+	return db.Model(&OutboxItem{}).
+		Where("id = ?", id).
+		Updates(map[string]any{
+			"status":          status,
+			"attempts":        attempts,
+			"last_error":      lastError,
+			"next_attempt_at": nextAttemptAt,
+		}).Error
+}
+
+// OutboxRetryNow makes the given items, or all of them if no ID is passed,
+// due for a retry with their attempts reset
+func OutboxRetryNow(ids ...uint) error {
+
+	db := state.State.Database
+
+	query := db.Model(&OutboxItem{}).Where("status IN ?", []string{OutboxStatusPending, OutboxStatusFailed})
+	if len(ids) > 0 {
+		query = query.Where("id IN ?", ids)
+	}
+	return query.Updates(map[string]any{
+		"status":          OutboxStatusPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now().UTC(),
+	}).Error
+}
+
+// OutboxResetInterrupted marks the items which were being sent when the
+// bridge stopped as pending again. Only the items added before startedAt are
+// changed, the ones added since are being sent by this run.
+func OutboxResetInterrupted(startedAt time.Time) error {
+
+	db := state.State.Database
+
+	return db.Model(&OutboxItem{}).
+		Where("status = ? AND created_at < ?", OutboxStatusSending, startedAt).
+		Updates(map[string]any{
+			"status":          OutboxStatusPending,
+			"next_attempt_at": time.Now().UTC(),
+		}).Error
+}
+
+func OutboxDelete(id uint) error {
+
+	db := state.State.Database
+
+	res := db.Where("id = ?", id).Delete(&OutboxItem{})
+	return res.Error
+}
+
+// OutboxCancel removes an item unless it is being sent, reporting whether it
+// was removed
+func OutboxCancel(id uint) (bool, error) {
+
+	db := state.State.Database
+
+	res := db.Where("id = ? AND status <> ?", id, OutboxStatusSending).Delete(&OutboxItem{})
+	return res.RowsAffected > 0, res.Error
+}
+
+func ChatSettingsGet(waChatId string) (ChatSettings, bool, error) {
+
+	db := state.State.Database
+
+	var settings ChatSettings
+	res := db.Where("id = ?", waChatId).Find(&settings)
+
+	found := (settings.ID == waChatId && waChatId != "")
+	return settings, found, res.Error
+}
+
+func ChatSettingsSave(settings *ChatSettings) error {
+
+	db := state.State.Database
+
+	res := db.Save(settings)
+	return res.Error
+}
+
+func ChatSettingsDelete(waChatId string) error {
+
+	db := state.State.Database
+
+	res := db.Where("id = ?", waChatId).Delete(&ChatSettings{})
+	return res.Error
+}
+
 func ChatThreadAddNewPair(waChatId string, tgChatId, tgThreadId int64) error {
 
 	db := state.State.Database
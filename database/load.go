@@ -0,0 +1,356 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Loading a dump reuses the copy of the migrations, without progress to
+// resume from as the tables are loaded into empty databases
+func ignoreMigrationReport(string, int64, int64) error {
+	return nil
+}
+
+// ReadDumpManifest reads the manifest of a dump extracted into dir, checking
+// that the dump can be loaded and that the file of each table is there
+func ReadDumpManifest(dir string) (DumpManifest, error) {
+	var manifest DumpManifest
+
+	body, err := os.ReadFile(filepath.Join(dir, DumpManifestFile))
+	if err != nil {
+		return manifest, err
+	}
+	if err = json.Unmarshal(body, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid %s : %s", DumpManifestFile, err)
+	}
+	if manifest.Format != dumpFormatVersion {
+		return manifest, fmt.Errorf("the dump has the format %d, only the format %d can be loaded", manifest.Format, dumpFormatVersion)
+	}
+
+	for _, table := range manifest.Tables {
+		if _, err = os.Stat(filepath.Join(dir, table.Name+".jsonl")); err != nil {
+			return manifest, fmt.Errorf("the rows of table '%s' are missing", table.Name)
+		}
+	}
+
+	return manifest, nil
+}
+
+// LoadBridgeDump loads a logical dump of the bridge database, extracted into
+// dir, into db. The tables are created first and have to be empty.
+func LoadBridgeDump(db *gorm.DB, dir string, batchSize int) error {
+	manifest, err := ReadDumpManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	if err = autoMigrate(db); err != nil {
+		return fmt.Errorf("failed to create the tables : %s", err)
+	}
+
+	// Nothing is loaded unless every table is empty
+	statements := make(map[string]*gorm.Statement)
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db, Model: model}
+		if err = stmt.Parse(model); err != nil {
+			return err
+		}
+		var rows int64
+		if err = db.Model(model).Count(&rows).Error; err != nil {
+			return err
+		} else if rows > 0 {
+			return fmt.Errorf("the table '%s' already has %d rows in it, load the dump into an empty database", stmt.Table, rows)
+		}
+		statements[stmt.Table] = stmt
+	}
+
+	for _, table := range manifest.Tables {
+		stmt, found := statements[table.Name]
+		if !found {
+			return fmt.Errorf("unknown table '%s' in the dump", table.Name)
+		}
+		if err = loadTable(db, stmt, dir, table, batchSize); err != nil {
+			return fmt.Errorf("failed to load table '%s' : %s", table.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// ClearBridgeDatabase deletes every row of the tables of the bridge in db,
+// creating the missing tables, for a dump to be loaded into it
+func ClearBridgeDatabase(db *gorm.DB) error {
+	if err := autoMigrate(db); err != nil {
+		return fmt.Errorf("failed to create the tables : %s", err)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range models {
+			res := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(model)
+			if res.Error != nil {
+				return res.Error
+			}
+		}
+		return nil
+	})
+}
+
+func loadTable(db *gorm.DB, stmt *gorm.Statement, dir string, table DumpTable, batchSize int) error {
+	file, err := os.Open(filepath.Join(dir, table.Name+".jsonl"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	decoder.UseNumber()
+
+	// The columns which are not in the model anymore are left out
+	fields := make([]*schema.Field, len(table.Columns))
+	for idx, column := range table.Columns {
+		fields[idx] = stmt.Schema.LookUpField(column.Name)
+	}
+
+	var (
+		ctx       = context.Background()
+		modelType = reflect.TypeOf(stmt.Model).Elem()
+		sliceType = reflect.SliceOf(modelType)
+	)
+
+	return copyTable(db, stmt, table.Rows, MigrationProgress{}, ignoreMigrationReport, func(int64) (any, int, error) {
+		rows := reflect.New(sliceType)
+		for rows.Elem().Len() < batchSize && decoder.More() {
+			values, err := decodeDumpRow(decoder, table.Columns)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			row := reflect.New(modelType).Elem()
+			for idx, field := range fields {
+				value := values[idx]
+				if field == nil || value == nil {
+					continue
+				}
+				// SQLite stores the booleans in numeric columns, dumped
+				// as reals
+				if number, ok := value.(float64); ok && field.DataType != schema.Float && number == math.Trunc(number) {
+					value = int64(number)
+				}
+				if err = field.Set(ctx, row, value); err != nil {
+					return nil, 0, fmt.Errorf("invalid value for column '%s' : %s", table.Columns[idx].Name, err)
+				}
+			}
+			rows.Elem().Set(reflect.Append(rows.Elem(), row))
+		}
+		return rows.Interface(), rows.Elem().Len(), nil
+	})
+}
+
+// LoadStoreDump loads a logical dump of the WhatsApp session store, extracted
+// into dir, into the database opened with the given database/sql driver and
+// address. The schema is created by whatsmeow first, and its tables have to
+// be empty.
+func LoadStoreDump(dir, driver, address string) error {
+	manifest, err := ReadDumpManifest(dir)
+	if err != nil {
+		return err
+	}
+	dialect, err := storeDialect(driver)
+	if err != nil {
+		return err
+	}
+
+	container, err := sqlstore.New(context.Background(), driver, address, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create the WhatsApp store : %s", err)
+	}
+	if err = container.Close(); err != nil {
+		return err
+	}
+
+	toDB, err := sql.Open(driver, address)
+	if err != nil {
+		return err
+	}
+	defer toDB.Close()
+
+	existing, err := storeTables(toDB, dialect)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is loaded unless every table is empty, the version is set by
+	// whatsmeow when creating the schema
+	for _, table := range existing {
+		if table == "whatsmeow_version" {
+			continue
+		}
+		var rows int64
+		if err = toDB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&rows); err != nil {
+			return err
+		} else if rows > 0 {
+			return fmt.Errorf("the table '%s' already has %d rows in it, load the dump into an empty database", table, rows)
+		}
+	}
+
+	// The other tables reference the devices
+	tables := slices.Clone(manifest.Tables)
+	sort.SliceStable(tables, func(i, j int) bool {
+		return tables[i].Name == "whatsmeow_device" && tables[j].Name != "whatsmeow_device"
+	})
+
+	for _, table := range tables {
+		if table.Name == "whatsmeow_version" {
+			continue
+		}
+		if !slices.Contains(existing, table.Name) {
+			return fmt.Errorf("unknown table '%s' in the dump", table.Name)
+		}
+		if err = loadStoreTable(toDB, dialect, dir, table); err != nil {
+			return fmt.Errorf("failed to load table '%s' : %s", table.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// ClearStoreDatabase deletes every row of the tables of the WhatsApp session
+// store opened with the given database/sql driver and address, for a dump to
+// be loaded into it
+func ClearStoreDatabase(driver, address string) error {
+	dialect, err := storeDialect(driver)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open(driver, address)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tables, err := storeTables(db, dialect)
+	if err != nil {
+		return err
+	}
+
+	// The devices go last as the other tables reference them
+	sort.SliceStable(tables, func(i, j int) bool {
+		return tables[i] != "whatsmeow_device" && tables[j] == "whatsmeow_device"
+	})
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range tables {
+		if table == "whatsmeow_version" {
+			continue
+		}
+		if _, err = tx.Exec("DELETE FROM " + table); err != nil {
+			return fmt.Errorf("failed to clear table '%s' : %s", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func loadStoreTable(toDB *sql.DB, dialect, dir string, table DumpTable) error {
+	// The column names end up in the query, so only the ones of the table
+	// are accepted
+	rows, err := toDB.Query("SELECT * FROM " + table.Name + " WHERE 1 = 0")
+	if err != nil {
+		return err
+	}
+	existing, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	var columns []string
+	for _, column := range table.Columns {
+		if !slices.Contains(existing, column.Name) {
+			return fmt.Errorf("unknown column '%s' in the dump", column.Name)
+		}
+		columns = append(columns, column.Name)
+	}
+
+	file, err := os.Open(filepath.Join(dir, table.Name+".jsonl"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	decoder.UseNumber()
+
+	return copyStoreTable(toDB, dialect, table.Name, columns, table.Rows, MigrationProgress{}, ignoreMigrationReport, func() ([]any, error) {
+		if !decoder.More() {
+			return nil, nil
+		}
+		return decodeDumpRow(decoder, table.Columns)
+	})
+}
+
+// decodeDumpRow reads the next row of a table from its file, converting its
+// values back to what was read from the database
+func decodeDumpRow(decoder *json.Decoder, columns []DumpColumn) ([]any, error) {
+	var values []any
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+	if len(values) != len(columns) {
+		return nil, fmt.Errorf("a row has %d values for %d columns", len(values), len(columns))
+	}
+
+	for idx, column := range columns {
+		value, err := loadValue(column.Kind, values[idx])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for column '%s' : %s", column.Name, err)
+		}
+		values[idx] = value
+	}
+	return values, nil
+}
+
+// loadValue converts a value written in a dump, decoded with numbers kept as
+// json.Number, to what is given to the database for it
+func loadValue(kind string, value any) (any, error) {
+	switch value := value.(type) {
+	case nil, bool:
+		return value, nil
+	case string:
+		switch kind {
+		case "binary":
+			return base64.StdEncoding.DecodeString(value)
+		case "time":
+			return time.Parse(time.RFC3339Nano, value)
+		}
+		return value, nil
+	case json.Number:
+		if kind != "real" {
+			if integer, err := value.Int64(); err == nil {
+				return integer, nil
+			}
+		}
+		return value.Float64()
+	}
+	return nil, fmt.Errorf("unexpected value %v", value)
+}
@@ -0,0 +1,248 @@
+package database
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waAdv"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestLoadValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     string
+		value    any
+		expected any
+	}{
+		{"null", "text", nil, nil},
+		{"boolean", "boolean", true, true},
+		{"text", "text", "plain", "plain"},
+		{"binary", "binary", "AAEC", []byte{0, 1, 2}},
+		{"time", "time", "2024-01-02T02:04:05.000000006Z", time.Date(2024, 1, 2, 2, 4, 5, 6, time.UTC)},
+		{"integer", "integer", json.Number("42"), int64(42)},
+		{"real", "real", json.Number("1.5"), 1.5},
+		{"whole real", "real", json.Number("2"), 2.0},
+		{"fraction in an integer column", "integer", json.Number("1.5"), 1.5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := loadValue(test.kind, test.value)
+			if err != nil {
+				t.Fatalf("loadValue(%q, %#v) failed: %s", test.kind, test.value, err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			expectedJSON, _ := json.Marshal(test.expected)
+			if !bytes.Equal(gotJSON, expectedJSON) || (got == nil) != (test.expected == nil) {
+				t.Errorf("loadValue(%q, %#v) = %#v, expected %#v", test.kind, test.value, got, test.expected)
+			}
+		})
+	}
+
+	if _, err := loadValue("binary", "not base64!"); err == nil {
+		t.Errorf("loadValue() accepted invalid base64")
+	}
+}
+
+func openTestDatabase(t *testing.T, name string) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), name)), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open the database: %s", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// extractTestDump writes the files of the dir directory of a zip into a new
+// directory
+func extractTestDump(t *testing.T, archive []byte, dir string) string {
+	t.Helper()
+
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("failed to read the dump: %s", err)
+	}
+
+	output := t.TempDir()
+	for _, file := range reader.File {
+		name, err := filepath.Rel(dir, file.Name)
+		if err != nil {
+			t.Fatalf("unexpected file %q in the dump", file.Name)
+		}
+		input, err := file.Open()
+		if err != nil {
+			t.Fatalf("failed to open %q: %s", file.Name, err)
+		}
+		var body bytes.Buffer
+		_, err = body.ReadFrom(input)
+		input.Close()
+		if err != nil {
+			t.Fatalf("failed to read %q: %s", file.Name, err)
+		}
+		if err = os.WriteFile(filepath.Join(output, name), body.Bytes(), 0o600); err != nil {
+			t.Fatalf("failed to write %q: %s", name, err)
+		}
+	}
+	return output
+}
+
+func TestLoadBridgeDumpRoundTrip(t *testing.T) {
+	source := openTestDatabase(t, "source.db")
+	if err := autoMigrate(source); err != nil {
+		t.Fatalf("failed to create the tables: %s", err)
+	}
+
+	createdAt := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	pairs := []MsgIdPair{
+		{ID: "A", ParticipantId: "1@s.whatsapp.net", WaChatId: "2@g.us", TgChatId: -100, TgThreadId: 3, TgMsgId: 4, MarkRead: sql.NullBool{Bool: true, Valid: true}, AutoReacted: true, CreatedAt: createdAt},
+		{ID: "B", WaChatId: "2@g.us", TgChatId: -100, TgMsgId: 5, PartOf: "A", CreatedAt: createdAt},
+	}
+	location := LiveLocation{WaMsgId: "C", WaChatId: "2@g.us", Latitude: 48.8566, Longitude: 2.3522, Active: true, LastUpdateAt: createdAt}
+	if err := source.Create(&pairs).Error; err != nil {
+		t.Fatalf("failed to add the pairs: %s", err)
+	}
+	if err := source.Create(&location).Error; err != nil {
+		t.Fatalf("failed to add the live location: %s", err)
+	}
+
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	if err := DumpBridgeDatabase(zipWriter, "main-database", source); err != nil {
+		t.Fatalf("DumpBridgeDatabase() failed: %s", err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatalf("failed to close the dump: %s", err)
+	}
+	dir := extractTestDump(t, archive.Bytes(), "main-database")
+
+	target := openTestDatabase(t, "target.db")
+	if err := LoadBridgeDump(target, dir, 1); err != nil {
+		t.Fatalf("LoadBridgeDump() failed: %s", err)
+	}
+
+	var loadedPairs []MsgIdPair
+	if err := target.Order("id").Find(&loadedPairs).Error; err != nil {
+		t.Fatalf("failed to read the pairs: %s", err)
+	}
+	if len(loadedPairs) != len(pairs) {
+		t.Fatalf("loaded %d pairs, expected %d", len(loadedPairs), len(pairs))
+	}
+	for idx := range pairs {
+		loadedPairs[idx].CreatedAt = loadedPairs[idx].CreatedAt.UTC()
+		if loadedPairs[idx] != pairs[idx] {
+			t.Errorf("loaded pair %+v, expected %+v", loadedPairs[idx], pairs[idx])
+		}
+	}
+
+	var loadedLocation LiveLocation
+	if err := target.First(&loadedLocation).Error; err != nil {
+		t.Fatalf("failed to read the live location: %s", err)
+	}
+	loadedLocation.LastUpdateAt = loadedLocation.LastUpdateAt.UTC()
+	loadedLocation.ExpiresAt = loadedLocation.ExpiresAt.UTC()
+	location.ExpiresAt = location.ExpiresAt.UTC()
+	if loadedLocation != location {
+		t.Errorf("loaded live location %+v, expected %+v", loadedLocation, location)
+	}
+
+	// The dump is only loaded into empty tables
+	if err := LoadBridgeDump(target, dir, 1); err == nil {
+		t.Errorf("LoadBridgeDump() loaded the dump into tables which have rows")
+	}
+	if err := ClearBridgeDatabase(target); err != nil {
+		t.Fatalf("ClearBridgeDatabase() failed: %s", err)
+	}
+	if err := LoadBridgeDump(target, dir, 100); err != nil {
+		t.Errorf("LoadBridgeDump() failed after clearing the database: %s", err)
+	}
+}
+
+func TestLoadStoreDumpRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	sourceAddress := "file:" + filepath.Join(t.TempDir(), "source.db") + "?_foreign_keys=on"
+	targetAddress := "file:" + filepath.Join(t.TempDir(), "target.db") + "?_foreign_keys=on"
+
+	source, err := sqlstore.New(ctx, "sqlite3", sourceAddress, nil)
+	if err != nil {
+		t.Fatalf("failed to create the source store: %s", err)
+	}
+	device := source.NewDevice()
+	jid := types.NewJID("123456789", types.DefaultUserServer)
+	device.ID = &jid
+	device.PushName = "Bridge"
+	device.Account = &waAdv.ADVSignedDeviceIdentity{
+		Details:             []byte{1},
+		AccountSignature:    make([]byte, 64),
+		AccountSignatureKey: make([]byte, 32),
+		DeviceSignature:     make([]byte, 64),
+	}
+	if err = device.Save(ctx); err != nil {
+		t.Fatalf("failed to save the device: %s", err)
+	}
+	if err = device.Identities.PutIdentity(ctx, "987654321.0", [32]byte{1, 2, 3}); err != nil {
+		t.Fatalf("failed to save the identity: %s", err)
+	}
+	source.Close()
+
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	if err = DumpStoreDatabase(zipWriter, "whatsapp-login", "sqlite3", sourceAddress); err != nil {
+		t.Fatalf("DumpStoreDatabase() failed: %s", err)
+	}
+	if err = zipWriter.Close(); err != nil {
+		t.Fatalf("failed to close the dump: %s", err)
+	}
+	dir := extractTestDump(t, archive.Bytes(), "whatsapp-login")
+
+	if err = LoadStoreDump(dir, "sqlite3", targetAddress); err != nil {
+		t.Fatalf("LoadStoreDump() failed: %s", err)
+	}
+
+	target, err := sqlstore.New(ctx, "sqlite3", targetAddress, nil)
+	if err != nil {
+		t.Fatalf("failed to open the target store: %s", err)
+	}
+	defer target.Close()
+
+	loaded, err := target.GetFirstDevice(ctx)
+	if err != nil {
+		t.Fatalf("failed to read the device: %s", err)
+	}
+	if loaded.ID == nil || *loaded.ID != jid || loaded.PushName != device.PushName {
+		t.Errorf("loaded device %v (%q), expected %v (%q)", loaded.ID, loaded.PushName, jid, device.PushName)
+	}
+	if *loaded.IdentityKey.Priv != *device.IdentityKey.Priv {
+		t.Errorf("the identity key of the device changed")
+	}
+	if trusted, err := loaded.Identities.IsTrustedIdentity(ctx, "987654321.0", [32]byte{1, 2, 3}); err != nil || !trusted {
+		t.Errorf("the identity was not loaded: trusted = %v, err = %v", trusted, err)
+	}
+
+	// The dump is only loaded into empty tables
+	if err = LoadStoreDump(dir, "sqlite3", targetAddress); err == nil {
+		t.Errorf("LoadStoreDump() loaded the dump into tables which have rows")
+	}
+	if err = ClearStoreDatabase("sqlite3", targetAddress); err != nil {
+		t.Fatalf("ClearStoreDatabase() failed: %s", err)
+	}
+	if err = LoadStoreDump(dir, "sqlite3", targetAddress); err != nil {
+		t.Errorf("LoadStoreDump() failed after clearing the database: %s", err)
+	}
+}
@@ -0,0 +1,308 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MigrationProgress is the number of rows copied of each table, which the
+// caller keeps between runs to resume a migration which was interrupted. A
+// table is in it as soon as its copy started.
+type MigrationProgress map[string]int64
+
+// MigrationReport is called after each batch of rows copied to the target,
+// an error stops the migration
+type MigrationReport func(table string, copied, total int64) error
+
+// MigrateBridgeDatabase copies every table of the bridge from one database
+// to another, which can be of another type, creating the tables in the
+// target first. Each table is copied in batches ordered by primary key and
+// its number of rows is compared between both databases once copied. The
+// source must not change while it runs.
+func MigrateBridgeDatabase(from, to *gorm.DB, batchSize int, progress MigrationProgress, report MigrationReport) error {
+	if err := autoMigrate(to); err != nil {
+		return fmt.Errorf("failed to create the tables in the target : %s", err)
+	}
+
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: to, Model: model}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		if err := migrateTable(from, to, stmt, batchSize, progress, report); err != nil {
+			return fmt.Errorf("failed to migrate table '%s' : %s", stmt.Table, err)
+		}
+	}
+
+	return nil
+}
+
+func migrateTable(from, to *gorm.DB, stmt *gorm.Statement, batchSize int, progress MigrationProgress, report MigrationReport) error {
+	var (
+		model     = stmt.Model
+		sliceType = reflect.SliceOf(reflect.TypeOf(model).Elem())
+		total     int64
+	)
+
+	if err := from.Model(model).Count(&total).Error; err != nil {
+		return err
+	}
+
+	// Offsets stay stable as long as the order is total, which the primary
+	// key makes it
+	order := strings.Join(stmt.Schema.PrimaryFieldDBNames, ", ")
+	if order == "" {
+		order = strings.Join(stmt.Schema.DBNames, ", ")
+	}
+
+	return copyTable(to, stmt, total, progress, report, func(copied int64) (any, int, error) {
+		rows := reflect.New(sliceType)
+		res := from.Model(model).
+			Order(order).
+			Offset(int(copied)).
+			Limit(batchSize).
+			Find(rows.Interface())
+		return rows.Interface(), rows.Elem().Len(), res.Error
+	})
+}
+
+// nextRows returns the next rows to copy into a table, after the copied ones,
+// as a pointer to a slice of its model along with their number. No rows
+// means that all of them were read.
+type nextRows func(copied int64) (any, int, error)
+
+// copyTable inserts the total rows returned by next into the table of the
+// model of stmt, which has to be empty unless the progress says that the
+// copy already started
+func copyTable(to *gorm.DB, stmt *gorm.Statement, total int64, progress MigrationProgress, report MigrationReport, next nextRows) error {
+	var (
+		table      = stmt.Table
+		model      = stmt.Model
+		targetRows int64
+	)
+
+	if err := to.Model(model).Count(&targetRows).Error; err != nil {
+		return err
+	}
+
+	copied, started := progress[table]
+	if !started {
+		if targetRows > 0 {
+			return fmt.Errorf("the target already has %d rows in it, migrate into an empty database", targetRows)
+		}
+		progress[table] = 0
+		if err := report(table, 0, total); err != nil {
+			return err
+		}
+	}
+
+	for copied < total {
+		rows, count, err := next(copied)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			break
+		}
+
+		// Rows copied before an interruption which was not recorded yet
+		// are skipped
+		res := to.Clauses(clause.OnConflict{DoNothing: true}).
+			CreateInBatches(rows, 100)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		copied += int64(count)
+		progress[table] = copied
+		if err := report(table, copied, total); err != nil {
+			return err
+		}
+	}
+
+	if err := to.Model(model).Count(&targetRows).Error; err != nil {
+		return err
+	}
+	if targetRows != total {
+		return fmt.Errorf("the target has %d rows after copying the %d rows of the source", targetRows, total)
+	}
+
+	// Postgres does not move the sequence of an auto-increment key past the
+	// IDs inserted explicitly
+	if field := stmt.Schema.PrioritizedPrimaryField; to.Dialector.Name() == "postgres" && field != nil && field.AutoIncrement {
+		err := to.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', '%s'), COALESCE(MAX(%s), 0) + 1, false) FROM %s",
+			table, field.DBName, field.DBName, table)).Error
+		if err != nil {
+			return fmt.Errorf("failed to update the sequence of '%s' : %s", field.DBName, err)
+		}
+	}
+
+	return nil
+}
+
+// MigrateStoreDatabase copies the WhatsApp session store from one database
+// to another, opened with the given database/sql drivers and addresses. The
+// schema of the target is created by whatsmeow, then each table is copied
+// at once and its number of rows compared between both databases. The
+// progress records the tables which are done.
+func MigrateStoreDatabase(fromDriver, fromAddress, toDriver, toAddress string, progress MigrationProgress, report MigrationReport) error {
+	fromDialect, err := storeDialect(fromDriver)
+	if err != nil {
+		return err
+	}
+	toDialect, err := storeDialect(toDriver)
+	if err != nil {
+		return err
+	}
+
+	container, err := sqlstore.New(context.Background(), toDriver, toAddress, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create the WhatsApp store in the target : %s", err)
+	}
+	if err = container.Close(); err != nil {
+		return err
+	}
+
+	fromDB, err := sql.Open(fromDriver, fromAddress)
+	if err != nil {
+		return err
+	}
+	defer fromDB.Close()
+
+	toDB, err := sql.Open(toDriver, toAddress)
+	if err != nil {
+		return err
+	}
+	defer toDB.Close()
+
+	tables, err := storeTables(fromDB, fromDialect)
+	if err != nil {
+		return err
+	}
+
+	// The other tables reference the devices, the version is set by
+	// whatsmeow when creating the schema
+	sort.SliceStable(tables, func(i, j int) bool {
+		return tables[i] == "whatsmeow_device" && tables[j] != "whatsmeow_device"
+	})
+
+	for _, table := range tables {
+		if table == "whatsmeow_version" {
+			continue
+		}
+		if err = migrateStoreTable(fromDB, toDB, toDialect, table, progress, report); err != nil {
+			return fmt.Errorf("failed to migrate table '%s' : %s", table, err)
+		}
+	}
+
+	return nil
+}
+
+func migrateStoreTable(fromDB, toDB *sql.DB, toDialect, table string, progress MigrationProgress, report MigrationReport) error {
+	var total int64
+	if err := fromDB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&total); err != nil {
+		return err
+	}
+
+	rows, err := fromDB.Query("SELECT * FROM " + table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	var (
+		values  = make([]any, len(columns))
+		targets = make([]any, len(columns))
+	)
+	for idx := range values {
+		targets[idx] = &values[idx]
+	}
+
+	return copyStoreTable(toDB, toDialect, table, columns, total, progress, report, func() ([]any, error) {
+		if !rows.Next() {
+			return nil, rows.Err()
+		}
+		return values, rows.Scan(targets...)
+	})
+}
+
+// nextStoreRow returns the values of the next row to copy into a table of
+// the session store, in the order of its columns, or nil once all of them
+// were read
+type nextStoreRow func() ([]any, error)
+
+// copyStoreTable inserts the total rows returned by next into a table of the
+// session store, which has to be empty unless the progress says that it was
+// already copied
+func copyStoreTable(toDB *sql.DB, toDialect, table string, columns []string, total int64, progress MigrationProgress, report MigrationReport, next nextStoreRow) error {
+	var targetRows int64
+	if err := toDB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&targetRows); err != nil {
+		return err
+	}
+
+	copied, started := progress[table]
+	if started && copied == total && targetRows == total {
+		return nil
+	}
+	if !started && targetRows > 0 {
+		return fmt.Errorf("the target already has %d rows in it, migrate into an empty database", targetRows)
+	}
+
+	// The table is copied in a single transaction, an interrupted copy
+	// leaves it empty
+	var quoted, placeholders []string
+	for idx, column := range columns {
+		quoted = append(quoted, `"`+column+`"`)
+		if toDialect == "postgres" {
+			placeholders = append(placeholders, fmt.Sprintf("$%d", idx+1))
+		} else {
+			placeholders = append(placeholders, "?")
+		}
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING",
+		table, strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+
+	tx, err := toDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for {
+		values, err := next()
+		if err != nil {
+			return err
+		} else if values == nil {
+			break
+		}
+		if _, err = tx.Exec(insert, values...); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if err = toDB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&targetRows); err != nil {
+		return err
+	}
+	if targetRows != total {
+		return fmt.Errorf("the target has %d rows after copying the %d rows of the source", targetRows, total)
+	}
+
+	progress[table] = total
+	return report(table, total, total)
+}
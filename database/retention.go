@@ -0,0 +1,312 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"watgbridge/state"
+
+	"gorm.io/gorm"
+)
+
+// Rows deleted by a single query while pruning, to keep the queries and
+// their locks short
+const pruneBatchSize = 500
+
+// PruneResult counts the rows deleted by a pruning run
+type PruneResult struct {
+	MsgIdPairs      int64
+	MessageReceipts int64
+	Reactions       int64 // Reactions and reaction summaries
+	Polls           int64 // Poll pairs and votes
+	HistoryMessages int64
+}
+
+// MsgIdPrunePairs deletes the pairs older than maxAge, then the oldest
+// pairs of the chats having more than maxPerChat of them. Zero disables
+// either limit.
+func MsgIdPrunePairs(maxAge time.Duration, maxPerChat int) (int64, error) {
+	db := state.State.Database
+
+	var deleted int64
+
+	if maxAge > 0 {
+		cutoff := time.Now().UTC().Add(-maxAge)
+		for {
+			var expiredIds []string
+			res := db.Model(&MsgIdPair{}).
+				Where("created_at < ?", cutoff).
+				Limit(pruneBatchSize).
+				Pluck("id", &expiredIds)
+			if res.Error != nil {
+				return deleted, res.Error
+			}
+			if len(expiredIds) == 0 {
+				break
+			}
+
+			res = db.Where("id IN ?", expiredIds).Delete(&MsgIdPair{})
+			if res.Error != nil {
+				return deleted, res.Error
+			}
+			deleted += res.RowsAffected
+		}
+	}
+
+	if maxPerChat <= 0 {
+		return deleted, nil
+	}
+
+	var chatIds []string
+	res := db.Model(&MsgIdPair{}).
+		Group("wa_chat_id").
+		Having("COUNT(*) > ?", maxPerChat).
+		Pluck("wa_chat_id", &chatIds)
+	if res.Error != nil {
+		return deleted, res.Error
+	}
+
+	for _, waChatId := range chatIds {
+		var excessIds []string
+		// MySQL does not accept an offset without a limit
+		res = db.Model(&MsgIdPair{}).
+			Where("wa_chat_id = ?", waChatId).
+			Order("created_at DESC").
+			Offset(maxPerChat).
+			Limit(1<<30).
+			Pluck("id", &excessIds)
+		if res.Error != nil {
+			return deleted, res.Error
+		}
+
+		for len(excessIds) > 0 {
+			batch := excessIds[:min(len(excessIds), pruneBatchSize)]
+			excessIds = excessIds[len(batch):]
+
+			res = db.Where("wa_chat_id = ? AND id IN ?", waChatId, batch).Delete(&MsgIdPair{})
+			if res.Error != nil {
+				return deleted, res.Error
+			}
+			deleted += res.RowsAffected
+		}
+	}
+
+	return deleted, nil
+}
+
+// HistoryMessagePrune deletes the messages stored from history syncs which
+// were sent more than maxAge ago, zero keeping them all
+func HistoryMessagePrune(maxAge time.Duration) (int64, error) {
+	db := state.State.Database
+
+	if maxAge <= 0 {
+		return 0, nil
+	}
+	res := db.Where("timestamp < ?", time.Now().UTC().Add(-maxAge)).Delete(&HistoryMessage{})
+	return res.RowsAffected, res.Error
+}
+
+// MsgReceiptPrune deletes the receipts older than maxAge, zero keeping them
+// all, and the receipts of messages whose pair does not exist anymore
+func MsgReceiptPrune(maxAge time.Duration) (int64, error) {
+	db := state.State.Database
+
+	var deleted int64
+
+	if maxAge > 0 {
+		res := db.Where("receipt_time < ?", time.Now().UTC().Add(-maxAge)).Delete(&MessageReceipt{})
+		if res.Error != nil {
+			return deleted, res.Error
+		}
+		deleted += res.RowsAffected
+	}
+
+	pairsTable, err := tableName(&MsgIdPair{})
+	if err != nil {
+		return deleted, err
+	}
+	receiptsTable, err := tableName(&MessageReceipt{})
+	if err != nil {
+		return deleted, err
+	}
+
+	res := db.Where(fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s WHERE %s.id = %s.wa_msg_id)",
+		pairsTable, pairsTable, receiptsTable)).Delete(&MessageReceipt{})
+	deleted += res.RowsAffected
+	return deleted, res.Error
+}
+
+// MsgReactionPrune deletes the reactions and reaction summaries of messages
+// whose pair does not exist anymore
+func MsgReactionPrune() (int64, error) {
+	var deleted int64
+
+	for _, model := range []any{&MessageReaction{}, &ReactionSummary{}} {
+		res, err := pruneOrphans(model, "wa_msg_id", &MsgIdPair{}, "id")
+		deleted += res
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// PollPairPrune deletes the poll pairs of messages whose pair does not exist
+// anymore, then the votes of the polls which are gone
+func PollPairPrune() (int64, error) {
+	deleted, err := pruneOrphans(&PollPair{}, "id", &MsgIdPair{}, "id")
+	if err != nil {
+		return deleted, err
+	}
+
+	votes, err := pruneOrphans(&PollVote{}, "wa_poll_id", &PollPair{}, "id")
+	return deleted + votes, err
+}
+
+// pruneOrphans deletes the rows of model whose column does not match the
+// parentColumn of any row of parent
+func pruneOrphans(model any, column string, parent any, parentColumn string) (int64, error) {
+	db := state.State.Database
+
+	table, err := tableName(model)
+	if err != nil {
+		return 0, err
+	}
+	parentTable, err := tableName(parent)
+	if err != nil {
+		return 0, err
+	}
+
+	res := db.Where(fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s WHERE %s.%s = %s.%s)",
+		parentTable, parentTable, parentColumn, table, column)).Delete(model)
+	return res.RowsAffected, res.Error
+}
+
+// Optimize reclaims the space left by deleted rows and refreshes the
+// statistics used by the query planner, in the way of each database type
+func Optimize() error {
+	db := state.State.Database
+
+	switch db.Dialector.Name() {
+	case "sqlite":
+		if err := db.Exec("VACUUM").Error; err != nil {
+			return err
+		}
+		return db.Exec("ANALYZE").Error
+
+	case "postgres":
+		// VACUUM cannot run inside a transaction, which Exec does not start
+		for _, model := range []any{&MsgIdPair{}, &MessageReceipt{}} {
+			table, err := tableName(model)
+			if err != nil {
+				return err
+			}
+			if err = db.Exec("VACUUM ANALYZE " + table).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "mysql":
+		// OPTIMIZE rebuilds InnoDB tables and analyzes them afterwards
+		for _, model := range []any{&MsgIdPair{}, &MessageReceipt{}} {
+			table, err := tableName(model)
+			if err != nil {
+				return err
+			}
+			if err = db.Exec("OPTIMIZE TABLE " + table).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("optimizing a database of type '%s' is not supported", db.Dialector.Name())
+}
+
+// TableStats describes the size of a table
+type TableStats struct {
+	Name string
+	Rows int64
+	Size int64 // Bytes used by the table and its indexes, -1 if unknown
+}
+
+// DatabaseStats returns the number of rows and size of every table of the
+// bridge, along with the size of the whole database or -1 if unknown
+func DatabaseStats() ([]TableStats, int64, error) {
+	db := state.State.Database
+
+	var (
+		tables    []TableStats
+		totalSize int64 = -1
+	)
+
+	for _, model := range models {
+		table, err := tableName(model)
+		if err != nil {
+			return nil, totalSize, err
+		}
+
+		stats := TableStats{Name: table, Size: -1}
+		if err = db.Model(model).Count(&stats.Rows).Error; err != nil {
+			return nil, totalSize, err
+		}
+
+		switch db.Dialector.Name() {
+		case "postgres":
+			db.Raw("SELECT pg_total_relation_size(?)", table).Scan(&stats.Size)
+		case "mysql":
+			db.Raw("SELECT data_length + index_length FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?",
+				table).Scan(&stats.Size)
+		}
+
+		tables = append(tables, stats)
+	}
+
+	switch db.Dialector.Name() {
+	case "sqlite":
+		var pageCount, pageSize int64
+		if db.Raw("PRAGMA page_count").Scan(&pageCount).Error == nil &&
+			db.Raw("PRAGMA page_size").Scan(&pageSize).Error == nil {
+			totalSize = pageCount * pageSize
+		}
+	case "postgres":
+		db.Raw("SELECT pg_database_size(current_database())").Scan(&totalSize)
+	case "mysql":
+		db.Raw("SELECT SUM(data_length + index_length) FROM information_schema.tables WHERE table_schema = DATABASE()").
+			Scan(&totalSize)
+	}
+
+	return tables, totalSize, nil
+}
+
+// ChatPairCount is the number of message pairs stored for a chat
+type ChatPairCount struct {
+	WaChatId string
+	Count    int64
+}
+
+// MsgIdCountByChat returns the chats with the most stored pairs, limit of
+// them at most
+func MsgIdCountByChat(limit int) ([]ChatPairCount, error) {
+	db := state.State.Database
+
+	var counts []ChatPairCount
+	res := db.Model(&MsgIdPair{}).
+		Select("wa_chat_id, COUNT(*) AS count").
+		Group("wa_chat_id").
+		Order("count DESC").
+		Limit(limit).
+		Scan(&counts)
+	return counts, res.Error
+}
+
+// tableName returns the name of the table of the given model
+func tableName(model any) (string, error) {
+	stmt := &gorm.Statement{DB: state.State.Database}
+	if err := stmt.Parse(model); err != nil {
+		return "", err
+	}
+	return stmt.Table, nil
+}
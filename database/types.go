@@ -2,9 +2,12 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
 
 	"watgbridge/state"
+
+	"gorm.io/gorm"
 )
 
 type MsgIdPair struct {
@@ -20,6 +23,157 @@ type MsgIdPair struct {
 
 	MarkRead sql.NullBool
 	AutoReacted bool
+
+	PartOf string `gorm:"index"` // ID of the message, for the parts it was split into after the first one
+
+	CreatedAt time.Time `gorm:"index"` // Used to prune old pairs
+}
+
+type PollPair struct {
+	// WhatsApp
+	ID         string `gorm:"primaryKey;"` // Poll creation message ID
+	WaChatId   string `gorm:"primaryKey;"` // Chat JID
+	WaSenderId string // Poll creator JID
+	Options    string // JSON encoded list of option names, in order
+
+	// Telegram
+	TgChatId   int64
+	TgThreadId int64
+	TgMsgId    int64
+	TgPollId   string `gorm:"index"`
+	TallyMsgId int64  // Message showing the running tally of WhatsApp votes
+}
+
+type PollVote struct {
+	WaPollId        string `gorm:"primaryKey;"`
+	WaChatId        string `gorm:"primaryKey;"`
+	VoterId         string `gorm:"primaryKey;"`
+	SelectedOptions string // JSON encoded list of selected option names
+	UpdatedAt       time.Time
+}
+
+type LiveLocation struct {
+	// WhatsApp
+	WaMsgId        string `gorm:"primaryKey;"` // Message ID of the first live location message
+	WaChatId       string `gorm:"primaryKey;"`
+	WaSenderId     string
+	SequenceNumber int64
+	Latitude       float64 // Last position sent, for the update ending the session
+	Longitude      float64
+
+	// Telegram
+	TgChatId   int64
+	TgThreadId int64
+	TgMsgId    int64
+
+	FromTelegram bool
+	Active       bool
+	ExpiresAt    time.Time // Zero if the sharing has no known end
+	LastUpdateAt time.Time
+}
+
+// OptionNames decodes the stored poll options
+func (p PollPair) OptionNames() []string {
+	var options []string
+	_ = json.Unmarshal([]byte(p.Options), &options)
+	return options
+}
+
+// OptionNames decodes the options selected by the voter
+func (v PollVote) OptionNames() []string {
+	var options []string
+	_ = json.Unmarshal([]byte(v.SelectedOptions), &options)
+	return options
+}
+
+type MessageReaction struct {
+	WaMsgId   string `gorm:"primaryKey;"` // Reacted message ID
+	WaChatId  string `gorm:"primaryKey;"`
+	ReactorId string `gorm:"primaryKey;"`
+	Emoji     string
+	UpdatedAt time.Time
+}
+
+type ReactionSummary struct {
+	WaMsgId      string `gorm:"primaryKey;"` // Reacted message ID
+	WaChatId     string `gorm:"primaryKey;"`
+	TgChatId     int64
+	SummaryMsgId int64 // Message listing the reactions which could not be shown natively
+}
+
+type HistoryMessage struct {
+	WaChatId   string    `gorm:"primaryKey;"` // Chat JID as received in the history sync
+	WaMsgId    string    `gorm:"primaryKey;"`
+	Timestamp  time.Time `gorm:"index"`
+	RawMessage []byte    // Protobuf encoded WebMessageInfo
+}
+
+// ArchivedMessage is a bridged message kept for /search when the archive is
+// enabled, in either direction
+type ArchivedMessage struct {
+	ID uint `gorm:"primaryKey;"` // Stable row ID, used by the SQLite full-text index
+
+	// WhatsApp
+	WaMsgId    string `gorm:"uniqueIndex:idx_archived_msg_chat;size:191"` // Sized for MySQL, which cannot index TEXT
+	WaChatId   string `gorm:"uniqueIndex:idx_archived_msg_chat;index"`
+	SenderId   string `gorm:"index"`
+	SenderName string
+	Timestamp  time.Time `gorm:"index"`
+
+	FromTelegram bool   // Sent from Telegram to WhatsApp
+	Text         string // Text or caption
+	MediaType    string
+	MimeType     string
+	FileName     string
+	FileSize     uint64
+
+	// Telegram
+	TgChatId   int64
+	TgThreadId int64
+	TgMsgId    int64
+	TgFileId   string // Media of the Telegram message, downloaded by /exportchat
+}
+
+type HistoryImportJob struct {
+	WaChatId      string `gorm:"primaryKey;"`
+	Since         time.Time
+	LastTimestamp time.Time // Timestamp and ID of the last replayed message, to resume after restarts
+	LastMsgId     string
+	Imported      int64
+	Finished      bool
+}
+
+// Statuses of the outbox items
+const (
+	OutboxStatusSending = "sending"
+	OutboxStatusPending = "pending"
+	OutboxStatusFailed  = "failed"
+)
+
+type OutboxItem struct {
+	ID uint `gorm:"primaryKey;"`
+
+	// WhatsApp
+	WaChatId       string
+	Participant    string // Arguments to send the message again
+	StanzaId       string
+	QuotedWaChatId string
+	IsReply        bool
+	AlbumId        string // AlbumMessage the item belongs to, if any
+
+	// Telegram
+	TgChatId   int64
+	TgThreadId int64
+	TgMsgId    int64
+	ContextMsg []byte // JSON encoded update message, forwarded message and the message it replies to
+	ForwardMsg []byte
+	ReplyToMsg []byte
+
+	Status        string `gorm:"index"`
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
 }
 
 type ChatThreadPair struct {
@@ -43,6 +197,27 @@ type ChatEphemeralSettings struct {
 	EphemeralTimer uint32
 }
 
+// ChatSettings overrides the global options for a single chat, the options
+// which are not set follow the config file
+type ChatSettings struct {
+	ID     string `gorm:"primaryKey;"` // WhatsApp Chat ID
+	Muted  bool   // Nothing from the chat is bridged
+	Silent bool   // Messages from the chat are sent without a notification
+
+	SkipImages     sql.NullBool
+	SkipGIFs       sql.NullBool
+	SkipVideos     sql.NullBool
+	SkipVoiceNotes sql.NullBool
+	SkipAudios     sql.NullBool
+	SkipDocuments  sql.NullBool
+	SkipStickers   sql.NullBool
+	SkipContacts   sql.NullBool
+	SkipLocations  sql.NullBool
+
+	SkipChatDetails  sql.NullBool // Compact header without the chat name
+	SendReadReceipts sql.NullBool
+}
+
 type MessageReceipt struct {
 	WaMsgId       string    `gorm:"primaryKey;index:idx_receipt_msg_chat_participant"`
 	WaChatId      string    `gorm:"primaryKey;index:idx_receipt_msg_chat_participant"`
@@ -51,13 +226,45 @@ type MessageReceipt struct {
 	ReceiptTime   time.Time
 }
 
+// BackupMessage is a backup archive sent by the bridge, kept to delete the
+// older ones
+type BackupMessage struct {
+	ID        uint  `gorm:"primaryKey"`
+	TgChatId  int64 `gorm:"index"`
+	TgMsgId   int64
+	CreatedAt time.Time
+}
+
+// Models of all the tables of the bridge
+var models = []any{
+	&MsgIdPair{},
+	&ChatThreadPair{},
+	&ContactName{},
+	&ChatEphemeralSettings{},
+	&MessageReceipt{},
+	&PollPair{},
+	&PollVote{},
+	&LiveLocation{},
+	&MessageReaction{},
+	&ReactionSummary{},
+	&HistoryMessage{},
+	&HistoryImportJob{},
+	&ArchivedMessage{},
+	&OutboxItem{},
+	&ChatSettings{},
+	&BackupMessage{},
+}
+
 func AutoMigrate() error {
-	db := state.State.Database
-	return db.AutoMigrate(
-		&MsgIdPair{},
-		&ChatThreadPair{},
-		&ContactName{},
-		&ChatEphemeralSettings{},
-		&MessageReceipt{},
-	)
+	return autoMigrate(state.State.Database)
+}
+
+func autoMigrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(models...); err != nil {
+		return err
+	}
+
+	// Pairs stored before they had a creation time are counted from now on,
+	// so that the retention policy does not leave them forever
+	return db.Model(&MsgIdPair{}).Where("created_at IS NULL").Update("created_at", time.Now().UTC()).Error
 }
@@ -4,12 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"os/exec"
 	"strconv"
 	"time"
 
 	"watgbridge/database"
+	"watgbridge/metrics"
 	"watgbridge/modules"
 	"watgbridge/state"
 	"watgbridge/telegram"
@@ -63,13 +65,63 @@ func sendRestartNotification(logger *zap.Logger) bool {
 	return true
 }
 
+// registerMetricsGauges adds the metrics read from the state of the bridge
+// when they are collected
+func registerMetricsGauges() {
+	metrics.RegisterGauge("watgbridge_whatsapp_connected",
+		"Whether the WhatsApp client is connected and logged in", func() float64 {
+			waClient := state.State.WhatsAppClient()
+			if waClient.IsConnected() && waClient.IsLoggedIn() {
+				return 1
+			}
+			return 0
+		})
+	metrics.RegisterGauge("watgbridge_outbox_pending",
+		"Messages waiting in the outbox to be sent to WhatsApp", func() float64 {
+			pending, err := database.OutboxCountPending()
+			if err != nil {
+				return math.NaN()
+			}
+			return float64(pending)
+		})
+	metrics.RegisterGauge("watgbridge_uptime_seconds",
+		"Time since the bridge was started", func() float64 {
+			return time.Since(state.State.StartTime).Seconds()
+		})
+}
+
 func main() {
 	// Load configuration file
 	cfg := state.State.Config
 	cfg.SetDefaults()
 
-	if len(os.Args) > 1 {
-		cfg.Path = os.Args[1]
+	// watgbridge [config path]
+	// watgbridge restore <backup zip> [config path]
+	// watgbridge decrypt <encrypted backup> [config path]
+	// watgbridge migrate --from <config path> --to <config path> [--whatsapp]
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "migrate" {
+		migrateFromCommandLine(args[1:])
+		return
+	}
+
+	var restoreArchive, decryptArchive string
+	if len(args) > 0 && (args[0] == "restore" || args[0] == "decrypt") {
+		if len(args) < 2 {
+			fmt.Println("Usage: watgbridge restore <backup zip> [config path]")
+			fmt.Println("       watgbridge decrypt <encrypted backup> [config path]")
+			os.Exit(2)
+		}
+		if args[0] == "restore" {
+			restoreArchive = args[1]
+		} else {
+			decryptArchive = args[1]
+		}
+		args = args[2:]
+	}
+
+	if len(args) > 0 {
+		cfg.Path = args[0]
 	}
 
 	err := cfg.LoadConfig()
@@ -137,6 +189,16 @@ func main() {
 		_ = logger.Sync()
 	}
 
+	if decryptArchive != "" {
+		decryptFromCommandLine(decryptArchive)
+		return
+	}
+
+	if restoreArchive != "" {
+		restoreFromCommandLine(logger, restoreArchive)
+		return
+	}
+
 	configChanged := false
 	if cfg.GitExecutable == "" {
 		cfg.GitExecutable = findExecutablePath(logger, cfg, "git", true)
@@ -163,6 +225,11 @@ func main() {
 		}
 	}
 
+	// Another bridge or a restore using the same databases would corrupt them
+	if err = utils.LockBridge(); err != nil {
+		logger.Fatal("failed to lock the databases", zap.Error(err))
+	}
+
 	// Setup database
 	db, err := database.Connect()
 	if err != nil {
@@ -178,6 +245,14 @@ func main() {
 		)
 	}
 
+	if cfg.Archive.Enabled {
+		if err = database.ArchiveSetupIndex(); err != nil {
+			logger.Fatal("could not create the search index of the message archive",
+				zap.Error(err),
+			)
+		}
+	}
+
 	err = telegram.NewTelegramClient()
 	if err != nil {
 		logger.Fatal("failed to initialize telegram client",
@@ -197,13 +272,17 @@ func main() {
 	s := gocron.NewScheduler(time.UTC)
 	s.TagsUnique()
 	_, _ = s.Every(1).Hour().Tag("foo").Do(func() {
-		contacts, err := state.State.WhatsAppClient.Store.Contacts.GetAllContacts(context.Background())
+		contacts, err := state.State.WhatsAppClient().Store.Contacts.GetAllContacts(context.Background())
 		if err == nil {
 			_ = database.ContactNameBulkAddOrUpdate(contacts)
 		}
 	})
+	s.StartAsync()
+	telegram.StopBridge = func(ctx context.Context) {
+		stopBridge(ctx, logger, s)
+	}
 
-	state.State.WhatsAppClient.AddEventHandler(whatsapp.WhatsAppEventHandler)
+	whatsapp.AddEventHandler(whatsapp.WhatsAppEventHandler)
 	telegram.AddTelegramHandlers()
 	modules.LoadModuleHandlers()
 
@@ -224,6 +303,13 @@ func main() {
 	}
 	_ = logger.Sync()
 
+	err = telegram.StartReceivingUpdates()
+	if err != nil {
+		logger.Fatal("failed to start receiving telegram updates",
+			zap.Error(err),
+		)
+	}
+
 	startMessageSuccessful := sendRestartNotification(logger)
 
 	if !startMessageSuccessful && !cfg.Telegram.SkipStartupMessage {
@@ -231,6 +317,19 @@ func main() {
 	}
 
 	utils.StartAutomaticDatabaseBackups()
+	utils.StartAutomaticDatabasePruning()
+	whatsapp.StartLiveLocationWatcher()
+	utils.StartOutboxWorker()
+	whatsapp.StartHealthMonitor()
+	if cfg.WhatsApp.HistoryImport.Enabled {
+		whatsapp.ResumeHistoryImports()
+	}
+	modules.StartModules()
+	if cfg.Metrics.Enabled {
+		registerMetricsGauges()
+		metrics.StartServer()
+	}
 
-	state.State.TelegramUpdater.Idle()
+	waitForShutdownSignal(logger)
+	shutdown(logger, s)
 }
@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directions in which messages are bridged
+const (
+	WhatsAppToTelegram = "whatsapp_to_telegram"
+	TelegramToWhatsApp = "telegram_to_whatsapp"
+)
+
+var (
+	BridgedMessages = newCounter("watgbridge_bridged_messages_total",
+		"Messages bridged, by direction and type of message", "direction", "type")
+	SendDuration = newHistogram("watgbridge_send_duration_seconds",
+		"Time taken to bridge a message, from receiving it to having sent it to the other side",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}, "direction")
+	ConversionFailures = newCounter("watgbridge_conversion_failures_total",
+		"Stickers and audios which could not be converted for the other side", "conversion")
+	TelegramRateLimited = newCounter("watgbridge_telegram_rate_limited_total",
+		"Telegram requests retried after being rate limited", "method")
+	DatabaseErrors = newCounter("watgbridge_database_errors_total",
+		"Database queries which failed", "operation")
+)
+
+// metric is anything which can be written in the Prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     []metric
+)
+
+func register(m metric) {
+	registryLock.Lock()
+	registry = append(registry, m)
+	registryLock.Unlock()
+}
+
+// WriteTo writes all the metrics in the Prometheus text exposition format
+func WriteTo(w io.Writer) {
+	registryLock.Lock()
+	metrics := append([]metric{}, registry...)
+	registryLock.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Counter is a value which only goes up, kept separately for every
+// combination of its labels
+type Counter struct {
+	name, help string
+	labels     []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter with the given label values, in the order of
+// the labels of the counter
+func (c *Counter) Inc(labelValues ...string) {
+	key := formatLabels(c.labels, labelValues, "")
+
+	c.lock.Lock()
+	c.values[key]++
+	c.lock.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatValue(c.values[key]))
+	}
+}
+
+// Histogram counts durations in buckets, kept separately for every
+// combination of its labels
+type Histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	lock   sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	register(h)
+	return h
+}
+
+// Observe records a duration with the given label values
+func (h *Histogram) Observe(d time.Duration, labelValues ...string) {
+	var (
+		key     = formatLabels(h.labels, labelValues, "")
+		seconds = d.Seconds()
+	)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, found := h.series[key]
+	if !found {
+		s = &histogramSeries{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+	for idx, bound := range h.buckets {
+		if seconds <= bound {
+			s.counts[idx]++
+		}
+	}
+	s.sum += seconds
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for idx, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(h.labels, s.labelValues, formatValue(bound)), s.counts[idx])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// gaugeFunc is a value read when the metrics are collected
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+// RegisterGauge adds a metric whose value is read from the given function
+// every time the metrics are collected
+func RegisterGauge(name, help string, value func() float64) {
+	register(&gaugeFunc{name, help, value})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value()))
+}
+
+func writeHeader(w io.Writer, name, help, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// formatLabels returns the label set of a series, with the le label of a
+// histogram bucket at the end if it is not empty
+func formatLabels(labels, values []string, le string) string {
+	var pairs []string
+	for idx, label := range labels {
+		value := ""
+		if idx < len(values) {
+			value = values[idx]
+		}
+		pairs = append(pairs, label+"=\""+escapeLabelValue(value)+"\"")
+	}
+	if le != "" {
+		pairs = append(pairs, "le=\""+le+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
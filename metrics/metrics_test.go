@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   []string
+		values   []string
+		le       string
+		expected string
+	}{
+		{"no labels", nil, nil, "", ""},
+		{"one label", []string{"direction"}, []string{"in"}, "", `{direction="in"}`},
+		{"several labels", []string{"a", "b"}, []string{"1", "2"}, "", `{a="1",b="2"}`},
+		{"missing value", []string{"a", "b"}, []string{"1"}, "", `{a="1",b=""}`},
+		{"bucket only", nil, nil, "+Inf", `{le="+Inf"}`},
+		{"bucket last", []string{"a"}, []string{"1"}, "0.5", `{a="1",le="0.5"}`},
+		{"escaped", []string{"a"}, []string{"quo\"te\\new\nline"}, "", `{a="quo\"te\\new\nline"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := formatLabels(test.labels, test.values, test.le); got != test.expected {
+				t.Errorf("formatLabels() = %s, expected %s", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := &Histogram{
+		name:    "test_duration_seconds",
+		help:    "Test durations",
+		labels:  []string{"direction"},
+		buckets: []float64{0.5, 1},
+		series:  make(map[string]*histogramSeries),
+	}
+	h.Observe(250*time.Millisecond, "in")
+	h.Observe(750*time.Millisecond, "in")
+	h.Observe(2*time.Second, "in")
+
+	var output strings.Builder
+	h.write(&output)
+
+	expected := `# HELP test_duration_seconds Test durations
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{direction="in",le="0.5"} 1
+test_duration_seconds_bucket{direction="in",le="1"} 2
+test_duration_seconds_bucket{direction="in",le="+Inf"} 3
+test_duration_seconds_sum{direction="in"} 3
+test_duration_seconds_count{direction="in"} 3
+`
+	if output.String() != expected {
+		t.Errorf("histogram output:\n%s\nexpected:\n%s", output.String(), expected)
+	}
+}
@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"watgbridge/state"
+
+	"go.uber.org/zap"
+)
+
+// How long polling may go without a successful getUpdates before Telegram is
+// reported as unhealthy, getUpdates returns at least every 10 seconds
+const telegramPollingTimeout = time.Minute
+
+var (
+	server *http.Server
+
+	telegramLock        sync.Mutex
+	lastTelegramPoll    time.Time
+	lastTelegramPollErr error
+)
+
+// TelegramRequestDone records the result of a request to the Telegram API,
+// used to tell whether polling for updates is still working
+func TelegramRequestDone(method string, err error) {
+	if method != "getUpdates" {
+		return
+	}
+
+	telegramLock.Lock()
+	defer telegramLock.Unlock()
+
+	if err == nil {
+		lastTelegramPoll = time.Now()
+	}
+	lastTelegramPollErr = err
+}
+
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	OK       bool        `json:"ok"`
+	WhatsApp healthCheck `json:"whatsapp"`
+	Database healthCheck `json:"database"`
+	Telegram healthCheck `json:"telegram"`
+}
+
+func checkWhatsApp() healthCheck {
+	waClient := state.State.WhatsAppClient()
+	if waClient == nil || !waClient.IsConnected() {
+		return healthCheck{Detail: "not connected"}
+	}
+	if !waClient.IsLoggedIn() {
+		return healthCheck{Detail: "not logged in"}
+	}
+	return healthCheck{OK: true}
+}
+
+func checkDatabase(ctx context.Context) healthCheck {
+	if state.State.Database == nil {
+		return healthCheck{Detail: "not connected"}
+	}
+	sqlDB, err := state.State.Database.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+	if err != nil {
+		return healthCheck{Detail: err.Error()}
+	}
+	return healthCheck{OK: true}
+}
+
+func checkTelegram() healthCheck {
+	if state.State.Config.Telegram.Webhook.Enabled {
+		// Updates are pushed to the webhook, there is nothing to poll
+		return healthCheck{OK: true, Detail: "receiving updates through webhook"}
+	}
+
+	telegramLock.Lock()
+	defer telegramLock.Unlock()
+
+	if lastTelegramPoll.IsZero() {
+		return healthCheck{Detail: "polling has not started"}
+	}
+	if since := time.Since(lastTelegramPoll); since > telegramPollingTimeout {
+		check := healthCheck{Detail: "no successful poll for " + since.Round(time.Second).String()}
+		if lastTelegramPollErr != nil {
+			check.Detail += ": " + lastTelegramPollErr.Error()
+		}
+		return check
+	}
+	return healthCheck{OK: true}
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	report := healthReport{
+		WhatsApp: checkWhatsApp(),
+		Database: checkDatabase(ctx),
+		Telegram: checkTelegram(),
+	}
+	report.OK = report.WhatsApp.OK && report.Database.OK && report.Telegram.OK
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WriteTo(w)
+}
+
+// StartServer starts the HTTP server serving /healthz and /metrics on the
+// configured address
+func StartServer() {
+	var (
+		cfg    = state.State.Config
+		logger = state.State.Logger
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	server = &http.Server{
+		Addr:              cfg.Metrics.ListenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics server stopped", zap.Error(err))
+		}
+	}()
+
+	logger.Info("serving health checks and metrics",
+		zap.String("listen_addr", cfg.Metrics.ListenAddr),
+	)
+}
+
+// StopServer stops the server started by StartServer, if any
+func StopServer(ctx context.Context) error {
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+
+	"watgbridge/database"
+	"watgbridge/state"
+)
+
+// Progress of a migration, saved after every batch so that running the same
+// command again resumes it
+type migrationProgress struct {
+	Bridge   database.MigrationProgress `json:"bridge"`
+	WhatsApp database.MigrationProgress `json:"whatsapp"`
+}
+
+// migrateFromCommandLine copies the databases of the bridge from the ones of
+// a config to the ones of another, which can be of another type. The bridge
+// must not be running while it does.
+func migrateFromCommandLine(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fromPath := flags.String("from", "", "config file of the databases to copy from")
+	toPath := flags.String("to", "", "config file of the databases to copy to")
+	withStore := flags.Bool("whatsapp", false, "copy the WhatsApp login database too, logging in again is not needed then")
+	batchSize := flags.Int("batch-size", 1000, "rows copied at once")
+	progressPath := flags.String("progress", "watgbridge-migrate.json", "file keeping the progress, to resume an interrupted migration")
+	flags.Parse(args)
+
+	if *fromPath == "" || *toPath == "" || *batchSize <= 0 {
+		fmt.Println("Usage: watgbridge migrate --from <config path> --to <config path> [--whatsapp]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	fromCfg, err := loadMigrationConfig(*fromPath)
+	if err != nil {
+		fmt.Printf("Failed to load %s: %s\n", *fromPath, err)
+		os.Exit(1)
+	}
+	toCfg, err := loadMigrationConfig(*toPath)
+	if err != nil {
+		fmt.Printf("Failed to load %s: %s\n", *toPath, err)
+		os.Exit(1)
+	}
+
+	if reflect.DeepEqual(fromCfg.Database, toCfg.Database) {
+		fmt.Println("Both configs use the same database")
+		os.Exit(1)
+	}
+	if *withStore && fromCfg.WhatsApp.LoginDatabase == toCfg.WhatsApp.LoginDatabase {
+		fmt.Println("Both configs use the same WhatsApp login database")
+		os.Exit(1)
+	}
+
+	progress := migrationProgress{
+		Bridge:   database.MigrationProgress{},
+		WhatsApp: database.MigrationProgress{},
+	}
+	progressBody, err := os.ReadFile(*progressPath)
+	if err == nil {
+		if err = json.Unmarshal(progressBody, &progress); err != nil {
+			fmt.Printf("Failed to read the progress in %s: %s\n", *progressPath, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Resuming the migration recorded in %s\n", *progressPath)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Failed to read the progress in %s: %s\n", *progressPath, err)
+		os.Exit(1)
+	}
+
+	report := func(table string, copied, total int64) error {
+		fmt.Printf("  %s: %d/%d rows\n", table, copied, total)
+
+		progressBody, err := json.Marshal(progress)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(*progressPath, progressBody, 0o600)
+	}
+
+	fromDB, err := database.ConnectWith(fromCfg.Database)
+	if err != nil {
+		fmt.Printf("Failed to connect to the database of %s: %s\n", *fromPath, err)
+		os.Exit(1)
+	}
+	toDB, err := database.ConnectWith(toCfg.Database)
+	if err != nil {
+		fmt.Printf("Failed to connect to the database of %s: %s\n", *toPath, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Copying the bridge database (%s to %s)\n", fromCfg.Database["type"], toCfg.Database["type"])
+	err = database.MigrateBridgeDatabase(fromDB, toDB, *batchSize, progress.Bridge, report)
+	if err != nil {
+		fmt.Printf("Migration stopped: %s\nRun the same command again to resume it\n", err)
+		os.Exit(1)
+	}
+
+	if *withStore {
+		fromStore, toStore := fromCfg.WhatsApp.LoginDatabase, toCfg.WhatsApp.LoginDatabase
+		fmt.Printf("Copying the WhatsApp login database (%s to %s)\n", fromStore.Type, toStore.Type)
+		err = database.MigrateStoreDatabase(fromStore.Type, fromStore.URL, toStore.Type, toStore.URL,
+			progress.WhatsApp, report)
+		if err != nil {
+			fmt.Printf("Migration stopped: %s\nRun the same command again to resume it\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err = os.Remove(*progressPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Failed to remove %s: %s\n", *progressPath, err)
+	}
+	fmt.Printf("Migration done, every table has as many rows in both databases. Start the bridge with %s now\n", *toPath)
+}
+
+func loadMigrationConfig(path string) (*state.Config, error) {
+	cfg := &state.Config{Path: path}
+	cfg.SetDefaults()
+	if err := cfg.LoadConfig(); err != nil {
+		return nil, err
+	}
+
+	if cfg.WhatsApp.LoginDatabase.Type == "" || cfg.WhatsApp.LoginDatabase.URL == "" {
+		cfg.WhatsApp.LoginDatabase.Type = "sqlite3"
+		cfg.WhatsApp.LoginDatabase.URL = "file:wawebstore.db?foreign_keys=on"
+	}
+	return cfg, nil
+}
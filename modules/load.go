@@ -5,6 +5,7 @@ import (
 
 	"watgbridge/state"
 	"watgbridge/telegram"
+	"watgbridge/whatsapp"
 
 	"github.com/PaulSonOfLars/gotgbot/v2/ext"
 	"go.mau.fi/whatsmeow"
@@ -32,6 +33,8 @@ func LoadModuleHandlers() {
 	logger := state.State.Logger
 	defer logger.Sync()
 
+	loadRegisteredModules()
+
 	for handlerGroup, handlers := range TelegramHandlers {
 		for _, handler := range handlers {
 			state.State.TelegramDispatcher.AddHandlerToGroup(handler, handlerGroup)
@@ -39,7 +42,7 @@ func LoadModuleHandlers() {
 	}
 
 	for _, handler := range WhatsAppHandlers {
-		state.State.WhatsAppClient.AddEventHandler(handler)
+		whatsapp.AddEventHandler(handler)
 	}
 
 	if len(state.State.Modules) > 0 {
@@ -0,0 +1,186 @@
+package modules
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"watgbridge/state"
+	"watgbridge/telegram"
+	"watgbridge/utils"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// AuthLevel decides who is allowed to use a command or callback of a module
+type AuthLevel int
+
+const (
+	// AuthSudo allows the owner and the sudo users, like the built-in commands
+	AuthSudo AuthLevel = iota
+	// AuthOwner allows only the owner
+	AuthOwner
+	// AuthAnyone skips the authorization check, the handler must do its own
+	AuthAnyone
+)
+
+type Command struct {
+	Name        string
+	Description string // Commands without a description are hidden from /help
+	Handler     handlers.Response
+	AuthLevel   AuthLevel
+}
+
+type Callback struct {
+	Prefix    string // Callback queries with data starting with this are handled
+	Handler   handlers.Response
+	AuthLevel AuthLevel
+}
+
+// Config is the section of config.yaml under modules.<module name>
+type Config struct {
+	node *yaml.Node
+}
+
+// IsSet reports whether the section is present in the config file
+func (c Config) IsSet() bool {
+	return c.node != nil
+}
+
+// Decode unmarshals the section into v, leaving v untouched if the section
+// is missing
+func (c Config) Decode(v any) error {
+	if c.node == nil {
+		return nil
+	}
+	return c.node.Decode(v)
+}
+
+// Module describes a module built into the bridge. Modules call Register
+// from an init function in a file of this package.
+//
+// Init is called with the config section before any handler is added, Start
+// once the bridge is connected and receiving updates, and Shutdown when the
+// bridge stops. All of them are optional.
+type Module struct {
+	Name      string
+	Commands  []Command
+	Callbacks []Callback
+
+	Init     func(cfg Config) error
+	Start    func() error
+	Shutdown func() error
+}
+
+var registeredModules []Module
+
+// Register adds a module to be loaded on startup
+func Register(module Module) {
+	registeredModules = append(registeredModules, module)
+}
+
+func withAuthLevel(level AuthLevel, response handlers.Response) handlers.Response {
+	return func(b *gotgbot.Bot, c *ext.Context) error {
+		switch level {
+		case AuthAnyone:
+		case AuthOwner:
+			if c.EffectiveSender == nil || c.EffectiveSender.Id() != state.State.Config.Telegram.OwnerID {
+				if c.CallbackQuery != nil {
+					c.CallbackQuery.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+						Text:      "Only the owner can use this",
+						ShowAlert: true,
+						CacheTime: 60,
+					})
+				}
+				return nil
+			}
+		default:
+			if !utils.TgUpdateIsAuthorized(b, c) {
+				return nil
+			}
+		}
+		return response(b, c)
+	}
+}
+
+func loadRegisteredModules() {
+	logger := state.State.Logger
+
+	for _, module := range registeredModules {
+		if module.Init != nil {
+			moduleCfg := Config{}
+			if node, found := state.State.Config.Modules[module.Name]; found {
+				moduleCfg.node = &node
+			}
+			if err := module.Init(moduleCfg); err != nil {
+				logger.Error("failed to initialize module, skipping it",
+					zap.String("module", module.Name),
+					zap.Error(err),
+				)
+				continue
+			}
+		}
+
+		for _, command := range module.Commands {
+			telegram.AddCommand(
+				handlers.NewCommand(command.Name, withAuthLevel(command.AuthLevel, command.Handler)),
+				command.Description,
+			)
+		}
+
+		for _, callback := range module.Callbacks {
+			prefix := callback.Prefix
+			state.State.TelegramDispatcher.AddHandlerToGroup(handlers.NewCallback(
+				func(cq *gotgbot.CallbackQuery) bool {
+					return strings.HasPrefix(cq.Data, prefix)
+				}, withAuthLevel(callback.AuthLevel, callback.Handler)), telegram.DispatcherCallbackHandlerGroup)
+		}
+
+		if !slices.Contains(state.State.Modules, module.Name) {
+			state.State.Modules = append(state.State.Modules, module.Name)
+		}
+	}
+}
+
+// StartModules runs the start hooks of the loaded modules
+func StartModules() {
+	logger := state.State.Logger
+	defer logger.Sync()
+
+	for _, module := range registeredModules {
+		if module.Start == nil || !slices.Contains(state.State.Modules, module.Name) {
+			continue
+		}
+		if err := module.Start(); err != nil {
+			logger.Error("failed to start module",
+				zap.String("module", module.Name),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// ShutdownModules runs the shutdown hooks of the loaded modules in the
+// reverse order of their loading
+func ShutdownModules() error {
+	var errs []string
+
+	for idx := len(registeredModules) - 1; idx >= 0; idx-- {
+		module := registeredModules[idx]
+		if module.Shutdown == nil || !slices.Contains(state.State.Modules, module.Name) {
+			continue
+		}
+		if err := module.Shutdown(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", module.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to shutdown modules : %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -32,6 +32,8 @@ in
 
     subPackages = ["."];
 
+    tags = ["sqlite_fts5"];
+
     ldflags = [
       "-s"
       "-w"
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"watgbridge/state"
+	"watgbridge/utils"
+
+	"go.uber.org/zap"
+)
+
+// restoreFromCommandLine restores a backup archive made by the bridge, then
+// starts the bridge in place of this process. The bridge must not be running
+// while its databases are replaced, which its lock file tells.
+func restoreFromCommandLine(logger *zap.Logger, zipPath string) {
+	defer logger.Sync()
+
+	if err := utils.LockBridge(); err != nil {
+		fmt.Printf("Cannot restore %s: %s\n", zipPath, err)
+		os.Exit(1)
+	}
+
+	kept, err := utils.RestoreDatabaseBackup(zipPath)
+	if err != nil {
+		fmt.Printf("Failed to restore %s: %s\n", zipPath, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Restored %s\n", zipPath)
+	if len(kept) > 0 {
+		fmt.Println("The previous databases were kept at:")
+		for _, keptFile := range kept {
+			fmt.Printf("  %s\n", keptFile)
+		}
+	}
+
+	fmt.Println("Starting the bridge...")
+	_ = logger.Sync()
+	if err = utils.RestartBridge(0, 0); err != nil {
+		fmt.Printf("Failed to start the bridge: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// decryptFromCommandLine writes the zip of a backup encrypted with the
+// passphrase of the config next to it
+func decryptFromCommandLine(backupPath string) {
+	backupFile, err := os.Open(backupPath)
+	if err != nil {
+		fmt.Printf("Failed to read %s: %s\n", backupPath, err)
+		os.Exit(1)
+	}
+	defer backupFile.Close()
+
+	passphrase := state.State.Config.Backup.Passphrase
+	if passphrase == "" {
+		fmt.Println("No backup.passphrase is set in the config")
+		os.Exit(1)
+	}
+
+	zipPath := strings.TrimSuffix(backupPath, ".enc")
+	if zipPath == backupPath {
+		zipPath += ".zip"
+	}
+	if err = utils.DecryptBackupToFile(backupFile, zipPath, passphrase); err != nil {
+		fmt.Printf("Failed to decrypt %s: %s\n", backupPath, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Decrypted %s to %s\n", backupPath, zipPath)
+}
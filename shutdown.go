@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"watgbridge/database"
+	"watgbridge/metrics"
+	"watgbridge/modules"
+	"watgbridge/state"
+	"watgbridge/utils"
+	"watgbridge/whatsapp"
+
+	"github.com/go-co-op/gocron"
+	"go.uber.org/zap"
+)
+
+// waitForShutdownSignal blocks until SIGINT or SIGTERM is received. A second
+// signal exits right away without waiting for the shutdown to finish.
+func waitForShutdownSignal(logger *zap.Logger) {
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-sigChan
+	logger.Info("received signal, shutting down",
+		zap.String("signal", sig.String()),
+	)
+	_ = logger.Sync()
+
+	go func() {
+		<-sigChan
+		logger.Warn("received second signal, exiting without waiting")
+		_ = logger.Sync()
+		os.Exit(1)
+	}()
+}
+
+// shutdown stops everything in the reverse order of starting it. The running
+// handlers on both sides are given until the configured timeout to finish
+// bridging what they started, after which the rest is closed anyway.
+func shutdown(logger *zap.Logger, scheduler *gocron.Scheduler) {
+	cfg := state.State.Config
+	defer logger.Sync()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(cfg.ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	if err := metrics.StopServer(ctx); err != nil {
+		logger.Error("failed to stop metrics server", zap.Error(err))
+	}
+
+	// Stops receiving updates and waits for the running Telegram handlers,
+	// while WhatsApp is still connected for them to send their messages
+	tgStopped := make(chan error, 1)
+	go func() {
+		tgStopped <- state.State.TelegramUpdater.Stop()
+	}()
+	select {
+	case err := <-tgStopped:
+		if err != nil {
+			logger.Error("failed to stop telegram updater", zap.Error(err))
+		}
+	case <-ctx.Done():
+		logger.Warn("timed out waiting for telegram handlers to finish")
+	}
+
+	stopBridge(ctx, logger, scheduler)
+
+	logger.Info("shutdown complete")
+}
+
+// stopBridge stops everything using the databases and closes them, once no
+// more Telegram updates are handled. It is shared by the shutdown and by
+// /restore, which replaces the databases afterwards.
+func stopBridge(ctx context.Context, logger *zap.Logger, scheduler *gocron.Scheduler) {
+	// Albums still waiting for more items are sent with what arrived
+	waitFor(ctx, logger, "media groups to be sent", utils.FlushMediaGroups())
+
+	// The imports go on from the message they were at after the next start
+	waitFor(ctx, logger, "history imports to stop", whatsapp.StopHistoryImports())
+
+	// A queued message being retried is given the time to reach WhatsApp
+	waitFor(ctx, logger, "the outbox worker to finish", utils.StopOutboxWorker())
+
+	// Disconnecting must not be reported nor followed by a reconnection
+	waitFor(ctx, logger, "whatsapp reconnection to stop", whatsapp.StopHealthMonitor())
+
+	// Albums from WhatsApp still waiting for more items are sent with what
+	// arrived, while their media can still be downloaded
+	whatsapp.FlushWaAlbums()
+
+	state.State.WhatsAppClient().Disconnect()
+	waitFor(ctx, logger, "whatsapp handlers to finish", whatsapp.StopEventHandlers())
+
+	waitFor(ctx, logger, "live location watcher to finish", whatsapp.StopLiveLocationWatcher())
+
+	scheduler.Stop()
+	waitFor(ctx, logger, "database backup to finish", utils.StopAutomaticDatabaseBackups())
+	waitFor(ctx, logger, "database pruning to finish", utils.StopAutomaticDatabasePruning())
+
+	if err := modules.ShutdownModules(); err != nil {
+		logger.Error("failed to shutdown modules", zap.Error(err))
+	}
+
+	if err := whatsapp.CloseStore(); err != nil {
+		logger.Error("failed to close whatsapp database", zap.Error(err))
+	}
+	if err := database.Close(); err != nil {
+		logger.Error("failed to close database", zap.Error(err))
+	}
+}
+
+// waitFor waits until done is, or logs that it timed out waiting for what
+// name describes once ctx is done
+func waitFor(ctx context.Context, logger *zap.Logger, name string, done context.Context) {
+	select {
+	case <-done.Done():
+	case <-ctx.Done():
+		logger.Warn("timed out waiting for " + name)
+	}
+}
@@ -18,6 +18,8 @@ type Config struct {
 	FfmpegExecutable string `yaml:"ffmpeg_executable"`
 	DebugMode        bool   `yaml:"debug_mode"`
 
+	ShutdownTimeoutSeconds int `yaml:"shutdown_timeout_seconds"`
+
 	UseGithHubBinaries bool   `yaml:"use_github_binaries"`
 	Architecture       string `yaml:"architecture"`
 
@@ -43,6 +45,22 @@ type Config struct {
 		TagAllEnabled       bool    `yaml:"tag_all_enabled"`
 		AutoReactWhenAllRead bool   `yaml:"auto_react_when_all_read"`
 		AutoReactRemoveAfter int64  `yaml:"auto_react_remove_after_seconds"`
+		KeepPendingUpdates   bool   `yaml:"keep_pending_updates"`
+		QuickActionsButton   bool   `yaml:"quick_actions_button"`
+		Webhook              struct {
+			Enabled     bool   `yaml:"enabled"`
+			ListenAddr  string `yaml:"listen_addr"`
+			PublicURL   string `yaml:"public_url"`
+			Path        string `yaml:"path"`
+			SecretToken string `yaml:"secret_token"`
+			CertFile    string `yaml:"cert_file"`
+			KeyFile     string `yaml:"key_file"`
+		} `yaml:"webhook"`
+		Outbox struct {
+			MaxAttempts       int `yaml:"max_attempts"`
+			RetryDelaySeconds int `yaml:"retry_delay_seconds"`
+			MaxDelaySeconds   int `yaml:"max_delay_seconds"`
+		} `yaml:"outbox"`
 	} `yaml:"telegram"`
 
 	WhatsApp struct {
@@ -54,8 +72,21 @@ type Config struct {
 			PackName   string `yaml:"pack_name"`
 			AuthorName string `yaml:"author_name"`
 		} `yaml:"sticker_metadata"`
+		HistoryImport struct {
+			Enabled           bool   `yaml:"enabled"`
+			SyncDaysLimit     uint32 `yaml:"sync_days_limit"`
+			DefaultDays       uint32 `yaml:"default_days"`
+			MessagesPerMinute uint32 `yaml:"messages_per_minute"`
+		} `yaml:"history_import"`
+		Health struct {
+			NotifyAfterSeconds       uint32 `yaml:"notify_after_seconds"`
+			AutoReconnect            bool   `yaml:"auto_reconnect"`
+			ReconnectMaxDelaySeconds uint32 `yaml:"reconnect_max_delay_seconds"`
+		} `yaml:"health"`
 		SessionName                    string   `yaml:"session_name"`
 		ClientMode                     string   `yaml:"client_mode"`
+		LoginMethod                    string   `yaml:"login_method"`
+		PairPhone                      string   `yaml:"pair_phone"`
 		TagAllAllowedGroups            []string `yaml:"tag_all_allowed_groups"`
 		IgnoreChats                    []string `yaml:"ignore_chats"`
 		StatusIgnoredChats             []string `yaml:"status_ignored_chats"`
@@ -79,6 +110,7 @@ type Config struct {
 		CreateThreadForInfoUpdates     bool     `yaml:"create_thread_for_info_updates"`
 		SkipPinnedMessages             bool     `yaml:"skip_pinned_messages"`
 		StatusMessageDurationSeconds   uint32   `yaml:"status_message_duration_seconds"`
+		LiveLocationTimeoutMinutes     uint32   `yaml:"live_location_timeout_minutes"`
 	} `yaml:"whatsapp"`
 
 	Database map[string]string `yaml:"database"`
@@ -87,7 +119,28 @@ type Config struct {
 		Mode         string `yaml:"mode"`
 		CronSchedule string `yaml:"cron_schedule"`
 		ThreadName   string `yaml:"thread_name"`
+		Passphrase   string `yaml:"passphrase"`
+		KeepLast     uint32 `yaml:"keep_last"`
 	} `yaml:"backup"`
+
+	Retention struct {
+		MaxAgeDays         uint32 `yaml:"max_age_days"`
+		MaxMessagesPerChat uint32 `yaml:"max_messages_per_chat"`
+		CronSchedule       string `yaml:"cron_schedule"`
+		Vacuum             bool   `yaml:"vacuum"`
+	} `yaml:"retention"`
+
+	Archive struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"archive"`
+
+	Metrics struct {
+		Enabled    bool   `yaml:"enabled"`
+		ListenAddr string `yaml:"listen_addr"`
+	} `yaml:"metrics"`
+
+	// Sections of the modules, keyed by the module name
+	Modules map[string]yaml.Node `yaml:"modules,omitempty"`
 }
 
 func (cfg *Config) LoadConfig() error {
@@ -158,18 +211,36 @@ func (cfg *Config) SaveConfig() error {
 
 func (cfg *Config) SetDefaults() {
 	cfg.TimeZone = "UTC"
+	cfg.ShutdownTimeoutSeconds = 30
 
 	cfg.WhatsApp.SessionName = "watgbridge"
 	cfg.WhatsApp.ClientMode = "android"
+	cfg.WhatsApp.LoginMethod = "qr"
 	cfg.WhatsApp.LoginDatabase.Type = "sqlite3"
 	cfg.WhatsApp.LoginDatabase.URL = "file:wawebstore.db?foreign_keys=on"
 	cfg.WhatsApp.StickerMetadata.PackName = "WaTgBridge"
 	cfg.WhatsApp.StickerMetadata.AuthorName = "WaTgBridge"
 	cfg.WhatsApp.StatusMessageDurationSeconds = 86400
+	cfg.WhatsApp.LiveLocationTimeoutMinutes = 15
+	cfg.WhatsApp.HistoryImport.SyncDaysLimit = 30
+	cfg.WhatsApp.HistoryImport.DefaultDays = 7
+	cfg.WhatsApp.HistoryImport.MessagesPerMinute = 20
+	cfg.WhatsApp.Health.NotifyAfterSeconds = 120
+	cfg.WhatsApp.Health.ReconnectMaxDelaySeconds = 300
 
 	cfg.Telegram.ConfirmationType = "emoji"
+	cfg.Telegram.Webhook.ListenAddr = "127.0.0.1:8443"
+	cfg.Telegram.Webhook.Path = "telegram-webhook"
+	cfg.Telegram.Outbox.MaxAttempts = 10
+	cfg.Telegram.Outbox.RetryDelaySeconds = 30
+	cfg.Telegram.Outbox.MaxDelaySeconds = 3600
 
 	cfg.Backup.Mode = "none"
 	cfg.Backup.CronSchedule = "0 0 * * *"
 	cfg.Backup.ThreadName = "Database Backups"
+
+	cfg.Retention.CronSchedule = "0 4 * * *"
+	cfg.Retention.Vacuum = true
+
+	cfg.Metrics.ListenAddr = "127.0.0.1:9090"
 }
@@ -3,6 +3,7 @@ package state
 import (
 	_ "embed"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
@@ -25,7 +26,9 @@ type state struct {
 	TelegramUpdater    *ext.Updater
 	TelegramCommands   []gotgbot.BotCommand
 
-	WhatsAppClient *whatsmeow.Client
+	// Replaced by /relogin while handlers use it, so only accessed through
+	// WhatsAppClient and SetWhatsAppClient
+	whatsAppClient atomic.Pointer[whatsmeow.Client]
 
 	Modules []string
 
@@ -35,6 +38,14 @@ type state struct {
 
 var State state
 
+func (s *state) WhatsAppClient() *whatsmeow.Client {
+	return s.whatsAppClient.Load()
+}
+
+func (s *state) SetWhatsAppClient(client *whatsmeow.Client) {
+	s.whatsAppClient.Store(client)
+}
+
 func init() {
 	WATGBRIDGE_VERSION = strings.TrimSpace(WATGBRIDGE_VERSION)
 	State.Config = &Config{Path: "config.yaml"}
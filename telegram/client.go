@@ -1,9 +1,12 @@
 package telegram
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"watgbridge/state"
@@ -14,6 +17,56 @@ import (
 	"go.uber.org/zap"
 )
 
+// StopBridge stops everything using the databases once no more updates are
+// received, it is set by main and used by /restore before replacing them
+var StopBridge func(ctx context.Context)
+
+// Number of updates being handled by the dispatcher
+var runningUpdates atomic.Int64
+
+// countingProcessor keeps runningUpdates up to date, for a handler to wait
+// for the other ones
+type countingProcessor struct {
+	ext.BaseProcessor
+}
+
+func (p countingProcessor) ProcessUpdate(d *ext.Dispatcher, b *gotgbot.Bot, ctx *ext.Context) error {
+	runningUpdates.Add(1)
+	defer runningUpdates.Add(-1)
+
+	return p.BaseProcessor.ProcessUpdate(d, b, ctx)
+}
+
+// waitForOtherUpdates blocks until the update of the calling handler is the
+// only one being handled, it returns false if the context ended first. The
+// dispatcher cannot be stopped from one of its handlers as it would wait for
+// it too.
+func waitForOtherUpdates(ctx context.Context) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for runningUpdates.Load() > 1 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+var allowedUpdates = []string{
+	"message",
+	"edited_message",
+	"channel_post",
+	"edited_channel_post",
+	"callback_query",
+	"poll_answer",
+	"message_reaction",
+	"my_chat_member",
+	"chat_member",
+}
+
 func NewTelegramClient() error {
 	var (
 		cfg    = state.State.Config
@@ -47,6 +100,7 @@ func NewTelegramClient() error {
 			)
 		},
 		MaxRoutines: ext.DefaultMaxRoutines,
+		Processor:   countingProcessor{},
 	})
 
 	updater := ext.NewUpdater(dispatcher, &ext.UpdaterOpts{
@@ -60,28 +114,6 @@ func NewTelegramClient() error {
 	state.State.TelegramUpdater = updater
 	state.State.TelegramDispatcher = dispatcher
 
-	err = updater.StartPolling(bot, &ext.PollingOpts{
-		DropPendingUpdates: true,
-		GetUpdatesOpts: &gotgbot.GetUpdatesOpts{
-			Timeout: 9,
-			AllowedUpdates: []string{
-				"message",
-				"edited_message",
-				"channel_post",
-				"edited_channel_post",
-				"callback_query",
-				"my_chat_member",
-				"chat_member",
-			},
-			RequestOpts: &gotgbot.RequestOpts{
-				Timeout: 10 * time.Second,
-			},
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("telegram failed to start polling : %s", err)
-	}
-
 	logger.Info("successfully logged into telegram",
 		zap.Int64("id", bot.Id),
 		zap.String("name", bot.FirstName),
@@ -91,3 +123,64 @@ func NewTelegramClient() error {
 
 	return nil
 }
+
+// StartReceivingUpdates starts fetching updates from Telegram, either by
+// long polling or through a webhook. It is called once all the handlers are
+// added so that no pending update is missed.
+func StartReceivingUpdates() error {
+	var (
+		cfg     = state.State.Config
+		logger  = state.State.Logger
+		bot     = state.State.TelegramBot
+		updater = state.State.TelegramUpdater
+		webhook = cfg.Telegram.Webhook
+	)
+	defer logger.Sync()
+
+	if !webhook.Enabled {
+		err := updater.StartPolling(bot, &ext.PollingOpts{
+			DropPendingUpdates:    !cfg.Telegram.KeepPendingUpdates,
+			EnableWebhookDeletion: true,
+			GetUpdatesOpts: &gotgbot.GetUpdatesOpts{
+				Timeout:        9,
+				AllowedUpdates: allowedUpdates,
+				RequestOpts: &gotgbot.RequestOpts{
+					Timeout: 10 * time.Second,
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("telegram failed to start polling : %s", err)
+		}
+		return nil
+	}
+
+	if webhook.PublicURL == "" {
+		return fmt.Errorf("telegram webhook is enabled but public_url is not set")
+	}
+
+	err := updater.StartWebhook(bot, strings.Trim(webhook.Path, "/"), ext.WebhookOpts{
+		ListenAddr:  webhook.ListenAddr,
+		SecretToken: webhook.SecretToken,
+		CertFile:    webhook.CertFile,
+		KeyFile:     webhook.KeyFile,
+	})
+	if err != nil {
+		return fmt.Errorf("telegram failed to start webhook server : %s", err)
+	}
+
+	err = updater.SetAllBotWebhooks(webhook.PublicURL, &gotgbot.SetWebhookOpts{
+		AllowedUpdates: allowedUpdates,
+		SecretToken:    webhook.SecretToken,
+	})
+	if err != nil {
+		return fmt.Errorf("telegram failed to set webhook : %s", err)
+	}
+
+	logger.Info("receiving telegram updates through webhook",
+		zap.String("listen_addr", webhook.ListenAddr),
+		zap.String("public_url", webhook.PublicURL),
+	)
+
+	return nil
+}
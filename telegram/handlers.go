@@ -9,14 +9,14 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"path"
+	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"watgbridge/database"
 	"watgbridge/state"
 	"watgbridge/utils"
+	"watgbridge/whatsapp"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext"
@@ -92,6 +92,14 @@ func AddTelegramHandlers() {
 			handlers.NewCommand("restartwa", RestartWhatsAppConnectionHandler),
 			"Restart the WhatsApp client",
 		},
+		waTgBridgeCommand{
+			handlers.NewCommand("pair", PairCommandHandler),
+			"Log in to WhatsApp with a pairing code sent for a phone number",
+		},
+		waTgBridgeCommand{
+			handlers.NewCommand("relogin", ReloginCommandHandler),
+			"Log out and link WhatsApp again with a new QR or pairing code",
+		},
 		waTgBridgeCommand{
 			handlers.NewCommand("joininvitelink", JoinInviteLinkHandler),
 			"Join a WhatsApp chat using invite link",
@@ -108,6 +116,14 @@ func AddTelegramHandlers() {
 			handlers.NewCommand("unlinkthread", UnlinkThreadHandler),
 			"Unlink the current thread from its WhatsApp chat",
 		},
+		waTgBridgeCommand{
+			handlers.NewCommand("actions", ActionsCommandHandler),
+			"Show quick actions for the WhatsApp chat of the current thread",
+		},
+		waTgBridgeCommand{
+			handlers.NewCommand("chatsettings", ChatSettingsCommandHandler),
+			"Change what is bridged from the WhatsApp chat of the current thread",
+		},
 		waTgBridgeCommand{
 			handlers.NewCommand("getprofilepicture", GetProfilePictureHandler),
 			"Get the profile picture of user or group using its ID",
@@ -128,6 +144,10 @@ func AddTelegramHandlers() {
 			handlers.NewCommand("info", MessageInfoCommandHandler),
 			"Show delivery/read info for a replied bridged message",
 		},
+		waTgBridgeCommand{
+			handlers.NewCommand("status", StatusCommandHandler),
+			"Show the health of the WhatsApp and Telegram connections",
+		},
 		waTgBridgeCommand{
 			handlers.NewCommand("help", HelpCommandHandler),
 			"Get all the available commands",
@@ -136,6 +156,18 @@ func AddTelegramHandlers() {
 			handlers.NewCommand("backup", BackupCommandHandler),
 			"Generate and send a database backup now",
 		},
+		waTgBridgeCommand{
+			handlers.NewCommand("restore", RestoreCommandHandler),
+			"Restore the database backup replied to and restart",
+		},
+		waTgBridgeCommand{
+			handlers.NewCommand("dbstats", DatabaseStatsCommandHandler),
+			"Show the size of the database tables and the retention policy",
+		},
+		waTgBridgeCommand{
+			handlers.NewCommand("queue", QueueCommandHandler),
+			"List, retry or cancel messages waiting to be sent to WhatsApp",
+		},
 		waTgBridgeCommand{
 			handlers.NewCommand("block", BlockCommandHandler),
 			"Block a user in WhatsApp",
@@ -154,6 +186,23 @@ func AddTelegramHandlers() {
 		},
 	)
 
+	if cfg.WhatsApp.HistoryImport.Enabled {
+		commands = append(commands, waTgBridgeCommand{
+			handlers.NewCommand("importhistory", ImportHistoryHandler),
+			"Import past messages of a WhatsApp chat into its topic",
+		})
+	}
+
+	if cfg.Archive.Enabled {
+		commands = append(commands, waTgBridgeCommand{
+			handlers.NewCommand("search", SearchCommandHandler),
+			"Search the archived messages of all chats",
+		}, waTgBridgeCommand{
+			handlers.NewCommand("exportchat", ExportChatCommandHandler),
+			"Export the archived messages of a chat as a zip with JSON and HTML transcripts",
+		})
+	}
+
 	for _, command := range commands {
 		dispatcher.AddHandler(command.command)
 		if command.description != "" {
@@ -170,6 +219,45 @@ func AddTelegramHandlers() {
 		func(cq *gotgbot.CallbackQuery) bool {
 			return strings.HasPrefix(cq.Data, "revoke")
 		}, RevokeCallbackHandler), DispatcherCallbackHandlerGroup)
+
+	dispatcher.AddHandlerToGroup(handlers.NewCallback(
+		func(cq *gotgbot.CallbackQuery) bool {
+			return strings.HasPrefix(cq.Data, "relogin")
+		}, ReloginCallbackHandler), DispatcherCallbackHandlerGroup)
+
+	dispatcher.AddHandlerToGroup(handlers.NewCallback(
+		func(cq *gotgbot.CallbackQuery) bool {
+			return strings.HasPrefix(cq.Data, "chatsettings_")
+		}, ChatSettingsCallbackHandler), DispatcherCallbackHandlerGroup)
+
+	dispatcher.AddHandlerToGroup(handlers.NewCallback(
+		func(cq *gotgbot.CallbackQuery) bool {
+			return strings.HasPrefix(cq.Data, "actions_")
+		}, ActionsCallbackHandler), DispatcherCallbackHandlerGroup)
+
+	dispatcher.AddHandler(handlers.NewPollAnswer(nil, PollAnswerHandler))
+
+	dispatcher.AddHandler(handlers.NewReaction(
+		func(mr *gotgbot.MessageReactionUpdated) bool {
+			return mr.Chat.Id == cfg.Telegram.TargetChatID
+		}, MessageReactionHandler))
+}
+
+// AddCommand registers a command from outside this package, so that it is
+// listed in /help and in the bot commands, and not bridged to WhatsApp.
+// Commands without a description are hidden from the lists.
+func AddCommand(command handlers.Command, description string) {
+	commands = append(commands, waTgBridgeCommand{command, description})
+
+	state.State.TelegramDispatcher.AddHandler(command)
+	if description != "" {
+		state.State.TelegramCommands = append(state.State.TelegramCommands,
+			gotgbot.BotCommand{
+				Command:     command.Command,
+				Description: description,
+			},
+		)
+	}
 }
 
 func BridgeTelegramToWhatsAppHandler(b *gotgbot.Bot, c *ext.Context) error {
@@ -184,7 +272,7 @@ func BridgeTelegramToWhatsAppHandler(b *gotgbot.Bot, c *ext.Context) error {
 	}
 
 	var (
-		waClient     = state.State.WhatsAppClient
+		waClient     = state.State.WhatsAppClient()
 		msgToForward = c.EffectiveMessage
 		msgToReplyTo = c.EffectiveMessage.ReplyToMessage
 	)
@@ -308,6 +396,12 @@ func BridgeTelegramToWhatsAppHandler(b *gotgbot.Bot, c *ext.Context) error {
 
 	waChatJID, _ := utils.WaParseJID(waChatID)
 
+	// Photos and videos of a media group are sent together as an album
+	if msgToForward.MediaGroupId != "" && (len(msgToForward.Photo) > 0 || msgToForward.Video != nil) {
+		utils.TgQueueMediaGroupItem(b, c, msgToForward, msgToReplyTo, waChatJID, participantID, stanzaID, quotedWaChatID, stanzaID != "")
+		return nil
+	}
+
 	return utils.TgSendToWhatsApp(b, c, msgToForward, msgToReplyTo, waChatJID, participantID, stanzaID, quotedWaChatID, stanzaID != "")
 }
 
@@ -318,7 +412,7 @@ func BridgeTelegramEditedToWhatsAppHandler(b *gotgbot.Bot, c *ext.Context) error
 	}
 
 	var (
-		waClient  = state.State.WhatsAppClient
+		waClient  = state.State.WhatsAppClient()
 		msgEdited = c.EffectiveMessage
 	)
 
@@ -331,6 +425,16 @@ func BridgeTelegramEditedToWhatsAppHandler(b *gotgbot.Bot, c *ext.Context) error
 		return nil
 	}
 
+	if msgEdited.Location != nil {
+		if _, err := utils.TgUpdateLiveLocationOnWhatsApp(msgEdited); err != nil {
+			state.State.Logger.Warn("failed to update live location on whatsapp",
+				zap.Int64("tg_msg_id", msgEdited.MessageId),
+				zap.Error(err),
+			)
+		}
+		return nil
+	}
+
 	// Determine edited text (caption preferred)
 	var editedText string
 	if msgEdited.Caption != "" {
@@ -409,7 +513,7 @@ func GetWhatsAppGroupsHandler(b *gotgbot.Bot, c *ext.Context) error {
 		return nil
 	}
 
-	waClient := state.State.WhatsAppClient
+	waClient := state.State.WhatsAppClient()
 
 	waGroups, err := waClient.GetJoinedGroups(context.Background())
 	if err != nil {
@@ -505,7 +609,12 @@ func FindGroupMembersHandler(b *gotgbot.Bot, c *ext.Context) error {
 		groupJID, _ = utils.WaParseJID(waChatID)
 	}
 
-	groupInfo, err := state.State.WhatsAppClient.GetGroupInfo(context.Background(), groupJID)
+	return sendGroupMembers(b, c, groupJID)
+}
+
+// sendGroupMembers replies with the members of the group and their IDs
+func sendGroupMembers(b *gotgbot.Bot, c *ext.Context, groupJID waTypes.JID) error {
+	groupInfo, err := state.State.WhatsAppClient().GetGroupInfo(context.Background(), groupJID)
 	if err != nil {
 		return utils.TgReplyWithErrorByContext(b, c, "Failed to get group info", err)
 	}
@@ -571,8 +680,8 @@ func MessageInfoCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
 	}
 
 	waSelfJID := ""
-	if state.State.WhatsAppClient != nil && state.State.WhatsAppClient.Store != nil {
-		waSelfJID = state.State.WhatsAppClient.Store.ID.String()
+	if state.State.WhatsAppClient() != nil && state.State.WhatsAppClient().Store != nil {
+		waSelfJID = state.State.WhatsAppClient().Store.ID.String()
 	}
 
 	delivered := []string{}
@@ -681,11 +790,7 @@ func UpdateAndRestartHandler(b *gotgbot.Bot, c *ext.Context) error {
 
 	}
 
-	os.Setenv("WATG_IS_RESTARTED", "1")
-	os.Setenv("WATG_CHAT_ID", fmt.Sprint(c.EffectiveChat.Id))
-	os.Setenv("WATG_MESSAGE_ID", fmt.Sprint(c.EffectiveMessage.MessageId))
-
-	err := syscall.Exec(path.Join(".", "watgbridge"), []string{}, os.Environ())
+	err := utils.RestartBridge(c.EffectiveChat.Id, c.EffectiveMessage.MessageId)
 	if err != nil {
 		return utils.TgReplyWithErrorByContext(b, c, "Failed to run exec syscall to restart the bot", err)
 	}
@@ -700,7 +805,7 @@ func SyncContactsHandler(b *gotgbot.Bot, c *ext.Context) error {
 
 	utils.TgReplyTextByContext(b, c, "Starting syncing contacts... may take some time", nil, false)
 
-	waClient := state.State.WhatsAppClient
+	waClient := state.State.WhatsAppClient()
 
 	err := waClient.FetchAppState(context.Background(), appstate.WAPatchCriticalUnblockLow, false, false)
 	if err != nil {
@@ -735,7 +840,7 @@ func RestartWhatsAppConnectionHandler(b *gotgbot.Bot, c *ext.Context) error {
 		return nil
 	}
 
-	waClient := state.State.WhatsAppClient
+	waClient := state.State.WhatsAppClient()
 
 	waClient.Disconnect()
 	err := waClient.Connect()
@@ -747,6 +852,128 @@ func RestartWhatsAppConnectionHandler(b *gotgbot.Bot, c *ext.Context) error {
 	return err
 }
 
+func PairCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	var (
+		cfg      = state.State.Config
+		waClient = state.State.WhatsAppClient()
+	)
+
+	usageString := "Usage : <code>" + html.EscapeString("/pair <phone>") + "</code>\n"
+	usageString += "Example : <code>/pair +91 98765 43210</code>"
+
+	args := c.Args()
+	if len(args) <= 1 {
+		_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
+		return err
+	}
+
+	phone, ok := utils.WaNormalizePhone(strings.Join(args[1:], ""))
+	if !ok {
+		_, err := utils.TgReplyTextByContext(b, c, "Invalid phone number, include the country code\n\n"+usageString, nil, false)
+		return err
+	}
+
+	if waClient.Store.ID != nil {
+		_, err := utils.TgReplyTextByContext(b, c, fmt.Sprintf("Already logged in to WhatsApp as <code>%s</code>",
+			html.EscapeString(waClient.Store.ID.ToNonAD().String())), nil, false)
+		return err
+	}
+
+	go func() {
+		err := whatsapp.LoginWithPairCode(waClient, phone)
+		if err != nil {
+			utils.TgSendErrorById(b, cfg.Telegram.OwnerID, 0, "Failed to log in to WhatsApp", err)
+		}
+	}()
+
+	_, err := utils.TgReplyTextByContext(b, c, "Requesting a pairing code, it will be sent to the owner", nil, false)
+	return err
+}
+
+func ReloginCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	usageString := "Usage : <code>" + html.EscapeString("/relogin [phone]") + "</code>\n"
+	usageString += "Example : <code>/relogin +91 98765 43210</code>"
+
+	var phone string
+	if args := c.Args(); len(args) > 1 {
+		var ok bool
+		phone, ok = utils.WaNormalizePhone(strings.Join(args[1:], ""))
+		if !ok {
+			_, err := utils.TgReplyTextByContext(b, c, "Invalid phone number, include the country code\n\n"+usageString, nil, false)
+			return err
+		}
+	}
+
+	if state.State.WhatsAppClient().IsLoggedIn() {
+		_, err := utils.TgReplyTextByContext(b, c, "WhatsApp is still logged in, log out the linked device from the phone first", nil, false)
+		return err
+	}
+
+	_, err := utils.TgReplyTextByContext(b, c,
+		"Log in to WhatsApp again ? The current device of the bridge will be logged out and removed",
+		utils.TgMakeReloginKeyboard(phone), false)
+	return err
+}
+
+// ReloginCallbackHandler handles the confirmation of /relogin, as well as the
+// button sent when WhatsApp logged the bridge out which needs none
+func ReloginCallbackHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	var (
+		cq   = c.CallbackQuery
+		data = strings.Split(cq.Data, "_")
+	)
+
+	if len(data) == 2 && data[1] == "n" {
+		cq.Message.EditReplyMarkup(b, &gotgbot.EditMessageReplyMarkupOpts{})
+		_, err := cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text: "Aborted",
+		})
+		return err
+	}
+
+	if state.State.WhatsAppClient().IsLoggedIn() {
+		_, err := cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "WhatsApp is still logged in, log out the linked device from the phone first",
+			ShowAlert: true,
+		})
+		return err
+	}
+
+	var phone string
+	if len(data) == 3 && data[2] == "y" {
+		phone = data[1]
+	}
+
+	cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+		Text: "Logging in to WhatsApp again, the code to link the bridge will be sent to the owner",
+	})
+	cq.Message.EditReplyMarkup(b, &gotgbot.EditMessageReplyMarkupOpts{})
+
+	go relogin(b, phone)
+	return nil
+}
+
+// relogin links WhatsApp again in the background, as it only returns once
+// the code is used or expires
+func relogin(b *gotgbot.Bot, phone string) {
+	err := whatsapp.Relogin(phone)
+	if err != nil {
+		utils.TgSendErrorById(b, state.State.Config.Telegram.OwnerID, 0, "Failed to log in to WhatsApp again, send /relogin to retry", err)
+	}
+}
+
 func JoinInviteLinkHandler(b *gotgbot.Bot, c *ext.Context) error {
 	if !utils.TgUpdateIsAuthorized(b, c) {
 		return nil
@@ -761,7 +988,7 @@ func JoinInviteLinkHandler(b *gotgbot.Bot, c *ext.Context) error {
 	}
 	inviteLink := args[1]
 
-	waClient := state.State.WhatsAppClient
+	waClient := state.State.WhatsAppClient()
 
 	groupID, err := waClient.JoinGroupWithLink(context.Background(), inviteLink)
 	if err != nil {
@@ -794,7 +1021,7 @@ func SetTargetGroupChatHandler(b *gotgbot.Bot, c *ext.Context) error {
 	var (
 		cfg      = state.State.Config
 		groupID  = args[1]
-		waClient = state.State.WhatsAppClient
+		waClient = state.State.WhatsAppClient()
 	)
 
 	groupJID, _ := utils.WaParseJID(groupID)
@@ -855,136 +1082,423 @@ func UnlinkThreadHandler(b *gotgbot.Bot, c *ext.Context) error {
 	return err
 }
 
-func handleBlockUnblockUser(b *gotgbot.Bot, c *ext.Context, action events.BlocklistChangeAction) error {
+func ChatSettingsCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
 	if !utils.TgUpdateIsAuthorized(b, c) {
 		return nil
 	}
+
 	if !c.EffectiveMessage.IsTopicMessage || c.EffectiveMessage.MessageThreadId == 0 {
 		_, err := utils.TgReplyTextByContext(b, c, "The command should be sent in a topic", nil, false)
 		return err
 	}
 
-	var (
-		tgChatId   = c.EffectiveChat.Id
-		tgThreadId = c.EffectiveMessage.MessageThreadId
-	)
-
-	waChatId, err := database.ChatThreadGetWaFromTg(tgChatId, tgThreadId)
+	waChatId, err := database.ChatThreadGetWaFromTg(c.EffectiveChat.Id, c.EffectiveMessage.MessageThreadId)
 	if err != nil {
-		err = utils.TgReplyWithErrorByContext(b, c, "Failed to get existing chat ID pairing", err)
-		return err
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to get existing chat ID pairing", err)
 	} else if waChatId == "" {
 		_, err := utils.TgReplyTextByContext(b, c, "No existing chat pairing found!!", nil, false)
 		return err
 	}
-	jid, _ := utils.WaParseJID(waChatId)
-	_, err = state.State.WhatsAppClient.UpdateBlocklist(context.Background(), jid, action)
+
+	settings, found, err := database.ChatSettingsGet(waChatId)
 	if err != nil {
-		err = utils.TgReplyWithErrorByContext(b, c, "Failed to change the blocklist status", err)
-		return err
-	}
-	actionText := "blocked"
-	if action == events.BlocklistChangeActionUnblock {
-		actionText = "unblocked"
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to get the chat settings", err)
+	} else if !found {
+		settings = database.ChatSettings{ID: waChatId}
 	}
 
-	_, err = utils.TgReplyTextByContext(b, c, fmt.Sprintf("Successfully %s the user", actionText), nil, false)
+	_, err = utils.TgReplyTextByContext(b, c, utils.TgChatSettingsText(settings),
+		utils.TgMakeChatSettingsKeyboard(settings), false)
 	return err
 }
 
-func BlockCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
-	return handleBlockUnblockUser(b, c, events.BlocklistChangeActionBlock)
-}
-
-func UnblockCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
-	return handleBlockUnblockUser(b, c, events.BlocklistChangeActionUnblock)
-}
-
-func SetTargetPrivateChatHandler(b *gotgbot.Bot, c *ext.Context) error {
+func ChatSettingsCallbackHandler(b *gotgbot.Bot, c *ext.Context) error {
 	if !utils.TgUpdateIsAuthorized(b, c) {
 		return nil
 	}
 
-	usageString := "Usage (Send in a topic): <code>" + html.EscapeString("/settargetprivatechat <user_id>") + "</code>"
-
-	args := c.Args()
-	if len(args) <= 1 {
-		_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
-		return err
-	}
+	var (
+		cq   = c.CallbackQuery
+		data = strings.SplitN(cq.Data, "_", 3)
+	)
 
-	if !c.EffectiveMessage.IsTopicMessage || c.EffectiveMessage.MessageThreadId == 0 {
-		_, err := utils.TgReplyTextByContext(b, c, "The command should be sent in a topic", nil, false)
+	if len(data) != 3 {
+		_, err := cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "Invalid callback query",
+			ShowAlert: true,
+		})
 		return err
 	}
 
 	var (
-		cfg     = state.State.Config
-		groupID = args[1]
+		key      = data[1]
+		waChatId = data[2]
 	)
 
-	userJID, _ := utils.WaParseJID(groupID)
+	settings, found, err := database.ChatSettingsGet(waChatId)
+	if err != nil {
+		_, err = cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "Failed to get the chat settings : " + err.Error(),
+			ShowAlert: true,
+		})
+		return err
+	} else if !found {
+		settings = database.ChatSettings{ID: waChatId}
+	}
 
-	_, threadFound, err := database.ChatThreadGetTgFromWa(userJID.String(), cfg.Telegram.TargetChatID)
+	if key == "reset" {
+		err = database.ChatSettingsDelete(waChatId)
+		settings = database.ChatSettings{ID: waChatId}
+	} else if !utils.ChatSettingsToggle(&settings, key) {
+		_, err := cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "Invalid callback query",
+			ShowAlert: true,
+		})
+		return err
+	} else {
+		err = database.ChatSettingsSave(&settings)
+	}
 	if err != nil {
-		return utils.TgReplyWithErrorByContext(b, c, "Failed to check database for existing mapping", err)
-	} else if threadFound {
-		_, err = utils.TgReplyTextByContext(b, c, "A topic already exists in database for the given WhatsApp chat. Aborting...", nil, false)
+		_, err = cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "Failed to save the chat settings : " + err.Error(),
+			ShowAlert: true,
+		})
 		return err
 	}
 
-	err = database.ChatThreadAddNewPair(userJID.String(), cfg.Telegram.TargetChatID, c.EffectiveMessage.MessageThreadId)
+	cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "Saved"})
+	_, _, err = cq.Message.EditReplyMarkup(b, &gotgbot.EditMessageReplyMarkupOpts{
+		ReplyMarkup: *utils.TgMakeChatSettingsKeyboard(settings),
+	})
+	return err
+}
+
+func ActionsCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	if !c.EffectiveMessage.IsTopicMessage || c.EffectiveMessage.MessageThreadId == 0 {
+		_, err := utils.TgReplyTextByContext(b, c, "The command should be sent in a topic", nil, false)
+		return err
+	}
+
+	waChatId, err := database.ChatThreadGetWaFromTg(c.EffectiveChat.Id, c.EffectiveMessage.MessageThreadId)
 	if err != nil {
-		return utils.TgReplyWithErrorByContext(b, c, "Failed to add the mapping in database. Unsuccessful", err)
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to get existing chat ID pairing", err)
+	} else if waChatId == "" {
+		_, err := utils.TgReplyTextByContext(b, c, "No existing chat pairing found!!", nil, false)
+		return err
 	}
 
-	_, err = utils.TgReplyTextByContext(b, c, "Successfully mapped", nil, false)
+	_, err = utils.TgReplyTextByContext(b, c, actionsText(waChatId), utils.TgMakeActionsKeyboard(waChatId, false), false)
 	return err
 }
 
-func GetProfilePictureHandler(b *gotgbot.Bot, c *ext.Context) error {
+func actionsText(waChatId string) string {
+	jid, _ := utils.WaParseJID(waChatId)
+	return fmt.Sprintf("Quick actions for <b>%s</b> (<code>%s</code>)",
+		html.EscapeString(utils.WaGetChatName(jid)), html.EscapeString(waChatId))
+}
+
+func ActionsCallbackHandler(b *gotgbot.Bot, c *ext.Context) error {
 	if !utils.TgUpdateIsAuthorized(b, c) {
 		return nil
 	}
 
-	args := c.Args()
 	var (
-		waClient = state.State.WhatsAppClient
-		userID   string
+		cq   = c.CallbackQuery
+		data = strings.SplitN(cq.Data, "_", 3)
 	)
-	if len(args) <= 1 {
-		tgChatId := c.EffectiveChat.Id
-		tgThreadId := c.EffectiveMessage.MessageThreadId
 
-		waChatId, err := database.ChatThreadGetWaFromTg(tgChatId, tgThreadId)
-		if err != nil {
-			return utils.TgReplyWithErrorByContext(b, c, "Failed to get existing chat ID pairing", err)
-		} else if waChatId == "" {
-			_, err := utils.TgReplyTextByContext(b, c, "No existing chat pairing found!!", nil, false)
-			return err
-		}
+	if len(data) != 3 {
+		_, err := cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "Invalid callback query",
+			ShowAlert: true,
+		})
+		return err
+	}
 
-		userID = waChatId
-	} else {
-		userID = args[1]
+	var (
+		action   = data[1]
+		waChatId = data[2]
+		err      error
+	)
+
+	// The actions reply in the thread of the keyboard, like the commands
+	// they stand for
+	switch action {
+	case "menu":
+		_, _, err = b.EditMessageText(actionsText(waChatId), &gotgbot.EditMessageTextOpts{
+			ChatId:      c.EffectiveChat.Id,
+			MessageId:   c.EffectiveMessage.MessageId,
+			ReplyMarkup: *utils.TgMakeActionsKeyboard(waChatId, false),
+		})
+	case "block":
+		err = updateBlocklist(b, c, waChatId, events.BlocklistChangeActionBlock)
+	case "unblock":
+		err = updateBlocklist(b, c, waChatId, events.BlocklistChangeActionUnblock)
+	case "mute":
+		err = toggleChatMuted(b, c, waChatId)
+	case "picture":
+		err = sendProfilePicture(b, c, waChatId)
+	case "members":
+		groupJID, _ := utils.WaParseJID(waChatId)
+		err = sendGroupMembers(b, c, groupJID)
+	case "read":
+		err = markChatRead(b, c, waChatId)
+	case "info":
+		err = sendChatInfo(b, c, waChatId)
+	case "unlink":
+		_, _, err = b.EditMessageText("Unlink this thread from its WhatsApp chat ?", &gotgbot.EditMessageTextOpts{
+			ChatId:      c.EffectiveChat.Id,
+			MessageId:   c.EffectiveMessage.MessageId,
+			ReplyMarkup: *utils.TgMakeActionsKeyboard(waChatId, true),
+		})
+	case "unlinkconfirm":
+		b.EditMessageReplyMarkup(&gotgbot.EditMessageReplyMarkupOpts{
+			ChatId:    c.EffectiveChat.Id,
+			MessageId: c.EffectiveMessage.MessageId,
+		})
+		err = UnlinkThreadHandler(b, c)
+	default:
+		_, err = cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "Invalid callback query",
+			ShowAlert: true,
+		})
+		return err
 	}
 
-	userJID, _ := utils.WaParseJID(userID)
+	// Errors are answered already by TgReplyWithErrorByContext, in which case
+	// answering again does nothing
+	cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{})
+	return err
+}
 
-	ppInfo, err := waClient.GetProfilePictureInfo(context.Background(), userJID, &whatsmeow.GetProfilePictureParams{})
+// toggleChatMuted mutes the chat in its settings, or unmutes it
+func toggleChatMuted(b *gotgbot.Bot, c *ext.Context, waChatId string) error {
+	settings, found, err := database.ChatSettingsGet(waChatId)
 	if err != nil {
-		return utils.TgReplyWithErrorByContext(b, c, "Failed to fetch profile picture info from WhatsApp", err)
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to get the chat settings", err)
+	} else if !found {
+		settings = database.ChatSettings{ID: waChatId}
 	}
 
-	res, err := http.DefaultClient.Get(ppInfo.URL)
-	if err != nil {
-		return utils.TgReplyWithErrorByContext(b, c, "Failed to make HTTP GET request to profile picture URL", err)
+	utils.ChatSettingsToggle(&settings, "mute")
+	if err = database.ChatSettingsSave(&settings); err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to save the chat settings", err)
 	}
-	defer res.Body.Close()
 
-	imgBytes, err := io.ReadAll(res.Body)
-	if err != nil {
-		return utils.TgReplyWithErrorByContext(b, c, "Failed to read HTTP response body", err)
+	text := "Muted the chat, nothing from it is bridged until it is unmuted"
+	if !settings.Muted {
+		text = "Unmuted the chat"
+	}
+	_, err = utils.TgReplyTextByContext(b, c, text, nil, false)
+	return err
+}
+
+// markChatRead sends read receipts for the messages of the chat which were
+// bridged but not read yet
+func markChatRead(b *gotgbot.Bot, c *ext.Context, waChatId string) error {
+	jid, _ := utils.WaParseJID(waChatId)
+	marked, err := utils.WaMarkChatRead(jid)
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to get unread messages to mark them read", err)
+	}
+
+	_, err = utils.TgReplyTextByContext(b, c, fmt.Sprintf("Marked %d messages as read", marked), nil, false)
+	return err
+}
+
+// sendChatInfo replies with what is known about the WhatsApp chat
+func sendChatInfo(b *gotgbot.Bot, c *ext.Context, waChatId string) error {
+	var (
+		waClient = state.State.WhatsAppClient()
+		jid, _   = utils.WaParseJID(waChatId)
+		infoText = fmt.Sprintf("<b>%s</b>\n\n• <b>ID</b>: <code>%s</code>\n",
+			html.EscapeString(utils.WaGetChatName(jid)), html.EscapeString(jid.String()))
+	)
+
+	if jid.Server == waTypes.GroupServer {
+		groupInfo, err := waClient.GetGroupInfo(context.Background(), jid)
+		if err != nil {
+			return utils.TgReplyWithErrorByContext(b, c, "Failed to get group info", err)
+		}
+
+		if !groupInfo.OwnerJID.IsEmpty() {
+			infoText += fmt.Sprintf("• <b>Owner</b>: %s\n", html.EscapeString(utils.WaGetContactName(groupInfo.OwnerJID)))
+		}
+		if !groupInfo.GroupCreated.IsZero() {
+			infoText += fmt.Sprintf("• <b>Created</b>: %s\n",
+				html.EscapeString(groupInfo.GroupCreated.In(state.State.LocalLocation).Format(state.State.Config.TimeFormat)))
+		}
+		infoText += fmt.Sprintf("• <b>Members</b>: %d\n", len(groupInfo.Participants))
+		infoText += fmt.Sprintf("• <b>Only admins can send</b>: %t\n", groupInfo.IsAnnounce)
+		infoText += fmt.Sprintf("• <b>Disappearing messages</b>: %t\n", groupInfo.IsEphemeral)
+		if groupInfo.Topic != "" {
+			infoText += fmt.Sprintf("\n<i>%s</i>\n", html.EscapeString(groupInfo.Topic))
+		}
+	} else {
+		infoText += fmt.Sprintf("• <b>Phone</b>: <code>+%s</code>\n", html.EscapeString(jid.User))
+		if users, err := waClient.GetUserInfo(context.Background(), []waTypes.JID{jid}); err == nil {
+			if user, found := users[jid]; found {
+				if user.VerifiedName != nil && user.VerifiedName.Details != nil {
+					infoText += fmt.Sprintf("• <b>Business</b>: %s\n", html.EscapeString(user.VerifiedName.Details.GetVerifiedName()))
+				}
+				if user.Status != "" {
+					infoText += fmt.Sprintf("• <b>About</b>: %s\n", html.EscapeString(user.Status))
+				}
+			}
+		}
+	}
+
+	if settings, found, err := database.ChatSettingsGet(waChatId); err == nil && found && settings.Muted {
+		infoText += "• <b>Muted</b>: true\n"
+	}
+
+	_, err := utils.TgReplyTextByContext(b, c, infoText, nil, false)
+	return err
+}
+
+func handleBlockUnblockUser(b *gotgbot.Bot, c *ext.Context, action events.BlocklistChangeAction) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+	if !c.EffectiveMessage.IsTopicMessage || c.EffectiveMessage.MessageThreadId == 0 {
+		_, err := utils.TgReplyTextByContext(b, c, "The command should be sent in a topic", nil, false)
+		return err
+	}
+
+	var (
+		tgChatId   = c.EffectiveChat.Id
+		tgThreadId = c.EffectiveMessage.MessageThreadId
+	)
+
+	waChatId, err := database.ChatThreadGetWaFromTg(tgChatId, tgThreadId)
+	if err != nil {
+		err = utils.TgReplyWithErrorByContext(b, c, "Failed to get existing chat ID pairing", err)
+		return err
+	} else if waChatId == "" {
+		_, err := utils.TgReplyTextByContext(b, c, "No existing chat pairing found!!", nil, false)
+		return err
+	}
+
+	return updateBlocklist(b, c, waChatId, action)
+}
+
+// updateBlocklist blocks or unblocks the user of the given chat
+func updateBlocklist(b *gotgbot.Bot, c *ext.Context, waChatId string, action events.BlocklistChangeAction) error {
+	jid, _ := utils.WaParseJID(waChatId)
+	_, err := state.State.WhatsAppClient().UpdateBlocklist(context.Background(), jid, action)
+	if err != nil {
+		err = utils.TgReplyWithErrorByContext(b, c, "Failed to change the blocklist status", err)
+		return err
+	}
+	actionText := "blocked"
+	if action == events.BlocklistChangeActionUnblock {
+		actionText = "unblocked"
+	}
+
+	_, err = utils.TgReplyTextByContext(b, c, fmt.Sprintf("Successfully %s the user", actionText), nil, false)
+	return err
+}
+
+func BlockCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
+	return handleBlockUnblockUser(b, c, events.BlocklistChangeActionBlock)
+}
+
+func UnblockCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
+	return handleBlockUnblockUser(b, c, events.BlocklistChangeActionUnblock)
+}
+
+func SetTargetPrivateChatHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	usageString := "Usage (Send in a topic): <code>" + html.EscapeString("/settargetprivatechat <user_id>") + "</code>"
+
+	args := c.Args()
+	if len(args) <= 1 {
+		_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
+		return err
+	}
+
+	if !c.EffectiveMessage.IsTopicMessage || c.EffectiveMessage.MessageThreadId == 0 {
+		_, err := utils.TgReplyTextByContext(b, c, "The command should be sent in a topic", nil, false)
+		return err
+	}
+
+	var (
+		cfg     = state.State.Config
+		groupID = args[1]
+	)
+
+	userJID, _ := utils.WaParseJID(groupID)
+
+	_, threadFound, err := database.ChatThreadGetTgFromWa(userJID.String(), cfg.Telegram.TargetChatID)
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to check database for existing mapping", err)
+	} else if threadFound {
+		_, err = utils.TgReplyTextByContext(b, c, "A topic already exists in database for the given WhatsApp chat. Aborting...", nil, false)
+		return err
+	}
+
+	err = database.ChatThreadAddNewPair(userJID.String(), cfg.Telegram.TargetChatID, c.EffectiveMessage.MessageThreadId)
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to add the mapping in database. Unsuccessful", err)
+	}
+
+	_, err = utils.TgReplyTextByContext(b, c, "Successfully mapped", nil, false)
+	return err
+}
+
+func GetProfilePictureHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	args := c.Args()
+	var userID string
+	if len(args) <= 1 {
+		tgChatId := c.EffectiveChat.Id
+		tgThreadId := c.EffectiveMessage.MessageThreadId
+
+		waChatId, err := database.ChatThreadGetWaFromTg(tgChatId, tgThreadId)
+		if err != nil {
+			return utils.TgReplyWithErrorByContext(b, c, "Failed to get existing chat ID pairing", err)
+		} else if waChatId == "" {
+			_, err := utils.TgReplyTextByContext(b, c, "No existing chat pairing found!!", nil, false)
+			return err
+		}
+
+		userID = waChatId
+	} else {
+		userID = args[1]
+	}
+
+	return sendProfilePicture(b, c, userID)
+}
+
+// sendProfilePicture replies with the profile picture of the user or group
+func sendProfilePicture(b *gotgbot.Bot, c *ext.Context, userID string) error {
+	waClient := state.State.WhatsAppClient()
+	userJID, _ := utils.WaParseJID(userID)
+
+	ppInfo, err := waClient.GetProfilePictureInfo(context.Background(), userJID, &whatsmeow.GetProfilePictureParams{})
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to fetch profile picture info from WhatsApp", err)
+	}
+
+	res, err := http.DefaultClient.Get(ppInfo.URL)
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to make HTTP GET request to profile picture URL", err)
+	}
+	defer res.Body.Close()
+
+	imgBytes, err := io.ReadAll(res.Body)
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to read HTTP response body", err)
 	}
 
 	opts := &gotgbot.SendPhotoOpts{
@@ -1042,6 +1556,90 @@ func SyncTopicNamesHandler(b *gotgbot.Bot, c *ext.Context) error {
 	return err
 }
 
+func StatusCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	var (
+		cfg           = state.State.Config
+		waClient      = state.State.WhatsAppClient()
+		localLocation = state.State.LocalLocation
+		health        = whatsapp.GetConnectionHealth()
+		now           = time.Now().UTC()
+	)
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return fmt.Sprintf("%s [ %s ago ]", t.In(localLocation).Format(cfg.TimeFormat), now.Sub(t).Round(time.Second))
+	}
+
+	statusText := "<b>Bridge</b>\n"
+	statusText += fmt.Sprintf("• <b>Uptime</b>: %s (since %s)\n",
+		now.Sub(state.State.StartTime).Round(time.Second), state.State.StartTime.In(localLocation).Format(cfg.TimeFormat))
+
+	statusText += "\n<b>WhatsApp</b>\n"
+	statusText += fmt.Sprintf("• <b>Connected</b>: %v\n", waClient.IsConnected())
+	statusText += fmt.Sprintf("• <b>Logged In</b>: %v\n", waClient.IsLoggedIn())
+	if health.State != "" {
+		statusText += fmt.Sprintf("• <b>State</b>: %s for %s\n", html.EscapeString(health.State), now.Sub(health.Since).Round(time.Second))
+	}
+	if health.Detail != "" {
+		statusText += fmt.Sprintf("• <b>Detail</b>: <i>%s</i>\n", html.EscapeString(health.Detail))
+	}
+	if health.ReconnectAttempts > 0 {
+		statusText += fmt.Sprintf("• <b>Reconnect Attempts</b>: %d\n", health.ReconnectAttempts)
+	}
+	statusText += fmt.Sprintf("• <b>Last Connected</b>: %s\n", formatTime(health.LastConnected))
+	statusText += fmt.Sprintf("• <b>Last Disconnected</b>: %s\n", formatTime(health.LastDisconnected))
+	statusText += fmt.Sprintf("• <b>Last Message</b>: %s\n", formatTime(health.LastMessage))
+
+	statusText += "\n<b>Telegram</b>\n"
+	requestStart := time.Now()
+	if _, err := b.GetMe(nil); err != nil {
+		statusText += fmt.Sprintf("• <b>API</b>: unreachable (<code>%s</code>)\n", html.EscapeString(err.Error()))
+	} else {
+		statusText += fmt.Sprintf("• <b>API</b>: reachable in %s\n", time.Since(requestStart).Round(time.Millisecond))
+	}
+	if cfg.Telegram.Webhook.Enabled {
+		statusText += "• <b>Updates</b>: webhook\n"
+		if webhookInfo, err := b.GetWebhookInfo(nil); err == nil {
+			statusText += fmt.Sprintf("• <b>Pending Updates</b>: %d\n", webhookInfo.PendingUpdateCount)
+			if webhookInfo.LastErrorDate != 0 {
+				statusText += fmt.Sprintf("• <b>Last Webhook Error</b>: %s (<code>%s</code>)\n",
+					formatTime(time.Unix(webhookInfo.LastErrorDate, 0).UTC()), html.EscapeString(webhookInfo.LastErrorMessage))
+			}
+		}
+	} else {
+		statusText += "• <b>Updates</b>: long polling\n"
+	}
+
+	statusText += "\n<b>Queues</b>\n"
+	if items, err := database.OutboxGetAll(); err != nil {
+		statusText += fmt.Sprintf("• <b>Outbox</b>: unknown (<code>%s</code>)\n", html.EscapeString(err.Error()))
+	} else {
+		var pending, failed int
+		for _, item := range items {
+			if item.Status == database.OutboxStatusFailed {
+				failed++
+			} else {
+				pending++
+			}
+		}
+		statusText += fmt.Sprintf("• <b>Outbox</b>: %d pending, %d given up\n", pending, failed)
+	}
+	if cfg.WhatsApp.HistoryImport.Enabled {
+		if jobs, err := database.HistoryImportJobGetUnfinished(); err == nil {
+			statusText += fmt.Sprintf("• <b>History Imports</b>: %d running\n", len(jobs))
+		}
+	}
+
+	_, err := utils.TgReplyTextByContext(b, c, statusText, nil, false)
+	return err
+}
+
 func HelpCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
 	if !utils.TgUpdateIsAuthorized(b, c) {
 		return nil
@@ -1082,6 +1680,190 @@ func BackupCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
 	return err
 }
 
+func DatabaseStatsCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	var (
+		cfg           = state.State.Config
+		localLocation = state.State.LocalLocation
+	)
+
+	tables, totalSize, err := database.DatabaseStats()
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to get the database stats", err)
+	}
+
+	chatCounts, err := database.MsgIdCountByChat(10)
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to count the message pairs of the chats", err)
+	}
+
+	formatSize := func(size int64) string {
+		switch {
+		case size < 0:
+			return "unknown size"
+		case size < 1024:
+			return fmt.Sprintf("%d B", size)
+		case size < 1024*1024:
+			return fmt.Sprintf("%.1f KiB", float64(size)/1024)
+		case size < 1024*1024*1024:
+			return fmt.Sprintf("%.1f MiB", float64(size)/(1024*1024))
+		}
+		return fmt.Sprintf("%.2f GiB", float64(size)/(1024*1024*1024))
+	}
+
+	statsText := fmt.Sprintf("<b>Database</b> (%s, %s)\n",
+		html.EscapeString(state.State.Database.Dialector.Name()), formatSize(totalSize))
+	for _, table := range tables {
+		statsText += fmt.Sprintf("• <b>%s</b>: %d rows", html.EscapeString(table.Name), table.Rows)
+		if table.Size >= 0 {
+			statsText += ", " + formatSize(table.Size)
+		}
+		statsText += "\n"
+	}
+
+	if len(chatCounts) > 0 {
+		statsText += "\n<b>Chats With The Most Message Pairs</b>\n"
+		for _, chatCount := range chatCounts {
+			chatName := chatCount.WaChatId
+			if jid, ok := utils.WaParseJID(chatCount.WaChatId); ok {
+				chatName = utils.WaGetChatName(jid)
+			}
+			statsText += fmt.Sprintf("• %s (<code>%s</code>): %d\n",
+				html.EscapeString(chatName), html.EscapeString(chatCount.WaChatId), chatCount.Count)
+		}
+	}
+
+	statsText += "\n<b>Retention</b>\n"
+	if !utils.DatabasePruningEnabled() {
+		statsText += "• <b>Pruning</b>: disabled\n"
+	} else {
+		if cfg.Retention.MaxAgeDays > 0 {
+			statsText += fmt.Sprintf("• <b>Max Age</b>: %d days\n", cfg.Retention.MaxAgeDays)
+		}
+		if cfg.Retention.MaxMessagesPerChat > 0 {
+			statsText += fmt.Sprintf("• <b>Max Messages Per Chat</b>: %d\n", cfg.Retention.MaxMessagesPerChat)
+		}
+		statsText += fmt.Sprintf("• <b>Schedule</b>: <code>%s</code>\n", html.EscapeString(cfg.Retention.CronSchedule))
+
+		lastTime, lastResult, lastErr := utils.LastDatabasePruning()
+		switch {
+		case lastTime.IsZero():
+			statsText += "• <b>Last Pruning</b>: not since the bridge started\n"
+		case lastErr != nil:
+			statsText += fmt.Sprintf("• <b>Last Pruning</b>: %s, failed (<code>%s</code>)\n",
+				lastTime.In(localLocation).Format(cfg.TimeFormat), html.EscapeString(lastErr.Error()))
+		default:
+			statsText += fmt.Sprintf("• <b>Last Pruning</b>: %s, deleted %d message pairs, %d receipts, %d reactions, %d poll rows and %d history messages\n",
+				lastTime.In(localLocation).Format(cfg.TimeFormat), lastResult.MsgIdPairs, lastResult.MessageReceipts,
+				lastResult.Reactions, lastResult.Polls, lastResult.HistoryMessages)
+		}
+	}
+
+	_, err = utils.TgReplyTextByContext(b, c, statsText, nil, false)
+	return err
+}
+
+func RestoreCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	var (
+		cfg     = state.State.Config
+		logger  = state.State.Logger
+		replyTo = c.EffectiveMessage.ReplyToMessage
+	)
+
+	if c.EffectiveSender.Id() != cfg.Telegram.OwnerID {
+		_, err := utils.TgReplyTextByContext(b, c, "Only the owner can restore a backup", nil, false)
+		return err
+	}
+
+	// Telegram can deliver the command again after the restart it caused
+	if time.Unix(c.EffectiveMessage.Date, 0).Before(state.State.StartTime) {
+		return nil
+	}
+
+	if replyTo == nil || replyTo.Document == nil {
+		_, err := utils.TgReplyTextByContext(b, c, "Reply to a backup archive sent by the bot with /restore", nil, false)
+		return err
+	}
+
+	if !cfg.Telegram.SelfHostedAPI && replyTo.Document.FileSize > utils.DownloadSizeLimit {
+		_, err := utils.TgReplyTextByContext(b, c, "Unable to download the archive as it exceeds Telegram size restriction", nil, false)
+		return err
+	}
+
+	file, err := b.GetFile(replyTo.Document.FileId, &gotgbot.GetFileOpts{})
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to retrieve the archive file from Telegram", err)
+	}
+	archiveBytes, err := utils.TgDownloadByFilePath(b, file.FilePath)
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to download the archive from Telegram", err)
+	}
+
+	archiveFile, err := os.CreateTemp("", "watgbridge-restore-*.zip")
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to save the archive", err)
+	}
+	archivePath := archiveFile.Name()
+	_, err = archiveFile.Write(archiveBytes)
+	if closeErr := archiveFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(archivePath)
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to save the archive", err)
+	}
+
+	if err = utils.ValidateDatabaseBackup(archivePath); err != nil {
+		os.Remove(archivePath)
+		return utils.TgReplyWithErrorByContext(b, c, "The archive cannot be restored", err)
+	}
+
+	utils.TgReplyTextByContext(b, c, "The backup is valid, stopping the bridge to restore it...", nil, false)
+
+	// Everything using the databases is stopped before they are replaced.
+	// Updates stop being fetched, but the dispatcher is left running as this
+	// handler is one of its own.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	state.State.TelegramUpdater.StopAllBots()
+	if !waitForOtherUpdates(ctx) {
+		logger.Warn("timed out waiting for telegram handlers to finish before restoring")
+	}
+	StopBridge(ctx)
+
+	kept, err := utils.RestoreDatabaseBackup(archivePath)
+	os.Remove(archivePath)
+	if err != nil {
+		// The databases are closed already, so the bridge is restarted anyway
+		// with the files it had
+		utils.TgReplyWithErrorByContext(b, c, "Failed to restore the backup, restarting with the previous databases", err)
+	} else {
+		restoreText := "Restored the backup, now restarting..."
+		if len(kept) > 0 {
+			restoreText += "\n\nThe previous databases were kept at:\n"
+			for _, keptFile := range kept {
+				restoreText += fmt.Sprintf("• <code>%s</code>\n", html.EscapeString(keptFile))
+			}
+		}
+		utils.TgReplyTextByContext(b, c, restoreText, nil, false)
+	}
+
+	err = utils.RestartBridge(c.EffectiveChat.Id, c.EffectiveMessage.MessageId)
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to run exec syscall to restart the bot", err)
+	}
+
+	return nil
+}
+
 func SendToWhatsAppHandler(b *gotgbot.Bot, c *ext.Context) error {
 	if !utils.TgUpdateIsAuthorized(b, c) {
 		return nil
@@ -1113,6 +1895,319 @@ func SendToWhatsAppHandler(b *gotgbot.Bot, c *ext.Context) error {
 	return utils.TgSendToWhatsApp(b, c, msgToForward, msgToReplyTo, waChatJID, participantID, stanzaID, "", false)
 }
 
+func ImportHistoryHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	cfg := state.State.Config
+
+	usageString := "Usage : <code>" + html.EscapeString("/importhistory <jid> [days]") + "</code>\n"
+	usageString += "Example : <code>/importhistory 911234567890 30</code>"
+
+	args := c.Args()
+	if len(args) <= 1 {
+		_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
+		return err
+	}
+
+	waChatJID, ok := utils.WaParseJID(args[1])
+	if !ok {
+		_, err := utils.TgReplyTextByContext(b, c, "Provided JID is not valid", nil, false)
+		return err
+	}
+
+	days := cfg.WhatsApp.HistoryImport.DefaultDays
+	if len(args) > 2 {
+		parsedDays, err := strconv.ParseUint(args[2], 10, 32)
+		if err != nil || parsedDays == 0 {
+			_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
+			return err
+		}
+		days = uint32(parsedDays)
+	}
+
+	found, err := whatsapp.StartHistoryImport(waChatJID, days)
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to start the history import", err)
+	} else if !found {
+		_, err = utils.TgReplyTextByContext(b, c,
+			"No history is stored for this chat, or all of it was already imported. WhatsApp only sends the history when the device gets linked with 'history_import' enabled", nil, false)
+		return err
+	}
+
+	_, err = utils.TgReplyTextByContext(b, c,
+		fmt.Sprintf("Importing the last %d days of <code>%s</code>, you will be notified once it finishes",
+			days, html.EscapeString(waChatJID.String())), nil, false)
+	return err
+}
+
+func SearchCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	var (
+		cfg           = state.State.Config
+		waClient      = state.State.WhatsAppClient()
+		localLocation = state.State.LocalLocation
+	)
+
+	usageString := "Usage : <code>" + html.EscapeString("/search <words> [in:<jid>] [from:<jid>|me] [after:YYYY-MM-DD] [before:YYYY-MM-DD]") + "</code>\n"
+	usageString += "Example : <code>/search invoice from:911234567890 after:2024-01-01</code>"
+
+	query := database.ArchiveQuery{Limit: 10}
+	for _, arg := range c.Args()[1:] {
+		key, value, _ := strings.Cut(arg, ":")
+		switch key {
+		case "in", "from":
+			jid, ok := utils.WaParseJID(value)
+			if value == "me" && key == "from" {
+				jid, ok = waClient.Store.ID.ToNonAD(), true
+			}
+			if value == "" || !ok {
+				_, err := utils.TgReplyTextByContext(b, c,
+					fmt.Sprintf("<code>%s</code> is not a valid JID", html.EscapeString(value)), nil, false)
+				return err
+			}
+			if key == "in" {
+				query.WaChatId = jid.String()
+			} else {
+				query.SenderId = jid.String()
+			}
+		case "before", "after":
+			date, err := time.ParseInLocation("2006-01-02", value, localLocation)
+			if err != nil {
+				_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
+				return err
+			}
+			if key == "before" {
+				query.Before = date
+			} else {
+				query.After = date
+			}
+		default:
+			query.Terms = append(query.Terms, arg)
+		}
+	}
+
+	if len(query.Terms) == 0 {
+		_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
+		return err
+	}
+
+	results, err := database.ArchiveSearch(query)
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to search the archive", err)
+	} else if len(results) == 0 {
+		_, err = utils.TgReplyTextByContext(b, c, "No archived message matches the search", nil, false)
+		return err
+	}
+
+	resultsText := fmt.Sprintf("<b>Newest %d matches</b>\n\n", len(results))
+	for _, result := range results {
+		chatName := result.WaChatId
+		if jid, ok := utils.WaParseJID(result.WaChatId); ok {
+			chatName = utils.WaGetChatName(jid)
+		}
+
+		timestamp := html.EscapeString(result.Timestamp.In(localLocation).Format(cfg.TimeFormat))
+		if result.TgMsgId != 0 {
+			link := gotgbot.Message{Chat: gotgbot.Chat{Id: result.TgChatId}, MessageId: result.TgMsgId}.GetLink()
+			timestamp = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(link), timestamp)
+		}
+
+		snippet := result.Text
+		if snippet == "" {
+			snippet = result.FileName
+		}
+		if len([]rune(snippet)) > 100 {
+			snippet = utils.SubString(snippet, 0, 100) + "…"
+		}
+
+		resultsText += fmt.Sprintf("• %s <b>%s</b> in <b>%s</b>", timestamp,
+			html.EscapeString(result.SenderName), html.EscapeString(chatName))
+		if result.MediaType != "" && result.MediaType != "text" {
+			resultsText += fmt.Sprintf(" [%s]", html.EscapeString(result.MediaType))
+		}
+		resultsText += fmt.Sprintf(": %s\n", html.EscapeString(snippet))
+	}
+
+	_, err = utils.TgReplyTextByContext(b, c, resultsText, nil, false)
+	return err
+}
+
+func ExportChatCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	localLocation := state.State.LocalLocation
+
+	usageString := "Usage : <code>" + html.EscapeString("/exportchat [jid] [from YYYY-MM-DD] [to YYYY-MM-DD] [json|html|all]") + "</code>\n"
+	usageString += "The JID can be left out in the topic of the chat\n"
+	usageString += "Example : <code>/exportchat 911234567890 2024-01-01 2024-03-31 html</code>"
+
+	var (
+		waChatId string
+		dates    []time.Time
+		format   = utils.ExportFormatAll
+	)
+	for _, arg := range c.Args()[1:] {
+		if date, err := time.ParseInLocation("2006-01-02", arg, localLocation); err == nil {
+			dates = append(dates, date)
+			continue
+		}
+
+		switch arg {
+		case utils.ExportFormatJSON, utils.ExportFormatHTML, utils.ExportFormatAll:
+			format = arg
+		default:
+			if waChatId != "" {
+				_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
+				return err
+			}
+			jid, ok := utils.WaParseJID(arg)
+			if !ok {
+				_, err := utils.TgReplyTextByContext(b, c, "Provided JID is not valid", nil, false)
+				return err
+			}
+			waChatId = jid.String()
+		}
+	}
+
+	if len(dates) > 2 {
+		_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
+		return err
+	}
+
+	if waChatId == "" {
+		if !c.EffectiveMessage.IsTopicMessage || c.EffectiveMessage.MessageThreadId == 0 {
+			_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
+			return err
+		}
+
+		var err error
+		waChatId, err = database.ChatThreadGetWaFromTg(c.EffectiveChat.Id, c.EffectiveMessage.MessageThreadId)
+		if err != nil {
+			return utils.TgReplyWithErrorByContext(b, c, "Failed to get existing chat ID pairing", err)
+		} else if waChatId == "" {
+			_, err := utils.TgReplyTextByContext(b, c, "No existing chat pairing found!!", nil, false)
+			return err
+		}
+	}
+
+	// The end date is included in the export
+	var from, to time.Time
+	if len(dates) > 0 {
+		from = dates[0]
+	}
+	if len(dates) > 1 {
+		to = dates[1].AddDate(0, 0, 1)
+	}
+
+	waChatJID, _ := utils.WaParseJID(waChatId)
+	exported, err := utils.ExportChat(waChatJID, from, to, format)
+	if err != nil {
+		return utils.TgReplyWithErrorByContext(b, c, "Failed to export the chat", err)
+	} else if exported == 0 {
+		_, err = utils.TgReplyTextByContext(b, c, "No archived message of the chat in this period", nil, false)
+		return err
+	}
+
+	_, err = utils.TgReplyTextByContext(b, c, fmt.Sprintf("Exported %d messages", exported), nil, false)
+	return err
+}
+
+func QueueCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	usageString := "Usage : <code>" + html.EscapeString("/queue [retry|cancel <id|all>]") + "</code>\n"
+	usageString += "Example : <code>/queue retry 12</code>"
+
+	args := c.Args()
+	if len(args) <= 1 {
+		items, err := database.OutboxGetAll()
+		if err != nil {
+			return utils.TgReplyWithErrorByContext(b, c, "Failed to get the outbox from database", err)
+		}
+		_, err = utils.TgReplyTextByContext(b, c, utils.TgMakeOutboxText(items), nil, false)
+		return err
+	}
+
+	if len(args) != 3 || (args[1] != "retry" && args[1] != "cancel") {
+		_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
+		return err
+	}
+
+	var items []database.OutboxItem
+	if args[2] == "all" {
+		allItems, err := database.OutboxGetAll()
+		if err != nil {
+			return utils.TgReplyWithErrorByContext(b, c, "Failed to get the outbox from database", err)
+		}
+		items = allItems
+	} else {
+		id, err := strconv.ParseUint(strings.TrimPrefix(args[2], "#"), 10, 32)
+		if err != nil {
+			_, err := utils.TgReplyTextByContext(b, c, usageString, nil, false)
+			return err
+		}
+		item, found, err := database.OutboxGet(uint(id))
+		if err != nil {
+			return utils.TgReplyWithErrorByContext(b, c, "Failed to get the outbox from database", err)
+		} else if !found {
+			_, err := utils.TgReplyTextByContext(b, c, "No queued message with this ID", nil, false)
+			return err
+		}
+		items = append(items, item)
+	}
+
+	if len(items) == 0 {
+		_, err := utils.TgReplyTextByContext(b, c, "The outbox is empty, everything was sent to WhatsApp", nil, false)
+		return err
+	}
+
+	if args[1] == "retry" {
+		ids := make([]uint, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		if err := database.OutboxRetryNow(ids...); err != nil {
+			return utils.TgReplyWithErrorByContext(b, c, "Failed to update the outbox", err)
+		}
+		utils.WakeOutbox()
+
+		_, err := utils.TgReplyTextByContext(b, c,
+			fmt.Sprintf("Retrying %d queued messages", len(items)), nil, false)
+		return err
+	}
+
+	// A message being sent may reach WhatsApp anyway, so it is left alone
+	cancelled := 0
+	for _, item := range items {
+		removed, err := database.OutboxCancel(item.ID)
+		if err != nil {
+			return utils.TgReplyWithErrorByContext(b, c, "Failed to remove from the outbox", err)
+		} else if !removed {
+			continue
+		}
+		cancelled++
+		b.SetMessageReaction(item.TgChatId, item.TgMsgId, &gotgbot.SetMessageReactionOpts{
+			Reaction: []gotgbot.ReactionType{},
+		})
+	}
+
+	replyText := fmt.Sprintf("Cancelled %d queued messages, they will not be sent", cancelled)
+	if skipped := len(items) - cancelled; skipped > 0 {
+		replyText += fmt.Sprintf("\n%d messages are being sent right now and could not be cancelled", skipped)
+	}
+	_, err := utils.TgReplyTextByContext(b, c, replyText, nil, false)
+	return err
+}
+
 func RevokeCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
 	if !utils.TgUpdateIsAuthorized(b, c) {
 		return nil
@@ -1126,7 +2221,7 @@ func RevokeCommandHandler(b *gotgbot.Bot, c *ext.Context) error {
 	}
 
 	var (
-		waClient    = state.State.WhatsAppClient
+		waClient    = state.State.WhatsAppClient()
 		msgToRevoke = c.EffectiveMessage.ReplyToMessage
 		chatId      = c.EffectiveChat.Id
 	)
@@ -1153,7 +2248,7 @@ func RevokeCallbackHandler(b *gotgbot.Bot, c *ext.Context) error {
 	}
 
 	var (
-		waClient = state.State.WhatsAppClient
+		waClient = state.State.WhatsAppClient()
 		cq       = c.CallbackQuery
 		data     = strings.Split(cq.Data, "_")
 	)
@@ -1258,7 +2353,7 @@ func SetStatusMessageHandler(b *gotgbot.Bot, c *ext.Context) error {
 		return err
 	}
 
-	waClient := state.State.WhatsAppClient
+	waClient := state.State.WhatsAppClient()
 	err := utils.WaSetStatusMessage(context.Background(), waClient, statusText)
 	if err != nil {
 		return utils.TgReplyWithErrorByContext(b, c, "Failed to update WhatsApp status message", err)
@@ -1268,3 +2363,93 @@ func SetStatusMessageHandler(b *gotgbot.Bot, c *ext.Context) error {
 		fmt.Sprintf("Successfully updated WhatsApp status message to:\n\n<code>%s</code>", html.EscapeString(statusText)), nil, false)
 	return err
 }
+
+func PollAnswerHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	var (
+		waClient   = state.State.WhatsAppClient()
+		pollAnswer = c.PollAnswer
+	)
+
+	pollPair, found, err := database.PollPairGetByTgPollId(pollAnswer.PollId)
+	if err != nil {
+		return fmt.Errorf("failed to get poll pair from database : %s", err)
+	} else if !found {
+		return nil
+	}
+
+	options := pollPair.OptionNames()
+	selectedOptions := []string{}
+	for _, optionId := range pollAnswer.OptionIds {
+		if optionId >= 0 && optionId < int64(len(options)) {
+			selectedOptions = append(selectedOptions, options[optionId])
+		}
+	}
+
+	pollInfo, err := utils.WaPollMessageInfo(pollPair)
+	if err != nil {
+		return utils.TgSendErrorById(b, pollPair.TgChatId, pollPair.TgThreadId, "Failed to send poll vote to WhatsApp", err)
+	}
+
+	voteMsg, err := waClient.BuildPollVote(context.Background(), &pollInfo, selectedOptions)
+	if err != nil {
+		return utils.TgSendErrorById(b, pollPair.TgChatId, pollPair.TgThreadId, "Failed to encrypt poll vote for WhatsApp", err)
+	}
+
+	_, err = waClient.SendMessage(context.Background(), pollInfo.Chat, voteMsg)
+	if err != nil {
+		return utils.TgSendErrorById(b, pollPair.TgChatId, pollPair.TgThreadId, "Failed to send poll vote to WhatsApp", err)
+	}
+
+	err = database.PollVoteUpsert(pollPair.ID, pollPair.WaChatId, waClient.Store.ID.ToNonAD().String(), selectedOptions)
+	if err != nil {
+		return fmt.Errorf("failed to save own poll vote to database : %s", err)
+	}
+
+	return utils.TgUpdatePollTally(pollPair)
+}
+
+func MessageReactionHandler(b *gotgbot.Bot, c *ext.Context) error {
+	if !utils.TgUpdateIsAuthorized(b, c) {
+		return nil
+	}
+
+	var (
+		waClient        = state.State.WhatsAppClient()
+		messageReaction = c.MessageReaction
+	)
+
+	waMsgId, participantId, waChatId, err := database.MsgIdGetWaFromTgMessage(messageReaction.Chat.Id, messageReaction.MessageId)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve mapping from database : %s", err)
+	} else if waMsgId == "" {
+		return nil
+	}
+
+	newReaction := utils.WaReactionFromTg(messageReaction.NewReaction)
+	if newReaction == "" && len(messageReaction.NewReaction) > 0 {
+		// Only custom or paid reactions were set, nothing to mirror
+		return nil
+	}
+
+	waChatJID, ok := utils.WaParseJID(waChatId)
+	if !ok {
+		return fmt.Errorf("invalid chat JID stored for message: %s", waChatId)
+	}
+	senderJID, ok := utils.WaParseJID(participantId)
+	if !ok {
+		senderJID = waClient.Store.ID.ToNonAD()
+	}
+
+	_, err = waClient.SendMessage(context.Background(), waChatJID,
+		waClient.BuildReaction(waChatJID, senderJID.ToNonAD(), waMsgId, newReaction))
+	if err != nil {
+		threadId, _, _ := database.ChatThreadGetTgFromWa(waChatId, messageReaction.Chat.Id)
+		return utils.TgSendErrorById(b, messageReaction.Chat.Id, threadId, "Failed to send reaction to WhatsApp", err)
+	}
+
+	return nil
+}
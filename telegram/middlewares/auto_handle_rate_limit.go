@@ -8,6 +8,8 @@ import (
 	"strings"
 	"time"
 
+	"watgbridge/metrics"
+
 	"github.com/PaulSonOfLars/gotgbot/v2"
 )
 
@@ -25,6 +27,7 @@ func (b *autoHandleRateLimitBotClient) RequestWithContext(ctx context.Context,
 
 	for {
 		response, err := b.BotClient.RequestWithContext(ctx, token, method, params, opts)
+		metrics.TelegramRequestDone(method, err)
 		if err == nil {
 			return response, err
 		}
@@ -38,6 +41,7 @@ func (b *autoHandleRateLimitBotClient) RequestWithContext(ctx context.Context,
 			fields := strings.Fields(tgError.Description)
 			timeToSleep, _ := strconv.ParseInt(fields[len(fields)-1], 10, 64)
 			log.Printf("[auto_handle_rate_limit] sleeping for %v seconds", timeToSleep)
+			metrics.TelegramRateLimited.Inc(method)
 			time.Sleep(time.Second * time.Duration(timeToSleep))
 			continue
 		}
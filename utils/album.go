@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"watgbridge/state"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	waTypes "go.mau.fi/whatsmeow/types"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// How long to wait for the rest of a Telegram media group after its last
+// message arrived, as every message of the group comes in its own update
+const tgMediaGroupWait = 1500 * time.Millisecond
+
+type tgMediaGroupItem struct {
+	c                          *ext.Context
+	msgToForward, msgToReplyTo *gotgbot.Message
+	participant, stanzaId      string
+	quotedWaChatID             string
+	isReply                    bool
+}
+
+type tgMediaGroup struct {
+	waChatJID waTypes.JID
+	items     []tgMediaGroupItem
+	timer     *time.Timer
+}
+
+var (
+	tgMediaGroupsLock   sync.Mutex
+	tgMediaGroups       = make(map[string]*tgMediaGroup)
+	tgMediaGroupsWorker = NewWorker()
+)
+
+// TgQueueMediaGroupItem buffers a photo or video of a Telegram media group,
+// which is sent to WhatsApp as an album together with the rest of the group
+func TgQueueMediaGroupItem(b *gotgbot.Bot, c *ext.Context,
+	msgToForward, msgToReplyTo *gotgbot.Message,
+	waChatJID waTypes.JID, participant, stanzaId, quotedWaChatID string,
+	isReply bool) {
+
+	key := strconv.FormatInt(msgToForward.Chat.Id, 10) + "/" + msgToForward.MediaGroupId
+
+	tgMediaGroupsLock.Lock()
+	defer tgMediaGroupsLock.Unlock()
+
+	group, found := tgMediaGroups[key]
+	if !found {
+		group = &tgMediaGroup{waChatJID: waChatJID}
+		tgMediaGroups[key] = group
+		group.timer = time.AfterFunc(tgMediaGroupWait, func() {
+			tgMediaGroupsLock.Lock()
+			if tgMediaGroups[key] != group {
+				// Already sent by FlushMediaGroups
+				tgMediaGroupsLock.Unlock()
+				return
+			}
+			delete(tgMediaGroups, key)
+			tgMediaGroupsLock.Unlock()
+
+			if tgMediaGroupsWorker.Enter() {
+				defer tgMediaGroupsWorker.Exit()
+				tgSendMediaGroupToWhatsApp(b, group)
+			}
+		})
+	} else {
+		group.timer.Reset(tgMediaGroupWait)
+	}
+
+	group.items = append(group.items, tgMediaGroupItem{
+		c:              c,
+		msgToForward:   msgToForward,
+		msgToReplyTo:   msgToReplyTo,
+		participant:    participant,
+		stanzaId:       stanzaId,
+		quotedWaChatID: quotedWaChatID,
+		isReply:        isReply,
+	})
+}
+
+// FlushMediaGroups sends the media groups which are still waiting for more
+// items right away, used on shutdown once no more updates are received. The
+// returned context is done once every group was sent.
+func FlushMediaGroups() context.Context {
+	tgMediaGroupsLock.Lock()
+	groups := tgMediaGroups
+	tgMediaGroups = make(map[string]*tgMediaGroup)
+	for _, group := range groups {
+		group.timer.Stop()
+	}
+	tgMediaGroupsLock.Unlock()
+
+	for _, group := range groups {
+		tgMediaGroupsWorker.Go(func() {
+			tgSendMediaGroupToWhatsApp(state.State.TelegramBot, group)
+		})
+	}
+
+	return tgMediaGroupsWorker.Stop()
+}
+
+// tgSendMediaGroupToWhatsApp sends an AlbumMessage announcing the items of
+// the group, followed by the items pointing back to it
+func tgSendMediaGroupToWhatsApp(b *gotgbot.Bot, group *tgMediaGroup) {
+	var (
+		logger   = state.State.Logger
+		waClient = state.State.WhatsAppClient()
+		items    = group.items
+	)
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].msgToForward.MessageId < items[j].msgToForward.MessageId
+	})
+
+	// Telegram clients put the caption of the whole group on one of its
+	// messages, while WhatsApp shows the caption of the first item
+	var captioned []int
+	for idx, item := range items {
+		if item.msgToForward.Caption != "" {
+			captioned = append(captioned, idx)
+		}
+	}
+	if len(captioned) == 1 && captioned[0] != 0 {
+		var (
+			first       = *items[0].msgToForward
+			withCaption = *items[captioned[0]].msgToForward
+		)
+		first.Caption, first.CaptionEntities = withCaption.Caption, withCaption.CaptionEntities
+		withCaption.Caption, withCaption.CaptionEntities = "", nil
+		items[0].msgToForward, items[captioned[0]].msgToForward = &first, &withCaption
+	}
+
+	var albumId string
+	if len(items) > 1 {
+		var imageCount, videoCount uint32
+		for _, item := range items {
+			if item.msgToForward.Video != nil {
+				videoCount++
+			} else {
+				imageCount++
+			}
+		}
+
+		sentMsg, err := waClient.SendMessage(context.Background(), group.waChatJID, &waE2E.Message{
+			AlbumMessage: &waE2E.AlbumMessage{
+				ExpectedImageCount: proto.Uint32(imageCount),
+				ExpectedVideoCount: proto.Uint32(videoCount),
+			},
+		})
+		if err != nil {
+			logger.Warn("failed to start an album in WhatsApp, sending the media group as separate messages",
+				zap.String("chat_id", group.waChatJID.String()),
+				zap.Error(err),
+			)
+		} else {
+			albumId = sentMsg.ID
+		}
+	}
+
+	for _, item := range items {
+		err := tgQueueToWhatsApp(b, item.c, item.msgToForward, item.msgToReplyTo, group.waChatJID,
+			item.participant, item.stanzaId, item.quotedWaChatID, item.isReply, albumId)
+		if err != nil {
+			logger.Error("failed to send media group item to WhatsApp",
+				zap.Int64("tg_msg_id", item.msgToForward.MessageId),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// waAlbumItemContextInfo makes a message an item of the album we sent with
+// the given ID
+func waAlbumItemContextInfo(waChatJID waTypes.JID, albumId string) *waE2E.MessageContextInfo {
+	return &waE2E.MessageContextInfo{
+		MessageAssociation: &waE2E.MessageAssociation{
+			AssociationType: waE2E.MessageAssociation_MEDIA_ALBUM.Enum(),
+			ParentMessageKey: &waCommon.MessageKey{
+				RemoteJID: proto.String(waChatJID.String()),
+				FromMe:    proto.Bool(true),
+				ID:        proto.String(albumId),
+			},
+		},
+	}
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"time"
+
+	"watgbridge/database"
+	"watgbridge/state"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.mau.fi/whatsmeow/types"
+	"go.uber.org/zap"
+)
+
+// TgArchiveMessage adds a message sent from Telegram to WhatsApp to the
+// archive, if it is enabled
+func TgArchiveMessage(msg *gotgbot.Message, waMsgId string, waChatJID types.JID, sentAt time.Time) {
+	var (
+		cfg      = state.State.Config
+		waClient = state.State.WhatsAppClient()
+	)
+
+	if !cfg.Archive.Enabled {
+		return
+	}
+
+	archived := &database.ArchivedMessage{
+		WaMsgId:      waMsgId,
+		WaChatId:     waChatJID.String(),
+		SenderId:     waClient.Store.ID.ToNonAD().String(),
+		SenderName:   "You",
+		Timestamp:    sentAt.UTC(),
+		FromTelegram: true,
+		Text:         msg.GetText(),
+		MediaType:    tgMessageType(msg),
+		TgChatId:     msg.Chat.Id,
+		TgThreadId:   msg.MessageThreadId,
+		TgMsgId:      msg.MessageId,
+		TgFileId:     TgMessageFileId(msg),
+	}
+
+	switch {
+	case len(msg.Photo) > 0:
+		archived.MimeType = "image/jpeg"
+		archived.FileSize = uint64(msg.Photo[len(msg.Photo)-1].FileSize)
+	case msg.Video != nil:
+		archived.MimeType, archived.FileName, archived.FileSize = msg.Video.MimeType, msg.Video.FileName, uint64(msg.Video.FileSize)
+	case msg.Animation != nil:
+		archived.MimeType, archived.FileName, archived.FileSize = msg.Animation.MimeType, msg.Animation.FileName, uint64(msg.Animation.FileSize)
+	case msg.Audio != nil:
+		archived.MimeType, archived.FileName, archived.FileSize = msg.Audio.MimeType, msg.Audio.FileName, uint64(msg.Audio.FileSize)
+	case msg.Voice != nil:
+		archived.MimeType, archived.FileSize = msg.Voice.MimeType, uint64(msg.Voice.FileSize)
+	case msg.Document != nil:
+		archived.MimeType, archived.FileName, archived.FileSize = msg.Document.MimeType, msg.Document.FileName, uint64(msg.Document.FileSize)
+	}
+
+	if err := database.ArchiveSaveMessage(archived); err != nil {
+		state.State.Logger.Warn("failed to archive message",
+			zap.String("msg_id", waMsgId),
+			zap.Error(err),
+		)
+	}
+}
+
+// TgMessageFileId returns the file ID of the media of a message, the largest
+// size of a photo, or an empty string if it has no media
+func TgMessageFileId(msg *gotgbot.Message) string {
+	switch {
+	case len(msg.Photo) > 0:
+		return msg.Photo[len(msg.Photo)-1].FileId
+	case msg.Video != nil:
+		return msg.Video.FileId
+	case msg.VideoNote != nil:
+		return msg.VideoNote.FileId
+	case msg.Animation != nil:
+		return msg.Animation.FileId
+	case msg.Audio != nil:
+		return msg.Audio.FileId
+	case msg.Voice != nil:
+		return msg.Voice.FileId
+	case msg.Document != nil:
+		return msg.Document.FileId
+	case msg.Sticker != nil:
+		return msg.Sticker.FileId
+	default:
+		return ""
+	}
+}
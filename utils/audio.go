@@ -16,7 +16,9 @@ import (
 
 // ConvertAudioToWhatsAppFormat converts Telegram audio to a WhatsApp-compatible format.
 // It uses OGG Opus 16kHz, which provides good compression and full WhatsApp support.
-func ConvertAudioToWhatsAppFormat(audioData []byte, updateId int64) ([]byte, error) {
+func ConvertAudioToWhatsAppFormat(audioData []byte, updateId int64) (_ []byte, err error) {
+	defer countConversionFailure("audio_to_opus", &err)
+
 	logger := state.State.Logger
 	defer logger.Sync()
 
@@ -2,6 +2,16 @@ package utils
 
 import (
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
@@ -10,11 +20,13 @@ import (
 	"strings"
 	"time"
 
+	"watgbridge/database"
 	"watgbridge/state"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
 	"github.com/robfig/cron/v3"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
 type backupFile struct {
@@ -84,21 +96,39 @@ func appendBackupArtifacts(filesMap map[string]backupFile, displayName, dbPath s
 	}
 }
 
-func collectDatabaseFiles() []backupFile {
+// Names of the databases in the backup archives
+const (
+	backupMainDatabase  = "main-database.db"
+	backupLoginDatabase = "whatsapp-login.db"
+)
+
+// sqliteDatabasePaths returns the paths of the SQLite databases which are
+// backed up, by their name in the archives
+func sqliteDatabasePaths() map[string]string {
 	cfg := state.State.Config
-	filesMap := map[string]backupFile{}
+	paths := map[string]string{}
 
 	dbType := strings.ToLower(strings.TrimSpace(cfg.Database["type"]))
 	if dbType == "sqlite" {
-		appendBackupArtifacts(filesMap, "main-database.db", strings.TrimSpace(cfg.Database["path"]))
+		paths[backupMainDatabase] = strings.TrimSpace(cfg.Database["path"])
 	}
 
 	if strings.EqualFold(strings.TrimSpace(cfg.WhatsApp.LoginDatabase.Type), "sqlite3") {
 		if waDBPath, err := extractSQLitePath(strings.TrimSpace(cfg.WhatsApp.LoginDatabase.URL)); err == nil {
-			appendBackupArtifacts(filesMap, "whatsapp-login.db", waDBPath)
+			paths[backupLoginDatabase] = waDBPath
 		}
 	}
 
+	return paths
+}
+
+func collectDatabaseFiles() []backupFile {
+	filesMap := map[string]backupFile{}
+
+	for displayName, dbPath := range sqliteDatabasePaths() {
+		appendBackupArtifacts(filesMap, displayName, dbPath)
+	}
+
 	files := make([]backupFile, 0, len(filesMap))
 	for _, backupItem := range filesMap {
 		files = append(files, backupItem)
@@ -107,68 +137,135 @@ func collectDatabaseFiles() []backupFile {
 	return files
 }
 
-func makeBackupZip(files []backupFile, now time.Time) (*os.File, string, error) {
+// Directories of the logical dumps in the backup archives, for the databases
+// which are not stored in SQLite
+const (
+	backupMainDump  = "main-database"
+	backupLoginDump = "whatsapp-login"
+)
+
+type backupDump struct {
+	Dir   string
+	Write func(zipWriter *zip.Writer, dir string) error
+}
+
+// collectDatabaseDumps returns the databases which are backed up with a
+// logical dump, as they cannot be copied as a file, with mainDB being the
+// database of the bridge
+func collectDatabaseDumps(mainDB *gorm.DB) []backupDump {
+	cfg := state.State.Config
+
+	var dumps []backupDump
+
+	dbType := strings.ToLower(strings.TrimSpace(cfg.Database["type"]))
+	if dbType == "postgres" || dbType == "mysql" {
+		dumps = append(dumps, backupDump{
+			Dir: backupMainDump,
+			Write: func(zipWriter *zip.Writer, dir string) error {
+				return database.DumpBridgeDatabase(zipWriter, dir, mainDB)
+			},
+		})
+	}
+
+	loginDB := cfg.WhatsApp.LoginDatabase
+	if loginDB.Type != "" && !strings.EqualFold(strings.TrimSpace(loginDB.Type), "sqlite3") {
+		dumps = append(dumps, backupDump{
+			Dir: backupLoginDump,
+			Write: func(zipWriter *zip.Writer, dir string) error {
+				return database.DumpStoreDatabase(zipWriter, dir, strings.TrimSpace(loginDB.Type), loginDB.URL)
+			},
+		})
+	}
+
+	return dumps
+}
+
+// makeBackupZip writes the backup into a temporary file, encrypted while it
+// is written when a passphrase is given
+func makeBackupZip(files []backupFile, dumps []backupDump, now time.Time, passphrase string) (*os.File, string, error) {
 	temporaryFile, err := os.CreateTemp("", "watgbridge-backup-*.zip")
 	if err != nil {
 		return nil, "", err
 	}
 
-	zipWriter := zip.NewWriter(temporaryFile)
+	fail := func(err error) (*os.File, string, error) {
+		_ = temporaryFile.Close()
+		_ = os.Remove(temporaryFile.Name())
+		return nil, "", err
+	}
+
+	backupName := fmt.Sprintf("watgbridge-backup-%s.zip", now.Format("02-01-2006-150405"))
+
+	var (
+		output    io.Writer = temporaryFile
+		encrypter io.WriteCloser
+	)
+	if passphrase != "" {
+		encrypter, err = EncryptBackup(temporaryFile, passphrase)
+		if err != nil {
+			return fail(err)
+		}
+		output = encrypter
+		backupName += encryptedBackupExt
+	}
+
+	zipWriter := zip.NewWriter(output)
 
 	for _, backupItem := range files {
 		archiveEntry, err := zipWriter.Create(backupItem.DisplayName)
 		if err != nil {
 			_ = zipWriter.Close()
-			_ = temporaryFile.Close()
-			_ = os.Remove(temporaryFile.Name())
-			return nil, "", err
+			return fail(err)
 		}
 
 		inputFile, err := os.Open(backupItem.Path)
 		if err != nil {
 			_ = zipWriter.Close()
-			_ = temporaryFile.Close()
-			_ = os.Remove(temporaryFile.Name())
-			return nil, "", err
+			return fail(err)
 		}
 
 		_, err = io.Copy(archiveEntry, inputFile)
 		_ = inputFile.Close()
 		if err != nil {
 			_ = zipWriter.Close()
-			_ = temporaryFile.Close()
-			_ = os.Remove(temporaryFile.Name())
-			return nil, "", err
+			return fail(err)
+		}
+	}
+
+	for _, dump := range dumps {
+		if err := dump.Write(zipWriter, dump.Dir); err != nil {
+			_ = zipWriter.Close()
+			return fail(fmt.Errorf("failed to dump %s : %s", dump.Dir, err))
 		}
 	}
 
 	if err := zipWriter.Close(); err != nil {
-		_ = temporaryFile.Close()
-		_ = os.Remove(temporaryFile.Name())
-		return nil, "", err
+		return fail(err)
+	}
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			return fail(err)
+		}
 	}
 
 	if _, err := temporaryFile.Seek(0, 0); err != nil {
-		_ = temporaryFile.Close()
-		_ = os.Remove(temporaryFile.Name())
-		return nil, "", err
+		return fail(err)
 	}
 
-	backupName := fmt.Sprintf("watgbridge-backup-%s.zip", now.Format("02-01-2006-150405"))
 	return temporaryFile, backupName, nil
 }
 
 func sendBackupArchive(mode string) error {
 	cfg := state.State.Config
-	tgBot := state.State.TelegramBot
 
 	files := collectDatabaseFiles()
-	if len(files) == 0 {
-		return fmt.Errorf("no sqlite database files were found to back up")
+	dumps := collectDatabaseDumps(state.State.Database)
+	if len(files) == 0 && len(dumps) == 0 {
+		return fmt.Errorf("no database was found to back up")
 	}
 
 	now := time.Now().UTC()
-	backupZip, backupName, err := makeBackupZip(files, now)
+	backupZip, backupName, err := makeBackupZip(files, dumps, now, cfg.Backup.Passphrase)
 	if err != nil {
 		return err
 	}
@@ -177,13 +274,71 @@ func sendBackupArchive(mode string) error {
 		_ = os.Remove(backupZip.Name())
 	}()
 
-	fileToSend := gotgbot.FileReader{
-		Name: backupName,
-		Data: backupZip,
+	sentMsg, err := sendDocumentByMode(mode, gotgbot.FileReader{Name: backupName, Data: backupZip},
+		fmt.Sprintf("Database backup (%s UTC)", now.Format("02-01-2006 15:04:05")))
+	if err != nil {
+		return err
+	}
+
+	// Only the backups of the thread are removed, the private chat with the
+	// owner is left as it is
+	if mode == "thread" {
+		if err = database.BackupMessageAdd(sentMsg.Chat.Id, sentMsg.MessageId); err != nil {
+			return fmt.Errorf("failed to save the backup message : %s", err)
+		}
+		// The backup was sent, failing to clean up after it is not a failure
+		// of the backup
+		if cfg.Backup.KeepLast > 0 {
+			if err = deleteOlderBackups(sentMsg.Chat.Id, int(cfg.Backup.KeepLast)); err != nil {
+				state.State.Logger.Error("failed to delete older backups", zap.Error(err))
+			}
+		}
+	}
+
+	return nil
+}
+
+// deleteOlderBackups deletes the backups sent to a chat but the keep newest
+func deleteOlderBackups(tgChatId int64, keep int) error {
+	tgBot := state.State.TelegramBot
+
+	backups, err := database.BackupMessageGetOlder(tgChatId, keep)
+	if err != nil || len(backups) == 0 {
+		return err
 	}
 
+	var (
+		ids      []uint
+		tgMsgIds []int64
+	)
+	for _, backup := range backups {
+		ids = append(ids, backup.ID)
+		tgMsgIds = append(tgMsgIds, backup.TgMsgId)
+	}
+
+	// Telegram deletes up to 100 messages at once, skipping the ones which
+	// are already gone
+	for len(tgMsgIds) > 0 {
+		batch := tgMsgIds[:min(len(tgMsgIds), 100)]
+		tgMsgIds = tgMsgIds[len(batch):]
+
+		if _, err = tgBot.DeleteMessages(tgChatId, batch, &gotgbot.DeleteMessagesOpts{}); err != nil {
+			return fmt.Errorf("failed to delete older backups : %s", err)
+		}
+	}
+
+	return database.BackupMessageDelete(ids)
+}
+
+// sendDocumentByMode sends a document to the owner in the private mode, or
+// to the backups thread in the thread mode which is reopened for it and
+// closed again afterwards
+func sendDocumentByMode(mode string, document gotgbot.FileReader, caption string) (*gotgbot.Message, error) {
+	cfg := state.State.Config
+	tgBot := state.State.TelegramBot
+
 	sendOpts := &gotgbot.SendDocumentOpts{
-		Caption: fmt.Sprintf("Database backup (%s UTC)", now.Format("02-01-2006 15:04:05")),
+		Caption: caption,
 	}
 
 	targetChatId := cfg.Telegram.OwnerID
@@ -197,16 +352,16 @@ func sendBackupArchive(mode string) error {
 
 		threadId, err := TgGetOrMakeThreadFromWa_String("database_backups", targetChatId, threadName)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		_, _ = tgBot.ReopenForumTopic(targetChatId, threadId, &gotgbot.ReopenForumTopicOpts{})
 		sendOpts.MessageThreadId = threadId
 	}
 
-	_, err = tgBot.SendDocument(targetChatId, &fileToSend, sendOpts)
+	sentMsg, err := tgBot.SendDocument(targetChatId, &document, sendOpts)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if mode == "thread" {
@@ -217,6 +372,183 @@ func sendBackupArchive(mode string) error {
 		}
 	}
 
+	return sentMsg, nil
+}
+
+// Encrypted backups are the zip split into chunks sealed with AES-256-GCM,
+// under a key derived from the passphrase with PBKDF2-SHA256, so that they
+// are encrypted and decrypted without holding them in memory. They start
+// with the magic, followed by the salt of the key and the prefix of the
+// nonces. The nonce of a chunk ends with its number and a flag set on the
+// last one, which makes a reordered or truncated backup fail to decrypt.
+const (
+	encryptedBackupExt        = ".enc"
+	encryptedBackupMagic      = "WATGBAK1"
+	encryptedBackupSaltSize   = 16
+	encryptedBackupPrefixSize = 7
+	encryptedBackupChunkSize  = 64 * 1024
+	encryptedBackupIterations = 600000
+	encryptedBackupHeaderSize = len(encryptedBackupMagic) + encryptedBackupSaltSize + encryptedBackupPrefixSize
+)
+
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, encryptedBackupIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// backupChunks seals or opens the chunks of an encrypted backup in order
+type backupChunks struct {
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+}
+
+func (c *backupChunks) nextNonce(last bool) []byte {
+	binary.BigEndian.PutUint32(c.nonce[encryptedBackupPrefixSize:], c.counter)
+	c.nonce[len(c.nonce)-1] = 0
+	if last {
+		c.nonce[len(c.nonce)-1] = 1
+	}
+	c.counter += 1
+	return c.nonce
+}
+
+type backupEncrypter struct {
+	backupChunks
+	dst     io.Writer
+	pending []byte
+}
+
+// EncryptBackup returns a writer encrypting what is written to it into dst
+// with the passphrase. It must be closed to write the last chunk.
+func EncryptBackup(dst io.Writer, passphrase string) (io.WriteCloser, error) {
+	header := make([]byte, encryptedBackupHeaderSize)
+	copy(header, encryptedBackupMagic)
+	if _, err := rand.Read(header[len(encryptedBackupMagic):]); err != nil {
+		return nil, err
+	}
+
+	salt := header[len(encryptedBackupMagic) : len(encryptedBackupMagic)+encryptedBackupSaltSize]
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dst.Write(header); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[len(header)-encryptedBackupPrefixSize:])
+	return &backupEncrypter{backupChunks: backupChunks{aead: aead, nonce: nonce}, dst: dst}, nil
+}
+
+func (e *backupEncrypter) Write(p []byte) (int, error) {
+	e.pending = append(e.pending, p...)
+
+	// A full chunk is only written once more follows, as the last one has to
+	// be flagged
+	for len(e.pending) > encryptedBackupChunkSize {
+		if err := e.writeChunk(e.pending[:encryptedBackupChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.pending = e.pending[encryptedBackupChunkSize:]
+	}
+	return len(p), nil
+}
+
+func (e *backupEncrypter) Close() error {
+	err := e.writeChunk(e.pending, true)
+	e.pending = nil
+	return err
+}
+
+func (e *backupEncrypter) writeChunk(chunk []byte, last bool) error {
+	sealed := e.aead.Seal(nil, e.nextNonce(last), chunk, []byte(encryptedBackupMagic))
+	_, err := e.dst.Write(sealed)
+	return err
+}
+
+// IsEncryptedBackup tells whether data starts like an encrypted backup
+func IsEncryptedBackup(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedBackupMagic))
+}
+
+type backupDecrypter struct {
+	backupChunks
+	src    *bufio.Reader
+	sealed []byte
+	opened []byte
+	done   bool
+}
+
+// DecryptBackup returns a reader of the backup encrypted with the passphrase
+// read from src. Reading fails once a chunk does not decrypt.
+func DecryptBackup(src io.Reader, passphrase string) (io.Reader, error) {
+	header := make([]byte, encryptedBackupHeaderSize)
+	n, err := io.ReadFull(src, header)
+	if !IsEncryptedBackup(header[:n]) {
+		return nil, errors.New("not an encrypted backup")
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, errors.New("the encrypted backup is truncated")
+	} else if err != nil {
+		return nil, err
+	}
+
+	salt := header[len(encryptedBackupMagic) : len(encryptedBackupMagic)+encryptedBackupSaltSize]
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[len(header)-encryptedBackupPrefixSize:])
+	return &backupDecrypter{
+		backupChunks: backupChunks{aead: aead, nonce: nonce},
+		src:          bufio.NewReader(src),
+		sealed:       make([]byte, encryptedBackupChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *backupDecrypter) Read(p []byte) (int, error) {
+	if len(d.opened) == 0 && !d.done {
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	if len(d.opened) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, d.opened)
+	d.opened = d.opened[n:]
+	return n, nil
+}
+
+func (d *backupDecrypter) readChunk() error {
+	n, err := io.ReadFull(d.src, d.sealed)
+	last := false
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	case nil:
+		_, peekErr := d.src.Peek(1)
+		last = peekErr == io.EOF
+	default:
+		return err
+	}
+
+	d.opened, err = d.aead.Open(d.opened[:0], d.nextNonce(last), d.sealed[:n], []byte(encryptedBackupMagic))
+	if err != nil {
+		return errors.New("wrong passphrase or damaged backup")
+	}
+	d.done = last
 	return nil
 }
 
@@ -242,6 +574,8 @@ func resolveBackupSchedule() string {
 	return "0 0 * * *"
 }
 
+var backupScheduler *cron.Cron
+
 func StartAutomaticDatabaseBackups() {
 	cfg := state.State.Config
 	logger := state.State.Logger
@@ -272,24 +606,33 @@ func StartAutomaticDatabaseBackups() {
 		zap.String("cron_schedule", schedule),
 	)
 
-	go func() {
-		cronScheduler := cron.New(cron.WithLocation(state.State.LocalLocation))
-
-		_, err := cronScheduler.AddFunc(schedule, func() {
-			if err := RunDatabaseBackupOnce(); err != nil {
-				logger.Error("failed to run automatic database backup", zap.Error(err))
-			} else {
-				logger.Info("automatic database backup sent successfully")
-			}
-		})
-		if err != nil {
-			logger.Error("failed to register backup cron schedule",
-				zap.String("cron_schedule", schedule),
-				zap.Error(err),
-			)
-			return
+	cronScheduler := cron.New(cron.WithLocation(state.State.LocalLocation))
+	_, err := cronScheduler.AddFunc(schedule, func() {
+		if err := RunDatabaseBackupOnce(); err != nil {
+			logger.Error("failed to run automatic database backup", zap.Error(err))
+		} else {
+			logger.Info("automatic database backup sent successfully")
 		}
+	})
+	if err != nil {
+		logger.Error("failed to register backup cron schedule",
+			zap.String("cron_schedule", schedule),
+			zap.Error(err),
+		)
+		return
+	}
 
-		cronScheduler.Start()
-	}()
+	cronScheduler.Start()
+	backupScheduler = cronScheduler
+}
+
+// StopAutomaticDatabaseBackups stops scheduling backups, the returned context
+// is done once a backup which is already running finishes
+func StopAutomaticDatabaseBackups() context.Context {
+	if backupScheduler == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	return backupScheduler.Stop()
 }
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func encryptForTest(t *testing.T, plaintext []byte, passphrase string) []byte {
+	t.Helper()
+
+	var encrypted bytes.Buffer
+	encrypter, err := EncryptBackup(&encrypted, passphrase)
+	if err != nil {
+		t.Fatalf("EncryptBackup() failed: %s", err)
+	}
+	if _, err = encrypter.Write(plaintext); err != nil {
+		t.Fatalf("writing the backup failed: %s", err)
+	}
+	if err = encrypter.Close(); err != nil {
+		t.Fatalf("closing the backup failed: %s", err)
+	}
+	return encrypted.Bytes()
+}
+
+func decryptForTest(data []byte, passphrase string) ([]byte, error) {
+	plaintext, err := DecryptBackup(bytes.NewReader(data), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(plaintext)
+}
+
+func TestEncryptBackupRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{"empty", []byte{}},
+		{"small", []byte("PK\x03\x04 not really a zip")},
+		{"exactly one chunk", bytes.Repeat([]byte("a"), encryptedBackupChunkSize)},
+		{"several chunks", bytes.Repeat([]byte("abc"), encryptedBackupChunkSize)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encrypted := encryptForTest(t, test.plaintext, "correct horse")
+			if !IsEncryptedBackup(encrypted) {
+				t.Fatalf("IsEncryptedBackup() = false for an encrypted backup")
+			}
+			if len(test.plaintext) > 0 && bytes.Contains(encrypted, test.plaintext) {
+				t.Fatalf("the encrypted backup contains the plaintext")
+			}
+
+			decrypted, err := decryptForTest(encrypted, "correct horse")
+			if err != nil {
+				t.Fatalf("DecryptBackup() failed: %s", err)
+			}
+			if !bytes.Equal(decrypted, test.plaintext) {
+				t.Errorf("DecryptBackup() gave %d bytes, expected %d", len(decrypted), len(test.plaintext))
+			}
+		})
+	}
+}
+
+func TestDecryptBackupErrors(t *testing.T) {
+	encrypted := encryptForTest(t, []byte("backup"), "correct horse")
+	multiChunk := encryptForTest(t, bytes.Repeat([]byte("a"), 2*encryptedBackupChunkSize), "correct horse")
+	firstChunkEnd := encryptedBackupHeaderSize + encryptedBackupChunkSize + 16
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase string
+		expected   string
+	}{
+		{"wrong passphrase", encrypted, "battery staple", "wrong passphrase or damaged backup"},
+		{"not encrypted", []byte("PK\x03\x04"), "correct horse", "not an encrypted backup"},
+		{"truncated magic", encrypted[:len(encryptedBackupMagic)-1], "correct horse", "not an encrypted backup"},
+		{"truncated header", encrypted[:encryptedBackupHeaderSize-1], "correct horse", "the encrypted backup is truncated"},
+		{"no chunk", encrypted[:encryptedBackupHeaderSize], "correct horse", "wrong passphrase or damaged backup"},
+		{"truncated chunk", encrypted[:len(encrypted)-1], "correct horse", "wrong passphrase or damaged backup"},
+		{"truncated after a chunk", multiChunk[:firstChunkEnd], "correct horse", "wrong passphrase or damaged backup"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decryptForTest(test.data, test.passphrase)
+			if err == nil || err.Error() != test.expected {
+				t.Errorf("DecryptBackup() error = %v, expected %q", err, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"database/sql"
+	"html"
+	"slices"
+
+	"watgbridge/database"
+	"watgbridge/state"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.uber.org/zap"
+)
+
+// chatSettingOption is a global option which can be overridden for a chat
+type chatSettingOption struct {
+	key, name string
+	setting   func(*database.ChatSettings) *sql.NullBool
+	global    func(*state.Config) bool
+	// Labels of the values of the option, for false and true
+	labels [2]string
+}
+
+var chatSettingOptions = []chatSettingOption{
+	{"images", "Images", func(s *database.ChatSettings) *sql.NullBool { return &s.SkipImages },
+		func(cfg *state.Config) bool { return cfg.WhatsApp.SkipImages }, [2]string{"✅", "❌"}},
+	{"gifs", "GIFs", func(s *database.ChatSettings) *sql.NullBool { return &s.SkipGIFs },
+		func(cfg *state.Config) bool { return cfg.WhatsApp.SkipGIFs }, [2]string{"✅", "❌"}},
+	{"videos", "Videos", func(s *database.ChatSettings) *sql.NullBool { return &s.SkipVideos },
+		func(cfg *state.Config) bool { return cfg.WhatsApp.SkipVideos }, [2]string{"✅", "❌"}},
+	{"voice", "Voice notes", func(s *database.ChatSettings) *sql.NullBool { return &s.SkipVoiceNotes },
+		func(cfg *state.Config) bool { return cfg.WhatsApp.SkipVoiceNotes }, [2]string{"✅", "❌"}},
+	{"audios", "Audios", func(s *database.ChatSettings) *sql.NullBool { return &s.SkipAudios },
+		func(cfg *state.Config) bool { return cfg.WhatsApp.SkipAudios }, [2]string{"✅", "❌"}},
+	{"documents", "Documents", func(s *database.ChatSettings) *sql.NullBool { return &s.SkipDocuments },
+		func(cfg *state.Config) bool { return cfg.WhatsApp.SkipDocuments }, [2]string{"✅", "❌"}},
+	{"stickers", "Stickers", func(s *database.ChatSettings) *sql.NullBool { return &s.SkipStickers },
+		func(cfg *state.Config) bool { return cfg.WhatsApp.SkipStickers }, [2]string{"✅", "❌"}},
+	{"contacts", "Contacts", func(s *database.ChatSettings) *sql.NullBool { return &s.SkipContacts },
+		func(cfg *state.Config) bool { return cfg.WhatsApp.SkipContacts }, [2]string{"✅", "❌"}},
+	{"locations", "Locations", func(s *database.ChatSettings) *sql.NullBool { return &s.SkipLocations },
+		func(cfg *state.Config) bool { return cfg.WhatsApp.SkipLocations }, [2]string{"✅", "❌"}},
+	{"header", "Header", func(s *database.ChatSettings) *sql.NullBool { return &s.SkipChatDetails },
+		func(cfg *state.Config) bool { return cfg.WhatsApp.SkipChatDetails }, [2]string{"full", "compact"}},
+	{"receipts", "Read receipts", func(s *database.ChatSettings) *sql.NullBool { return &s.SendReadReceipts },
+		func(cfg *state.Config) bool { return cfg.Telegram.SendMyReadReceipts }, [2]string{"off", "on"}},
+}
+
+// WaChatConfig returns the config to bridge the given chat with, which is the
+// global config with the settings of the chat applied over it, along with the
+// settings themselves
+func WaChatConfig(waChatId string) (*state.Config, database.ChatSettings) {
+	cfg := state.State.Config
+
+	settings, found, err := database.ChatSettingsGet(waChatId)
+	if err != nil {
+		state.State.Logger.Warn("failed to get chat settings from database, using the global ones",
+			zap.String("chat_id", waChatId),
+			zap.Error(err),
+		)
+		return cfg, database.ChatSettings{ID: waChatId}
+	}
+	if !found {
+		return cfg, database.ChatSettings{ID: waChatId}
+	}
+
+	return chatConfigWithSettings(cfg, settings), settings
+}
+
+// chatConfigWithSettings returns a copy of the global config with the
+// settings of a chat applied over it
+func chatConfigWithSettings(cfg *state.Config, settings database.ChatSettings) *state.Config {
+	chatCfg := *cfg
+	chatCfg.WhatsApp.SkipImages = settings.SkipImages.Bool || (!settings.SkipImages.Valid && cfg.WhatsApp.SkipImages)
+	chatCfg.WhatsApp.SkipGIFs = settings.SkipGIFs.Bool || (!settings.SkipGIFs.Valid && cfg.WhatsApp.SkipGIFs)
+	chatCfg.WhatsApp.SkipVideos = settings.SkipVideos.Bool || (!settings.SkipVideos.Valid && cfg.WhatsApp.SkipVideos)
+	chatCfg.WhatsApp.SkipVoiceNotes = settings.SkipVoiceNotes.Bool || (!settings.SkipVoiceNotes.Valid && cfg.WhatsApp.SkipVoiceNotes)
+	chatCfg.WhatsApp.SkipAudios = settings.SkipAudios.Bool || (!settings.SkipAudios.Valid && cfg.WhatsApp.SkipAudios)
+	chatCfg.WhatsApp.SkipDocuments = settings.SkipDocuments.Bool || (!settings.SkipDocuments.Valid && cfg.WhatsApp.SkipDocuments)
+	chatCfg.WhatsApp.SkipStickers = settings.SkipStickers.Bool || (!settings.SkipStickers.Valid && cfg.WhatsApp.SkipStickers)
+	chatCfg.WhatsApp.SkipContacts = settings.SkipContacts.Bool || (!settings.SkipContacts.Valid && cfg.WhatsApp.SkipContacts)
+	chatCfg.WhatsApp.SkipLocations = settings.SkipLocations.Bool || (!settings.SkipLocations.Valid && cfg.WhatsApp.SkipLocations)
+	chatCfg.WhatsApp.SkipChatDetails = settings.SkipChatDetails.Bool || (!settings.SkipChatDetails.Valid && cfg.WhatsApp.SkipChatDetails)
+	chatCfg.Telegram.SendMyReadReceipts = settings.SendReadReceipts.Bool || (!settings.SendReadReceipts.Valid && cfg.Telegram.SendMyReadReceipts)
+
+	return &chatCfg
+}
+
+// ChatSettingsToggle changes the setting with the given key to its next
+// value. Overridable options go from the global value to both values in
+// turn and back to the global value. It returns false for an unknown key.
+func ChatSettingsToggle(settings *database.ChatSettings, key string) bool {
+	switch key {
+	case "mute":
+		settings.Muted = !settings.Muted
+		return true
+	case "silent":
+		settings.Silent = !settings.Silent
+		return true
+	}
+
+	idx := slices.IndexFunc(chatSettingOptions, func(option chatSettingOption) bool {
+		return option.key == key
+	})
+	if idx == -1 {
+		return false
+	}
+
+	var (
+		option  = chatSettingOptions[idx]
+		setting = option.setting(settings)
+		global  = option.global(state.State.Config)
+	)
+	switch {
+	case !setting.Valid:
+		*setting = sql.NullBool{Bool: !global, Valid: true}
+	case setting.Bool != global:
+		*setting = sql.NullBool{Bool: global, Valid: true}
+	default:
+		*setting = sql.NullBool{}
+	}
+	return true
+}
+
+// TgChatSettingsText describes the settings of a chat for the message with
+// the /chatsettings keyboard
+func TgChatSettingsText(settings database.ChatSettings) string {
+	chatName := settings.ID
+	if jid, ok := WaParseJID(settings.ID); ok {
+		chatName = WaGetChatName(jid)
+	}
+
+	return "<b>Settings of</b> " + html.EscapeString(chatName) + " (<code>" + html.EscapeString(settings.ID) + "</code>)\n\n" +
+		"Media types marked ✅ are bridged and ❌ are skipped. Options marked <i>default</i> follow the config file, " +
+		"tap an option to override it for this chat."
+}
+
+// TgMakeChatSettingsKeyboard makes the keyboard of /chatsettings, whose
+// buttons toggle the settings of the chat
+func TgMakeChatSettingsKeyboard(settings database.ChatSettings) *gotgbot.InlineKeyboardMarkup {
+	var (
+		cfg     = state.State.Config
+		prefix  = "chatsettings_"
+		suffix  = "_" + settings.ID
+		buttons []gotgbot.InlineKeyboardButton
+	)
+
+	onOff := func(value bool) string {
+		if value {
+			return "on"
+		}
+		return "off"
+	}
+	buttons = append(buttons,
+		gotgbot.InlineKeyboardButton{Text: "Muted: " + onOff(settings.Muted), CallbackData: prefix + "mute" + suffix},
+		gotgbot.InlineKeyboardButton{Text: "Silent: " + onOff(settings.Silent), CallbackData: prefix + "silent" + suffix},
+	)
+
+	for _, option := range chatSettingOptions {
+		var (
+			setting = option.setting(&settings)
+			value   = option.global(cfg)
+		)
+		if setting.Valid {
+			value = setting.Bool
+		}
+
+		label := option.labels[0]
+		if value {
+			label = option.labels[1]
+		}
+		if !setting.Valid {
+			label += " (default)"
+		}
+
+		buttons = append(buttons, gotgbot.InlineKeyboardButton{
+			Text:         option.name + ": " + label,
+			CallbackData: prefix + option.key + suffix,
+		})
+	}
+
+	var keyboard [][]gotgbot.InlineKeyboardButton
+	for len(buttons) > 0 {
+		row := buttons[:min(len(buttons), 2)]
+		buttons = buttons[len(row):]
+		keyboard = append(keyboard, row)
+	}
+	keyboard = append(keyboard, []gotgbot.InlineKeyboardButton{
+		{Text: "Reset to defaults", CallbackData: prefix + "reset" + suffix},
+	})
+
+	return &gotgbot.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
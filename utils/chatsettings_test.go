@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"database/sql"
+	"testing"
+
+	"watgbridge/database"
+	"watgbridge/state"
+)
+
+func TestChatConfigWithSettings(t *testing.T) {
+	var (
+		unset = sql.NullBool{}
+		on    = sql.NullBool{Bool: true, Valid: true}
+		off   = sql.NullBool{Bool: false, Valid: true}
+	)
+
+	tests := []struct {
+		name     string
+		global   bool
+		setting  sql.NullBool
+		expected bool
+	}{
+		{"unset keeps global off", false, unset, false},
+		{"unset keeps global on", true, unset, true},
+		{"on overrides global off", false, on, true},
+		{"off overrides global on", true, off, false},
+		{"on with global on", true, on, true},
+		{"off with global off", false, off, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &state.Config{}
+			cfg.WhatsApp.SkipImages = test.global
+			cfg.Telegram.SendMyReadReceipts = test.global
+
+			chatCfg := chatConfigWithSettings(cfg, database.ChatSettings{
+				SkipImages:       test.setting,
+				SendReadReceipts: test.setting,
+			})
+			if chatCfg.WhatsApp.SkipImages != test.expected {
+				t.Errorf("SkipImages = %v, expected %v", chatCfg.WhatsApp.SkipImages, test.expected)
+			}
+			if chatCfg.Telegram.SendMyReadReceipts != test.expected {
+				t.Errorf("SendMyReadReceipts = %v, expected %v", chatCfg.Telegram.SendMyReadReceipts, test.expected)
+			}
+			if cfg.WhatsApp.SkipImages != test.global {
+				t.Errorf("the global config was changed")
+			}
+		})
+	}
+}
+
+func TestChatSettingsToggle(t *testing.T) {
+	state.State.Config = &state.Config{}
+	state.State.Config.WhatsApp.SkipImages = true
+
+	var (
+		unset = sql.NullBool{}
+		on    = sql.NullBool{Bool: true, Valid: true}
+		off   = sql.NullBool{Bool: false, Valid: true}
+	)
+
+	tests := []struct {
+		name     string
+		current  sql.NullBool
+		expected sql.NullBool
+	}{
+		{"global to opposite", unset, off},
+		{"opposite to global", off, on},
+		{"global value back to unset", on, unset},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := database.ChatSettings{SkipImages: test.current}
+			if !ChatSettingsToggle(&settings, "images") {
+				t.Fatalf("ChatSettingsToggle() = false for a known key")
+			}
+			if settings.SkipImages != test.expected {
+				t.Errorf("SkipImages = %+v, expected %+v", settings.SkipImages, test.expected)
+			}
+		})
+	}
+
+	t.Run("mute and silent", func(t *testing.T) {
+		var settings database.ChatSettings
+		ChatSettingsToggle(&settings, "mute")
+		ChatSettingsToggle(&settings, "silent")
+		if !settings.Muted || !settings.Silent {
+			t.Errorf("Muted = %v, Silent = %v, expected both true", settings.Muted, settings.Silent)
+		}
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		var settings database.ChatSettings
+		if ChatSettingsToggle(&settings, "nothing") {
+			t.Errorf("ChatSettingsToggle() = true for an unknown key")
+		}
+	})
+}
@@ -0,0 +1,263 @@
+package utils
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+	"time"
+
+	"watgbridge/database"
+	"watgbridge/state"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.mau.fi/whatsmeow/types"
+	"go.uber.org/zap"
+)
+
+// Transcripts which can be put in a chat export
+const (
+	ExportFormatJSON = "json"
+	ExportFormatHTML = "html"
+	ExportFormatAll  = "all"
+)
+
+// Room left in an export for the transcripts when the size of the media is
+// limited by the upload limit of the Bot API
+const exportTranscriptReserve = 8 << 20
+
+var errExportTooLarge = errors.New("the export would exceed the upload size limit")
+
+type exportedMessage struct {
+	ID           string    `json:"id"`
+	SenderId     string    `json:"sender_id"`
+	SenderName   string    `json:"sender_name"`
+	Timestamp    time.Time `json:"timestamp"`
+	FromTelegram bool      `json:"from_telegram"`
+	Text         string    `json:"text,omitempty"`
+	MediaType    string    `json:"media_type,omitempty"`
+	MimeType     string    `json:"mime_type,omitempty"`
+	FileName     string    `json:"file_name,omitempty"`
+	FileSize     uint64    `json:"file_size,omitempty"`
+	MediaFile    string    `json:"media_file,omitempty"` // Path of the media in the zip, if it could be included
+	TelegramLink string    `json:"telegram_link,omitempty"`
+}
+
+type chatTranscript struct {
+	ChatId     string            `json:"chat_id"`
+	ChatName   string            `json:"chat_name"`
+	ExportedAt time.Time         `json:"exported_at"`
+	From       *time.Time        `json:"from,omitempty"`
+	To         *time.Time        `json:"to,omitempty"`
+	Messages   []exportedMessage `json:"messages"`
+}
+
+var transcriptTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		return t.In(state.State.LocalLocation).Format(state.State.Config.TimeFormat)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.ChatName}}</title>
+<style>
+body { font-family: sans-serif; background: #efeae2; margin: 0 auto; padding: 1em; max-width: 60em; }
+.msg { background: #fff; border-radius: 8px; padding: .5em .75em; margin: .5em 0; max-width: 70%; width: fit-content; }
+.me { background: #d9fdd3; margin-left: auto; }
+.meta { color: #667781; font-size: .8em; }
+.text { white-space: pre-wrap; overflow-wrap: anywhere; }
+img, video { max-width: 100%; border-radius: 4px; }
+</style>
+</head>
+<body>
+<h1>{{.ChatName}}</h1>
+<p class="meta">{{.ChatId}} · {{len .Messages}} messages{{if .From}} from {{time .From}}{{end}}{{if .To}} to {{time .To}}{{end}} · exported {{time .ExportedAt}}</p>
+{{range .Messages}}<div class="msg{{if .FromTelegram}} me{{end}}">
+<div class="meta"><b>{{.SenderName}}</b> · {{time .Timestamp}}{{if .TelegramLink}} · <a href="{{.TelegramLink}}">Telegram</a>{{end}}</div>
+{{if .MediaFile}}{{if eq .MediaType "image" "sticker"}}<img src="{{.MediaFile}}" alt="">
+{{else if eq .MediaType "video" "gif" "video_note"}}<video src="{{.MediaFile}}" controls></video>
+{{else if eq .MediaType "audio" "voice_note"}}<audio src="{{.MediaFile}}" controls></audio>
+{{else}}<a href="{{.MediaFile}}">{{or .FileName .MediaFile}}</a>
+{{end}}{{else if and .MediaType (ne .MediaType "text")}}<div class="meta">[{{.MediaType}}{{if .FileName}}: {{.FileName}}{{end}}, not included]</div>
+{{end}}{{if .Text}}<div class="text">{{.Text}}</div>{{end}}
+</div>
+{{end}}</body>
+</html>
+`))
+
+// ExportChat puts the archived messages of a chat sent between from and to
+// in a zip, with a JSON and/or HTML transcript and the media which can still
+// be downloaded from Telegram, and sends it in the backup delivery mode, to
+// the owner if backups are disabled. Unless the Bot API is self-hosted, media
+// which would make the zip exceed the upload limit is left out and marked as
+// not included. It returns the number of messages exported, nothing is sent
+// when there are none.
+func ExportChat(waChatJID types.JID, from, to time.Time, format string) (int, error) {
+	var (
+		cfg    = state.State.Config
+		logger = state.State.Logger
+		tgBot  = state.State.TelegramBot
+		now    = time.Now().UTC()
+	)
+
+	messages, err := database.ArchiveGetChatMessages(waChatJID.String(), from, to)
+	if err != nil {
+		return 0, err
+	} else if len(messages) == 0 {
+		return 0, nil
+	}
+
+	transcript := chatTranscript{
+		ChatId:     waChatJID.String(),
+		ChatName:   WaGetChatName(waChatJID),
+		ExportedAt: now,
+	}
+	if !from.IsZero() {
+		transcript.From = &from
+	}
+	if !to.IsZero() {
+		transcript.To = &to
+	}
+
+	exportFile, err := os.CreateTemp("", "watgbridge-export-*.zip")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = exportFile.Close()
+		_ = os.Remove(exportFile.Name())
+	}()
+
+	zipWriter := zip.NewWriter(exportFile)
+
+	var (
+		mediaBudget  = int64(UploadSizeLimit) - exportTranscriptReserve
+		mediaSkipped int
+	)
+	if cfg.Telegram.SelfHostedAPI {
+		mediaBudget = -1
+	}
+
+	for idx, message := range messages {
+		exported := exportedMessage{
+			ID:           message.WaMsgId,
+			SenderId:     message.SenderId,
+			SenderName:   message.SenderName,
+			Timestamp:    message.Timestamp,
+			FromTelegram: message.FromTelegram,
+			Text:         message.Text,
+			MediaType:    message.MediaType,
+			MimeType:     message.MimeType,
+			FileName:     message.FileName,
+			FileSize:     message.FileSize,
+		}
+		if message.TgMsgId != 0 {
+			exported.TelegramLink = gotgbot.Message{
+				Chat:      gotgbot.Chat{Id: message.TgChatId},
+				MessageId: message.TgMsgId,
+			}.GetLink()
+		}
+
+		// The Bot API only serves files up to 20 MB, unless it is self-hosted
+		// in which case they are read from its directory
+		if message.TgFileId != "" {
+			mediaFile, size, err := exportMedia(tgBot, zipWriter, message.TgFileId, idx+1, mediaBudget)
+			if errors.Is(err, errExportTooLarge) {
+				mediaSkipped += 1
+			} else if err != nil {
+				logger.Debug("media of exported message is not available",
+					zap.String("msg_id", message.WaMsgId),
+					zap.Error(err),
+				)
+			}
+			exported.MediaFile = mediaFile
+			if mediaBudget >= 0 {
+				mediaBudget -= size
+			}
+		}
+
+		transcript.Messages = append(transcript.Messages, exported)
+	}
+
+	if format == ExportFormatJSON || format == ExportFormatAll {
+		entry, err := zipWriter.Create("transcript.json")
+		if err != nil {
+			return 0, err
+		}
+		encoder := json.NewEncoder(entry)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(transcript); err != nil {
+			return 0, err
+		}
+	}
+
+	if format == ExportFormatHTML || format == ExportFormatAll {
+		entry, err := zipWriter.Create("transcript.html")
+		if err != nil {
+			return 0, err
+		}
+		if err = transcriptTemplate.Execute(entry, transcript); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = zipWriter.Close(); err != nil {
+		return 0, err
+	}
+	if info, err := exportFile.Stat(); err != nil {
+		return 0, err
+	} else if !cfg.Telegram.SelfHostedAPI && uint64(info.Size()) > UploadSizeLimit {
+		return 0, fmt.Errorf("%w, export a shorter period", errExportTooLarge)
+	}
+	if _, err = exportFile.Seek(0, 0); err != nil {
+		return 0, err
+	}
+
+	mode := normalizeBackupMode(cfg.Backup.Mode)
+	if mode != "thread" {
+		mode = "private"
+	}
+
+	exportName := fmt.Sprintf("chat-export-%s-%s.zip", waChatJID.User, now.Format("02-01-2006-150405"))
+	caption := fmt.Sprintf("Export of %s (%d messages)", transcript.ChatName, len(messages))
+	if mediaSkipped > 0 {
+		caption += fmt.Sprintf("\n\n%d media files were not included to stay under the upload size limit", mediaSkipped)
+	}
+	_, err = sendDocumentByMode(mode, gotgbot.FileReader{Name: exportName, Data: exportFile}, caption)
+	return len(messages), err
+}
+
+// exportMedia downloads a file from Telegram into the media directory of the
+// export, returning its path in the zip and its size. Files larger than the
+// budget left are not downloaded, a negative budget is unlimited.
+func exportMedia(b *gotgbot.Bot, zipWriter *zip.Writer, fileId string, number int, budget int64) (string, int64, error) {
+	file, err := b.GetFile(fileId, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	if budget >= 0 && file.FileSize > budget {
+		return "", 0, errExportTooLarge
+	}
+
+	data, err := TgDownloadByFilePath(b, file.FilePath)
+	if err != nil {
+		return "", 0, err
+	}
+	if budget >= 0 && int64(len(data)) > budget {
+		return "", 0, errExportTooLarge
+	}
+
+	mediaFile := fmt.Sprintf("media/%05d%s", number, path.Ext(file.FilePath))
+	entry, err := zipWriter.Create(mediaFile)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err = entry.Write(data); err != nil {
+		return "", 0, err
+	}
+	return mediaFile, int64(len(data)), nil
+}
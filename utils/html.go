@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits of Telegram on the length of the text after parsing the entities,
+// counted in UTF-16 code units
+const (
+	TgMessageLengthLimit = 4096
+	TgCaptionLengthLimit = 1024
+)
+
+type tgHTMLToken struct {
+	text    string
+	length  int    // Visible length, zero for tags
+	tag     string // Name of the tag, empty for text
+	closing bool
+}
+
+func tgTokenizeHTML(text string) []tgHTMLToken {
+	var tokens []tgHTMLToken
+
+	for len(text) > 0 {
+		switch text[0] {
+		case '<':
+			if end := strings.IndexByte(text, '>'); end != -1 {
+				inner := text[1:end]
+				closing := strings.HasPrefix(inner, "/")
+				if fields := strings.Fields(strings.TrimPrefix(inner, "/")); len(fields) > 0 {
+					tokens = append(tokens, tgHTMLToken{
+						text:    text[:end+1],
+						tag:     fields[0],
+						closing: closing,
+					})
+					text = text[end+1:]
+					continue
+				}
+			}
+		case '&':
+			if end := strings.IndexByte(text, ';'); end > 1 && end <= 10 {
+				tokens = append(tokens, tgHTMLToken{text: text[:end+1], length: 1})
+				text = text[end+1:]
+				continue
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(text)
+		length := 1
+		if r > 0xFFFF {
+			length = 2
+		}
+		tokens = append(tokens, tgHTMLToken{text: text[:size], length: length})
+		text = text[size:]
+	}
+
+	return tokens
+}
+
+func tgJoinHTMLTokens(tokens []tgHTMLToken) string {
+	var builder strings.Builder
+	for _, token := range tokens {
+		builder.WriteString(token.text)
+	}
+	return builder.String()
+}
+
+// TgSplitHTML splits a HTML formatted text into parts which fit in the given
+// limit. The text is split after a new line or a space where possible, never
+// inside a tag, an entity or a character, and the tags open at the split are
+// closed at the end of a part and opened again in the next one.
+func TgSplitHTML(text string, limit int) []string {
+	var (
+		tokens = tgTokenizeHTML(text)
+		parts  []string
+	)
+
+	for len(tokens) > 0 {
+		var (
+			length   int
+			openTags []tgHTMLToken
+
+			splitAt       = len(tokens)
+			splitOpenTags []tgHTMLToken
+
+			newLineAt, spaceAt             = -1, -1
+			newLineOpenTags, spaceOpenTags []tgHTMLToken
+		)
+
+		for idx, token := range tokens {
+			if token.length > 0 && length+token.length > limit {
+				splitAt = idx
+				break
+			}
+			length += token.length
+
+			if token.tag != "" {
+				if !token.closing {
+					openTags = append(openTags, token)
+				} else {
+					for tagIdx := len(openTags) - 1; tagIdx >= 0; tagIdx-- {
+						if openTags[tagIdx].tag == token.tag {
+							openTags = append(openTags[:tagIdx:tagIdx], openTags[tagIdx+1:]...)
+							break
+						}
+					}
+				}
+			}
+
+			switch token.text {
+			case "\n":
+				newLineAt, newLineOpenTags = idx+1, append([]tgHTMLToken(nil), openTags...)
+				// A new line too early in the part wastes most of it
+				if length < limit/2 {
+					newLineAt = -1
+				}
+				fallthrough
+			case " ":
+				spaceAt, spaceOpenTags = idx+1, append([]tgHTMLToken(nil), openTags...)
+			}
+		}
+
+		if splitAt == len(tokens) {
+			parts = append(parts, tgJoinHTMLTokens(tokens))
+			break
+		}
+
+		splitOpenTags = openTags
+		skip := 0
+		if next := tokens[splitAt].text; next == "\n" || next == " " {
+			// The part is full right before a separator, which is dropped
+			skip = 1
+		} else if newLineAt != -1 {
+			splitAt, splitOpenTags = newLineAt, newLineOpenTags
+		} else if spaceAt != -1 {
+			splitAt, splitOpenTags = spaceAt, spaceOpenTags
+		}
+
+		part := tgJoinHTMLTokens(tokens[:splitAt])
+		for idx := len(splitOpenTags) - 1; idx >= 0; idx-- {
+			part += "</" + splitOpenTags[idx].tag + ">"
+		}
+		parts = append(parts, part)
+
+		tokens = append(append([]tgHTMLToken(nil), splitOpenTags...), tokens[splitAt+skip:]...)
+	}
+
+	return parts
+}
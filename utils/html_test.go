@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTgSplitHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		limit    int
+		expected []string
+	}{
+		{"fits", "hello", 10, []string{"hello"}},
+		{"exactly at the limit", "hello", 5, []string{"hello"}},
+		{"no break point", "abcdef", 3, []string{"abc", "def"}},
+		{"entity at the limit", "ab&amp;", 3, []string{"ab&amp;"}},
+		{"entity past the limit", "abc&amp;d", 3, []string{"abc", "&amp;d"}},
+		{"tags are not counted", "<b>abc</b>", 3, []string{"<b>abc</b>"}},
+		{"open tag across a split", "<b>abcdef</b>", 3, []string{"<b>abc</b>", "<b>def</b>"}},
+		{"nested tags across a split", "<b><i>abcd</i></b>", 2, []string{"<b><i>ab</i></b>", "<b><i>cd</i></b>"}},
+		{"closed tag before a split", "<b>ab</b>cdef", 3, []string{"<b>ab</b>c", "def"}},
+		{"tag attributes are kept", `<a href="https://example.com">link text</a>`, 4,
+			[]string{`<a href="https://example.com">link</a>`, `<a href="https://example.com">text</a>`}},
+		{"surrogate pair at the limit", "ab😀", 4, []string{"ab😀"}},
+		{"surrogate pair past the limit", "ab😀", 3, []string{"ab", "😀"}},
+		{"surrogate pair not split", "a😀b", 2, []string{"a", "😀", "b"}},
+		{"multi-byte runes", "héllo", 2, []string{"hé", "ll", "o"}},
+		{"separator at the split is dropped", "hello world", 5, []string{"hello", "world"}},
+		{"prefers a space", "hello world again", 13, []string{"hello world ", "again"}},
+		{"prefers a new line", "aaaa bbb\ncc dd", 12, []string{"aaaa bbb\n", "cc dd"}},
+		{"ignores an early new line", "a\nbbbbbbbb cc", 10, []string{"a\nbbbbbbbb", "cc"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := TgSplitHTML(test.input, test.limit)
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("TgSplitHTML(%q, %d) = %q, expected %q", test.input, test.limit, got, test.expected)
+			}
+		})
+	}
+}
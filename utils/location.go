@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"watgbridge/database"
+	"watgbridge/state"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+// TgLiveLocationIndefinitePeriod is the live_period which lets a Telegram
+// live location be updated forever
+const TgLiveLocationIndefinitePeriod = 0x7FFFFFFF
+
+// TgLiveLocationExpiry returns when a live location shared on Telegram stops
+// being updated, or the zero time if it is shared indefinitely
+func TgLiveLocationExpiry(msg *gotgbot.Message) time.Time {
+	if msg.Location == nil || msg.Location.LivePeriod == TgLiveLocationIndefinitePeriod {
+		return time.Time{}
+	}
+	return time.Unix(msg.Date, 0).UTC().Add(time.Duration(msg.Location.LivePeriod) * time.Second)
+}
+
+// TgUpdateLiveLocationOnWhatsApp mirrors a position update of a live
+// location shared on Telegram to the bridged WhatsApp live location. It
+// returns false if the message is not an active bridged live location.
+func TgUpdateLiveLocationOnWhatsApp(msg *gotgbot.Message) (bool, error) {
+	waClient := state.State.WhatsAppClient()
+
+	liveLocation, found, err := database.LiveLocationGetByTg(msg.Chat.Id, msg.MessageId)
+	if err != nil {
+		return false, err
+	} else if !found || !liveLocation.FromTelegram || !liveLocation.Active {
+		return false, nil
+	}
+
+	location := msg.Location
+
+	if location.LivePeriod == 0 {
+		// Telegram drops the live period once the sharing is stopped
+		liveLocation.Latitude, liveLocation.Longitude = location.Latitude, location.Longitude
+		err = TgEndLiveLocationOnWhatsApp(liveLocation)
+		if deactivateErr := database.LiveLocationDeactivate(liveLocation.WaMsgId, liveLocation.WaChatId); err == nil {
+			err = deactivateErr
+		}
+		return true, err
+	}
+
+	waChatJID, ok := WaParseJID(liveLocation.WaChatId)
+	if !ok {
+		return true, fmt.Errorf("invalid chat JID stored for live location: %s", liveLocation.WaChatId)
+	}
+
+	sequenceNumber := liveLocation.SequenceNumber + 1
+
+	_, err = waClient.SendMessage(context.Background(), waChatJID,
+		waClient.BuildEdit(waChatJID, liveLocation.WaMsgId, &waE2E.Message{
+			LiveLocationMessage: &waE2E.LiveLocationMessage{
+				DegreesLatitude:                   proto.Float64(location.Latitude),
+				DegreesLongitude:                  proto.Float64(location.Longitude),
+				AccuracyInMeters:                  proto.Uint32(uint32(location.HorizontalAccuracy)),
+				DegreesClockwiseFromMagneticNorth: proto.Uint32(uint32(location.Heading)),
+				SequenceNumber:                    proto.Int64(sequenceNumber),
+			},
+		}))
+	if err != nil {
+		return true, err
+	}
+
+	return true, database.LiveLocationSetPosition(liveLocation.WaMsgId, liveLocation.WaChatId, sequenceNumber,
+		location.Latitude, location.Longitude)
+}
+
+// TgEndLiveLocationOnWhatsApp sends the last update of a live location shared
+// from Telegram, at its last position and marked as ended, for it to stop
+// looking live on WhatsApp. The session is left for the caller to deactivate.
+func TgEndLiveLocationOnWhatsApp(liveLocation database.LiveLocation) error {
+	waClient := state.State.WhatsAppClient()
+
+	waChatJID, ok := WaParseJID(liveLocation.WaChatId)
+	if !ok {
+		return fmt.Errorf("invalid chat JID stored for live location: %s", liveLocation.WaChatId)
+	}
+
+	_, err := waClient.SendMessage(context.Background(), waChatJID,
+		waClient.BuildEdit(waChatJID, liveLocation.WaMsgId, &waE2E.Message{
+			LiveLocationMessage: &waE2E.LiveLocationMessage{
+				DegreesLatitude:  proto.Float64(liveLocation.Latitude),
+				DegreesLongitude: proto.Float64(liveLocation.Longitude),
+				Caption:          proto.String("Live location ended"),
+				SequenceNumber:   proto.Int64(liveLocation.SequenceNumber + 1),
+			},
+		}))
+	return err
+}
@@ -0,0 +1,418 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"sync"
+	"time"
+
+	"watgbridge/database"
+	"watgbridge/metrics"
+	"watgbridge/state"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	waTypes "go.mau.fi/whatsmeow/types"
+	"go.uber.org/zap"
+)
+
+// waSendError is returned by tgSendToWhatsApp when uploading or sending to
+// WhatsApp failed, after which the message is kept in the outbox
+type waSendError struct {
+	message string
+	err     error
+}
+
+func (e *waSendError) Error() string {
+	return e.message + " : " + e.err.Error()
+}
+
+func (e *waSendError) Unwrap() error {
+	return e.err
+}
+
+var (
+	outboxLock sync.Mutex
+	outboxWake = make(chan struct{}, 1)
+
+	outboxWorker = NewWorker()
+
+	// Chats whose queued messages the worker is sending
+	outboxRetryingLock  sync.Mutex
+	outboxRetryingChats = map[string]bool{}
+)
+
+// tgOutboxChatBusy tells whether a new message to a chat has to wait in the
+// outbox, behind the messages queued before it
+func tgOutboxChatBusy(waChatId string) bool {
+	outboxRetryingLock.Lock()
+	retrying := outboxRetryingChats[waChatId]
+	outboxRetryingLock.Unlock()
+	if retrying {
+		return true
+	}
+
+	pending, err := database.OutboxHasPending(waChatId)
+	if err != nil {
+		state.State.Logger.Warn("failed to check the outbox of a chat", zap.String("chat_id", waChatId), zap.Error(err))
+	}
+	return pending
+}
+
+func tgOutboxSetRetrying(waChatId string, retrying bool) {
+	outboxRetryingLock.Lock()
+	defer outboxRetryingLock.Unlock()
+
+	if retrying {
+		outboxRetryingChats[waChatId] = true
+	} else {
+		delete(outboxRetryingChats, waChatId)
+	}
+}
+
+// TgSendToWhatsApp sends a Telegram message to a WhatsApp chat. The message
+// is recorded in the outbox while it is being sent, and stays there to be
+// retried with backoff if WhatsApp fails to take it.
+func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
+	msgToForward, msgToReplyTo *gotgbot.Message,
+	waChatJID waTypes.JID, participant, stanzaId, quotedWaChatID string,
+	isReply bool) error {
+
+	return tgQueueToWhatsApp(b, c, msgToForward, msgToReplyTo, waChatJID, participant, stanzaId, quotedWaChatID, isReply, "")
+}
+
+// tgQueueToWhatsApp is TgSendToWhatsApp for an item of the album with the
+// given ID, or for a single message if albumId is empty
+func tgQueueToWhatsApp(b *gotgbot.Bot, c *ext.Context,
+	msgToForward, msgToReplyTo *gotgbot.Message,
+	waChatJID waTypes.JID, participant, stanzaId, quotedWaChatID string,
+	isReply bool, albumId string) error {
+
+	var (
+		cfg    = state.State.Config
+		logger = state.State.Logger
+	)
+
+	// Messages sent while older ones of the chat wait to be retried are
+	// queued behind them, for WhatsApp to get them in order
+	queued := tgOutboxChatBusy(waChatJID.String())
+
+	item := database.OutboxItem{
+		WaChatId:       waChatJID.String(),
+		Participant:    participant,
+		StanzaId:       stanzaId,
+		QuotedWaChatId: quotedWaChatID,
+		IsReply:        isReply,
+		AlbumId:        albumId,
+		TgChatId:       msgToForward.Chat.Id,
+		TgThreadId:     msgToForward.MessageThreadId,
+		TgMsgId:        msgToForward.MessageId,
+		Status:         database.OutboxStatusSending,
+		NextAttemptAt:  time.Now().UTC(),
+	}
+
+	var err error
+	item.ContextMsg, err = json.Marshal(c.EffectiveMessage)
+	if err == nil {
+		item.ForwardMsg, err = json.Marshal(msgToForward)
+	}
+	if err == nil && msgToReplyTo != nil {
+		item.ReplyToMsg, err = json.Marshal(msgToReplyTo)
+	}
+	if err == nil {
+		err = database.OutboxAddNew(&item)
+	}
+	if err != nil {
+		logger.Warn("failed to add message to outbox, it will not be retried",
+			zap.Int64("tg_msg_id", msgToForward.MessageId),
+			zap.Error(err),
+		)
+		item.ID = 0
+	}
+
+	if queued && item.ID != 0 {
+		if err = database.OutboxSetStatus(item.ID, database.OutboxStatusPending); err == nil {
+			if cfg.Telegram.ConfirmationType == "emoji" && !cfg.Telegram.AutoReactWhenAllRead {
+				b.SetMessageReaction(item.TgChatId, item.TgMsgId, &gotgbot.SetMessageReactionOpts{
+					Reaction: []gotgbot.ReactionType{gotgbot.ReactionTypeEmoji{Emoji: "👀"}},
+				})
+			}
+			WakeOutbox()
+			return nil
+		}
+		logger.Warn("failed to queue message behind the outbox of its chat, sending it now",
+			zap.Uint("outbox_id", item.ID),
+			zap.Error(err),
+		)
+	}
+
+	start := time.Now()
+	err = tgSendToWhatsApp(b, c, msgToForward, msgToReplyTo, waChatJID, participant, stanzaId, quotedWaChatID, isReply, albumId)
+
+	var sendErr *waSendError
+	if !errors.As(err, &sendErr) {
+		if err == nil {
+			metrics.SendDuration.Observe(time.Since(start), metrics.TelegramToWhatsApp)
+		}
+		if item.ID != 0 {
+			database.OutboxDelete(item.ID)
+		}
+		return err
+	}
+
+	if item.ID == 0 {
+		return TgReplyWithErrorByContext(b, c, sendErr.message, sendErr.err)
+	}
+	return tgOutboxAttemptFailed(b, c, item, sendErr)
+}
+
+// tgOutboxNextDelay returns how long to wait before the next attempt, which
+// doubles after every failed one
+func tgOutboxNextDelay(attempts int) time.Duration {
+	cfg := state.State.Config
+
+	var (
+		delay    = time.Duration(max(cfg.Telegram.Outbox.RetryDelaySeconds, 1)) * time.Second
+		maxDelay = time.Duration(max(cfg.Telegram.Outbox.MaxDelaySeconds, 1)) * time.Second
+	)
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+func tgOutboxAttemptFailed(b *gotgbot.Bot, c *ext.Context, item database.OutboxItem, sendErr *waSendError) error {
+	var (
+		cfg         = state.State.Config
+		logger      = state.State.Logger
+		attempts    = item.Attempts + 1
+		useReaction = cfg.Telegram.ConfirmationType == "emoji" && !cfg.Telegram.AutoReactWhenAllRead
+	)
+
+	logger.Warn("failed to send message to WhatsApp",
+		zap.Uint("outbox_id", item.ID),
+		zap.Int("attempts", attempts),
+		zap.Error(sendErr),
+	)
+
+	if attempts >= cfg.Telegram.Outbox.MaxAttempts {
+		err := database.OutboxSetAttempt(item.ID, database.OutboxStatusFailed, attempts, sendErr.Error(), time.Time{})
+		if err != nil {
+			return TgReplyWithErrorByContext(b, c, "Failed to update the outbox", err)
+		}
+		if useReaction {
+			b.SetMessageReaction(item.TgChatId, item.TgMsgId, &gotgbot.SetMessageReactionOpts{
+				Reaction: []gotgbot.ReactionType{gotgbot.ReactionTypeEmoji{Emoji: "👎"}},
+			})
+		}
+		return TgReplyWithErrorByContext(b, c,
+			fmt.Sprintf("%s, gave up after %d attempts. Use <code>/queue retry %d</code> to try again", sendErr.message, attempts, item.ID),
+			sendErr.err)
+	}
+
+	err := database.OutboxSetAttempt(item.ID, database.OutboxStatusPending, attempts, sendErr.Error(),
+		time.Now().UTC().Add(tgOutboxNextDelay(attempts)))
+	if err != nil {
+		return TgReplyWithErrorByContext(b, c, "Failed to update the outbox", err)
+	}
+
+	if attempts > 1 {
+		// Only the first failure is reported, the retries are visible in /queue
+		return nil
+	}
+
+	if useReaction {
+		b.SetMessageReaction(item.TgChatId, item.TgMsgId, &gotgbot.SetMessageReactionOpts{
+			Reaction: []gotgbot.ReactionType{gotgbot.ReactionTypeEmoji{Emoji: "👀"}},
+		})
+	}
+	return TgReplyWithErrorByContext(b, c,
+		fmt.Sprintf("%s, queued to be retried as #%d (see /queue)", sendErr.message, item.ID),
+		sendErr.err)
+}
+
+// tgRetryOutboxItem sends a queued message again, rebuilding the update it
+// came from so that the confirmations and errors are replied to as before.
+// It returns false when the item is still queued afterwards.
+func tgRetryOutboxItem(b *gotgbot.Bot, item database.OutboxItem) bool {
+	logger := state.State.Logger
+
+	var (
+		contextMsg   gotgbot.Message
+		msgToForward gotgbot.Message
+		msgToReplyTo *gotgbot.Message
+	)
+	err := json.Unmarshal(item.ContextMsg, &contextMsg)
+	if err == nil {
+		err = json.Unmarshal(item.ForwardMsg, &msgToForward)
+	}
+	if err == nil && len(item.ReplyToMsg) > 0 {
+		msgToReplyTo = &gotgbot.Message{}
+		err = json.Unmarshal(item.ReplyToMsg, msgToReplyTo)
+	}
+	waChatJID, ok := WaParseJID(item.WaChatId)
+	if err != nil || !ok {
+		logger.Error("dropping outbox item which cannot be decoded",
+			zap.Uint("outbox_id", item.ID),
+			zap.Error(err),
+		)
+		database.OutboxDelete(item.ID)
+		return true
+	}
+
+	if err := database.OutboxSetStatus(item.ID, database.OutboxStatusSending); err != nil {
+		logger.Error("failed to update outbox item status", zap.Uint("outbox_id", item.ID), zap.Error(err))
+		return false
+	}
+
+	// Negative update IDs keep the temporary files of the conversions apart
+	// from the ones of the live updates
+	c := ext.NewContext(b, &gotgbot.Update{UpdateId: -int64(item.ID), Message: &contextMsg}, nil)
+
+	err = tgSendToWhatsApp(b, c, &msgToForward, msgToReplyTo, waChatJID,
+		item.Participant, item.StanzaId, item.QuotedWaChatId, item.IsReply, item.AlbumId)
+
+	var sendErr *waSendError
+	if errors.As(err, &sendErr) {
+		tgOutboxAttemptFailed(b, c, item, sendErr)
+		return false
+	}
+
+	database.OutboxDelete(item.ID)
+	if err != nil {
+		logger.Error("failed to retry outbox item", zap.Uint("outbox_id", item.ID), zap.Error(err))
+	} else {
+		logger.Info("sent queued message to WhatsApp", zap.Uint("outbox_id", item.ID))
+	}
+	return true
+}
+
+func tgRetryDueOutboxItems() {
+	var (
+		logger   = state.State.Logger
+		tgBot    = state.State.TelegramBot
+		waClient = state.State.WhatsAppClient()
+	)
+
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+
+	if !waClient.IsConnected() || !waClient.IsLoggedIn() {
+		return
+	}
+
+	items, err := database.OutboxGetPending()
+	if err != nil {
+		logger.Error("failed to get pending outbox items from database", zap.Error(err))
+		return
+	}
+
+	// The messages of a chat are sent in order, the ones after a message
+	// which is not due yet or fails again keep waiting for it
+	var (
+		now     = time.Now().UTC()
+		blocked = map[string]bool{}
+	)
+	for _, item := range items {
+		select {
+		case <-outboxWorker.Stopping():
+			return
+		default:
+		}
+		if blocked[item.WaChatId] {
+			continue
+		}
+		if item.NextAttemptAt.After(now) {
+			blocked[item.WaChatId] = true
+			continue
+		}
+		if !waClient.IsConnected() {
+			return
+		}
+
+		tgOutboxSetRetrying(item.WaChatId, true)
+		if !tgRetryOutboxItem(tgBot, item) {
+			blocked[item.WaChatId] = true
+		}
+		tgOutboxSetRetrying(item.WaChatId, false)
+	}
+}
+
+// WakeOutbox makes the outbox worker look for due items right away, used
+// after reconnecting to WhatsApp and by /queue retry
+func WakeOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// StartOutboxWorker retries the queued messages when they are due, starting
+// with the ones interrupted by the last shutdown
+func StartOutboxWorker() {
+	if err := database.OutboxResetInterrupted(state.State.StartTime); err != nil {
+		state.State.Logger.Error("failed to reset interrupted outbox items", zap.Error(err))
+	}
+
+	outboxWorker.Go(func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-outboxWake:
+			case <-outboxWorker.Stopping():
+				return
+			}
+			tgRetryDueOutboxItems()
+		}
+	})
+}
+
+// StopOutboxWorker stops retrying queued messages, the returned context is
+// done once a message which is already being retried was sent
+func StopOutboxWorker() context.Context {
+	return outboxWorker.Stop()
+}
+
+// TgMakeOutboxText lists the queued messages for /queue
+func TgMakeOutboxText(items []database.OutboxItem) string {
+	if len(items) == 0 {
+		return "The outbox is empty, everything was sent to WhatsApp"
+	}
+
+	outboxText := fmt.Sprintf("<b>%d queued messages</b>\n\n", len(items))
+	for _, item := range items {
+		chatName := item.WaChatId
+		if chatJID, ok := WaParseJID(item.WaChatId); ok {
+			if chatJID.Server == waTypes.GroupServer {
+				chatName = WaGetGroupName(chatJID)
+			} else {
+				chatName = WaGetContactName(chatJID)
+			}
+		}
+
+		var statusText string
+		if item.Status == database.OutboxStatusFailed {
+			statusText = "gave up"
+		} else if item.Status == database.OutboxStatusSending {
+			statusText = "sending"
+		} else {
+			statusText = "next try in " + time.Until(item.NextAttemptAt).Round(time.Second).String()
+		}
+
+		outboxText += fmt.Sprintf("<code>#%d</code> to <b>%s</b> — %s, %d attempts\n<i>%s</i>\n\n",
+			item.ID, html.EscapeString(chatName), statusText, item.Attempts,
+			html.EscapeString(SubString(item.LastError, 0, 200)))
+
+		if len(outboxText) > 3800 {
+			outboxText += "..."
+			break
+		}
+	}
+	return outboxText
+}
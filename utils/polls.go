@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+
+	"watgbridge/database"
+	"watgbridge/state"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	waTypes "go.mau.fi/whatsmeow/types"
+)
+
+const (
+	TgPollMaxOptions        = 12
+	TgPollMaxQuestionLength = 300
+	TgPollMaxOptionLength   = 100
+	TgPollMaxDescLength     = 1024
+)
+
+func WaGetPollCreationMessage(msg *waE2E.Message) *waE2E.PollCreationMessage {
+	if i := msg.GetPollCreationMessage(); i != nil {
+		return i
+	} else if i := msg.GetPollCreationMessageV2(); i != nil {
+		return i
+	} else if i := msg.GetPollCreationMessageV3(); i != nil {
+		return i
+	}
+	return nil
+}
+
+func WaPollOptionNames(pollMsg *waE2E.PollCreationMessage) []string {
+	options := make([]string, 0, len(pollMsg.GetOptions()))
+	for _, option := range pollMsg.GetOptions() {
+		options = append(options, option.GetOptionName())
+	}
+	return options
+}
+
+// WaPollOptionsFromHashes maps the SHA-256 hashes carried by a decrypted
+// poll vote back to the option names of the poll
+func WaPollOptionsFromHashes(options []string, selectedHashes [][]byte) []string {
+	optionHashes := whatsmeow.HashPollOptions(options)
+
+	selected := []string{}
+	for _, selectedHash := range selectedHashes {
+		for idx, optionHash := range optionHashes {
+			if bytes.Equal(selectedHash, optionHash) {
+				selected = append(selected, options[idx])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// TgPollIsBridgeable reports whether a poll fits in the limits of a native
+// Telegram poll
+func TgPollIsBridgeable(question string, options []string) bool {
+	if question == "" || len([]rune(question)) > TgPollMaxQuestionLength {
+		return false
+	}
+	if len(options) < 2 || len(options) > TgPollMaxOptions {
+		return false
+	}
+	for _, option := range options {
+		if option == "" || len([]rune(option)) > TgPollMaxOptionLength {
+			return false
+		}
+	}
+	return true
+}
+
+func TgMakePollTallyText(pollPair database.PollPair, votes []database.PollVote) string {
+	var (
+		options = pollPair.OptionNames()
+		voters  = make(map[string][]string)
+		total   = 0
+	)
+
+	for _, vote := range votes {
+		selected := vote.OptionNames()
+		if len(selected) == 0 {
+			continue
+		}
+		total += 1
+
+		voterName := vote.VoterId
+		if voterJID, ok := WaParseJID(vote.VoterId); ok {
+			voterName = WaGetContactName(voterJID)
+		}
+		for _, option := range selected {
+			voters[option] = append(voters[option], voterName)
+		}
+	}
+
+	tallyText := fmt.Sprintf("📊 <b>WhatsApp votes</b> (%d voters)\n\n", total)
+	for optionNum, option := range options {
+		tallyText += fmt.Sprintf("%v. %s — <b>%d</b>", optionNum+1, html.EscapeString(option), len(voters[option]))
+		if len(voters[option]) > 0 {
+			tallyText += fmt.Sprintf("\n    <i>%s</i>", html.EscapeString(strings.Join(voters[option], ", ")))
+		}
+		tallyText += "\n"
+	}
+
+	// Only the start is kept when there are too many voters to list
+	return TgSplitHTML(tallyText, 4000)[0]
+}
+
+// TgUpdatePollTally sends or edits the running tally of WhatsApp votes,
+// posted as a reply to the bridged poll in its topic
+func TgUpdatePollTally(pollPair database.PollPair) error {
+	tgBot := state.State.TelegramBot
+
+	votes, err := database.PollVoteGetAll(pollPair.ID, pollPair.WaChatId)
+	if err != nil {
+		return err
+	}
+	tallyText := TgMakePollTallyText(pollPair, votes)
+
+	if pollPair.TallyMsgId != 0 {
+		_, _, err = tgBot.EditMessageText(tallyText, &gotgbot.EditMessageTextOpts{
+			ChatId:    pollPair.TgChatId,
+			MessageId: pollPair.TallyMsgId,
+		})
+		if err == nil || strings.Contains(err.Error(), "message is not modified") {
+			return nil
+		}
+	}
+
+	sentMsg, err := tgBot.SendMessage(pollPair.TgChatId, tallyText, &gotgbot.SendMessageOpts{
+		MessageThreadId:     pollPair.TgThreadId,
+		ReplyParameters:     TgMakeReplyParameters(pollPair.TgMsgId, 0),
+		DisableNotification: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	return database.PollPairSetTallyMsgId(pollPair.ID, pollPair.WaChatId, sentMsg.MessageId)
+}
+
+// WaPollMessageInfo rebuilds the minimal message info of a poll needed to
+// encrypt votes for it
+func WaPollMessageInfo(pollPair database.PollPair) (waTypes.MessageInfo, error) {
+	waClient := state.State.WhatsAppClient()
+
+	chatJID, ok := WaParseJID(pollPair.WaChatId)
+	if !ok {
+		return waTypes.MessageInfo{}, fmt.Errorf("invalid chat JID stored for poll: %s", pollPair.WaChatId)
+	}
+	senderJID, ok := WaParseJID(pollPair.WaSenderId)
+	if !ok {
+		return waTypes.MessageInfo{}, fmt.Errorf("invalid sender JID stored for poll: %s", pollPair.WaSenderId)
+	}
+
+	return waTypes.MessageInfo{
+		MessageSource: waTypes.MessageSource{
+			Chat:     chatJID,
+			Sender:   senderJID,
+			IsFromMe: senderJID.User == waClient.Store.ID.User || senderJID.User == waClient.Store.GetLID().User,
+			IsGroup:  chatJID.Server == waTypes.GroupServer,
+		},
+		ID: pollPair.ID,
+	}, nil
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"watgbridge/database"
+	"watgbridge/state"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// TgAllowedReactions is the set of emojis which can be used with
+// setMessageReaction, as listed in the Bot API documentation
+var TgAllowedReactions = map[string]struct{}{
+	"❤": {}, "👍": {}, "👎": {}, "🔥": {}, "🥰": {}, "👏": {}, "😁": {}, "🤔": {}, "🤯": {}, "😱": {},
+	"🤬": {}, "😢": {}, "🎉": {}, "🤩": {}, "🤮": {}, "💩": {}, "🙏": {}, "👌": {}, "🕊": {}, "🤡": {},
+	"🥱": {}, "🥴": {}, "😍": {}, "🐳": {}, "❤‍🔥": {}, "🌚": {}, "🌭": {}, "💯": {}, "🤣": {}, "⚡": {},
+	"🍌": {}, "🏆": {}, "💔": {}, "🤨": {}, "😐": {}, "🍓": {}, "🍾": {}, "💋": {}, "🖕": {}, "😈": {},
+	"😴": {}, "😭": {}, "🤓": {}, "👻": {}, "👨‍💻": {}, "👀": {}, "🎃": {}, "🙈": {}, "😇": {}, "😨": {},
+	"🤝": {}, "✍": {}, "🤗": {}, "🫡": {}, "🎅": {}, "🎄": {}, "☃": {}, "💅": {}, "🤪": {}, "🗿": {},
+	"🆒": {}, "💘": {}, "🙉": {}, "🦄": {}, "😘": {}, "💊": {}, "🙊": {}, "😎": {}, "👾": {}, "🤷‍♂": {},
+	"🤷": {}, "🤷‍♀": {}, "😡": {},
+}
+
+// TgNormalizeReactionEmoji strips the variation selectors and skin tone
+// modifiers WhatsApp adds to emojis, which Telegram does not accept in
+// reactions
+func TgNormalizeReactionEmoji(emoji string) string {
+	return strings.Map(func(r rune) rune {
+		if r == 0xFE0F || (r >= 0x1F3FB && r <= 0x1F3FF) {
+			return -1
+		}
+		return r
+	}, emoji)
+}
+
+// tgPickNativeReaction returns the allowed emoji used by most people, the
+// latest one winning ties, as bots can only set a single reaction
+func tgPickNativeReaction(reactions []database.MessageReaction) string {
+	var (
+		counts   = make(map[string]int)
+		selected string
+	)
+	for _, reaction := range reactions {
+		emoji := TgNormalizeReactionEmoji(reaction.Emoji)
+		if _, found := TgAllowedReactions[emoji]; !found {
+			continue
+		}
+		counts[emoji] += 1
+		if counts[emoji] >= counts[selected] {
+			selected = emoji
+		}
+	}
+	return selected
+}
+
+func TgMakeReactionSummaryText(reactions []database.MessageReaction) string {
+	var (
+		waClient = state.State.WhatsAppClient()
+		emojis   []string
+		reactors = make(map[string][]string)
+	)
+
+	for _, reaction := range reactions {
+		reactorName := reaction.ReactorId
+		if reactorJID, ok := WaParseJID(reaction.ReactorId); ok {
+			if reactorJID.User == waClient.Store.ID.User {
+				reactorName = "You"
+			} else {
+				reactorName = WaGetContactName(reactorJID)
+			}
+		}
+		if _, found := reactors[reaction.Emoji]; !found {
+			emojis = append(emojis, reaction.Emoji)
+		}
+		reactors[reaction.Emoji] = append(reactors[reaction.Emoji], reactorName)
+	}
+
+	summaryText := "<b>Reactions</b>\n"
+	for _, emoji := range emojis {
+		summaryText += fmt.Sprintf("%s — <i>%s</i>\n",
+			html.EscapeString(emoji), html.EscapeString(strings.Join(reactors[emoji], ", ")))
+	}
+
+	// Only the start is kept when there are too many reactors to list
+	return TgSplitHTML(summaryText, 4000)[0]
+}
+
+// tgReactionShownNatively tells whether the native reaction alone shows the
+// reactions, which is the case when everyone used the same allowed emoji
+func tgReactionShownNatively(reactions []database.MessageReaction, nativeEmoji string) bool {
+	if nativeEmoji == "" {
+		return false
+	}
+	for _, reaction := range reactions {
+		if TgNormalizeReactionEmoji(reaction.Emoji) != nativeEmoji {
+			return false
+		}
+	}
+	return true
+}
+
+// tgBotReactsToOwnMessages tells whether the bot uses its reaction on the
+// messages sent from Telegram, for the emoji confirmations, the outbox
+// markers or the reaction once everyone read them
+func tgBotReactsToOwnMessages() bool {
+	cfg := state.State.Config
+	return cfg.Telegram.ConfirmationType == "emoji" || cfg.Telegram.AutoReactWhenAllRead
+}
+
+// TgSyncWaReactions mirrors the stored WhatsApp reactions of a message to
+// its bridged Telegram message. The most common emoji is set as a native
+// reaction, and a single summary reply listing everyone is kept up to date
+// when the native reaction cannot show them. Bots can only set one reaction,
+// so the reactions to own messages are only summarized when the bot already
+// reacts to them.
+func TgSyncWaReactions(waMsgId, waChatId string, fromMe bool, tgChatId, tgThreadId, tgMsgId int64) error {
+	tgBot := state.State.TelegramBot
+
+	reactions, err := database.MsgReactionGetAll(waMsgId, waChatId)
+	if err != nil {
+		return err
+	}
+
+	shownNatively := false
+	if !fromMe || !tgBotReactsToOwnMessages() {
+		nativeReaction := []gotgbot.ReactionType{}
+		nativeEmoji := tgPickNativeReaction(reactions)
+		if nativeEmoji != "" {
+			nativeReaction = append(nativeReaction, gotgbot.ReactionTypeEmoji{Emoji: nativeEmoji})
+		}
+		_, err = tgBot.SetMessageReaction(tgChatId, tgMsgId, &gotgbot.SetMessageReactionOpts{
+			Reaction: nativeReaction,
+		})
+		shownNatively = err == nil && tgReactionShownNatively(reactions, nativeEmoji)
+	}
+
+	summary, summaryFound, err := database.ReactionSummaryGet(waMsgId, waChatId)
+	if err != nil {
+		return err
+	}
+
+	needsSummary := len(reactions) > 0 && !shownNatively
+
+	if !needsSummary {
+		if summaryFound {
+			tgBot.DeleteMessage(summary.TgChatId, summary.SummaryMsgId, &gotgbot.DeleteMessageOpts{})
+			return database.ReactionSummaryDelete(waMsgId, waChatId)
+		}
+		return nil
+	}
+
+	summaryText := TgMakeReactionSummaryText(reactions)
+
+	if summaryFound {
+		_, _, err = tgBot.EditMessageText(summaryText, &gotgbot.EditMessageTextOpts{
+			ChatId:    summary.TgChatId,
+			MessageId: summary.SummaryMsgId,
+		})
+		if err == nil || strings.Contains(err.Error(), "message is not modified") {
+			return nil
+		}
+	}
+
+	sentMsg, err := tgBot.SendMessage(tgChatId, summaryText, &gotgbot.SendMessageOpts{
+		MessageThreadId:     tgThreadId,
+		ReplyParameters:     TgMakeReplyParameters(tgMsgId, 0),
+		DisableNotification: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	return database.ReactionSummarySet(waMsgId, waChatId, tgChatId, sentMsg.MessageId)
+}
+
+// WaReactionFromTg returns the emoji to react with on WhatsApp for a list of
+// Telegram reactions, or an empty string which revokes the reaction. Custom
+// and paid reactions have no WhatsApp equivalent and are skipped.
+func WaReactionFromTg(reactions []gotgbot.ReactionType) string {
+	for _, reaction := range reactions {
+		if emojiReaction, ok := reaction.(gotgbot.ReactionTypeEmoji); ok {
+			if emojiReaction.Emoji == "❤" {
+				// WhatsApp shows the bare heart as a plain text symbol
+				return "❤️"
+			}
+			return emojiReaction.Emoji
+		}
+	}
+	return ""
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"testing"
+
+	"watgbridge/database"
+)
+
+func TestTgReactionShownNatively(t *testing.T) {
+	makeReactions := func(emojis ...string) []database.MessageReaction {
+		var reactions []database.MessageReaction
+		for _, emoji := range emojis {
+			reactions = append(reactions, database.MessageReaction{Emoji: emoji})
+		}
+		return reactions
+	}
+
+	tests := []struct {
+		name      string
+		reactions []database.MessageReaction
+		expected  bool
+	}{
+		{"no reactions", makeReactions(), false},
+		{"single allowed emoji", makeReactions("👍"), true},
+		{"same emoji from several people", makeReactions("👍", "👍", "👍"), true},
+		{"skin tones are the same emoji", makeReactions("👍🏽", "👍"), true},
+		{"different emojis", makeReactions("👍", "❤"), false},
+		{"emoji which is not allowed", makeReactions("🦀"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nativeEmoji := tgPickNativeReaction(test.reactions)
+			if got := tgReactionShownNatively(test.reactions, nativeEmoji); got != test.expected {
+				t.Errorf("tgReactionShownNatively() = %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
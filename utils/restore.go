@@ -0,0 +1,500 @@
+package utils
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"watgbridge/database"
+	"watgbridge/state"
+
+	_ "github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// A table which has to be in each database of a backup for it to be restored
+var restoreRequiredTables = map[string]string{
+	backupMainDatabase:  "chat_thread_pairs",
+	backupLoginDatabase: "whatsmeow_device",
+	backupMainDump:      "chat_thread_pairs",
+	backupLoginDump:     "whatsmeow_device",
+}
+
+// Number of rows of the bridge database loaded at once from a dump
+const restoreDumpBatchSize = 1000
+
+// extractDatabaseBackup checks that a backup archive only holds databases
+// which are backed up with the current config, extracts them into a new
+// temporary directory and checks their integrity. It returns the directory,
+// to be removed by the caller, the extracted SQLite database of each target
+// path and the extracted directory of each logical dump.
+func extractDatabaseBackup(zipPath string) (string, map[string]string, map[string]string, error) {
+	targets := sqliteDatabasePaths()
+
+	dumpTargets := map[string]bool{}
+	for _, dump := range collectDatabaseDumps(nil) {
+		dumpTargets[dump.Dir] = true
+	}
+
+	tempDir, err := os.MkdirTemp("", "watgbridge-restore-*")
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	fail := func(err error) (string, map[string]string, map[string]string, error) {
+		os.RemoveAll(tempDir)
+		return "", nil, nil, err
+	}
+
+	zipPath, err = decryptBackupFile(zipPath, tempDir)
+	if err != nil {
+		return fail(err)
+	}
+
+	archive, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fail(fmt.Errorf("not a valid zip archive : %s", err))
+	}
+	defer archive.Close()
+
+	var (
+		extracted = map[string]string{}
+		dumps     = map[string]string{}
+	)
+	for _, file := range archive.File {
+		if isDump, err := extractDumpFile(file, tempDir, dumps); isDump {
+			if err != nil {
+				return fail(err)
+			}
+			if dumpName, _, _ := strings.Cut(file.Name, "/"); !dumpTargets[dumpName] {
+				return fail(fmt.Errorf("unexpected dump '%s' in the archive, its database is stored in SQLite in the config", dumpName))
+			}
+			continue
+		}
+
+		displayName := strings.TrimSuffix(strings.TrimSuffix(file.Name, "-wal"), "-shm")
+		if _, found := targets[displayName]; !found {
+			return fail(fmt.Errorf("unexpected file '%s' in the archive, it is not a backup or its database is not SQLite in the config", file.Name))
+		}
+
+		if err = extractZipFile(file, filepath.Join(tempDir, file.Name)); err != nil {
+			return fail(err)
+		}
+		if displayName == file.Name {
+			extracted[targets[displayName]] = filepath.Join(tempDir, file.Name)
+		}
+	}
+
+	if len(extracted) == 0 && len(dumps) == 0 {
+		return fail(errors.New("the archive does not contain any database"))
+	}
+
+	for displayName, target := range targets {
+		dbPath, found := extracted[target]
+		if !found {
+			continue
+		}
+		if err = checkSQLiteDatabase(dbPath, restoreRequiredTables[displayName]); err != nil {
+			return fail(fmt.Errorf("%s is not valid : %s", displayName, err))
+		}
+	}
+
+	for dumpName, dumpDir := range dumps {
+		if err = checkDatabaseDump(dumpDir, restoreRequiredTables[dumpName]); err != nil {
+			return fail(fmt.Errorf("the dump %s is not valid : %s", dumpName, err))
+		}
+	}
+
+	return tempDir, extracted, dumps, nil
+}
+
+// extractDumpFile extracts a file of a zip which is part of a logical dump
+// into the directory of the dump under dir, recording it in dumps. It returns
+// false for the other files.
+func extractDumpFile(file *zip.File, dir string, dumps map[string]string) (bool, error) {
+	dumpName, name, found := strings.Cut(file.Name, "/")
+	if !found || (dumpName != backupMainDump && dumpName != backupLoginDump) {
+		return false, nil
+	}
+
+	// Only the files written by a dump are accepted, with no directories
+	// which could lead outside of it
+	if name != database.DumpManifestFile && (!strings.HasSuffix(name, ".jsonl") || strings.ContainsAny(name, `/\`)) {
+		return true, fmt.Errorf("unexpected file '%s' in the archive", file.Name)
+	}
+
+	dumpDir := filepath.Join(dir, dumpName)
+	if err := os.MkdirAll(dumpDir, 0o700); err != nil {
+		return true, err
+	}
+	dumps[dumpName] = dumpDir
+
+	return true, extractZipFile(file, filepath.Join(dumpDir, name))
+}
+
+// checkDatabaseDump checks that an extracted dump can be loaded and that it
+// has the given table
+func checkDatabaseDump(dumpDir, requiredTable string) error {
+	manifest, err := database.ReadDumpManifest(dumpDir)
+	if err != nil {
+		return err
+	}
+	for _, table := range manifest.Tables {
+		if table.Name == requiredTable {
+			return nil
+		}
+	}
+	return fmt.Errorf("the table '%s' is missing", requiredTable)
+}
+
+// decryptBackupFile decrypts an encrypted backup into dir with the passphrase
+// of the config, returning the path of the zip. Other files are returned as
+// they are.
+func decryptBackupFile(backupPath, dir string) (string, error) {
+	backupFile, err := os.Open(backupPath)
+	if err != nil {
+		return "", err
+	}
+	defer backupFile.Close()
+
+	backupReader := bufio.NewReader(backupFile)
+	magic, _ := backupReader.Peek(len(encryptedBackupMagic))
+	if !IsEncryptedBackup(magic) {
+		return backupPath, nil
+	}
+
+	passphrase := state.State.Config.Backup.Passphrase
+	if passphrase == "" {
+		return "", errors.New("the backup is encrypted but no backup.passphrase is set in the config")
+	}
+
+	zipPath := filepath.Join(dir, "backup.zip")
+	return zipPath, DecryptBackupToFile(backupReader, zipPath, passphrase)
+}
+
+// DecryptBackupToFile decrypts a backup encrypted with the passphrase into a
+// new file, which is removed again if it fails
+func DecryptBackupToFile(src io.Reader, outputPath, passphrase string) error {
+	plaintext, err := DecryptBackup(src, passphrase)
+	if err != nil {
+		return err
+	}
+
+	output, err := os.OpenFile(outputPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(output, plaintext)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+	}
+	return err
+}
+
+func extractZipFile(file *zip.File, destination string) error {
+	reader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	output, err := os.OpenFile(destination, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(output, reader); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// checkSQLiteDatabase opens an extracted database to check its integrity and
+// that it has the given table. The write-ahead log next to it, if any, is
+// merged into it on the way.
+func checkSQLiteDatabase(dbPath, requiredTable string) error {
+	header := make([]byte, 16)
+	file, err := os.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(file, header)
+	file.Close()
+	if err != nil || !bytes.Equal(header, []byte("SQLite format 3\x00")) {
+		return errors.New("not an SQLite database")
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err = db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return err
+	} else if result != "ok" {
+		return fmt.Errorf("integrity check failed : %s", result)
+	}
+
+	var tables int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", requiredTable).Scan(&tables)
+	if err != nil {
+		return err
+	} else if tables == 0 {
+		return fmt.Errorf("the table '%s' is missing", requiredTable)
+	}
+
+	_, err = db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
+// ValidateDatabaseBackup checks that the archive at zipPath is a backup which
+// can be restored with the current config
+func ValidateDatabaseBackup(zipPath string) error {
+	tempDir, _, _, err := extractDatabaseBackup(zipPath)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(tempDir)
+}
+
+// RestoreDatabaseBackup puts the databases of a backup archive in place of the
+// current ones. The SQLite files are moved aside next to them with a
+// .before-restore suffix, and the databases loaded from a logical dump are
+// first dumped into a zip of the same name next to the config. The bridge
+// has to be stopped, and restarted afterwards. It returns the paths the
+// current databases were kept at.
+func RestoreDatabaseBackup(zipPath string) ([]string, error) {
+	logger := state.State.Logger
+
+	tempDir, extracted, dumps, err := extractDatabaseBackup(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		suffix = ".before-restore-" + time.Now().Format("20060102-150405")
+		kept   []string
+		placed []string
+
+		mainDB        *gorm.DB
+		keptDump      string
+		previousDumps map[string]string
+	)
+
+	if _, found := dumps[backupMainDump]; found {
+		if mainDB, err = database.ConnectWith(state.State.Config.Database); err != nil {
+			return nil, fmt.Errorf("failed to connect to the database : %s", err)
+		}
+		if sqlDB, err := mainDB.DB(); err == nil {
+			defer sqlDB.Close()
+		}
+	}
+
+	// Everything done so far is undone if a database cannot be restored
+	rollback := func() {
+		for _, target := range placed {
+			os.Remove(target)
+		}
+		for _, keptFile := range kept {
+			if err := os.Rename(keptFile, strings.TrimSuffix(keptFile, suffix)); err != nil {
+				logger.Error("failed to move back database file after a failed restore",
+					zap.String("path", keptFile),
+					zap.Error(err),
+				)
+			}
+		}
+		if previousDumps == nil {
+			return
+		}
+		if err := loadDatabaseDumps(previousDumps, mainDB); err != nil {
+			logger.Error("failed to load back the databases after a failed restore",
+				zap.String("path", keptDump),
+				zap.Error(err),
+			)
+			return
+		}
+		os.Remove(keptDump)
+	}
+
+	if len(dumps) > 0 {
+		keptDump = filepath.Join(filepath.Dir(state.State.Config.Path), "watgbridge-dump"+suffix+".zip")
+		previousDumps, err = dumpCurrentDatabases(dumps, mainDB, keptDump, filepath.Join(tempDir, "previous"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to dump the current databases : %s", err)
+		}
+		if err = loadDatabaseDumps(dumps, mainDB); err != nil {
+			rollback()
+			return nil, err
+		}
+	}
+
+	for target, dbPath := range extracted {
+		for _, ext := range []string{"", "-wal", "-shm"} {
+			if _, err := os.Stat(target + ext); err != nil {
+				continue
+			}
+			if err := os.Rename(target+ext, target+ext+suffix); err != nil {
+				rollback()
+				return nil, err
+			}
+			kept = append(kept, target+ext+suffix)
+		}
+
+		if err := copyFile(dbPath, target); err != nil {
+			os.Remove(target)
+			rollback()
+			return nil, fmt.Errorf("failed to put %s in place : %s", target, err)
+		}
+		placed = append(placed, target)
+	}
+
+	if keptDump != "" {
+		kept = append(kept, keptDump)
+	}
+	return kept, nil
+}
+
+// dumpCurrentDatabases writes a logical dump of the current databases which
+// are about to be replaced by the dumps into keptZip, and extracts it into
+// dir for them to be loaded back if the restore fails
+func dumpCurrentDatabases(dumps map[string]string, mainDB *gorm.DB, keptZip, dir string) (map[string]string, error) {
+	var current []backupDump
+	for _, dump := range collectDatabaseDumps(mainDB) {
+		if _, found := dumps[dump.Dir]; found {
+			current = append(current, dump)
+		}
+	}
+
+	backupZip, _, err := makeBackupZip(nil, current, time.Now().UTC(), "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = backupZip.Close()
+		_ = os.Remove(backupZip.Name())
+	}()
+
+	if err = copyFile(backupZip.Name(), keptZip); err != nil {
+		os.Remove(keptZip)
+		return nil, err
+	}
+
+	archive, err := zip.OpenReader(keptZip)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	previous := map[string]string{}
+	for _, file := range archive.File {
+		if _, err = extractDumpFile(file, dir, previous); err != nil {
+			return nil, err
+		}
+	}
+	return previous, nil
+}
+
+// loadDatabaseDumps replaces the content of the databases of the config with
+// the extracted dumps, mainDB being the database of the bridge
+func loadDatabaseDumps(dumps map[string]string, mainDB *gorm.DB) error {
+	var (
+		loginDB = state.State.Config.WhatsApp.LoginDatabase
+		driver  = strings.TrimSpace(loginDB.Type)
+	)
+
+	for dumpName, dumpDir := range dumps {
+		var err error
+		switch dumpName {
+		case backupMainDump:
+			if err = database.ClearBridgeDatabase(mainDB); err == nil {
+				err = database.LoadBridgeDump(mainDB, dumpDir, restoreDumpBatchSize)
+			}
+		case backupLoginDump:
+			if err = database.ClearStoreDatabase(driver, loginDB.URL); err == nil {
+				err = database.LoadStoreDump(dumpDir, driver, loginDB.URL)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load the dump %s : %s", dumpName, err)
+		}
+	}
+	return nil
+}
+
+func copyFile(source, destination string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.OpenFile(destination, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(output, input); err != nil {
+		output.Close()
+		return err
+	}
+	if err = output.Sync(); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// RestartBridge replaces the running process with a new one of the bridge,
+// using the same config file. The new process replies to the given message
+// once it started, unless the chat ID is zero.
+func RestartBridge(notifyChatId, notifyMsgId int64) error {
+	if notifyChatId != 0 {
+		os.Setenv("WATG_IS_RESTARTED", "1")
+		os.Setenv("WATG_CHAT_ID", fmt.Sprint(notifyChatId))
+		os.Setenv("WATG_MESSAGE_ID", fmt.Sprint(notifyMsgId))
+	}
+
+	return syscall.Exec(path.Join(".", "watgbridge"), []string{"watgbridge", state.State.Config.Path}, os.Environ())
+}
+
+// Kept open for the lock to last as long as the process
+var bridgeLockFile *os.File
+
+// LockBridge takes the lock file next to the config, which tells that its
+// databases are in use, failing if another process holds it. The lock is
+// released when the process exits or is replaced by RestartBridge.
+func LockBridge() error {
+	lockPath := state.State.Config.Path + ".lock"
+
+	lockFile, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", lockPath, err)
+	}
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		lockFile.Close()
+		return fmt.Errorf("the bridge is running with %s, stop it first", state.State.Config.Path)
+	} else if err != nil {
+		lockFile.Close()
+		return fmt.Errorf("failed to lock %s: %w", lockPath, err)
+	}
+
+	bridgeLockFile = lockFile
+	return nil
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractDumpFile(t *testing.T) {
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	names := []string{
+		"main-database/manifest.json",
+		"main-database/chat_thread_pairs.jsonl",
+		"main-database.db",
+		"whatsapp-login/../../outside.jsonl",
+		"whatsapp-login/notes.txt",
+	}
+	for _, name := range names {
+		if _, err := zipWriter.Create(name); err != nil {
+			t.Fatalf("failed to add %q: %s", name, err)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatalf("failed to close the zip: %s", err)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatalf("failed to read the zip: %s", err)
+	}
+
+	tests := []struct {
+		isDump  bool
+		invalid bool
+	}{
+		{true, false},
+		{true, false},
+		{false, false},
+		{true, true},
+		{true, true},
+	}
+
+	dir := t.TempDir()
+	dumps := map[string]string{}
+	for idx, test := range tests {
+		file := reader.File[idx]
+		isDump, err := extractDumpFile(file, dir, dumps)
+		if isDump != test.isDump || (err != nil) != test.invalid {
+			t.Errorf("extractDumpFile(%q) = %v, %v, expected %v and an error: %v", file.Name, isDump, err, test.isDump, test.invalid)
+		}
+	}
+
+	if len(dumps) != 1 || dumps[backupMainDump] != filepath.Join(dir, backupMainDump) {
+		t.Errorf("extractDumpFile() recorded the dumps %v", dumps)
+	}
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"watgbridge/database"
+	"watgbridge/state"
+
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+var (
+	retentionScheduler *cron.Cron
+
+	lastPruningLock   sync.Mutex
+	lastPruningTime   time.Time
+	lastPruningResult database.PruneResult
+	lastPruningErr    error
+)
+
+// DatabasePruningEnabled tells whether the config sets any retention limit
+func DatabasePruningEnabled() bool {
+	cfg := state.State.Config
+	return cfg.Retention.MaxAgeDays > 0 || cfg.Retention.MaxMessagesPerChat > 0
+}
+
+// RunDatabasePruningOnce deletes the message pairs, receipts and stored
+// history messages which are past the configured retention, along with the
+// reactions and polls of the pruned pairs, then optimizes the database if
+// enabled
+func RunDatabasePruningOnce() (database.PruneResult, error) {
+	var (
+		cfg        = state.State.Config
+		maxAge     = time.Duration(cfg.Retention.MaxAgeDays) * 24 * time.Hour
+		maxPerChat = int(cfg.Retention.MaxMessagesPerChat)
+		result     database.PruneResult
+		err        error
+	)
+
+	defer func() {
+		lastPruningLock.Lock()
+		lastPruningTime = time.Now().UTC()
+		lastPruningResult = result
+		lastPruningErr = err
+		lastPruningLock.Unlock()
+	}()
+
+	result.MsgIdPairs, err = database.MsgIdPrunePairs(maxAge, maxPerChat)
+	if err != nil {
+		return result, err
+	}
+
+	result.MessageReceipts, err = database.MsgReceiptPrune(maxAge)
+	if err != nil {
+		return result, err
+	}
+
+	result.Reactions, err = database.MsgReactionPrune()
+	if err != nil {
+		return result, err
+	}
+
+	result.Polls, err = database.PollPairPrune()
+	if err != nil {
+		return result, err
+	}
+
+	result.HistoryMessages, err = database.HistoryMessagePrune(maxAge)
+	if err != nil {
+		return result, err
+	}
+
+	if cfg.Retention.Vacuum {
+		err = database.Optimize()
+	}
+	return result, err
+}
+
+// LastDatabasePruning returns when the last pruning ran, zero if it never
+// did, and what it deleted
+func LastDatabasePruning() (time.Time, database.PruneResult, error) {
+	lastPruningLock.Lock()
+	defer lastPruningLock.Unlock()
+
+	return lastPruningTime, lastPruningResult, lastPruningErr
+}
+
+func StartAutomaticDatabasePruning() {
+	cfg := state.State.Config
+	logger := state.State.Logger
+
+	if !DatabasePruningEnabled() {
+		logger.Info("automatic database pruning is disabled")
+		return
+	}
+
+	schedule := strings.TrimSpace(cfg.Retention.CronSchedule)
+	if schedule == "" {
+		schedule = "0 4 * * *"
+	}
+	cronParser := cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+	if _, err := cronParser.Parse(schedule); err != nil {
+		logger.Error("invalid retention cron schedule",
+			zap.String("cron_schedule", schedule),
+			zap.Error(err),
+		)
+		return
+	}
+
+	logger.Info("automatic database pruning enabled",
+		zap.Uint32("max_age_days", cfg.Retention.MaxAgeDays),
+		zap.Uint32("max_messages_per_chat", cfg.Retention.MaxMessagesPerChat),
+		zap.String("cron_schedule", schedule),
+	)
+
+	cronScheduler := cron.New(cron.WithLocation(state.State.LocalLocation))
+	retentionScheduler = cronScheduler
+
+	_, err := cronScheduler.AddFunc(schedule, func() {
+		startTime := time.Now()
+		result, err := RunDatabasePruningOnce()
+		if err != nil {
+			logger.Error("failed to prune database", zap.Error(err))
+			return
+		}
+		logger.Info("pruned database",
+			zap.Int64("msg_id_pairs", result.MsgIdPairs),
+			zap.Int64("message_receipts", result.MessageReceipts),
+			zap.Int64("reactions", result.Reactions),
+			zap.Int64("polls", result.Polls),
+			zap.Int64("history_messages", result.HistoryMessages),
+			zap.Duration("duration", time.Since(startTime)),
+		)
+	})
+	if err != nil {
+		logger.Error("failed to register retention cron schedule",
+			zap.String("cron_schedule", schedule),
+			zap.Error(err),
+		)
+		return
+	}
+
+	cronScheduler.Start()
+}
+
+// StopAutomaticDatabasePruning stops scheduling pruning, the returned
+// context is done once a pruning which is already running finishes
+func StopAutomaticDatabasePruning() context.Context {
+	if retentionScheduler == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	return retentionScheduler.Stop()
+}
@@ -13,6 +13,7 @@ import (
 	"os/exec"
 	"path/filepath"
 
+	"watgbridge/metrics"
 	"watgbridge/state"
 
 	"github.com/watgbridge/tgsconverter/libtgsconverter"
@@ -20,7 +21,17 @@ import (
 	"go.uber.org/zap"
 )
 
-func TGSConvertToWebp(tgsStickerData []byte, updateId int64) ([]byte, error) {
+// countConversionFailure is deferred by the conversions to count them in the
+// metrics when they return an error
+func countConversionFailure(conversion string, err *error) {
+	if *err != nil {
+		metrics.ConversionFailures.Inc(conversion)
+	}
+}
+
+func TGSConvertToWebp(tgsStickerData []byte, updateId int64) (_ []byte, err error) {
+	defer countConversionFailure("tgs_to_webp", &err)
+
 	logger := state.State.Logger
 	defer logger.Sync()
 	opt := libtgsconverter.NewConverterOptions()
@@ -52,7 +63,9 @@ func TGSConvertToWebp(tgsStickerData []byte, updateId int64) ([]byte, error) {
 	return nil, fmt.Errorf("sticker has a lot of data which cannot be handled by WhatsApp")
 }
 
-func WebmConvertToWebp(webmStickerData []byte, scale, pad string, updateId int64) ([]byte, error) {
+func WebmConvertToWebp(webmStickerData []byte, scale, pad string, updateId int64) (_ []byte, err error) {
+	defer countConversionFailure("webm_to_webp", &err)
+
 	logger := state.State.Logger
 	defer logger.Sync()
 
@@ -85,7 +98,9 @@ func WebmConvertToWebp(webmStickerData []byte, scale, pad string, updateId int64
 	return outputBuf.Bytes(), nil
 }
 
-func WebpImagePad(inputData []byte, wPad, hPad int, updateId int64) ([]byte, error) {
+func WebpImagePad(inputData []byte, wPad, hPad int, updateId int64) (_ []byte, err error) {
+	defer countConversionFailure("webp_pad", &err)
+
 	inputImage, err := webp.DecodeRGBA(inputData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode web image: %w", err)
@@ -114,7 +129,9 @@ func WebpImagePad(inputData []byte, wPad, hPad int, updateId int64) ([]byte, err
 	return outputBytes, nil
 }
 
-func AnimatedWebpConvertToWebm(inputData []byte, updateId string) ([]byte, error) {
+func AnimatedWebpConvertToWebm(inputData []byte, updateId string) (_ []byte, err error) {
+	defer countConversionFailure("webp_to_webm", &err)
+
 	var (
 		logger = state.State.Logger
 
@@ -203,7 +220,9 @@ func AnimatedWebpConvertToWebm(inputData []byte, updateId string) ([]byte, error
 }
 
 // Fallback function to convert to GIF if WEBM conversion fails
-func AnimatedWebpConvertToGif(inputData []byte, updateId string) ([]byte, error) {
+func AnimatedWebpConvertToGif(inputData []byte, updateId string) (_ []byte, err error) {
+	defer countConversionFailure("webp_to_gif", &err)
+
 	logger := state.State.Logger
 	defer logger.Sync()
 
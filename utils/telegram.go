@@ -10,10 +10,12 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
 	"watgbridge/database"
+	"watgbridge/metrics"
 	"watgbridge/state"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
@@ -54,6 +56,13 @@ func TgRegisterBotCommands(b *gotgbot.Bot, commands ...gotgbot.BotCommand) error
 	return err
 }
 
+// Topics created with the quick actions button enabled, by thread ID, whose
+// first bridged message is still to be given the button
+var (
+	tgQuickActionsLock    sync.Mutex
+	tgQuickActionsPending = make(map[int64]string)
+)
+
 func TgGetOrMakeThreadFromWa_String(waChatIdString string, tgChatId int64, threadName string) (int64, error) {
 	threadId, threadFound, err := database.ChatThreadGetTgFromWa(waChatIdString, tgChatId)
 	if err != nil {
@@ -70,15 +79,59 @@ func TgGetOrMakeThreadFromWa_String(waChatIdString string, tgChatId int64, threa
 		if err != nil {
 			return newForum.MessageThreadId, err
 		}
+		if state.State.Config.Telegram.QuickActionsButton &&
+			strings.ContainsRune(waChatIdString, '@') && waChatIdString != "status@broadcast" {
+			tgQuickActionsLock.Lock()
+			tgQuickActionsPending[newForum.MessageThreadId] = waChatIdString
+			tgQuickActionsLock.Unlock()
+		}
 		return newForum.MessageThreadId, nil
 	}
 
 	return threadId, nil
 }
 
+// TgAttachQuickActionsButton adds the button opening the actions of a chat
+// to the first message bridged into the topic created for it. Items of an
+// album cannot have a keyboard, the button then goes to the next message.
+func TgAttachQuickActionsButton(msg *gotgbot.Message) {
+	if msg.MediaGroupId != "" {
+		return
+	}
+
+	tgQuickActionsLock.Lock()
+	waChatIdString, pending := tgQuickActionsPending[msg.MessageThreadId]
+	delete(tgQuickActionsPending, msg.MessageThreadId)
+	tgQuickActionsLock.Unlock()
+	if !pending {
+		return
+	}
+
+	var keyboard gotgbot.InlineKeyboardMarkup
+	if msg.ReplyMarkup != nil {
+		keyboard = *msg.ReplyMarkup
+	}
+	keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []gotgbot.InlineKeyboardButton{{
+		Text:         "⚡ Actions",
+		CallbackData: "actions_menu_" + waChatIdString,
+	}})
+
+	_, _, err := state.State.TelegramBot.EditMessageReplyMarkup(&gotgbot.EditMessageReplyMarkupOpts{
+		ChatId:      msg.Chat.Id,
+		MessageId:   msg.MessageId,
+		ReplyMarkup: keyboard,
+	})
+	if err != nil {
+		state.State.Logger.Warn("failed to add quick actions button",
+			zap.Int64("tg_msg_id", msg.MessageId),
+			zap.Error(err),
+		)
+	}
+}
+
 func TgGetOrMakeThreadFromWa(waChatId waTypes.JID, tgChatId int64, threadName string) (int64, error) {
 	if waChatId.Server == waTypes.HiddenUserServer {
-		waClient := state.State.WhatsAppClient
+		waClient := state.State.WhatsAppClient()
 		pn, err := waClient.Store.LIDs.GetPNForLID(context.Background(), waChatId)
 		if err != nil {
 			return 0, err
@@ -321,17 +374,37 @@ func TgSendErrorById(b *gotgbot.Bot, chatId, threadId int64, eMessage string, e
 	return err
 }
 
-func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
+// tgSaveSentMessage pairs a message sent to WhatsApp with the Telegram one
+// it was bridged from, and archives it
+func tgSaveSentMessage(msgToForward *gotgbot.Message, waChatJID waTypes.JID, sentMsg whatsmeow.SendResponse) error {
+	var (
+		cfg      = state.State.Config
+		waClient = state.State.WhatsAppClient()
+	)
+
+	err := database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
+		cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
+	if err != nil {
+		return err
+	}
+	TgArchiveMessage(msgToForward, sentMsg.ID, waChatJID, sentMsg.Timestamp)
+	return nil
+}
+
+// tgSendToWhatsApp does the actual sending for TgSendToWhatsApp, returning a
+// *waSendError if it failed on the WhatsApp side and can be retried
+func tgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 	msgToForward, msgToReplyTo *gotgbot.Message,
 	waChatJID waTypes.JID, participant, stanzaId, quotedWaChatID string,
-	isReply bool) error {
+	isReply bool, albumId string) error {
 
 	var (
-		cfg      = state.State.Config
 		logger   = state.State.Logger
-		waClient = state.State.WhatsAppClient
+		waClient = state.State.WhatsAppClient()
 		mentions = []string{}
 	)
+	// Read receipts can be set for the chat in /chatsettings
+	cfg, _ := WaChatConfig(waChatJID.String())
 	formattedText := TgMessageTextForWhatsApp(msgToForward)
 
 	var entities []gotgbot.ParsedMessageEntity
@@ -443,7 +516,7 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		uploadedImage, err := waClient.Upload(context.Background(), imageBytes, whatsmeow.MediaImage)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to upload image to WhatsApp", err)
+			return &waSendError{"Failed to upload image to WhatsApp", err}
 		}
 
 		msgToSend := &waE2E.Message{
@@ -472,17 +545,18 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 		if isEphemeral {
 			msgToSend.ImageMessage.ContextInfo.Expiration = &ephemeralTimer
 		}
+		if albumId != "" {
+			msgToSend.MessageContextInfo = waAlbumItemContextInfo(waChatJID, albumId)
+		}
 
 		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to send image to WhatsApp", err)
+			return &waSendError{"Failed to send image to WhatsApp", err}
 		}
 		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
 		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
 
-		err = database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
-			cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
-		if err != nil {
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
 		}
 
@@ -509,7 +583,7 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		uploadedVideo, err := waClient.Upload(context.Background(), videoBytes, whatsmeow.MediaVideo)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to upload video to WhatsApp", err)
+			return &waSendError{"Failed to upload video to WhatsApp", err}
 		}
 
 		msgToSend := &waE2E.Message{
@@ -539,17 +613,18 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 		if isEphemeral {
 			msgToSend.VideoMessage.ContextInfo.Expiration = &ephemeralTimer
 		}
+		if albumId != "" {
+			msgToSend.MessageContextInfo = waAlbumItemContextInfo(waChatJID, albumId)
+		}
 
 		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to send video to WhatsApp", err)
+			return &waSendError{"Failed to send video to WhatsApp", err}
 		}
 		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
 		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
 
-		err = database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
-			cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
-		if err != nil {
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
 		}
 	} else if msgToForward.VideoNote != nil {
@@ -575,7 +650,7 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		uploadedVideo, err := waClient.Upload(context.Background(), videoBytes, whatsmeow.MediaVideo)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to upload video note to WhatsApp", err)
+			return &waSendError{"Failed to upload video note to WhatsApp", err}
 		}
 
 		msgToSend := &waE2E.Message{
@@ -606,14 +681,12 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to send video note to WhatsApp", err)
+			return &waSendError{"Failed to send video note to WhatsApp", err}
 		}
 		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
 		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
 
-		err = database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
-			cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
-		if err != nil {
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
 		}
 	} else if msgToForward.Animation != nil {
@@ -639,7 +712,7 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		uploadedAnimation, err := waClient.Upload(context.Background(), animationBytes, whatsmeow.MediaVideo)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to upload animation to WhatsApp", err)
+			return &waSendError{"Failed to upload animation to WhatsApp", err}
 		}
 
 		msgToSend := &waE2E.Message{
@@ -673,14 +746,12 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to send animation to WhatsApp", err)
+			return &waSendError{"Failed to send animation to WhatsApp", err}
 		}
 		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
 		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
 
-		err = database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
-			cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
-		if err != nil {
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
 		}
 	} else if msgToForward.Audio != nil {
@@ -715,7 +786,7 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		uploadedAudio, err := waClient.Upload(context.Background(), convertedAudioBytes, whatsmeow.MediaAudio)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to upload audio to WhatsApp", err)
+			return &waSendError{"Failed to upload audio to WhatsApp", err}
 		}
 
 		msgToSend := &waE2E.Message{
@@ -744,14 +815,12 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to send audio to WhatsApp", err)
+			return &waSendError{"Failed to send audio to WhatsApp", err}
 		}
 		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
 		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
 
-		err = database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
-			cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
-		if err != nil {
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
 		}
 	} else if msgToForward.Voice != nil {
@@ -786,7 +855,7 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		uploadedVoice, err := waClient.Upload(context.Background(), convertedVoiceBytes, whatsmeow.MediaAudio)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to upload voice to WhatsApp", err)
+			return &waSendError{"Failed to upload voice to WhatsApp", err}
 		}
 
 		msgToSend := &waE2E.Message{
@@ -815,14 +884,12 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to send voice to WhatsApp", err)
+			return &waSendError{"Failed to send voice to WhatsApp", err}
 		}
 		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
 		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
 
-		err = database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
-			cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
-		if err != nil {
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
 		}
 	} else if msgToForward.Document != nil {
@@ -848,7 +915,7 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		uploadedDocument, err := waClient.Upload(context.Background(), documentBytes, whatsmeow.MediaDocument)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to upload document to WhatsApp", err)
+			return &waSendError{"Failed to upload document to WhatsApp", err}
 		}
 
 		msgToSend := &waE2E.Message{
@@ -878,14 +945,12 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to send document to WhatsApp", err)
+			return &waSendError{"Failed to send document to WhatsApp", err}
 		}
 		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
 		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
 
-		err = database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
-			cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
-		if err != nil {
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
 		}
 	} else if msgToForward.Sticker != nil {
@@ -952,7 +1017,7 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		uploadedSticker, err := waClient.Upload(context.Background(), stickerBytes, whatsmeow.MediaImage)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to upload sticker to WhatsApp", err)
+			return &waSendError{"Failed to upload sticker to WhatsApp", err}
 		}
 
 		msgToSend := &waE2E.Message{
@@ -981,14 +1046,12 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to send sticker to WhatsApp", err)
+			return &waSendError{"Failed to send sticker to WhatsApp", err}
 		}
 		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
 		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
 
-		err = database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
-			cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
-		if err != nil {
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
 		}
 	} else if msgToForward.Contact != nil {
@@ -1042,14 +1105,12 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to send sticker to WhatsApp", err)
+			return &waSendError{"Failed to send sticker to WhatsApp", err}
 		}
 		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
 		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
 
-		err = database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
-			cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
-		if err != nil {
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
 		}
 
@@ -1060,12 +1121,12 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		msgToSend := &waE2E.Message{}
 		if isLive {
-			// TODO: make this live
 			msgToSend.LiveLocationMessage = &waE2E.LiveLocationMessage{
 				DegreesLatitude:                   &location.Latitude,
 				DegreesLongitude:                  &location.Longitude,
 				AccuracyInMeters:                  proto.Uint32(uint32(location.HorizontalAccuracy)),
 				DegreesClockwiseFromMagneticNorth: proto.Uint32(uint32(location.Heading)),
+				SequenceNumber:                    proto.Int64(1),
 				ContextInfo:                       &waE2E.ContextInfo{},
 			}
 			if isReply {
@@ -1092,17 +1153,65 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to send sticker to WhatsApp", err)
+			return &waSendError{"Failed to send sticker to WhatsApp", err}
 		}
 		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
 		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
 
-		err = database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
-			cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
+			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
+		}
+
+		if isLive {
+			err = database.LiveLocationAddNew(sentMsg.ID, waChatJID.String(), waClient.Store.ID.ToNonAD().String(), 1,
+				location.Latitude, location.Longitude,
+				cfg.Telegram.TargetChatID, msgToForward.MessageThreadId, msgToForward.MessageId, true,
+				TgLiveLocationExpiry(msgToForward))
+			if err != nil {
+				return TgReplyWithErrorByContext(b, c, "Failed to add live location to database", err)
+			}
+		}
+
+	} else if msgToForward.Poll != nil {
+
+		poll := msgToForward.Poll
+
+		options := make([]string, 0, len(poll.Options))
+		for _, option := range poll.Options {
+			options = append(options, option.Text)
+		}
+
+		selectableCount := 1
+		if poll.AllowsMultipleAnswers {
+			selectableCount = 0
+		}
+
+		msgToSend := waClient.BuildPollCreation(poll.Question, options, selectableCount)
+		msgToSend.PollCreationMessage.ContextInfo = &waE2E.ContextInfo{}
+		if isReply {
+			WaSetReplyContext(msgToSend.PollCreationMessage.ContextInfo, stanzaId, participant, replyRemoteJID)
+		}
+		if isEphemeral {
+			msgToSend.PollCreationMessage.ContextInfo.Expiration = &ephemeralTimer
+		}
+
+		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
+			return &waSendError{"Failed to send poll to WhatsApp", err}
+		}
+		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
+		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
+
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
 		}
 
+		err = database.PollPairAddNew(sentMsg.ID, waChatJID.String(), waClient.Store.ID.ToNonAD().String(), options,
+			cfg.Telegram.TargetChatID, msgToForward.MessageThreadId, msgToForward.MessageId, poll.Id)
+		if err != nil {
+			return TgReplyWithErrorByContext(b, c, "Failed to add poll to database", err)
+		}
+
 	} else if msgToForward.Text != "" {
 
 		if emojis := gomoji.CollectAll(msgToForward.Text); isReply && len(emojis) == 1 && gomoji.RemoveEmojis(msgToForward.Text) == "" {
@@ -1118,7 +1227,7 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 				},
 			})
 			if err != nil {
-				return TgReplyWithErrorByContext(b, c, "Failed to send reaction to WhatsApp", err)
+				return &waSendError{"Failed to send reaction to WhatsApp", err}
 			}
 			if cfg.Telegram.ConfirmationType != "none" {
 				msg, err := TgReplyTextByContext(b, c, "Successfully reacted", nil, cfg.Telegram.SilentConfirmation)
@@ -1155,14 +1264,12 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 
 		sentMsg, err := waClient.SendMessage(context.Background(), waChatJID, msgToSend)
 		if err != nil {
-			return TgReplyWithErrorByContext(b, c, "Failed to send message to WhatsApp", err)
+			return &waSendError{"Failed to send message to WhatsApp", err}
 		}
 		revokeKeyboard := TgMakeRevokeKeyboard(sentMsg.ID, waChatJID.String(), false)
 		SendMessageConfirmation(b, c, cfg, msgToForward, revokeKeyboard)
 
-		err = database.MsgIdAddNewPair(sentMsg.ID, waClient.Store.ID.String(), waChatJID.String(),
-			cfg.Telegram.TargetChatID, msgToForward.MessageId, msgToForward.MessageThreadId)
-		if err != nil {
+		if err = tgSaveSentMessage(msgToForward, waChatJID, sentMsg); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Failed to add to database", err)
 		}
 
@@ -1178,29 +1285,9 @@ func TgSendToWhatsApp(b *gotgbot.Bot, c *ext.Context,
 	}
 
 	if cfg.Telegram.SendMyReadReceipts {
-		unreadMsgs, err := database.MsgIdGetUnread(waChatJID.String())
-		if err != nil {
+		if _, err := WaMarkChatRead(waChatJID); err != nil {
 			return TgReplyWithErrorByContext(b, c, "Message sent but failed to get unread messages to mark them read", err)
 		}
-
-		for sender, msgIds := range unreadMsgs {
-			senderJID, _ := WaParseJID(sender)
-			err := waClient.MarkRead(context.Background(), msgIds, time.Now(), waChatJID, senderJID)
-			if err != nil {
-				logger.Warn(
-					"failed to mark messages as read",
-					zap.String("chat_id", waChatJID.String()),
-					zap.Any("msg_ids", msgIds),
-					zap.String("sender", senderJID.String()),
-				)
-			} else {
-				for _, msgId := range msgIds {
-					database.MsgIdMarkRead(waChatJID.String(), msgId)
-				}
-			}
-		}
-
-		// waClient.MarkRead(unreadMsgs, time.Now(), waChatJID, )
 	}
 
 	return nil
@@ -1231,6 +1318,74 @@ func TgMakeRevokeKeyboard(msgId, chatId string, confirm bool) *gotgbot.InlineKey
 	}
 }
 
+// TgMakeReloginKeyboard asks to confirm /relogin, which links the bridge
+// with the given phone number if not empty
+func TgMakeReloginKeyboard(phone string) *gotgbot.InlineKeyboardMarkup {
+
+	return &gotgbot.InlineKeyboardMarkup{
+		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
+			{{
+				Text:         "No, go back",
+				CallbackData: "relogin_n",
+			}},
+			{{
+				Text:         "Yes, I am sure",
+				CallbackData: "relogin_" + phone + "_y",
+			}},
+		},
+	}
+}
+
+// TgMakeActionsKeyboard makes the keyboard of /actions for the given chat.
+// With confirmUnlink, it asks to confirm unlinking the thread instead.
+func TgMakeActionsKeyboard(waChatId string, confirmUnlink bool) *gotgbot.InlineKeyboardMarkup {
+	button := func(text, action string) gotgbot.InlineKeyboardButton {
+		return gotgbot.InlineKeyboardButton{
+			Text:         text,
+			CallbackData: "actions_" + action + "_" + waChatId,
+		}
+	}
+
+	if confirmUnlink {
+		return &gotgbot.InlineKeyboardMarkup{
+			InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
+				{button("No, go back", "menu")},
+				{button("Yes, unlink the thread", "unlinkconfirm")},
+			},
+		}
+	}
+
+	var keyboard [][]gotgbot.InlineKeyboardButton
+	if jid, _ := WaParseJID(waChatId); jid.Server == waTypes.GroupServer {
+		keyboard = append(keyboard, []gotgbot.InlineKeyboardButton{
+			button("👥 Members", "members"),
+			button("ℹ️ Chat info", "info"),
+		})
+	} else {
+		keyboard = append(keyboard,
+			[]gotgbot.InlineKeyboardButton{
+				button("🚫 Block", "block"),
+				button("✅ Unblock", "unblock"),
+			},
+			[]gotgbot.InlineKeyboardButton{
+				button("ℹ️ Chat info", "info"),
+			},
+		)
+	}
+	keyboard = append(keyboard,
+		[]gotgbot.InlineKeyboardButton{
+			button("🔕 Mute / unmute", "mute"),
+			button("🖼 Profile picture", "picture"),
+		},
+		[]gotgbot.InlineKeyboardButton{
+			button("👀 Mark as read", "read"),
+			button("🔗 Unlink thread", "unlink"),
+		},
+	)
+
+	return &gotgbot.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
+
 func TgBuildUrlButton(text, url string) gotgbot.InlineKeyboardMarkup {
 	return gotgbot.InlineKeyboardMarkup{
 		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{{
@@ -1240,6 +1395,37 @@ func TgBuildUrlButton(text, url string) gotgbot.InlineKeyboardMarkup {
 	}
 }
 
+// tgMessageType names the type of a message the way it is sent to WhatsApp by
+// tgSendToWhatsApp, for the metrics
+func tgMessageType(msg *gotgbot.Message) string {
+	switch {
+	case len(msg.Photo) > 0:
+		return "image"
+	case msg.Video != nil:
+		return "video"
+	case msg.VideoNote != nil:
+		return "video_note"
+	case msg.Animation != nil:
+		return "gif"
+	case msg.Audio != nil:
+		return "audio"
+	case msg.Voice != nil:
+		return "voice_note"
+	case msg.Document != nil:
+		return "document"
+	case msg.Sticker != nil:
+		return "sticker"
+	case msg.Contact != nil:
+		return "contact"
+	case msg.Location != nil:
+		return "location"
+	case msg.Poll != nil:
+		return "poll"
+	default:
+		return "text"
+	}
+}
+
 func SendMessageConfirmation(
 	b *gotgbot.Bot,
 	c *ext.Context,
@@ -1247,6 +1433,9 @@ func SendMessageConfirmation(
 	msgToForward *gotgbot.Message,
 	revokeKeyboard *gotgbot.InlineKeyboardMarkup,
 ) {
+	// Every message sent to WhatsApp is confirmed, so it is counted here
+	metrics.BridgedMessages.Inc(metrics.TelegramToWhatsApp, tgMessageType(msgToForward))
+
 	switch cfg.Telegram.ConfirmationType {
 	case "emoji":
 		if cfg.Telegram.AutoReactWhenAllRead {
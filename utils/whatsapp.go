@@ -6,6 +6,8 @@ import (
 	"html"
 	"log"
 	"strings"
+	"time"
+	"unicode"
 
 	"watgbridge/database"
 	"watgbridge/state"
@@ -43,6 +45,25 @@ func WaSetStatusMessage(ctx context.Context, waClient *whatsmeow.Client, msg str
 	return waClient.SetStatusMessage(ctx, msg)
 }
 
+// WaNormalizePhone keeps only the digits of a phone number written with a
+// leading + or with spaces and dashes, as expected by WhatsApp
+func WaNormalizePhone(phone string) (string, bool) {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		if r == '+' || r == ' ' || r == '-' || r == '(' || r == ')' {
+			return -1
+		}
+		return 'x'
+	}, phone)
+
+	if strings.ContainsRune(digits, 'x') || len(digits) < 7 || len(digits) > 15 {
+		return "", false
+	}
+	return digits, true
+}
+
 func WaParseJID(s string) (types.JID, bool) {
 	if s[0] == '+' {
 		s = SubString(s, 1, len(s)-1)
@@ -132,7 +153,7 @@ func waNormalizeChatID(chatID string) string {
 		return chatID
 	}
 	if jid.Server == types.HiddenUserServer {
-		pn, err := state.State.WhatsAppClient.Store.LIDs.GetPNForLID(context.Background(), jid)
+		pn, err := state.State.WhatsAppClient().Store.LIDs.GetPNForLID(context.Background(), jid)
 		if err == nil {
 			jid = pn
 		}
@@ -201,7 +222,7 @@ func WaFuzzyFindContacts(query string) (map[string]string, int, error) {
 }
 
 func WaGetGroupName(jid types.JID) string {
-	waClient := state.State.WhatsAppClient
+	waClient := state.State.WhatsAppClient()
 
 	groupInfo, err := waClient.GetGroupInfo(context.Background(), jid)
 	if err != nil {
@@ -210,13 +231,21 @@ func WaGetGroupName(jid types.JID) string {
 	return groupInfo.Name
 }
 
+// WaGetChatName returns the name of the group or contact of the chat
+func WaGetChatName(jid types.JID) string {
+	if jid.Server == types.GroupServer {
+		return WaGetGroupName(jid)
+	}
+	return WaGetContactName(jid)
+}
+
 func WaGetContactName(jid types.JID) string {
-	if jid.ToNonAD() == state.State.WhatsAppClient.Store.ID.ToNonAD() {
+	if jid.ToNonAD() == state.State.WhatsAppClient().Store.ID.ToNonAD() {
 		return "You"
 	}
 
 	var name string
-	waClient := state.State.WhatsAppClient
+	waClient := state.State.WhatsAppClient()
 
 	var (
 		pn           types.JID
@@ -274,7 +303,7 @@ func WaGetContactName(jid types.JID) string {
 func WaTagAll(group types.JID, msg *waE2E.Message, msgId, msgSender string, msgIsFromMe bool) {
 	var (
 		cfg      = state.State.Config
-		waClient = state.State.WhatsAppClient
+		waClient = state.State.WhatsAppClient()
 		tgBot    = state.State.TelegramBot
 	)
 
@@ -337,7 +366,7 @@ func WaTagAll(group types.JID, msg *waE2E.Message, msgId, msgSender string, msgI
 }
 
 func WaSendText(chat types.JID, text, stanzaId, participantId string, quotedMsg *waE2E.Message, isReply bool) (whatsmeow.SendResponse, error) {
-	waClient := state.State.WhatsAppClient
+	waClient := state.State.WhatsAppClient()
 
 	msgToSend := &waE2E.Message{}
 	if isReply {
@@ -355,3 +384,171 @@ func WaSendText(chat types.JID, text, stanzaId, participantId string, quotedMsg
 
 	return waClient.SendMessage(context.Background(), chat, msgToSend)
 }
+
+// WaTextWithTelegramFormatting converts the WhatsApp formatting of a text to
+// Telegram HTML, escaping everything else. It does the opposite of
+// tgTextWithWhatsAppFormatting, and markup which WhatsApp would not render
+// is left as it is.
+func WaTextWithTelegramFormatting(text string) string {
+	var builder strings.Builder
+
+	for {
+		start := strings.Index(text, "```")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(text[start+3:], "```")
+		if end <= 0 {
+			break
+		}
+		end += start + 3
+
+		builder.WriteString(waFormatTelegramLines(text[:start]))
+
+		code := text[start+3 : end]
+		if strings.Contains(code, "\n") {
+			builder.WriteString("<pre>" + html.EscapeString(strings.Trim(code, "\n")) + "</pre>")
+		} else {
+			builder.WriteString("<code>" + html.EscapeString(code) + "</code>")
+		}
+		text = text[end+3:]
+	}
+
+	builder.WriteString(waFormatTelegramLines(text))
+	return builder.String()
+}
+
+// waFormatTelegramLines handles the line level formatting, which is quotes
+// and bulleted lists, outside of the code blocks
+func waFormatTelegramLines(text string) string {
+	var (
+		builder strings.Builder
+		lines   = strings.Split(text, "\n")
+		inQuote = false
+	)
+
+	for idx, line := range lines {
+		isQuote := strings.HasPrefix(line, "> ")
+		if isQuote {
+			line = strings.TrimPrefix(line, "> ")
+			if !inQuote {
+				builder.WriteString("<blockquote>")
+			}
+		}
+		inQuote = isQuote
+
+		if strings.HasPrefix(line, "* ") || strings.HasPrefix(line, "- ") {
+			line = "• " + line[2:]
+		}
+		builder.WriteString(waFormatTelegramInline([]rune(line)))
+
+		if idx < len(lines)-1 {
+			if inQuote && !strings.HasPrefix(lines[idx+1], "> ") {
+				builder.WriteString("</blockquote>")
+				inQuote = false
+			}
+			builder.WriteString("\n")
+		}
+	}
+	if inQuote {
+		builder.WriteString("</blockquote>")
+	}
+
+	return builder.String()
+}
+
+var waTelegramFormattingTags = map[rune]string{
+	'*': "b",
+	'_': "i",
+	'~': "s",
+	'`': "code",
+}
+
+func waFormatTelegramInline(text []rune) string {
+	var builder strings.Builder
+
+	for idx := 0; idx < len(text); idx++ {
+		tag, isDelimiter := waTelegramFormattingTags[text[idx]]
+		if isDelimiter && waIsOpeningDelimiter(text, idx) {
+			if end := waFindClosingDelimiter(text, idx); end != -1 {
+				inner := text[idx+1 : end]
+				if tag == "code" {
+					builder.WriteString("<code>" + html.EscapeString(string(inner)) + "</code>")
+				} else {
+					builder.WriteString("<" + tag + ">" + waFormatTelegramInline(inner) + "</" + tag + ">")
+				}
+				idx = end
+				continue
+			}
+		}
+		builder.WriteString(html.EscapeString(string(text[idx])))
+	}
+
+	return builder.String()
+}
+
+// waIsOpeningDelimiter reports whether the delimiter at idx can start a
+// formatted range, it must not be inside a word or followed by a space
+func waIsOpeningDelimiter(text []rune, idx int) bool {
+	if idx+1 >= len(text) || unicode.IsSpace(text[idx+1]) || text[idx+1] == text[idx] {
+		return false
+	}
+	return idx == 0 || !waIsWordRune(text[idx-1])
+}
+
+// waFindClosingDelimiter returns the index of the delimiter closing the one
+// at start, or -1 if there is none on the same line
+func waFindClosingDelimiter(text []rune, start int) int {
+	for idx := start + 2; idx < len(text); idx++ {
+		if text[idx] != text[start] {
+			continue
+		}
+		if unicode.IsSpace(text[idx-1]) {
+			continue
+		}
+		if idx+1 < len(text) && waIsWordRune(text[idx+1]) {
+			continue
+		}
+		return idx
+	}
+	return -1
+}
+
+func waIsWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// WaMarkChatRead marks the messages of the chat which were not read yet as
+// read in WhatsApp, returning how many of them were marked
+func WaMarkChatRead(waChatJID types.JID) (int, error) {
+	var (
+		logger   = state.State.Logger
+		waClient = state.State.WhatsAppClient()
+	)
+
+	unreadMsgs, err := database.MsgIdGetUnread(waChatJID.String())
+	if err != nil {
+		return 0, err
+	}
+
+	marked := 0
+	for sender, msgIds := range unreadMsgs {
+		senderJID, _ := WaParseJID(sender)
+		err := waClient.MarkRead(context.Background(), msgIds, time.Now(), waChatJID, senderJID)
+		if err != nil {
+			logger.Warn(
+				"failed to mark messages as read",
+				zap.String("chat_id", waChatJID.String()),
+				zap.Any("msg_ids", msgIds),
+				zap.String("sender", senderJID.String()),
+			)
+			continue
+		}
+		for _, msgId := range msgIds {
+			database.MsgIdMarkRead(waChatJID.String(), msgId)
+		}
+		marked += len(msgIds)
+	}
+
+	return marked, nil
+}
@@ -0,0 +1,51 @@
+package utils
+
+import "testing"
+
+func TestWaTextWithTelegramFormatting(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"plain", "hello world", "hello world"},
+		{"escapes html", "a < b && c > d", "a &lt; b &amp;&amp; c &gt; d"},
+		{"bold", "*bold*", "<b>bold</b>"},
+		{"italic", "some _italic_ text", "some <i>italic</i> text"},
+		{"strikethrough", "~gone~", "<s>gone</s>"},
+		{"inline code", "run `go build` now", "run <code>go build</code> now"},
+		{"monospace", "```mono```", "<code>mono</code>"},
+		{"multiline code block", "```\nfunc main() {\n\t*x* < 1\n}\n```", "<pre>func main() {\n\t*x* &lt; 1\n}</pre>"},
+		{"nested", "*bold _and italic_*", "<b>bold <i>and italic</i></b>"},
+		{"nested both ways", "_*both*_", "<i><b>both</b></i>"},
+		{"several on a line", "*a* and ~b~", "<b>a</b> and <s>b</s>"},
+		{"inside punctuation", "(*bold*).", "(<b>bold</b>)."},
+		{"code is not formatted", "`*not bold*`", "<code>*not bold*</code>"},
+		{"unclosed", "*not bold", "*not bold"},
+		{"space after opening", "a * not bold*", "a * not bold*"},
+		{"space before closing", "*not bold *", "*not bold *"},
+		{"inside a word", "snake_case_name", "snake_case_name"},
+		{"url", "https://example.com/a_b_c", "https://example.com/a_b_c"},
+		{"math", "2 * 3 * 4", "2 * 3 * 4"},
+		{"empty", "**", "**"},
+		{"does not span lines", "*first\nsecond*", "*first\nsecond*"},
+		{"crossed delimiters", "*a _b* c_", "<b>a _b</b> c_"},
+		{"unclosed code block", "```code", "```code"},
+		{"quote", "> quoted", "<blockquote>quoted</blockquote>"},
+		{"multiline quote", "> one\n> *two*\nafter", "<blockquote>one\n<b>two</b></blockquote>\nafter"},
+		{"separate quotes", "> one\n\n> two", "<blockquote>one</blockquote>\n\n<blockquote>two</blockquote>"},
+		{"greater than", "5 > 3", "5 &gt; 3"},
+		{"bulleted list", "* one\n- _two_", "• one\n• <i>two</i>"},
+		{"numbered list", "1. one\n2. two", "1. one\n2. two"},
+		{"unicode", "*héllo* wörld", "<b>héllo</b> wörld"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := WaTextWithTelegramFormatting(test.input)
+			if got != test.expected {
+				t.Errorf("WaTextWithTelegramFormatting(%q) = %q, expected %q", test.input, got, test.expected)
+			}
+		})
+	}
+}
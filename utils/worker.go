@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+// Worker tracks the goroutines of a background task, so that the shutdown
+// can stop it and wait for what it is doing. Once stopped, it does not take
+// new work anymore.
+type Worker struct {
+	lock     sync.Mutex
+	stopping bool
+	stop     chan struct{}
+	running  sync.WaitGroup
+}
+
+func NewWorker() *Worker {
+	return &Worker{stop: make(chan struct{})}
+}
+
+// Enter counts a piece of work which is starting, to be followed by Exit
+// once it is done. It returns false without counting it once the worker is
+// stopping, in which case the work must not be done.
+func (w *Worker) Enter() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.stopping {
+		return false
+	}
+	w.running.Add(1)
+	return true
+}
+
+func (w *Worker) Exit() {
+	w.running.Done()
+}
+
+// Go runs f in a goroutine counted by the worker, it returns false without
+// running it once the worker is stopping
+func (w *Worker) Go(f func()) bool {
+	if !w.Enter() {
+		return false
+	}
+	go func() {
+		defer w.Exit()
+		f()
+	}()
+	return true
+}
+
+// Stopping is closed once the worker is stopped, for its loops to return
+func (w *Worker) Stopping() <-chan struct{} {
+	return w.stop
+}
+
+// Stopped tells whether the worker was stopped, for long running work to
+// return early
+func (w *Worker) Stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop makes the worker refuse new work, the returned context is done once
+// the work which was running returned
+func (w *Worker) Stop() context.Context {
+	w.lock.Lock()
+	if !w.stopping {
+		w.stopping = true
+		close(w.stop)
+	}
+	w.lock.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		w.running.Wait()
+		cancel()
+	}()
+	return ctx
+}
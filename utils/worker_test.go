@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerStop(t *testing.T) {
+	w := NewWorker()
+
+	release := make(chan struct{})
+	if !w.Go(func() { <-release }) {
+		t.Fatalf("Go() = false before stopping")
+	}
+
+	done := w.Stop()
+	if !w.Stopped() {
+		t.Fatalf("Stopped() = false after Stop()")
+	}
+	if w.Enter() {
+		t.Fatalf("Enter() = true after Stop()")
+	}
+	if w.Go(func() { t.Errorf("work ran after Stop()") }) {
+		t.Fatalf("Go() = true after Stop()")
+	}
+
+	select {
+	case <-done.Done():
+		t.Fatalf("Stop() context done while work is running")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-done.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Stop() context not done after the work returned")
+	}
+
+	// Stopping again does not panic and is done right away
+	select {
+	case <-w.Stop().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("second Stop() context not done")
+	}
+}
@@ -0,0 +1,312 @@
+package whatsapp
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"watgbridge/utils"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types/events"
+	"go.uber.org/zap"
+)
+
+// WhatsApp sends an album as an AlbumMessage announcing the number of items,
+// followed by the items as separate messages pointing back to it. The items
+// are collected here and sent to Telegram as a single media group.
+
+const (
+	// How long to wait for the rest of an album after its last item arrived
+	waAlbumWait = 3 * time.Second
+	// Largest number of items Telegram accepts in a media group
+	tgMediaGroupLimit = 10
+)
+
+type waAlbumItem struct {
+	bc *bridgeContext
+	v  *events.Message
+}
+
+type waAlbum struct {
+	expected int
+	items    []waAlbumItem
+	timer    *time.Timer
+}
+
+var (
+	waAlbumsLock sync.Mutex
+	waAlbums     = make(map[string]*waAlbum)
+	// Set by FlushWaAlbums, after which album items are sent on their own
+	waAlbumsFlushed bool
+)
+
+// getAlbumParentId returns the ID of the AlbumMessage the message is an item
+// of, or an empty string if it is not part of an album
+func getAlbumParentId(msg *waE2E.Message) string {
+	association := msg.GetMessageContextInfo().GetMessageAssociation()
+	if association.GetAssociationType() != waE2E.MessageAssociation_MEDIA_ALBUM {
+		return ""
+	}
+	return association.GetParentMessageKey().GetID()
+}
+
+// getAlbum returns the album with the given key, creating it and (re)starting
+// its timer. Must be called with waAlbumsLock held.
+func getAlbum(key string) *waAlbum {
+	album, found := waAlbums[key]
+	if !found {
+		album = &waAlbum{}
+		waAlbums[key] = album
+		album.timer = time.AfterFunc(waAlbumWait, func() {
+			if !handlersWorker.Enter() {
+				return
+			}
+			defer handlersWorker.Exit()
+			flushAlbum(key)
+		})
+	} else {
+		album.timer.Reset(waAlbumWait)
+	}
+	return album
+}
+
+// takeAlbum removes the album from the buffer and returns its items. Must be
+// called with waAlbumsLock held.
+func takeAlbum(key string) []waAlbumItem {
+	album, found := waAlbums[key]
+	if !found {
+		return nil
+	}
+	album.timer.Stop()
+	delete(waAlbums, key)
+	return album.items
+}
+
+func flushAlbum(key string) {
+	waAlbumsLock.Lock()
+	items := takeAlbum(key)
+	waAlbumsLock.Unlock()
+
+	sendAlbum(items)
+}
+
+// FlushWaAlbums sends the albums still waiting for more items with what
+// arrived, counted as running handlers so that the shutdown waits for them.
+// The album items which arrive afterwards are sent on their own.
+func FlushWaAlbums() {
+	waAlbumsLock.Lock()
+	waAlbumsFlushed = true
+	var albums [][]waAlbumItem
+	for key := range waAlbums {
+		albums = append(albums, takeAlbum(key))
+	}
+	waAlbumsLock.Unlock()
+
+	for _, items := range albums {
+		handlersWorker.Go(func() {
+			sendAlbum(items)
+		})
+	}
+}
+
+// handleAlbumMessage notes how many items an album will have, so that it can
+// be sent as soon as all of them arrived
+func handleAlbumMessage(v *events.Message) {
+	var (
+		albumMsg = v.Message.GetAlbumMessage()
+		key      = v.Info.Chat.String() + "/" + v.Info.ID
+	)
+
+	waAlbumsLock.Lock()
+	if waAlbumsFlushed {
+		waAlbumsLock.Unlock()
+		return
+	}
+	album := getAlbum(key)
+	album.expected = int(albumMsg.GetExpectedImageCount() + albumMsg.GetExpectedVideoCount())
+	var items []waAlbumItem
+	if album.expected > 0 && len(album.items) >= album.expected {
+		items = takeAlbum(key)
+	}
+	waAlbumsLock.Unlock()
+
+	sendAlbum(items)
+}
+
+// queueAlbumItem buffers an image or video which is part of an album, and
+// returns false if the message should be bridged on its own instead
+func (bc *bridgeContext) queueAlbumItem(v *events.Message) bool {
+	albumId := getAlbumParentId(v.Message)
+	if albumId == "" {
+		return false
+	}
+
+	if imageMsg := v.Message.GetImageMessage(); imageMsg != nil {
+		if imageMsg.GetURL() == "" || bc.cfg.WhatsApp.SkipImages || bc.cfg.Telegram.SendImagesAsFile ||
+			(!bc.cfg.Telegram.SelfHostedAPI && imageMsg.GetFileLength() > utils.UploadSizeLimit) {
+			return false
+		}
+	} else if videoMsg := v.Message.GetVideoMessage(); videoMsg != nil && !videoMsg.GetGifPlayback() {
+		if videoMsg.GetURL() == "" || bc.cfg.WhatsApp.SkipVideos ||
+			(!bc.cfg.Telegram.SelfHostedAPI && videoMsg.GetFileLength() > utils.UploadSizeLimit) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	key := v.Info.Chat.String() + "/" + albumId
+
+	waAlbumsLock.Lock()
+	if waAlbumsFlushed {
+		waAlbumsLock.Unlock()
+		return false
+	}
+	album := getAlbum(key)
+	album.items = append(album.items, waAlbumItem{bc, v})
+	var items []waAlbumItem
+	if album.expected > 0 && len(album.items) >= album.expected {
+		items = takeAlbum(key)
+	}
+	waAlbumsLock.Unlock()
+
+	sendAlbum(items)
+	return true
+}
+
+// sendAlbumItemAlone bridges an album item the same way as any other image or
+// video, used when it cannot be sent in a media group
+func sendAlbumItemAlone(item waAlbumItem) {
+	if item.v.Message.GetImageMessage() != nil {
+		item.bc.handleImageMessage(item.v)
+	} else {
+		item.bc.handleVideoMessage(item.v)
+	}
+}
+
+// sendAlbum sends the items of an album to Telegram as media groups, with the
+// header of the first item as the caption of the group
+func sendAlbum(items []waAlbumItem) {
+	if len(items) == 0 {
+		return
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].v.Info.Timestamp.Before(items[j].v.Info.Timestamp)
+	})
+
+	for len(items) > 0 {
+		chunk := items[:min(len(items), tgMediaGroupLimit)]
+		items = items[len(chunk):]
+		sendMediaGroup(chunk)
+	}
+}
+
+func sendMediaGroup(items []waAlbumItem) {
+	type downloadedItem struct {
+		waAlbumItem
+		data []byte
+	}
+
+	var downloaded []downloadedItem
+	for _, item := range items {
+		var (
+			data []byte
+			err  error
+		)
+		if imageMsg := item.v.Message.GetImageMessage(); imageMsg != nil {
+			data, err = item.bc.waClient.Download(context.Background(), imageMsg)
+		} else {
+			data, err = item.bc.waClient.Download(context.Background(), item.v.Message.GetVideoMessage())
+		}
+		if err != nil {
+			item.bc.logger.Warn("failed to download album item, sending it on its own",
+				zap.String("msg_id", item.bc.msgId),
+				zap.Error(err),
+			)
+			sendAlbumItemAlone(item)
+			continue
+		}
+		downloaded = append(downloaded, downloadedItem{item, data})
+	}
+
+	// Telegram does not take media groups of a single item
+	if len(downloaded) < 2 {
+		for _, item := range downloaded {
+			sendAlbumItemAlone(item.waAlbumItem)
+		}
+		return
+	}
+
+	var (
+		first    = downloaded[0].bc
+		media    gotgbot.InputMedias
+		included []waAlbumItem
+	)
+
+	for idx, item := range downloaded {
+		var (
+			bc       = item.bc
+			imageMsg = item.v.Message.GetImageMessage()
+			videoMsg = item.v.Message.GetVideoMessage()
+		)
+
+		// Only the first item of the group carries the header
+		if idx > 0 {
+			bc.bridgedText = ""
+		}
+
+		if imageMsg != nil {
+			addCaption(&bc.bridgedText, imageMsg.GetCaption())
+			media = append(media, gotgbot.InputMediaPhoto{
+				Media:      &gotgbot.FileReader{Data: bytes.NewReader(item.data)},
+				Caption:    bc.caption(),
+				ParseMode:  gotgbot.ParseModeHTML,
+				HasSpoiler: imageMsg.GetViewOnce(),
+			})
+		} else {
+			addCaption(&bc.bridgedText, videoMsg.GetCaption())
+			media = append(media, gotgbot.InputMediaVideo{
+				Media: &gotgbot.FileReader{
+					Name: "video." + strings.Split(videoMsg.GetMimetype(), "/")[1],
+					Data: bytes.NewReader(item.data),
+				},
+				Caption:    bc.caption(),
+				ParseMode:  gotgbot.ParseModeHTML,
+				Duration:   int64(videoMsg.GetSeconds()),
+				Width:      int64(videoMsg.GetWidth()),
+				Height:     int64(videoMsg.GetHeight()),
+				HasSpoiler: videoMsg.GetViewOnce(),
+			})
+		}
+		included = append(included, item.waAlbumItem)
+	}
+
+	sentMsgs, err := first.tgBot.SendMediaGroup(first.cfg.Telegram.TargetChatID, media,
+		&gotgbot.SendMediaGroupOpts{
+			ReplyParameters:     utils.TgMakeReplyParameters(first.replyToMsgId, 0),
+			MessageThreadId:     first.threadId,
+			DisableNotification: first.silent,
+		})
+	if err != nil {
+		first.logger.Error("failed to send album to Telegram",
+			zap.String("msg_id", first.msgId),
+			zap.Int("items", len(included)),
+			zap.Error(err),
+		)
+		utils.TgSendErrorById(first.tgBot, first.cfg.Telegram.TargetChatID, first.threadId,
+			"Failed to send an album from WhatsApp as a media group", err)
+		return
+	}
+
+	for idx := range sentMsgs {
+		if idx < len(included) {
+			included[idx].bc.savePair(&sentMsgs[idx])
+		}
+	}
+}
@@ -1,24 +1,19 @@
 package whatsapp
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"html"
-	"os"
 
 	"watgbridge/state"
 
-	"github.com/PaulSonOfLars/gotgbot/v2"
 	_ "github.com/jackc/pgx/v5"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/mdp/qrterminal/v3"
-	"github.com/skip2/go-qrcode"
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/proto/waCompanionReg"
 	waWa6 "go.mau.fi/whatsmeow/proto/waWa6"
 	"go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types/events"
 	waLog "go.mau.fi/whatsmeow/util/log"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
@@ -54,6 +49,12 @@ const (
 	clientModeAndroidBusiness = "android_business"
 )
 
+var (
+	// Kept to create a new client when logging in again
+	deviceContainer *sqlstore.Container
+	waClientLogger  waLog.Logger
+)
+
 
 func NewWhatsAppClient() error {
 
@@ -81,7 +82,7 @@ func NewWhatsAppClient() error {
 	defer logger.Sync()
 
 	waDatabaseLogger := &whatsmeowLogger{logger: logger.Sugar().Named("WhatsMeow_Database")}
-	waClientLogger := &whatsmeowLogger{logger: logger.Sugar().Named("WhatsMeow_Client")}
+	waClientLogger = &whatsmeowLogger{logger: logger.Sugar().Named("WhatsMeow_Client")}
 
 	// Configure device as Android if client mode is set to android/android_business
 	isAndroidEmulation := cfg.WhatsApp.ClientMode == clientModeAndroid ||
@@ -149,61 +150,33 @@ func NewWhatsAppClient() error {
 		logger.Info("WhatsApp client configured as Web client")
 	}
 
-	container, err := sqlstore.New(context.Background(), state.State.Config.WhatsApp.LoginDatabase.Type,
+	if cfg.WhatsApp.HistoryImport.Enabled {
+		// Ask the phone for the recent history when linking, which is kept
+		// in the database to be imported later with /importhistory
+		historySyncConfig := store.DeviceProps.HistorySyncConfig
+		historySyncConfig.FullSyncDaysLimit = proto.Uint32(cfg.WhatsApp.HistoryImport.SyncDaysLimit)
+		historySyncConfig.RecentSyncDaysLimit = proto.Uint32(cfg.WhatsApp.HistoryImport.SyncDaysLimit)
+		historySyncConfig.FullSyncSizeMbLimit = proto.Uint32(1024)
+		historySyncConfig.StorageQuotaMb = proto.Uint32(10240)
+	}
+
+	deviceContainer, err = sqlstore.New(context.Background(), state.State.Config.WhatsApp.LoginDatabase.Type,
 		state.State.Config.WhatsApp.LoginDatabase.URL, waDatabaseLogger)
 	if err != nil {
 		return fmt.Errorf("could not initialize sqlstore for Whatsapp : %s", err)
 	}
 
-	deviceStore, err := container.GetFirstDevice(context.Background())
+	deviceStore, err := deviceContainer.GetFirstDevice(context.Background())
 	if err != nil {
 		return fmt.Errorf("could not initialize device store for Whatsapp : %s", err)
 	}
 
-	client := whatsmeow.NewClient(deviceStore, waClientLogger)
-	state.State.WhatsAppClient = client
+	client := newClient(deviceStore)
 
 	if client.Store.ID == nil {
-		qrChan, _ := client.GetQRChannel(context.Background())
-		err = client.Connect()
+		err = login(client, logger)
 		if err != nil {
-			return fmt.Errorf("could not connect to Whatsapp for login : %s", err)
-		}
-		for evt := range qrChan {
-			if evt.Event == "code" {
-				// var png []byte
-				// png, _err := qrcode.Encode("aklsdfjasdfaklsdfjlasdfjaskldfjasldfjaklsdfjals", qrcode.Highest, 256)
-				// if _err != nil {
-				// 	panic(_err)
-				// }
-
-				if state.State.TelegramBot != nil {
-					qrCodePNG, err := qrcode.Encode(evt.Code, qrcode.Highest, 512)
-					if err != nil {
-						state.State.TelegramBot.SendMessage(
-							state.State.Config.Telegram.OwnerID,
-							fmt.Sprintf(
-								"Please check your terminal and scan the QR code to login to WhatsApp. Failed to encode to PNG and send here:\n<code>%s</code>",
-								html.EscapeString(err.Error()),
-							),
-							&gotgbot.SendMessageOpts{},
-						)
-					} else {
-						state.State.TelegramBot.SendPhoto(
-							state.State.Config.Telegram.OwnerID,
-							gotgbot.InputFileByReader("qrcode.png", bytes.NewReader(qrCodePNG)),
-							&gotgbot.SendPhotoOpts{
-								Caption: "Scan the above QR code to login to WhatsApp.",
-							},
-						)
-					}
-				}
-				qrterminal.GenerateHalfBlock(evt.Code, qrterminal.L, os.Stdout)
-			} else {
-				logger.Info("received WhatsApp login event",
-					zap.Any("event", evt.Event),
-				)
-			}
+			return err
 		}
 	} else {
 		err = client.Connect()
@@ -219,3 +192,28 @@ func NewWhatsAppClient() error {
 
 	return nil
 }
+
+// newClient creates the client for a device and makes it the current one,
+// adding the handlers which have to be there before it connects
+func newClient(deviceStore *store.Device) *whatsmeow.Client {
+	client := whatsmeow.NewClient(deviceStore, waClientLogger)
+	state.State.SetWhatsAppClient(client)
+
+	if state.State.Config.WhatsApp.HistoryImport.Enabled {
+		// Registered before connecting as the history is sent right after
+		// the device gets linked
+		client.AddEventHandler(func(evt interface{}) {
+			if v, ok := evt.(*events.HistorySync); ok {
+				HistorySyncEventHandler(v)
+			}
+		})
+	}
+
+	eventHandlersLock.Lock()
+	for _, handler := range eventHandlers {
+		client.AddEventHandler(handler)
+	}
+	eventHandlersLock.Unlock()
+
+	return client
+}
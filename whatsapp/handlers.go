@@ -29,13 +29,38 @@ import (
 // Top-level event dispatcher
 // ============================================================
 
+// Counts the events being bridged, so that the shutdown can wait for the
+// media which is still being downloaded or converted
+var handlersWorker = utils.NewWorker()
+
+// StopEventHandlers makes the events which arrive from now on ignored, the
+// returned context is done once the events being handled are
+func StopEventHandlers() context.Context {
+	return handlersWorker.Stop()
+}
+
 func WhatsAppEventHandler(evt interface{}) {
+	if !handlersWorker.Enter() {
+		return
+	}
+	defer handlersWorker.Exit()
+
 	cfg := state.State.Config
 
+	// Keep track of the connection for /status and the health notifications
+	ConnectionEventHandler(evt)
+
 	switch v := evt.(type) {
 	case *events.LoggedOut:
 		LogoutHandler(v)
 
+	case *events.PairSuccess:
+		PairSuccessHandler(v)
+
+	case *events.Connected:
+		// Messages which failed while disconnected can be sent now
+		utils.WakeOutbox()
+
 	case *events.Receipt:
 		ReceiptEventHandler(v)
 
@@ -377,6 +402,28 @@ func handleMessageEvent(cfg *state.Config, v *events.Message) {
 		return
 	}
 
+	if v.Message.GetPollUpdateMessage() != nil {
+		PollUpdateEventHandler(v)
+		return
+	}
+
+	if v.Message.GetAlbumMessage() != nil {
+		handleAlbumMessage(v)
+		return
+	}
+
+	// Newer clients wrap the items of an album
+	if child := v.Message.GetAssociatedChildMessage().GetMessage(); child != nil {
+		if child.MessageContextInfo == nil {
+			child.MessageContextInfo = v.Message.GetMessageContextInfo()
+		}
+		v.Message = child
+	}
+
+	if v.Message.GetLiveLocationMessage() != nil && !isHistoryMessage(v) && LiveLocationUpdateEventHandler(v) {
+		return
+	}
+
 	isEdited := false
 	if protoMsg := v.Message.GetProtocolMessage(); protoMsg != nil &&
 		protoMsg.GetType() == waE2E.ProtocolMessage_MESSAGE_EDIT {
@@ -490,8 +537,8 @@ func MessageFromMeEventHandler(text string, v *events.Message, isEdited bool, is
 	}
 
 	// Reply with chat ID when ".id" is sent
-	if text == ".id" {
-		waClient := state.State.WhatsAppClient
+	if text == ".id" && !isHistoryMessage(v) {
+		waClient := state.State.WhatsAppClient()
 		_, err := waClient.SendMessage(context.Background(), v.Info.Chat, &waE2E.Message{
 			ExtendedTextMessage: &waE2E.ExtendedTextMessage{
 				Text: proto.String(fmt.Sprintf(
@@ -512,7 +559,7 @@ func MessageFromMeEventHandler(text string, v *events.Message, isEdited bool, is
 	}
 
 	// Tag everyone when @all / @everyone is used
-	if !isEdited {
+	if !isEdited && !isHistoryMessage(v) {
 		textSplit := strings.Fields(strings.ToLower(text))
 		if v.Info.IsGroup &&
 			(slices.Contains(textSplit, "@all") || slices.Contains(textSplit, "@everyone")) {
@@ -520,7 +567,7 @@ func MessageFromMeEventHandler(text string, v *events.Message, isEdited bool, is
 		}
 	}
 
-	if state.State.Config.WhatsApp.SendMyMessagesFromOtherDevices {
+	if state.State.Config.WhatsApp.SendMyMessagesFromOtherDevices || isHistoryMessage(v) {
 		MessageFromOthersEventHandler(text, v, isEdited, isDocument)
 	}
 }
@@ -531,13 +578,15 @@ func MessageFromMeEventHandler(text string, v *events.Message, isEdited bool, is
 
 func MessageFromOthersEventHandler(text string, v *events.Message, isEdited bool, isDocument bool) {
 	var (
-		cfg      = state.State.Config
-		logger   = state.State.Logger
-		tgBot    = state.State.TelegramBot
-		waClient = state.State.WhatsAppClient
+		logger     = state.State.Logger
+		tgBot      = state.State.TelegramBot
+		waClient   = state.State.WhatsAppClient()
+		receivedAt = time.Now()
 	)
 	defer logger.Sync()
 
+	cfg, chatSettings := utils.WaChatConfig(v.Info.Chat.String())
+
 	// Determine message ID
 	var msgId string
 	if isEdited {
@@ -567,7 +616,7 @@ func MessageFromOthersEventHandler(text string, v *events.Message, isEdited bool
 			zap.String("chat_jid", v.Info.Chat.String()),
 		)
 		return
-	} else if slices.Contains(cfg.WhatsApp.IgnoreChats, v.Info.Chat.User) {
+	} else if slices.Contains(cfg.WhatsApp.IgnoreChats, v.Info.Chat.User) || chatSettings.Muted {
 		logger.Debug("returning because message from an ignored chat",
 			zap.String("event_id", v.Info.ID),
 			zap.String("chat_jid", v.Info.Chat.String()),
@@ -581,7 +630,7 @@ func MessageFromOthersEventHandler(text string, v *events.Message, isEdited bool
 	)
 
 	// Handle @all / @everyone from allowed groups
-	if !isEdited {
+	if !isEdited && !isHistoryMessage(v) {
 		if lowercaseText := strings.ToLower(text); !v.Info.IsFromMe && v.Info.IsGroup &&
 			slices.Contains(cfg.WhatsApp.TagAllAllowedGroups, v.Info.Chat.User) &&
 			(strings.Contains(lowercaseText, "@all") || strings.Contains(lowercaseText, "@everyone")) {
@@ -617,7 +666,7 @@ func MessageFromOthersEventHandler(text string, v *events.Message, isEdited bool
 			}
 
 			// Notify when the bot owner is mentioned
-			if mentioned := contextInfo.GetMentionedJID(); v.Info.IsGroup && mentioned != nil {
+			if mentioned := contextInfo.GetMentionedJID(); v.Info.IsGroup && mentioned != nil && !isHistoryMessage(v) {
 				for _, jid := range mentioned {
 					parsedJid, _ := utils.WaParseJID(jid)
 					if parsedJid.User == waClient.Store.ID.User {
@@ -680,6 +729,17 @@ func MessageFromOthersEventHandler(text string, v *events.Message, isEdited bool
 		senderStr:    v.Info.MessageSource.Sender.String(),
 		chatStr:      v.Info.Chat.String(),
 		replyMarkup:  replyMarkup,
+		silent:       chatSettings.Silent,
+		msgType:      waMessageType(v.Message),
+		receivedAt:   receivedAt,
+	}
+	if cfg.Archive.Enabled {
+		bc.archive = waArchivedMessage(v, msgId, text, isEdited)
+	}
+
+	// Items of an album are sent together once all of them arrived
+	if !isEdited && bc.queueAlbumItem(v) {
+		return
 	}
 
 	// Dispatch to the appropriate media-type handler
@@ -749,9 +809,10 @@ func (bc *bridgeContext) handleImageMessage(v *events.Message) {
 		sentMsg, _ := bc.tgBot.SendDocument(bc.cfg.Telegram.TargetChatID,
 			&gotgbot.FileReader{Name: fileName, Data: bytes.NewReader(imageBytes)},
 			&gotgbot.SendDocumentOpts{
-				Caption:         bc.bridgedText,
-				ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-				MessageThreadId: bc.threadId,
+				Caption:             bc.caption(),
+				ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+				MessageThreadId:     bc.threadId,
+				DisableNotification: bc.silent,
 			})
 		bc.savePair(sentMsg)
 		return
@@ -760,10 +821,11 @@ func (bc *bridgeContext) handleImageMessage(v *events.Message) {
 	sentMsg, _ := bc.tgBot.SendPhoto(bc.cfg.Telegram.TargetChatID,
 		&gotgbot.FileReader{Data: bytes.NewReader(imageBytes)},
 		&gotgbot.SendPhotoOpts{
-			Caption:         bc.bridgedText,
-			ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-			HasSpoiler:      imageMsg.GetViewOnce(),
-			MessageThreadId: bc.threadId,
+			Caption:             bc.caption(),
+			ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+			HasSpoiler:          imageMsg.GetViewOnce(),
+			MessageThreadId:     bc.threadId,
+			DisableNotification: bc.silent,
 		})
 	bc.savePair(sentMsg)
 }
@@ -794,9 +856,10 @@ func (bc *bridgeContext) handleGifMessage(v *events.Message) {
 	sentMsg, _ := bc.tgBot.SendAnimation(bc.cfg.Telegram.TargetChatID,
 		&gotgbot.FileReader{Name: "animation.gif", Data: bytes.NewReader(gifBytes)},
 		&gotgbot.SendAnimationOpts{
-			Caption:         bc.bridgedText,
-			ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-			MessageThreadId: bc.threadId,
+			Caption:             bc.caption(),
+			ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+			MessageThreadId:     bc.threadId,
+			DisableNotification: bc.silent,
 		})
 	bc.savePair(sentMsg)
 }
@@ -841,17 +904,19 @@ func (bc *bridgeContext) handleVideoMessage(v *events.Message) {
 	if isPTV {
 		sentMsg, _ = bc.tgBot.SendVideoNote(bc.cfg.Telegram.TargetChatID, &fileToSend,
 			&gotgbot.SendVideoNoteOpts{
-				ReplyMarkup:     bc.replyMarkup,
-				ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-				MessageThreadId: bc.threadId,
+				ReplyMarkup:         bc.replyMarkup,
+				ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+				MessageThreadId:     bc.threadId,
+				DisableNotification: bc.silent,
 			})
 	} else {
 		sentMsg, _ = bc.tgBot.SendVideo(bc.cfg.Telegram.TargetChatID, &fileToSend,
 			&gotgbot.SendVideoOpts{
-				Caption:         bc.bridgedText,
-				ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-				HasSpoiler:      videoMsg.GetViewOnce(),
-				MessageThreadId: bc.threadId,
+				Caption:             bc.caption(),
+				ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+				HasSpoiler:          videoMsg.GetViewOnce(),
+				MessageThreadId:     bc.threadId,
+				DisableNotification: bc.silent,
 			})
 	}
 	bc.savePair(sentMsg)
@@ -881,10 +946,11 @@ func (bc *bridgeContext) handleVoiceNoteMessage(v *events.Message) {
 	sentMsg, _ := bc.tgBot.SendAudio(bc.cfg.Telegram.TargetChatID,
 		&gotgbot.FileReader{Name: "audio.ogg", Data: bytes.NewReader(audioBytes)},
 		&gotgbot.SendAudioOpts{
-			Caption:         bc.bridgedText,
-			Duration:        int64(audioMsg.GetSeconds()),
-			ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-			MessageThreadId: bc.threadId,
+			Caption:             bc.caption(),
+			Duration:            int64(audioMsg.GetSeconds()),
+			ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+			MessageThreadId:     bc.threadId,
+			DisableNotification: bc.silent,
 		})
 	bc.savePair(sentMsg)
 }
@@ -913,10 +979,11 @@ func (bc *bridgeContext) handleAudioMessage(v *events.Message) {
 	sentMsg, _ := bc.tgBot.SendAudio(bc.cfg.Telegram.TargetChatID,
 		&gotgbot.FileReader{Name: "audio.m4a", Data: bytes.NewReader(audioBytes)},
 		&gotgbot.SendAudioOpts{
-			Caption:         bc.bridgedText,
-			Duration:        int64(audioMsg.GetSeconds()),
-			ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-			MessageThreadId: bc.threadId,
+			Caption:             bc.caption(),
+			Duration:            int64(audioMsg.GetSeconds()),
+			ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+			MessageThreadId:     bc.threadId,
+			DisableNotification: bc.silent,
 		})
 	bc.savePair(sentMsg)
 }
@@ -947,9 +1014,10 @@ func (bc *bridgeContext) handleDocumentMessage(v *events.Message) {
 	sentMsg, _ := bc.tgBot.SendDocument(bc.cfg.Telegram.TargetChatID,
 		&gotgbot.FileReader{Name: documentMsg.GetFileName(), Data: bytes.NewReader(documentBytes)},
 		&gotgbot.SendDocumentOpts{
-			Caption:         bc.bridgedText,
-			ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-			MessageThreadId: bc.threadId,
+			Caption:             bc.caption(),
+			ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+			MessageThreadId:     bc.threadId,
+			DisableNotification: bc.silent,
 		})
 	bc.savePair(sentMsg)
 }
@@ -986,9 +1054,10 @@ func (bc *bridgeContext) handleStickerMessage(v *events.Message) {
 		sentMsg, _ := bc.tgBot.SendDocument(bc.cfg.Telegram.TargetChatID,
 			&gotgbot.FileReader{Name: "sticker." + stickerExt, Data: bytes.NewReader(stickerBytes)},
 			&gotgbot.SendDocumentOpts{
-				ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-				MessageThreadId: bc.threadId,
-				ReplyMarkup:     bc.replyMarkup,
+				ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+				MessageThreadId:     bc.threadId,
+				DisableNotification: bc.silent,
+				ReplyMarkup:         bc.replyMarkup,
 			})
 		bc.savePair(sentMsg)
 		return
@@ -1001,9 +1070,10 @@ func (bc *bridgeContext) handleStickerMessage(v *events.Message) {
 			sentMsg, _ := bc.tgBot.SendSticker(bc.cfg.Telegram.TargetChatID,
 				&gotgbot.FileReader{Name: "sticker.webm", Data: bytes.NewReader(webmBytes)},
 				&gotgbot.SendStickerOpts{
-					ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-					MessageThreadId: bc.threadId,
-					ReplyMarkup:     bc.replyMarkup,
+					ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+					MessageThreadId:     bc.threadId,
+					DisableNotification: bc.silent,
+					ReplyMarkup:         bc.replyMarkup,
 				})
 			bc.savePair(sentMsg)
 			return
@@ -1014,10 +1084,11 @@ func (bc *bridgeContext) handleStickerMessage(v *events.Message) {
 			sentMsg, _ := bc.tgBot.SendAnimation(bc.cfg.Telegram.TargetChatID,
 				&gotgbot.FileReader{Name: "animation.gif", Data: bytes.NewReader(gifBytes)},
 				&gotgbot.SendAnimationOpts{
-					Caption:         bc.bridgedText,
-					ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-					MessageThreadId: bc.threadId,
-					ReplyMarkup:     bc.replyMarkup,
+					Caption:             bc.caption(),
+					ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+					MessageThreadId:     bc.threadId,
+					DisableNotification: bc.silent,
+					ReplyMarkup:         bc.replyMarkup,
 				})
 			bc.savePair(sentMsg)
 			return
@@ -1028,9 +1099,10 @@ func (bc *bridgeContext) handleStickerMessage(v *events.Message) {
 	sentMsg, _ := bc.tgBot.SendSticker(bc.cfg.Telegram.TargetChatID,
 		&gotgbot.FileReader{Data: bytes.NewReader(stickerBytes)},
 		&gotgbot.SendStickerOpts{
-			ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-			MessageThreadId: bc.threadId,
-			ReplyMarkup:     bc.replyMarkup,
+			ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+			MessageThreadId:     bc.threadId,
+			DisableNotification: bc.silent,
+			ReplyMarkup:         bc.replyMarkup,
 		})
 	bc.savePair(sentMsg)
 }
@@ -1053,10 +1125,11 @@ func (bc *bridgeContext) handleContactMessage(v *events.Message) {
 	sentMsg, _ := bc.tgBot.SendContact(bc.cfg.Telegram.TargetChatID,
 		card.PreferredValue(goVCard.FieldTelephone), contactMsg.GetDisplayName(),
 		&gotgbot.SendContactOpts{
-			Vcard:           contactMsg.GetVcard(),
-			ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-			MessageThreadId: bc.threadId,
-			ReplyMarkup:     bc.replyMarkup,
+			Vcard:               contactMsg.GetVcard(),
+			ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+			MessageThreadId:     bc.threadId,
+			DisableNotification: bc.silent,
+			ReplyMarkup:         bc.replyMarkup,
 		})
 	bc.savePair(sentMsg)
 }
@@ -1076,8 +1149,9 @@ func (bc *bridgeContext) handleContactsArrayMessage(v *events.Message) {
 			bc.tgBot.SendMessage(bc.cfg.Telegram.TargetChatID,
 				"Couldn't send the vCard as failed to parse it",
 				&gotgbot.SendMessageOpts{
-					ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-					MessageThreadId: bc.threadId,
+					ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+					MessageThreadId:     bc.threadId,
+					DisableNotification: bc.silent,
 				})
 			continue
 		}
@@ -1085,10 +1159,11 @@ func (bc *bridgeContext) handleContactsArrayMessage(v *events.Message) {
 		sentMsg, _ := bc.tgBot.SendContact(bc.cfg.Telegram.TargetChatID,
 			card.PreferredValue(goVCard.FieldTelephone), contactMsg.GetDisplayName(),
 			&gotgbot.SendContactOpts{
-				Vcard:           contactMsg.GetVcard(),
-				ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-				MessageThreadId: bc.threadId,
-				ReplyMarkup:     bc.replyMarkup,
+				Vcard:               contactMsg.GetVcard(),
+				ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+				MessageThreadId:     bc.threadId,
+				DisableNotification: bc.silent,
+				ReplyMarkup:         bc.replyMarkup,
 			})
 		bc.savePair(sentMsg)
 	}
@@ -1120,42 +1195,106 @@ func (bc *bridgeContext) handleLiveLocationMessage(v *events.Message) {
 		return
 	}
 
-	sentMsg, _ := bc.tgBot.SendMessage(bc.cfg.Telegram.TargetChatID, bc.bridgedText,
+	liveLocationMsg := v.Message.GetLiveLocationMessage()
+
+	if isHistoryMessage(v) {
+		// The sharing is long over, only note that it happened
+		bc.sendFallbackText("")
+		return
+	}
+
+	headerMsg, _ := bc.tgBot.SendMessage(bc.cfg.Telegram.TargetChatID, bc.bridgedText,
 		&gotgbot.SendMessageOpts{
-			ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-			MessageThreadId: bc.threadId,
+			ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+			MessageThreadId:     bc.threadId,
+			DisableNotification: bc.silent,
+		})
+
+	var headerMsgId int64
+	if headerMsg != nil {
+		headerMsgId = headerMsg.MessageId
+	}
+
+	sentMsg, err := bc.tgBot.SendLocation(bc.cfg.Telegram.TargetChatID,
+		liveLocationMsg.GetDegreesLatitude(), liveLocationMsg.GetDegreesLongitude(),
+		&gotgbot.SendLocationOpts{
+			LivePeriod:         utils.TgLiveLocationIndefinitePeriod,
+			HorizontalAccuracy: float64(liveLocationMsg.GetAccuracyInMeters()),
+			Heading:            int64(liveLocationMsg.GetDegreesClockwiseFromMagneticNorth()),
+			ReplyParameters:    utils.TgMakeReplyParameters(headerMsgId, 0),
+			MessageThreadId:    bc.threadId,
+			ReplyMarkup:        bc.replyMarkup,
 		})
+	if err != nil {
+		bc.savePair(headerMsg)
+		return
+	}
 	bc.savePair(sentMsg)
+
+	err = database.LiveLocationAddNew(bc.msgId, bc.chatStr, bc.senderStr, liveLocationMsg.GetSequenceNumber(),
+		liveLocationMsg.GetDegreesLatitude(), liveLocationMsg.GetDegreesLongitude(),
+		bc.cfg.Telegram.TargetChatID, sentMsg.MessageThreadId, sentMsg.MessageId, false, time.Time{})
+	if err != nil {
+		bc.logger.Error("failed to save live location to database",
+			zap.String("event_id", v.Info.ID),
+			zap.Error(err),
+		)
+	}
 }
 
 func (bc *bridgeContext) handlePollMessage(v *events.Message) {
-	var pollMsg *waE2E.PollCreationMessage
-	if i := v.Message.GetPollCreationMessage(); i != nil {
-		pollMsg = i
-	} else if i := v.Message.GetPollCreationMessageV2(); i != nil {
-		pollMsg = i
-	} else if i := v.Message.GetPollCreationMessageV3(); i != nil {
-		pollMsg = i
+	var (
+		pollMsg = utils.WaGetPollCreationMessage(v.Message)
+		options = utils.WaPollOptionNames(pollMsg)
+	)
+
+	if utils.TgPollIsBridgeable(pollMsg.GetName(), options) {
+		pollOptions := make([]gotgbot.InputPollOption, 0, len(options))
+		for _, option := range options {
+			pollOptions = append(pollOptions, gotgbot.InputPollOption{Text: option})
+		}
+
+		description := bc.bridgedText
+		if len([]rune(description)) > utils.TgPollMaxDescLength {
+			description = utils.SubString(description, 0, utils.TgPollMaxDescLength)
+		}
+
+		sentMsg, err := bc.tgBot.SendPoll(bc.cfg.Telegram.TargetChatID, pollMsg.GetName(), pollOptions,
+			&gotgbot.SendPollOpts{
+				IsAnonymous:           proto.Bool(false),
+				AllowsMultipleAnswers: pollMsg.GetSelectableOptionsCount() != 1,
+				Description:           description,
+				DescriptionParseMode:  gotgbot.ParseModeHTML,
+				ReplyParameters:       utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+				MessageThreadId:       bc.threadId,
+			})
+		if err == nil && sentMsg.Poll != nil {
+			bc.savePair(sentMsg)
+			err = database.PollPairAddNew(bc.msgId, bc.chatStr, bc.senderStr, options,
+				bc.cfg.Telegram.TargetChatID, sentMsg.MessageThreadId, sentMsg.MessageId, sentMsg.Poll.Id)
+			if err != nil {
+				bc.logger.Error("failed to save poll pair to database",
+					zap.String("event_id", v.Info.ID),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+		bc.logger.Warn("failed to send native telegram poll, falling back to text",
+			zap.String("event_id", v.Info.ID),
+			zap.Error(err),
+		)
 	}
 
 	bc.bridgedText += "\n<i>It was the following poll:</i>\n\n"
 	bc.bridgedText += fmt.Sprintf("<b>%s</b>: (%v options selectable)\n\n",
 		html.EscapeString(pollMsg.GetName()), pollMsg.GetSelectableOptionsCount())
 
-	for optionNum, option := range pollMsg.GetOptions() {
-		if len(bc.bridgedText) > 4000 {
-			bc.bridgedText += "\n... <i>Plus some other options</i>"
-			break
-		}
-		bc.bridgedText += fmt.Sprintf("%v. %s\n", optionNum+1, html.EscapeString(option.GetOptionName()))
+	for optionNum, option := range options {
+		bc.bridgedText += fmt.Sprintf("%v. %s\n", optionNum+1, html.EscapeString(option))
 	}
 
-	sentMsg, _ := bc.tgBot.SendMessage(bc.cfg.Telegram.TargetChatID, bc.bridgedText,
-		&gotgbot.SendMessageOpts{
-			ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-			MessageThreadId: bc.threadId,
-		})
-	bc.savePair(sentMsg)
+	bc.sendText()
 }
 
 func (bc *bridgeContext) handleEventMessage(v *events.Message) {
@@ -1178,8 +1317,9 @@ func (bc *bridgeContext) handleEventMessage(v *events.Message) {
 
 	sentMsg, _ := bc.tgBot.SendMessage(bc.cfg.Telegram.TargetChatID, bc.bridgedText,
 		&gotgbot.SendMessageOpts{
-			ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-			MessageThreadId: bc.threadId,
+			ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+			MessageThreadId:     bc.threadId,
+			DisableNotification: bc.silent,
 		})
 	bc.savePair(sentMsg)
 }
@@ -1193,12 +1333,7 @@ func (bc *bridgeContext) handleTextOrReaction(text string, v *events.Message, is
 		return
 	}
 
-	// Truncate very long text
-	if len(text) > 4000 {
-		bc.bridgedText += html.EscapeString(utils.SubString(text, 0, 4000)) + "..."
-	} else {
-		bc.bridgedText += html.EscapeString(text)
-	}
+	bc.bridgedText += utils.WaTextWithTelegramFormatting(text)
 
 	// Replace @mentions with links
 	if mentioned := v.Message.GetExtendedTextMessage().GetContextInfo().GetMentionedJID(); mentioned != nil {
@@ -1212,39 +1347,81 @@ func (bc *bridgeContext) handleTextOrReaction(text string, v *events.Message, is
 		}
 	}
 
-	// Send (edit-in-place or new message)
-	var sentMsg *gotgbot.Message
-	var err error
-
 	if isEdited && !bc.cfg.WhatsApp.SendEditedMessageUpdates {
-		if isDocument {
-			sentMsg, _, err = bc.tgBot.EditMessageCaption(&gotgbot.EditMessageCaptionOpts{
-				ChatId:    bc.cfg.Telegram.TargetChatID,
-				MessageId: bc.replyToMsgId,
-				Caption:   bc.bridgedText,
-			})
-		} else {
-			sentMsg, _, err = bc.tgBot.EditMessageText(bc.bridgedText, &gotgbot.EditMessageTextOpts{
-				ChatId:    bc.cfg.Telegram.TargetChatID,
-				MessageId: bc.replyToMsgId,
-			})
-		}
+		bc.editTextInPlace(v, isDocument)
+		return
+	}
+
+	if _, err := bc.sendText(); err != nil {
+		bc.logger.Error("failed to send telegram message",
+			zap.String("event_id", v.Info.ID),
+			zap.Error(err),
+		)
+	}
+}
+
+// editTextInPlace updates the bridged message, and the parts it was split
+// into, with the edited text
+func (bc *bridgeContext) editTextInPlace(v *events.Message, isDocument bool) {
+	var (
+		parts []string
+		err   error
+	)
+
+	if isDocument {
+		parts = []string{bc.caption()}
+		_, _, err = bc.tgBot.EditMessageCaption(&gotgbot.EditMessageCaptionOpts{
+			ChatId:    bc.cfg.Telegram.TargetChatID,
+			MessageId: bc.replyToMsgId,
+			Caption:   parts[0],
+		})
+		parts = append(parts, bc.overflowParts...)
+		bc.overflowParts = nil
 	} else {
-		sentMsg, err = bc.tgBot.SendMessage(bc.cfg.Telegram.TargetChatID, bc.bridgedText,
-			&gotgbot.SendMessageOpts{
-				ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-				MessageThreadId: bc.threadId,
-			})
+		parts = utils.TgSplitHTML(bc.bridgedText, utils.TgMessageLengthLimit)
+		_, _, err = bc.tgBot.EditMessageText(parts[0], &gotgbot.EditMessageTextOpts{
+			ChatId:    bc.cfg.Telegram.TargetChatID,
+			MessageId: bc.replyToMsgId,
+		})
+	}
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		bc.logger.Error("failed to edit telegram message",
+			zap.String("event_id", v.Info.ID),
+			zap.Error(err),
+		)
+		return
 	}
 
+	existingParts, err := database.MsgIdGetParts(bc.msgId, bc.chatStr)
 	if err != nil {
-		bc.logger.Error("failed to send telegram message",
+		bc.logger.Error("failed to get message parts from database",
 			zap.String("event_id", v.Info.ID),
 			zap.Error(err),
 		)
 		return
 	}
-	bc.savePair(sentMsg)
+
+	for idx, part := range parts[1:] {
+		if idx < len(existingParts) {
+			bc.tgBot.EditMessageText(part, &gotgbot.EditMessageTextOpts{
+				ChatId:    existingParts[idx].TgChatId,
+				MessageId: existingParts[idx].TgMsgId,
+			})
+			continue
+		}
+
+		sentMsg, err := bc.tgBot.SendMessage(bc.cfg.Telegram.TargetChatID, part,
+			&gotgbot.SendMessageOpts{
+				ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+				MessageThreadId:     bc.threadId,
+				DisableNotification: bc.silent,
+			})
+		if err != nil {
+			return
+		}
+		database.MsgIdAddNewPart(bc.msgId, idx+2, bc.senderStr, bc.chatStr,
+			bc.cfg.Telegram.TargetChatID, sentMsg.MessageId, sentMsg.MessageThreadId)
+	}
 }
 
 func (bc *bridgeContext) handleReaction(v *events.Message, reactionMsg *waE2E.ReactionMessage) {
@@ -1262,7 +1439,7 @@ func (bc *bridgeContext) handleReaction(v *events.Message, reactionMsg *waE2E.Re
 		}
 	}
 
-	tgChatId, _, tgMsgId, err := database.MsgIdGetTgFromWa(reactionMsg.Key.GetID(), waChatIdForLookup)
+	tgChatId, tgThreadId, tgMsgId, err := database.MsgIdGetTgFromWa(reactionMsg.Key.GetID(), waChatIdForLookup)
 	if err != nil {
 		bc.logger.Error("failed to get message ID mapping from database",
 			zap.Error(err),
@@ -1276,40 +1453,256 @@ func (bc *bridgeContext) handleReaction(v *events.Message, reactionMsg *waE2E.Re
 		return
 	}
 
-	var reactionText string
-	if *reactionMsg.Text != "" {
-		reactionText = fmt.Sprintf("<code>Reacted to this message with %s</code>",
-			html.EscapeString(*reactionMsg.Text))
-	} else {
-		reactionText = "<code>Revoked their reaction to this message</code>"
+	reactorId := v.Info.Sender.ToNonAD().String()
+	if v.Info.IsFromMe {
+		reactorId = bc.waClient.Store.ID.ToNonAD().String()
 	}
-	bc.bridgedText += reactionText
 
-	sentMsg, err := bc.tgBot.SendMessage(bc.cfg.Telegram.TargetChatID, bc.bridgedText,
-		&gotgbot.SendMessageOpts{
-			ReplyParameters: &gotgbot.ReplyParameters{MessageId: tgMsgId},
-			MessageThreadId: bc.threadId,
-		})
+	err = database.MsgReactionUpsert(reactionMsg.Key.GetID(), waChatIdForLookup, reactorId, reactionMsg.GetText())
 	if err != nil {
-		bc.logger.Error("failed to send telegram reaction message",
+		bc.logger.Error("failed to save reaction to database",
 			zap.String("event_id", v.Info.ID),
 			zap.Error(err),
 		)
 		return
 	}
-	if sentMsg.MessageId != 0 {
-		database.MsgIdAddNewPair(bc.msgId, bc.senderStr, waChatIdForLookup,
-			bc.cfg.Telegram.TargetChatID, sentMsg.MessageId, sentMsg.MessageThreadId)
+
+	// The key of the reacted message is relative to the reactor, the pair
+	// tells whether it was sent by us
+	_, participantId, _, _ := database.MsgIdGetWaFromTg(tgChatId, tgMsgId, tgThreadId)
+	participantJID, _ := waTypes.ParseJID(participantId)
+	fromMe := participantJID.ToNonAD() == bc.waClient.Store.ID.ToNonAD()
+
+	err = utils.TgSyncWaReactions(reactionMsg.Key.GetID(), waChatIdForLookup, fromMe, tgChatId, tgThreadId, tgMsgId)
+	if err != nil {
+		bc.logger.Error("failed to update reactions on telegram",
+			zap.String("event_id", v.Info.ID),
+			zap.Error(err),
+		)
+	}
+}
+
+// ============================================================
+// Poll votes
+// ============================================================
+
+func PollUpdateEventHandler(v *events.Message) {
+	var (
+		logger   = state.State.Logger
+		waClient = state.State.WhatsAppClient()
+		pollKey  = v.Message.GetPollUpdateMessage().GetPollCreationMessageKey()
+	)
+	defer logger.Sync()
+
+	waChatId := v.Info.Chat.String()
+	if v.Info.Chat.Server == waTypes.HiddenUserServer {
+		pn, err := waClient.Store.LIDs.GetPNForLID(context.Background(), v.Info.Chat.ToNonAD())
+		if err == nil {
+			waChatId = pn.String()
+		}
+	}
+
+	pollPair, found, err := database.PollPairGetByWa(pollKey.GetID(), waChatId)
+	if err == nil && !found && waChatId != v.Info.Chat.String() {
+		pollPair, found, err = database.PollPairGetByWa(pollKey.GetID(), v.Info.Chat.String())
+	}
+	if err != nil {
+		logger.Error("failed to get poll pair from database",
+			zap.String("poll_id", pollKey.GetID()),
+			zap.String("chat_id", waChatId),
+			zap.Error(err),
+		)
+		return
+	} else if !found {
+		return
+	}
+
+	pollVote, err := waClient.DecryptPollVote(context.Background(), v)
+	if err != nil {
+		logger.Warn("failed to decrypt poll vote",
+			zap.String("event_id", v.Info.ID),
+			zap.String("poll_id", pollKey.GetID()),
+			zap.Error(err),
+		)
+		return
+	}
+
+	voterId := v.Info.Sender.ToNonAD().String()
+	if v.Info.IsFromMe {
+		voterId = waClient.Store.ID.ToNonAD().String()
+	}
+
+	selectedOptions := utils.WaPollOptionsFromHashes(pollPair.OptionNames(), pollVote.GetSelectedOptions())
+	err = database.PollVoteUpsert(pollPair.ID, pollPair.WaChatId, voterId, selectedOptions)
+	if err != nil {
+		logger.Error("failed to save poll vote to database",
+			zap.String("event_id", v.Info.ID),
+			zap.Error(err),
+		)
+		return
+	}
+
+	err = utils.TgUpdatePollTally(pollPair)
+	if err != nil {
+		logger.Error("failed to update poll tally on telegram",
+			zap.String("poll_id", pollPair.ID),
+			zap.Error(err),
+		)
 	}
 }
 
+// ============================================================
+// Live locations
+// ============================================================
+
+// LiveLocationUpdateEventHandler moves the bridged Telegram live location
+// when WhatsApp sends a newer position for an active session. It returns
+// false if there is no such session, in which case the message is bridged
+// as a new live location.
+func LiveLocationUpdateEventHandler(v *events.Message) bool {
+	var (
+		logger          = state.State.Logger
+		tgBot           = state.State.TelegramBot
+		liveLocationMsg = v.Message.GetLiveLocationMessage()
+		waChatId        = v.Info.Chat.String()
+	)
+	defer logger.Sync()
+
+	liveLocation, found, err := database.LiveLocationGetByWaMsg(v.Info.ID, waChatId)
+	if err == nil && !found {
+		liveLocation, found, err = database.LiveLocationGetActiveByWa(waChatId, v.Info.MessageSource.Sender.String())
+	}
+	if err != nil {
+		logger.Error("failed to get live location from database",
+			zap.String("event_id", v.Info.ID),
+			zap.String("chat_id", waChatId),
+			zap.Error(err),
+		)
+		return false
+	} else if !found || !liveLocation.Active || liveLocation.FromTelegram {
+		return false
+	}
+
+	if liveLocationMsg.GetSequenceNumber() != 0 && liveLocationMsg.GetSequenceNumber() <= liveLocation.SequenceNumber {
+		// Older or repeated update
+		return true
+	}
+
+	_, _, err = tgBot.EditMessageLiveLocation(
+		liveLocationMsg.GetDegreesLatitude(), liveLocationMsg.GetDegreesLongitude(),
+		&gotgbot.EditMessageLiveLocationOpts{
+			ChatId:             liveLocation.TgChatId,
+			MessageId:          liveLocation.TgMsgId,
+			HorizontalAccuracy: float64(liveLocationMsg.GetAccuracyInMeters()),
+			Heading:            int64(liveLocationMsg.GetDegreesClockwiseFromMagneticNorth()),
+		})
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		logger.Warn("failed to update live location on telegram",
+			zap.String("event_id", v.Info.ID),
+			zap.Int64("tg_msg_id", liveLocation.TgMsgId),
+			zap.Error(err),
+		)
+		if strings.Contains(err.Error(), "message can't be edited") {
+			database.LiveLocationDeactivate(liveLocation.WaMsgId, liveLocation.WaChatId)
+			return false
+		}
+		return true
+	}
+
+	err = database.LiveLocationSetSequence(liveLocation.WaMsgId, liveLocation.WaChatId, liveLocationMsg.GetSequenceNumber())
+	if err != nil {
+		logger.Error("failed to update live location in database",
+			zap.String("event_id", v.Info.ID),
+			zap.Error(err),
+		)
+	}
+	return true
+}
+
+// stopLiveLocation ends a bridged live location session. Sessions coming
+// from WhatsApp are also stopped on Telegram, and the ones from Telegram on
+// WhatsApp.
+func stopLiveLocation(liveLocation database.LiveLocation) {
+	var (
+		logger = state.State.Logger
+		tgBot  = state.State.TelegramBot
+	)
+
+	if liveLocation.FromTelegram {
+		if err := utils.TgEndLiveLocationOnWhatsApp(liveLocation); err != nil {
+			logger.Warn("failed to stop live location on whatsapp",
+				zap.String("wa_msg_id", liveLocation.WaMsgId),
+				zap.Error(err),
+			)
+		}
+	} else {
+		_, _, err := tgBot.StopMessageLiveLocation(&gotgbot.StopMessageLiveLocationOpts{
+			ChatId:    liveLocation.TgChatId,
+			MessageId: liveLocation.TgMsgId,
+		})
+		if err != nil && !strings.Contains(err.Error(), "message can't be edited") {
+			logger.Warn("failed to stop live location on telegram",
+				zap.Int64("tg_msg_id", liveLocation.TgMsgId),
+				zap.Error(err),
+			)
+		}
+	}
+
+	err := database.LiveLocationDeactivate(liveLocation.WaMsgId, liveLocation.WaChatId)
+	if err != nil {
+		logger.Error("failed to deactivate live location in database",
+			zap.String("wa_msg_id", liveLocation.WaMsgId),
+			zap.Error(err),
+		)
+	}
+}
+
+var liveLocationWorker = utils.NewWorker()
+
+// StartLiveLocationWatcher periodically stops the live locations which have
+// expired or for which WhatsApp stopped sending updates
+func StartLiveLocationWatcher() {
+	var (
+		cfg    = state.State.Config
+		logger = state.State.Logger
+	)
+
+	liveLocationWorker.Go(func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-liveLocationWorker.Stopping():
+				return
+			}
+
+			timeout := time.Duration(cfg.WhatsApp.LiveLocationTimeoutMinutes) * time.Minute
+			liveLocations, err := database.LiveLocationGetStale(time.Now().UTC().Add(-timeout))
+			if err != nil {
+				logger.Error("failed to get stale live locations from database", zap.Error(err))
+				continue
+			}
+			for _, liveLocation := range liveLocations {
+				stopLiveLocation(liveLocation)
+			}
+		}
+	})
+}
+
+// StopLiveLocationWatcher stops looking for stale live locations, the
+// returned context is done once a check which is already running finished
+func StopLiveLocationWatcher() context.Context {
+	return liveLocationWorker.Stop()
+}
+
 // ============================================================
 // Undecryptable / View-Once messages
 // ============================================================
 
 func UndecryptableMessageEventHandler(v *events.UndecryptableMessage) {
 	var (
-		cfg    = state.State.Config
 		logger = state.State.Logger
 		tgBot  = state.State.TelegramBot
 		msgId  = v.Info.ID
@@ -1319,7 +1712,8 @@ func UndecryptableMessageEventHandler(v *events.UndecryptableMessage) {
 	if v.UnavailableType != events.UnavailableTypeViewOnce {
 		return
 	}
-	if slices.Contains(cfg.WhatsApp.IgnoreChats, v.Info.Chat.User) {
+	cfg, chatSettings := utils.WaChatConfig(v.Info.Chat.String())
+	if slices.Contains(cfg.WhatsApp.IgnoreChats, v.Info.Chat.User) || chatSettings.Muted {
 		logger.Debug("returning because message from an ignored chat",
 			zap.String("event_id", v.Info.ID),
 			zap.String("chat_jid", v.Info.Chat.String()),
@@ -1386,7 +1780,7 @@ func ReceiptEventHandler(v *events.Receipt) {
 	participantID := v.Sender.ToNonAD().String()
 	waChatID := v.Chat.ToNonAD().String()
 	cfg := state.State.Config
-	waClient := state.State.WhatsAppClient
+	waClient := state.State.WhatsAppClient()
 	tgBot := state.State.TelegramBot
 
 	for _, msgId := range v.MessageIDs {
@@ -1497,7 +1891,7 @@ func UserAboutEventHandler(v *events.UserAbout) {
 		cfg      = state.State.Config
 		logger   = state.State.Logger
 		tgBot    = state.State.TelegramBot
-		waClient = state.State.WhatsAppClient
+		waClient = state.State.WhatsAppClient()
 	)
 	defer logger.Sync()
 
@@ -1569,6 +1963,10 @@ func RevokedMessageEventHandler(v *events.Message) {
 		waChatId    = v.Info.Chat.String()
 	)
 
+	if liveLocation, found, _ := database.LiveLocationGetByWaMsg(waMsgId, waChatId); found && liveLocation.Active {
+		stopLiveLocation(liveLocation)
+	}
+
 	if !cfg.WhatsApp.SendRevokedMessageUpdates {
 		return
 	}
@@ -1619,7 +2017,7 @@ func PictureEventHandler(v *events.Picture) {
 
 func handleGroupPictureEvent(v *events.Picture, cfg *state.Config, logger *zap.Logger, tgBot *gotgbot.Bot) {
 	// Use the concrete client for proper typing
-	client := state.State.WhatsAppClient
+	client := state.State.WhatsAppClient()
 	tgThreadId, err := utils.TgGetOrMakeThreadFromWa(v.JID.ToNonAD(), cfg.Telegram.TargetChatID,
 		utils.WaGetGroupName(v.JID))
 	if err != nil {
@@ -1643,7 +2041,7 @@ func handleGroupPictureEvent(v *events.Picture, cfg *state.Config, logger *zap.L
 }
 
 func handleUserPictureEvent(v *events.Picture, cfg *state.Config, logger *zap.Logger, tgBot *gotgbot.Bot) {
-	client := state.State.WhatsAppClient
+	client := state.State.WhatsAppClient()
 	targetJID := v.JID.ToNonAD()
 	threadName := utils.WaGetContactName(targetJID)
 
@@ -1713,7 +2111,7 @@ func GroupInfoEventHandler(v *events.GroupInfo) {
 		cfg      = state.State.Config
 		logger   = state.State.Logger
 		tgBot    = state.State.TelegramBot
-		waClient = state.State.WhatsAppClient
+		waClient = state.State.WhatsAppClient()
 	)
 	defer logger.Sync()
 
@@ -1815,7 +2213,8 @@ func GroupInfoEventHandler(v *events.GroupInfo) {
 	}
 
 	// Skip member join/leave for ignored chats
-	if slices.Contains(cfg.WhatsApp.IgnoreChats, v.JID.ToNonAD().User) {
+	_, chatSettings := utils.WaChatConfig(v.JID.ToNonAD().String())
+	if slices.Contains(cfg.WhatsApp.IgnoreChats, v.JID.ToNonAD().User) || chatSettings.Muted {
 		logger.Debug("returning because message from an ignored chat",
 			zap.String("chat_jid", v.JID.String()))
 		return
@@ -1977,6 +2376,28 @@ func LogoutHandler(v *events.LoggedOut) {
 	defer logger.Sync()
 
 	updateText := "You have been logged out from WhatsApp:\n\n"
-	updateText += fmt.Sprintf("<b>Reason:</b> %s", html.EscapeString(v.Reason.String()))
-	utils.TgSendTextById(tgBot, cfg.Telegram.OwnerID, 0, updateText)
+	updateText += fmt.Sprintf("<b>Reason:</b> %s\n\n", html.EscapeString(v.Reason.String()))
+	updateText += "Press the button below or send /relogin to link the bridge again"
+
+	_, err := tgBot.SendMessage(cfg.Telegram.OwnerID, updateText, &gotgbot.SendMessageOpts{
+		ReplyMarkup: gotgbot.InlineKeyboardMarkup{
+			InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{{
+				Text:         "Log in again",
+				CallbackData: "relogin",
+			}}},
+		},
+	})
+	if err != nil {
+		logger.Error("failed to send logout notification", zap.Error(err))
+	}
+}
+
+func PairSuccessHandler(v *events.PairSuccess) {
+	var (
+		cfg   = state.State.Config
+		tgBot = state.State.TelegramBot
+	)
+
+	utils.TgSendTextById(tgBot, cfg.Telegram.OwnerID, 0,
+		fmt.Sprintf("Successfully logged in to WhatsApp as <code>%s</code>", html.EscapeString(v.ID.ToNonAD().String())))
 }
@@ -0,0 +1,242 @@
+package whatsapp
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"sync"
+	"time"
+
+	"watgbridge/state"
+	"watgbridge/utils"
+
+	"go.mau.fi/whatsmeow/types/events"
+	"go.uber.org/zap"
+)
+
+// States of the connection to WhatsApp, as reported by /status
+const (
+	ConnectionConnected        = "connected"
+	ConnectionDisconnected     = "disconnected"
+	ConnectionStreamReplaced   = "replaced by another session"
+	ConnectionKeepAliveTimeout = "not answering keep-alives"
+	ConnectionTemporaryBan     = "temporarily banned"
+	ConnectionLoggedOut        = "logged out"
+)
+
+// ConnectionHealth is what is known about the connection to WhatsApp from
+// the events of the client
+type ConnectionHealth struct {
+	State  string
+	Detail string
+	Since  time.Time
+
+	LastConnected    time.Time
+	LastDisconnected time.Time
+	LastMessage      time.Time
+
+	ReconnectAttempts int
+}
+
+var (
+	healthLock        sync.Mutex
+	health            ConnectionHealth
+	healthNotifyTimer *time.Timer
+	healthNotified    bool
+	healthStopped     bool
+	reconnecting      bool
+
+	// Runs the reconnection, stopped with the monitor
+	healthWorker = utils.NewWorker()
+)
+
+// GetConnectionHealth returns the current state of the connection to WhatsApp
+func GetConnectionHealth() ConnectionHealth {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	return health
+}
+
+// StartHealthMonitor records the state of the connection made before the
+// event handlers were added
+func StartHealthMonitor() {
+	waClient := state.State.WhatsAppClient()
+	if waClient.IsConnected() && waClient.IsLoggedIn() {
+		setConnectionState(ConnectionConnected, "")
+	} else {
+		setConnectionState(ConnectionDisconnected, "")
+	}
+}
+
+// ConnectionEventHandler tracks the events telling about the connection
+func ConnectionEventHandler(evt interface{}) {
+	switch v := evt.(type) {
+	case *events.Connected, *events.KeepAliveRestored:
+		setConnectionState(ConnectionConnected, "")
+	case *events.Disconnected:
+		setConnectionState(ConnectionDisconnected, "")
+	case *events.StreamReplaced:
+		setConnectionState(ConnectionStreamReplaced, "")
+	case *events.KeepAliveTimeout:
+		setConnectionState(ConnectionKeepAliveTimeout, fmt.Sprintf("%d failed keep-alives", v.ErrorCount))
+	case *events.TemporaryBan:
+		setConnectionState(ConnectionTemporaryBan, v.String())
+	case *events.LoggedOut:
+		setConnectionState(ConnectionLoggedOut, v.Reason.String())
+	case *events.Message:
+		healthLock.Lock()
+		health.LastMessage = time.Now().UTC()
+		healthLock.Unlock()
+	}
+}
+
+func setConnectionState(newState, detail string) {
+	var (
+		cfg    = state.State.Config.WhatsApp.Health
+		logger = state.State.Logger
+		now    = time.Now().UTC()
+	)
+
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	health.Detail = detail
+	if healthStopped || health.State == newState {
+		return
+	}
+
+	var (
+		oldState = health.State
+		oldSince = health.Since
+	)
+	health.State, health.Since = newState, now
+
+	if oldState != "" {
+		logger.Info("WhatsApp connection state changed",
+			zap.String("from", oldState),
+			zap.String("to", newState),
+			zap.String("detail", detail),
+		)
+	}
+
+	if newState == ConnectionConnected {
+		health.LastConnected = now
+		health.ReconnectAttempts = 0
+		if healthNotifyTimer != nil {
+			healthNotifyTimer.Stop()
+			healthNotifyTimer = nil
+		}
+		if healthNotified {
+			healthNotified = false
+			go utils.TgSendTextById(state.State.TelegramBot, state.State.Config.Telegram.OwnerID, 0,
+				fmt.Sprintf("✅ WhatsApp is connected again after being down for %s", now.Sub(oldSince).Round(time.Second)))
+		}
+		return
+	}
+
+	if oldState == ConnectionConnected || oldState == "" {
+		health.LastDisconnected = now
+	}
+
+	// Logging out is already reported with a way to log in again
+	if newState != ConnectionLoggedOut && cfg.NotifyAfterSeconds > 0 && healthNotifyTimer == nil && !healthNotified {
+		healthNotifyTimer = time.AfterFunc(time.Duration(cfg.NotifyAfterSeconds)*time.Second, notifyConnectionDown)
+	}
+
+	// Reconnecting after another session took over would kick it out in turn
+	if cfg.AutoReconnect && !reconnecting && newState != ConnectionStreamReplaced &&
+		newState != ConnectionTemporaryBan && newState != ConnectionLoggedOut {
+		reconnecting = healthWorker.Go(reconnectWithBackoff)
+	}
+}
+
+func notifyConnectionDown() {
+	healthLock.Lock()
+	if healthStopped || health.State == ConnectionConnected {
+		healthLock.Unlock()
+		return
+	}
+	healthNotifyTimer = nil
+	healthNotified = true
+	current := health
+	healthLock.Unlock()
+
+	text := fmt.Sprintf("⚠️ WhatsApp has been <b>%s</b> for %s",
+		html.EscapeString(current.State), time.Since(current.Since).Round(time.Second))
+	if current.Detail != "" {
+		text += fmt.Sprintf("\n\n<i>%s</i>", html.EscapeString(current.Detail))
+	}
+	text += "\n\nUse /status for details or /restartwa to reconnect"
+
+	utils.TgSendTextById(state.State.TelegramBot, state.State.Config.Telegram.OwnerID, 0, text)
+}
+
+// Time given to whatsmeow to reconnect by itself before stepping in, longer
+// than its first retries which come a few seconds apart
+const reconnectFirstDelay = 30 * time.Second
+
+// reconnectWithBackoff reconnects to WhatsApp until the connection is back,
+// waiting twice as long after every attempt. whatsmeow reconnects by itself
+// after most disconnections, so it only steps in when that did not happen,
+// and leaves alone a connection which is up but not ready yet.
+func reconnectWithBackoff() {
+	var (
+		cfg      = state.State.Config.WhatsApp.Health
+		logger   = state.State.Logger
+		delay    = reconnectFirstDelay
+		maxDelay = max(time.Duration(cfg.ReconnectMaxDelaySeconds)*time.Second, reconnectFirstDelay)
+	)
+	for {
+		select {
+		case <-time.After(delay):
+		case <-healthWorker.Stopping():
+			return
+		}
+		delay = min(delay*2, maxDelay)
+
+		healthLock.Lock()
+		currentState := health.State
+		if healthStopped || currentState == ConnectionConnected || currentState == ConnectionStreamReplaced ||
+			currentState == ConnectionTemporaryBan || currentState == ConnectionLoggedOut {
+			reconnecting = false
+			healthLock.Unlock()
+			return
+		}
+		healthLock.Unlock()
+
+		waClient := state.State.WhatsAppClient()
+		if waClient.Store.ID == nil || waClient.IsConnected() {
+			continue
+		}
+
+		healthLock.Lock()
+		health.ReconnectAttempts++
+		attempt := health.ReconnectAttempts
+		healthLock.Unlock()
+
+		logger.Info("reconnecting to WhatsApp",
+			zap.String("state", currentState),
+			zap.Int("attempt", attempt),
+		)
+		waClient.Disconnect()
+		if err := waClient.Connect(); err != nil {
+			logger.Warn("failed to reconnect to WhatsApp", zap.Int("attempt", attempt), zap.Error(err))
+		}
+	}
+}
+
+// StopHealthMonitor stops notifying about the connection and reconnecting to
+// WhatsApp, the returned context is done once a reconnection attempt which
+// is already running finished
+func StopHealthMonitor() context.Context {
+	healthLock.Lock()
+	healthStopped = true
+	if healthNotifyTimer != nil {
+		healthNotifyTimer.Stop()
+		healthNotifyTimer = nil
+	}
+	healthLock.Unlock()
+
+	return healthWorker.Stop()
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"watgbridge/database"
+	"watgbridge/metrics"
 	"watgbridge/state"
 	"watgbridge/utils"
 
@@ -13,6 +14,7 @@ import (
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/proto/waE2E"
 	waTypes "go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
 	"go.uber.org/zap"
 )
 
@@ -31,45 +33,213 @@ type bridgeContext struct {
 	senderStr    string
 	chatStr      string
 	replyMarkup  gotgbot.InlineKeyboardMarkup
+	silent       bool // Sent without a notification, set in /chatsettings
+
+	// Type of the message and when it was received, for the metrics
+	msgType    string
+	receivedAt time.Time
+
+	// Rest of a text or caption which did not fit in the first message, sent
+	// as follow-ups by savePair
+	overflowParts []string
+
+	// Saved in the archive by savePair, nil when the archive is disabled
+	archive *database.ArchivedMessage
 }
 
 // savePair persists the WA↔TG message-ID mapping if the Telegram message
-// was sent successfully.
+// was sent successfully, and sends the overflowing parts after it.
 func (bc *bridgeContext) savePair(sentMsg *gotgbot.Message) {
 	if sentMsg != nil && sentMsg.MessageId != 0 {
+		metrics.BridgedMessages.Inc(metrics.WhatsAppToTelegram, bc.msgType)
+		metrics.SendDuration.Observe(time.Since(bc.receivedAt), metrics.WhatsAppToTelegram)
 		database.MsgIdAddNewPair(
 			bc.msgId, bc.senderStr, bc.chatStr,
 			bc.cfg.Telegram.TargetChatID,
 			sentMsg.MessageId, sentMsg.MessageThreadId,
 		)
+		if bc.archive != nil {
+			bc.archive.TgChatId = bc.cfg.Telegram.TargetChatID
+			bc.archive.TgThreadId = sentMsg.MessageThreadId
+			bc.archive.TgMsgId = sentMsg.MessageId
+			if fileId := utils.TgMessageFileId(sentMsg); fileId != "" {
+				bc.archive.TgFileId = fileId
+			}
+			if err := database.ArchiveSaveMessage(bc.archive); err != nil {
+				bc.logger.Warn("failed to archive message",
+					zap.String("msg_id", bc.msgId),
+					zap.Error(err),
+				)
+			}
+		}
+		utils.TgAttachQuickActionsButton(sentMsg)
+		bc.sendOverflowParts(sentMsg.MessageId)
+	}
+}
+
+// sendOverflowParts sends the parts which did not fit in the first message
+// as replies to it, saving each of them so that replies to any part are
+// bridged back to the same WhatsApp message
+func (bc *bridgeContext) sendOverflowParts(firstMsgId int64) {
+	overflowParts := bc.overflowParts
+	bc.overflowParts = nil
+
+	for idx, part := range overflowParts {
+		sentMsg, err := bc.tgBot.SendMessage(bc.cfg.Telegram.TargetChatID, part,
+			&gotgbot.SendMessageOpts{
+				ReplyParameters:     utils.TgMakeReplyParameters(firstMsgId, 0),
+				MessageThreadId:     bc.threadId,
+				DisableNotification: bc.silent,
+			})
+		if err != nil {
+			bc.logger.Error("failed to send part of a long message",
+				zap.String("msg_id", bc.msgId),
+				zap.Int("part", idx+2),
+				zap.Error(err),
+			)
+			return
+		}
+		database.MsgIdAddNewPart(bc.msgId, idx+2, bc.senderStr, bc.chatStr,
+			bc.cfg.Telegram.TargetChatID, sentMsg.MessageId, sentMsg.MessageThreadId)
+	}
+}
+
+// caption returns the part of the bridged text which fits in a caption,
+// keeping the rest to be sent after the media
+func (bc *bridgeContext) caption() string {
+	parts := utils.TgSplitHTML(bc.bridgedText, utils.TgCaptionLengthLimit)
+	if len(parts) == 0 {
+		return ""
+	}
+	bc.overflowParts = parts[1:]
+	return parts[0]
+}
+
+// sendText sends the bridged text, split over several messages if it is too
+// long for one, and saves all of them
+func (bc *bridgeContext) sendText() (*gotgbot.Message, error) {
+	parts := utils.TgSplitHTML(bc.bridgedText, utils.TgMessageLengthLimit)
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("nothing to send")
 	}
+
+	sentMsg, err := bc.tgBot.SendMessage(bc.cfg.Telegram.TargetChatID, parts[0],
+		&gotgbot.SendMessageOpts{
+			ReplyParameters:     utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
+			MessageThreadId:     bc.threadId,
+			DisableNotification: bc.silent,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	bc.overflowParts = parts[1:]
+	bc.savePair(sentMsg)
+	return sentMsg, nil
 }
 
 // sendFallbackText sends a text-only message (header + extra info) to
 // Telegram and saves the pair. Used when media cannot be sent.
 func (bc *bridgeContext) sendFallbackText(extraText string) {
-	sentMsg, _ := bc.tgBot.SendMessage(
-		bc.cfg.Telegram.TargetChatID,
-		bc.bridgedText+extraText,
-		&gotgbot.SendMessageOpts{
-			ReplyParameters: utils.TgMakeReplyParameters(bc.replyToMsgId, 0),
-			MessageThreadId: bc.threadId,
-		},
-	)
-	bc.savePair(sentMsg)
+	bc.bridgedText += extraText
+	bc.sendText()
+}
+
+// waMessageType names the type of a message the way it is dispatched to the
+// media-type handlers, for the metrics
+func waMessageType(msg *waE2E.Message) string {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return "image"
+	case msg.GetVideoMessage() != nil && msg.GetVideoMessage().GetGifPlayback():
+		return "gif"
+	case msg.GetVideoMessage() != nil || msg.GetPtvMessage() != nil:
+		return "video"
+	case msg.GetAudioMessage() != nil && msg.GetAudioMessage().GetPTT():
+		return "voice_note"
+	case msg.GetAudioMessage() != nil:
+		return "audio"
+	case msg.GetDocumentMessage() != nil:
+		return "document"
+	case msg.GetStickerMessage() != nil:
+		return "sticker"
+	case msg.GetContactMessage() != nil || msg.GetContactsArrayMessage() != nil:
+		return "contact"
+	case msg.GetLocationMessage() != nil || msg.GetLiveLocationMessage() != nil:
+		return "location"
+	case msg.GetPollCreationMessage() != nil ||
+		msg.GetPollCreationMessageV2() != nil ||
+		msg.GetPollCreationMessageV3() != nil:
+		return "poll"
+	case msg.GetEventMessage() != nil:
+		return "event"
+	case msg.GetReactionMessage() != nil:
+		return "reaction"
+	default:
+		return "text"
+	}
 }
 
-// addCaption appends a caption (truncated at 1020 chars if needed) to
-// the bridged text.
+// waArchivedMessage returns the archive entry of a message, without the
+// Telegram message which is only known once it is sent. It returns nil for
+// reactions, which are not archived. The media details of an edit are left
+// empty for the archive to keep the ones of the original message.
+func waArchivedMessage(v *events.Message, msgId, text string, isEdited bool) *database.ArchivedMessage {
+	msgType := waMessageType(v.Message)
+	if msgType == "reaction" {
+		return nil
+	}
+
+	// Senders hidden behind a LID are stored with their phone number when it
+	// is known, for /search from:<number> to find them
+	sender := v.Info.MessageSource.Sender.ToNonAD()
+	if sender.Server == waTypes.HiddenUserServer && !v.Info.MessageSource.SenderAlt.IsEmpty() {
+		sender = v.Info.MessageSource.SenderAlt.ToNonAD()
+	}
+
+	archived := &database.ArchivedMessage{
+		WaMsgId:    msgId,
+		WaChatId:   v.Info.Chat.String(),
+		SenderId:   sender.String(),
+		SenderName: utils.WaGetContactName(v.Info.Sender),
+		Timestamp:  v.Info.Timestamp.UTC(),
+		Text:       text,
+	}
+	if isEdited {
+		return archived
+	}
+
+	archived.MediaType = msgType
+	switch msg := v.Message; {
+	case msg.GetImageMessage() != nil:
+		archived.MimeType = msg.GetImageMessage().GetMimetype()
+		archived.FileSize = msg.GetImageMessage().GetFileLength()
+	case msg.GetVideoMessage() != nil:
+		archived.MimeType = msg.GetVideoMessage().GetMimetype()
+		archived.FileSize = msg.GetVideoMessage().GetFileLength()
+	case msg.GetAudioMessage() != nil:
+		archived.MimeType = msg.GetAudioMessage().GetMimetype()
+		archived.FileSize = msg.GetAudioMessage().GetFileLength()
+	case msg.GetDocumentMessage() != nil:
+		// The text of a document is its file name, unless it has a caption
+		archived.Text = msg.GetDocumentMessage().GetCaption()
+		archived.MimeType = msg.GetDocumentMessage().GetMimetype()
+		archived.FileName = msg.GetDocumentMessage().GetFileName()
+		archived.FileSize = msg.GetDocumentMessage().GetFileLength()
+	case msg.GetStickerMessage() != nil:
+		archived.MimeType = msg.GetStickerMessage().GetMimetype()
+		archived.FileSize = msg.GetStickerMessage().GetFileLength()
+	}
+	return archived
+}
+
+// addCaption appends a caption to the bridged text, the part which does not
+// fit in the caption limit is sent after the media.
 func addCaption(bridgedText *string, caption string) {
 	if caption == "" {
 		return
 	}
-	if len(caption) > 1020 {
-		*bridgedText += html.EscapeString(utils.SubString(caption, 0, 1020)) + "..."
-	} else {
-		*bridgedText += html.EscapeString(caption)
-	}
+	*bridgedText += utils.WaTextWithTelegramFormatting(caption)
 }
 
 // getContextInfo extracts the ContextInfo from any WhatsApp message type.
@@ -0,0 +1,311 @@
+package whatsapp
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"sync"
+	"time"
+
+	"watgbridge/database"
+	"watgbridge/state"
+	"watgbridge/utils"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/proto/waWeb"
+	waTypes "go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// Only one chat is imported at a time so that the pacing holds across
+// several /importhistory commands
+var historyImportLock sync.Mutex
+
+// The imports stop with the worker, and go on from where they were after the
+// next start
+var historyImportWorker = utils.NewWorker()
+
+// goHistoryImport runs the import of a chat in the background, unless the
+// imports were stopped
+func goHistoryImport(waChatId string) {
+	historyImportWorker.Go(func() {
+		runHistoryImport(waChatId)
+	})
+}
+
+// StopHistoryImports interrupts the running imports, the returned context is
+// done once they all returned
+func StopHistoryImports() context.Context {
+	return historyImportWorker.Stop()
+}
+
+// HistorySyncEventHandler stores the conversations received in history syncs
+// so that they can be replayed into Telegram with /importhistory
+func HistorySyncEventHandler(v *events.HistorySync) {
+	logger := state.State.Logger
+	defer logger.Sync()
+
+	var historyMessages []database.HistoryMessage
+	for _, conv := range v.Data.GetConversations() {
+		for _, historyMsg := range conv.GetMessages() {
+			webMsg := historyMsg.GetMessage()
+			if webMsg.GetKey().GetID() == "" || webMsg.GetMessage() == nil {
+				continue
+			}
+
+			rawMessage, err := proto.Marshal(webMsg)
+			if err != nil {
+				continue
+			}
+
+			historyMessages = append(historyMessages, database.HistoryMessage{
+				WaChatId:   conv.GetID(),
+				WaMsgId:    webMsg.GetKey().GetID(),
+				Timestamp:  time.Unix(int64(webMsg.GetMessageTimestamp()), 0).UTC(),
+				RawMessage: rawMessage,
+			})
+		}
+	}
+
+	err := database.HistoryMessageBulkAdd(historyMessages)
+	if err != nil {
+		logger.Error("failed to save history sync messages to database",
+			zap.String("sync_type", v.Data.GetSyncType().String()),
+			zap.Error(err),
+		)
+		return
+	}
+
+	logger.Info("stored messages from history sync",
+		zap.String("sync_type", v.Data.GetSyncType().String()),
+		zap.Int("conversations", len(v.Data.GetConversations())),
+		zap.Int("messages", len(historyMessages)),
+	)
+
+	if v.Data.GetSyncType() == waHistorySync.HistorySync_ON_DEMAND {
+		state.State.TelegramBot.SendMessage(state.State.Config.Telegram.OwnerID,
+			fmt.Sprintf("Received %d older messages from WhatsApp, run /importhistory again to import them", len(historyMessages)),
+			&gotgbot.SendMessageOpts{})
+	}
+}
+
+// historyChatIds returns the JIDs a chat may be stored under in history
+// syncs, which use LIDs for some private chats
+func historyChatIds(chatJID waTypes.JID) []string {
+	waClient := state.State.WhatsAppClient()
+
+	chatIds := []string{chatJID.String()}
+	switch chatJID.Server {
+	case waTypes.DefaultUserServer:
+		if lid, err := waClient.Store.LIDs.GetLIDForPN(context.Background(), chatJID); err == nil && !lid.IsEmpty() {
+			chatIds = append(chatIds, lid.String())
+		}
+	case waTypes.HiddenUserServer:
+		if pn, err := waClient.Store.LIDs.GetPNForLID(context.Background(), chatJID); err == nil && !pn.IsEmpty() {
+			chatIds = append(chatIds, pn.String())
+		}
+	}
+	return chatIds
+}
+
+// StartHistoryImport queues the import of the stored history of a chat
+// starting from the given number of days ago. If older messages than the
+// stored ones are needed, they are requested from the phone.
+func StartHistoryImport(chatJID waTypes.JID, days uint32) (bool, error) {
+	waClient := state.State.WhatsAppClient()
+
+	since := time.Now().UTC().Add(-time.Duration(days) * 24 * time.Hour)
+	chatIds := historyChatIds(chatJID)
+
+	oldest, found, err := database.HistoryMessageGetOldest(chatIds)
+	if err != nil {
+		return false, err
+	} else if !found {
+		return false, nil
+	}
+
+	if oldest.Timestamp.After(since) {
+		var webMsg waWeb.WebMessageInfo
+		if err := proto.Unmarshal(oldest.RawMessage, &webMsg); err == nil {
+			oldestChatJID, _ := waTypes.ParseJID(oldest.WaChatId)
+			_, err = waClient.SendPeerMessage(context.Background(), waClient.BuildHistorySyncRequest(&waTypes.MessageInfo{
+				MessageSource: waTypes.MessageSource{
+					Chat:     oldestChatJID,
+					IsFromMe: webMsg.GetKey().GetFromMe(),
+				},
+				ID:        oldest.WaMsgId,
+				Timestamp: oldest.Timestamp,
+			}, 50))
+			if err != nil {
+				state.State.Logger.Warn("failed to request older history from the phone",
+					zap.String("chat_id", oldest.WaChatId),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+
+	err = database.HistoryImportJobStart(chatJID.String(), since)
+	if err != nil {
+		return true, err
+	}
+
+	goHistoryImport(chatJID.String())
+	return true, nil
+}
+
+// ResumeHistoryImports continues the imports which were interrupted by a
+// restart
+func ResumeHistoryImports() {
+	jobs, err := database.HistoryImportJobGetUnfinished()
+	if err != nil {
+		state.State.Logger.Error("failed to get unfinished history imports from database", zap.Error(err))
+		return
+	}
+	for _, job := range jobs {
+		goHistoryImport(job.WaChatId)
+	}
+}
+
+func runHistoryImport(waChatId string) {
+	var (
+		cfg    = state.State.Config
+		logger = state.State.Logger
+		tgBot  = state.State.TelegramBot
+	)
+
+	historyImportLock.Lock()
+	defer historyImportLock.Unlock()
+
+	if historyImportWorker.Stopped() {
+		return
+	}
+
+	job, found, err := database.HistoryImportJobGet(waChatId)
+	if err != nil || !found || job.Finished {
+		return
+	}
+
+	chatJID, ok := utils.WaParseJID(waChatId)
+	if !ok {
+		database.HistoryImportJobFinish(waChatId)
+		return
+	}
+	chatIds := historyChatIds(chatJID)
+
+	delay := time.Minute / time.Duration(max(cfg.WhatsApp.HistoryImport.MessagesPerMinute, 1))
+
+	for {
+		historyMessages, err := database.HistoryMessageGetNext(chatIds, job.Since, job.LastTimestamp, job.LastMsgId, 50)
+		if err != nil {
+			logger.Error("failed to get history messages from database",
+				zap.String("chat_id", waChatId),
+				zap.Error(err),
+			)
+			return
+		} else if len(historyMessages) == 0 {
+			break
+		}
+
+		for _, historyMessage := range historyMessages {
+			if historyImportWorker.Stopped() {
+				return
+			}
+
+			if replayHistoryMessage(historyMessage) {
+				job.Imported += 1
+				select {
+				case <-time.After(delay):
+				case <-historyImportWorker.Stopping():
+				}
+			}
+
+			job.LastTimestamp = historyMessage.Timestamp
+			job.LastMsgId = historyMessage.WaMsgId
+			err = database.HistoryImportJobSetProgress(waChatId, job.LastTimestamp, job.LastMsgId, job.Imported)
+			if err != nil {
+				logger.Error("failed to save history import progress to database",
+					zap.String("chat_id", waChatId),
+					zap.Error(err),
+				)
+				return
+			}
+		}
+	}
+
+	database.HistoryImportJobFinish(waChatId)
+
+	// The imported messages are not needed anymore, the older ones are kept
+	// for an import going further back
+	err = database.HistoryMessageDelete(chatIds, job.Since)
+	if err != nil {
+		logger.Error("failed to delete imported history messages from database",
+			zap.String("chat_id", waChatId),
+			zap.Error(err),
+		)
+	}
+
+	var chatName string
+	if chatJID.Server == waTypes.GroupServer {
+		chatName = utils.WaGetGroupName(chatJID)
+	} else {
+		chatName = utils.WaGetContactName(chatJID)
+	}
+	tgBot.SendMessage(cfg.Telegram.OwnerID,
+		fmt.Sprintf("Finished importing %d messages from the history of <b>%s</b>",
+			job.Imported, html.EscapeString(chatName)),
+		&gotgbot.SendMessageOpts{})
+}
+
+// replayHistoryMessage bridges a single stored message as if it was just
+// received, returning false if it was not sent to Telegram
+func replayHistoryMessage(historyMessage database.HistoryMessage) bool {
+	var (
+		cfg      = state.State.Config
+		logger   = state.State.Logger
+		waClient = state.State.WhatsAppClient()
+	)
+
+	var webMsg waWeb.WebMessageInfo
+	if err := proto.Unmarshal(historyMessage.RawMessage, &webMsg); err != nil {
+		return false
+	}
+
+	chatJID, ok := utils.WaParseJID(historyMessage.WaChatId)
+	if !ok {
+		return false
+	}
+
+	if tgChatId, _, _, _ := database.MsgIdGetTgFromWa(historyMessage.WaMsgId, historyMessage.WaChatId); tgChatId != 0 {
+		// Already bridged live or by an earlier import
+		return false
+	}
+
+	v, err := waClient.ParseWebMessage(chatJID, &webMsg)
+	if err != nil {
+		logger.Warn("failed to parse history message",
+			zap.String("msg_id", historyMessage.WaMsgId),
+			zap.Error(err),
+		)
+		return false
+	}
+
+	// Revokes, edits, ephemeral settings, pins and poll votes from the past
+	// would change the bridge as if they just happened
+	if v.Message.GetProtocolMessage() != nil || getPinInChatMessage(v.Message) != nil ||
+		v.Message.GetPollUpdateMessage() != nil {
+		return false
+	}
+
+	handleMessageEvent(cfg, v)
+	return true
+}
+
+// isHistoryMessage reports whether a message is being replayed from a
+// history sync instead of being received live
+func isHistoryMessage(v *events.Message) bool {
+	return v.SourceWebMsg != nil
+}
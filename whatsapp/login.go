@@ -0,0 +1,334 @@
+package whatsapp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"watgbridge/state"
+	"watgbridge/utils"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/mdp/qrterminal/v3"
+	"github.com/skip2/go-qrcode"
+	"go.mau.fi/whatsmeow"
+	"go.uber.org/zap"
+)
+
+// Ways of linking a new session, set by whatsapp.login_method
+const (
+	loginMethodQR       = "qr"
+	loginMethodPairCode = "pair_code"
+)
+
+var (
+	// Only one login can be going on at a time
+	loginLock   sync.Mutex
+	reloginLock sync.Mutex
+
+	// Handlers added to every client, including the ones created by Relogin
+	eventHandlers     []whatsmeow.EventHandler
+	eventHandlersLock sync.Mutex
+
+	ErrLoginInProgress = errors.New("a login to WhatsApp is already in progress")
+	errPairCodeExpired = errors.New("the pairing code expired before it was entered")
+	errQRCodeExpired   = errors.New("the QR code was not scanned in time")
+)
+
+// AddEventHandler adds a handler to the WhatsApp client, which is added again
+// to the new client when logging in again with /relogin
+func AddEventHandler(handler whatsmeow.EventHandler) {
+	eventHandlersLock.Lock()
+	eventHandlers = append(eventHandlers, handler)
+	eventHandlersLock.Unlock()
+
+	state.State.WhatsAppClient().AddEventHandler(handler)
+}
+
+// login links the client to a WhatsApp account with the configured login
+// method, blocking until it is logged in
+func login(client *whatsmeow.Client, logger *zap.Logger) error {
+	cfg := state.State.Config
+
+	if cfg.WhatsApp.LoginMethod != loginMethodPairCode {
+		return loginWithQRCode(client, logger)
+	}
+
+	if state.State.TelegramBot == nil {
+		return fmt.Errorf("logging in with a pairing code needs the Telegram bot to send the code")
+	}
+
+	phone, ok := utils.WaNormalizePhone(cfg.WhatsApp.PairPhone)
+	if cfg.WhatsApp.PairPhone != "" && !ok {
+		logger.Warn("ignoring invalid pair_phone in config", zap.String("pair_phone", cfg.WhatsApp.PairPhone))
+	}
+
+	for {
+		if phone == "" {
+			phone = waitForPairCommand(logger)
+		}
+
+		err := LoginWithPairCode(client, phone)
+		if err == nil {
+			return nil
+		}
+
+		logger.Warn("failed to log in to WhatsApp with a pairing code",
+			zap.String("phone", phone),
+			zap.Error(err),
+		)
+		utils.TgSendTextById(state.State.TelegramBot, cfg.Telegram.OwnerID, 0, fmt.Sprintf(
+			"Failed to log in to WhatsApp: %s\n\nSend <code>%s</code> to try again",
+			html.EscapeString(err.Error()), html.EscapeString("/pair <phone>"),
+		))
+		phone = ""
+	}
+}
+
+func loginWithQRCode(client *whatsmeow.Client, logger *zap.Logger) error {
+	loginLock.Lock()
+	defer loginLock.Unlock()
+
+	qrChan, err := client.GetQRChannel(context.Background())
+	if err != nil {
+		return fmt.Errorf("could not start the login : %s", err)
+	}
+	err = client.Connect()
+	if err != nil {
+		return fmt.Errorf("could not connect to Whatsapp for login : %s", err)
+	}
+	for evt := range qrChan {
+		if evt.Event == whatsmeow.QRChannelSuccess.Event {
+			return nil
+		} else if evt.Event == "code" {
+			if state.State.TelegramBot != nil {
+				qrCodePNG, err := qrcode.Encode(evt.Code, qrcode.Highest, 512)
+				if err != nil {
+					state.State.TelegramBot.SendMessage(
+						state.State.Config.Telegram.OwnerID,
+						fmt.Sprintf(
+							"Please check your terminal and scan the QR code to login to WhatsApp. Failed to encode to PNG and send here:\n<code>%s</code>",
+							html.EscapeString(err.Error()),
+						),
+						&gotgbot.SendMessageOpts{},
+					)
+				} else {
+					state.State.TelegramBot.SendPhoto(
+						state.State.Config.Telegram.OwnerID,
+						gotgbot.InputFileByReader("qrcode.png", bytes.NewReader(qrCodePNG)),
+						&gotgbot.SendPhotoOpts{
+							Caption: "Scan the above QR code to login to WhatsApp.",
+						},
+					)
+				}
+			}
+			qrterminal.GenerateHalfBlock(evt.Code, qrterminal.L, os.Stdout)
+		} else {
+			logger.Info("received WhatsApp login event",
+				zap.Any("event", evt.Event),
+			)
+		}
+	}
+
+	return errQRCodeExpired
+}
+
+// LoginWithPairCode links the client to the WhatsApp account of the given
+// phone number, sending the pairing code to enter on the phone to the owner.
+// It returns once the code was entered, or with an error if it expired.
+func LoginWithPairCode(client *whatsmeow.Client, phone string) error {
+	var (
+		cfg    = state.State.Config
+		logger = state.State.Logger
+		tgBot  = state.State.TelegramBot
+	)
+
+	if !loginLock.TryLock() {
+		return ErrLoginInProgress
+	}
+	defer loginLock.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	qrChan, err := client.GetQRChannel(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start the login : %s", err)
+	}
+	if err = client.Connect(); err != nil {
+		return fmt.Errorf("could not connect to Whatsapp for login : %s", err)
+	}
+
+	codeRequested := false
+	for evt := range qrChan {
+		switch evt.Event {
+		case whatsmeow.QRChannelEventCode:
+			// The QR codes keep coming until the login websocket is closed,
+			// the pairing code is valid for as long as they do
+			if codeRequested {
+				continue
+			}
+			codeRequested = true
+
+			code, err := client.PairPhone(ctx, phone, true, whatsmeow.PairClientChrome, "Chrome (Linux)")
+			if err != nil {
+				client.Disconnect()
+				return fmt.Errorf("could not get a pairing code : %s", err)
+			}
+
+			logger.Info("requested WhatsApp pairing code", zap.String("phone", phone))
+			utils.TgSendTextById(tgBot, cfg.Telegram.OwnerID, 0, fmt.Sprintf(
+				"Your WhatsApp pairing code for <code>+%s</code> is:\n\n<code>%s</code>\n\n"+
+					"On your phone open WhatsApp > Linked devices > Link a device > Link with phone number instead, and enter the code. "+
+					"It expires in about %d seconds.",
+				phone, html.EscapeString(code), int(evt.Timeout.Seconds()),
+			))
+
+		case whatsmeow.QRChannelSuccess.Event:
+			return nil
+
+		case whatsmeow.QRChannelTimeout.Event:
+			return errPairCodeExpired
+
+		case whatsmeow.QRChannelEventError:
+			client.Disconnect()
+			return fmt.Errorf("pairing failed : %s", evt.Error)
+
+		default:
+			logger.Info("received WhatsApp login event",
+				zap.Any("event", evt.Event),
+			)
+		}
+	}
+
+	return errPairCodeExpired
+}
+
+// waitForPairCommand waits for the owner to send /pair with a phone number.
+// It is used while logging in at startup, when the Telegram handlers are not
+// receiving updates yet, and so fetches the updates itself.
+func waitForPairCommand(logger *zap.Logger) string {
+	var (
+		cfg   = state.State.Config
+		tgBot = state.State.TelegramBot
+	)
+
+	if cfg.Telegram.Webhook.Enabled {
+		// Updates cannot be fetched while a webhook is set, it is set again
+		// once the bot starts receiving updates
+		if _, err := tgBot.DeleteWebhook(nil); err != nil {
+			logger.Warn("failed to delete the Telegram webhook", zap.Error(err))
+		}
+	}
+
+	usageText := "Send <code>" + html.EscapeString("/pair <phone>") + "</code> with your phone number, including the country code, " +
+		"to log in to WhatsApp with a pairing code\n" +
+		"Example : <code>/pair +91 98765 43210</code>"
+	utils.TgSendTextById(tgBot, cfg.Telegram.OwnerID, 0, usageText)
+
+	var offset int64
+	for {
+		updates, err := tgBot.GetUpdates(&gotgbot.GetUpdatesOpts{
+			Offset:         offset,
+			Timeout:        9,
+			AllowedUpdates: []string{"message"},
+			RequestOpts: &gotgbot.RequestOpts{
+				Timeout: 10 * time.Second,
+			},
+		})
+		if err != nil {
+			logger.Warn("failed to get updates from Telegram while waiting for /pair", zap.Error(err))
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for _, update := range updates {
+			offset = update.UpdateId + 1
+
+			msg := update.Message
+			if msg == nil || msg.From == nil || msg.From.Id != cfg.Telegram.OwnerID {
+				continue
+			}
+
+			args := strings.Fields(msg.Text)
+			if len(args) == 0 || strings.Split(args[0], "@")[0] != "/pair" {
+				continue
+			}
+
+			phone, ok := utils.WaNormalizePhone(strings.Join(args[1:], ""))
+			if !ok {
+				utils.TgSendTextById(tgBot, cfg.Telegram.OwnerID, 0, usageText)
+				continue
+			}
+
+			// Mark the updates as handled so that they are not received again
+			tgBot.GetUpdates(&gotgbot.GetUpdatesOpts{Offset: offset, Timeout: 0})
+			return phone
+		}
+	}
+}
+
+// Relogin replaces the WhatsApp client with a new one and links it again,
+// after the old device is logged out and removed from the login database.
+// With the pair_code login method the code is requested for the given phone
+// number, or for pair_phone, and the owner is asked to send /pair if neither
+// is set.
+func Relogin(phone string) error {
+	var (
+		cfg    = state.State.Config
+		logger = state.State.Logger
+		tgBot  = state.State.TelegramBot
+	)
+
+	if !reloginLock.TryLock() {
+		return ErrLoginInProgress
+	}
+	defer reloginLock.Unlock()
+
+	// The handlers are removed first so that logging out is not reported as
+	// if the device was logged out from the phone
+	oldClient := state.State.WhatsAppClient()
+	oldClient.RemoveEventHandlers()
+	if oldClient.Store.ID != nil {
+		if err := oldClient.Logout(context.Background()); err != nil {
+			logger.Warn("failed to log out the old WhatsApp device, removing it from the database", zap.Error(err))
+			if err = oldClient.Store.Delete(context.Background()); err != nil {
+				return fmt.Errorf("could not remove the old device : %s", err)
+			}
+		}
+	}
+	oldClient.Disconnect()
+
+	client := newClient(deviceContainer.NewDevice())
+	logger.Info("created a new WhatsApp client to log in again")
+
+	if cfg.WhatsApp.LoginMethod != loginMethodPairCode {
+		return loginWithQRCode(client, logger)
+	}
+
+	if phone == "" {
+		phone, _ = utils.WaNormalizePhone(cfg.WhatsApp.PairPhone)
+	}
+	if phone == "" {
+		utils.TgSendTextById(tgBot, cfg.Telegram.OwnerID, 0,
+			"Send <code>"+html.EscapeString("/pair <phone>")+"</code> with your phone number, including the country code, "+
+				"to log in to WhatsApp with a pairing code")
+		return nil
+	}
+	return LoginWithPairCode(client, phone)
+}
+
+// CloseStore closes the database of the WhatsApp session, once the client is
+// disconnected
+func CloseStore() error {
+	if deviceContainer == nil {
+		return nil
+	}
+	return deviceContainer.Close()
+}